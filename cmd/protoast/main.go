@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protoast writes the AST of proto files as JSON
+package main // import "myitcv.io/g/cmd/protoast"
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/astjson"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fOutput      = flag.String("o", "", "Write the JSON to this file instead of stdout.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *fOutput != "" {
+		f, err := os.Create(*fOutput)
+		if err != nil {
+			log.Fatalf("Could not create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	bw := bufio.NewWriter(out)
+
+	if err := astjson.Encode(bw, fset); err != nil {
+		log.Fatalf("Could not encode AST: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write AST: %v", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protoast writes the resolved AST of the named files, which are found relative
+to the import paths, and of the files they import, as JSON. The encoding is
+that of the myitcv.io/g/protobuf/astjson package, which can also decode it.
+`)
+	flag.PrintDefaults()
+}
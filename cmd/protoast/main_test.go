@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/astjson"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"shop.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) TestEncode(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(astjson.Encode(ob, t.fset), IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/shop.json")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestRoundTrip(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(astjson.Encode(ob, t.fset), IsNil)
+
+	fset, err := astjson.Decode(ob)
+	c.Assert(err, IsNil)
+
+	// the Up and Type links are restored, so the ASTs are the same
+	c.Assert(fset, DeepEquals, t.fset)
+}
+
+func (t *MainTest) TestDecodeErrors(c *C) {
+	for _, tc := range []struct{ json, err string }{
+		{`{"version": 2}`, `unsupported version 2 \(want 1\)`},
+		{`{"version": 1, "files": [{"name": "a.proto", "services": [{"name": "S", "methods": [{"name": "M", "inType": ".Missing"}]}]}]}`, `a.proto: unknown type .Missing`},
+		{`{"version": 1, "files": [{"name": "a.proto", "messages": [{"name": "M", "fields": [{"name": "f", "type": "int128"}]}]}]}`, `a.proto: unknown scalar type int128`},
+	} {
+		_, err := astjson.Decode(strings.NewReader(tc.json))
+		c.Assert(err, ErrorMatches, tc.err)
+	}
+}
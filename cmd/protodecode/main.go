@@ -0,0 +1,179 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protodecode decodes protobuf messages, with or without their schema
+package main // import "myitcv.io/g/cmd/protodecode"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fFormat      = flag.String("format", "binary", "The format of the input: binary, hex or base64.")
+	fType        = flag.String("type", "", "The full name of the message type of the input, e.g. foo.Bar; requires -proto.")
+	fProtos      = protobuf.ImportPaths{}
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+	flag.Var(&fProtos, "proto", "A proto file defining the type of the input, found relative to the import paths (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() > 1 || (*fType == "") != (len(fProtos) == 0) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Could not open input: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	b, err := readInput(in, *fFormat)
+	if err != nil {
+		log.Fatalf("Could not read input: %v", err)
+	}
+
+	var m *ast.Message
+	if *fType != "" {
+		fset, err := parser.ParseFiles(fProtos, fImportPaths)
+		if err != nil {
+			log.Fatalf("Could not parse files: %v", err)
+		}
+		m = findMessage(fset, *fType)
+		if m == nil {
+			log.Fatalf("Could not find message type %v", *fType)
+		}
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+
+	if err := decode(bw, b, m); err != nil {
+		bw.Flush()
+		log.Fatalf("Could not decode input: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
+
+// readInput returns the bytes encoded by r in the named format.
+func readInput(r io.Reader, format string) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// whitespace is allowed anywhere in text formats
+	text := func() string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, string(b))
+	}
+
+	switch format {
+	case "binary":
+		return b, nil
+	case "hex":
+		return hex.DecodeString(text())
+	case "base64":
+		s := text()
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+			if res, err := enc.DecodeString(s); err == nil {
+				return res, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid base64")
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// findMessage returns the message with the full name within fset, or nil if
+// there is no such message.
+func findMessage(fset *ast.FileSet, name string) *ast.Message {
+	name = strings.TrimPrefix(name, ".")
+	for _, f := range fset.Files {
+		prefix := ""
+		if len(f.Package) > 0 {
+			prefix = strings.Join(f.Package, ".") + "."
+		}
+		if m := findNested(f.Messages, prefix, name); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func findNested(ms []*ast.Message, prefix, name string) *ast.Message {
+	for _, m := range ms {
+		full := prefix + m.Name
+		if full == name {
+			return m
+		}
+		if strings.HasPrefix(name, full+".") {
+			if res := findNested(m.Messages, full+".", name); res != nil {
+				return res
+			}
+		}
+	}
+	return nil
+}
+
+// decode writes the decoding of the message b to w: with its field names if
+// m, its type, is not nil, or else its field numbers and guesses at their
+// values.
+func decode(w io.Writer, b []byte, m *ast.Message) error {
+	p := &printer{w: new(bytes.Buffer)}
+	err := p.message(b, m, 0)
+	if _, werr := w.Write(p.w.Bytes()); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] [file]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protodecode decodes the protobuf message in file, or stdin, and prints its
+fields. Without a schema, each field is printed with its number and wire type,
+and its value is interpreted by guesswork: bytes may be a nested message, a
+string or packed varints, for example. With -proto and -type, fields are
+printed with their names and values according to their types, in the text
+format.
+`)
+	flag.PrintDefaults()
+}
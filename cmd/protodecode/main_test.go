@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"order.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+// order is a shop.Order, with an unknown field 9
+const order = `
+0a024131
+1003
+1a040102ac02
+220a0a0370656e1507000000
+2801
+32070a03657572 1005
+3803
+41000000000000f83f
+4801
+`
+
+func (t *MainTest) decode(c *C, in string, m *ast.Message) string {
+	b, err := readInput(strings.NewReader(in), "hex")
+	c.Assert(err, IsNil)
+
+	ob := bytes.NewBuffer(nil)
+	c.Assert(decode(ob, b, m), IsNil)
+	return ob.String()
+}
+
+func (t *MainTest) TestRaw(c *C) {
+	out := t.decode(c, order, nil)
+	c.Assert(out, Equals, `1 (bytes): "A1"
+2 (varint): 3
+3 (bytes) packed varints: [1 2 300]
+4 (bytes) message {
+  1 (bytes): "pen"
+  2 (fixed32): 7 (float: 1e-44)
+}
+5 (varint): 1
+6 (bytes) message {
+  1 (bytes): "eur"
+  2 (varint): 5
+}
+7 (varint): 3
+8 (fixed64): 4609434218613702656 (double: 1.5)
+9 (varint): 1
+`)
+}
+
+func (t *MainTest) TestRawGroup(c *C) {
+	out := t.decode(c, "0b 08ffffffffffffffffff01 0c", nil)
+	c.Assert(out, Equals, `1 (group) {
+  1 (varint): 18446744073709551615 (int64: -1)
+}
+`)
+}
+
+func (t *MainTest) TestTyped(c *C) {
+	m := findMessage(t.fset, "shop.Order")
+	c.Assert(m, NotNil)
+
+	out := t.decode(c, order, m)
+	c.Assert(out, Equals, `id: "A1"
+quantity: 3
+sizes: 1
+sizes: 2
+sizes: 300
+item {
+  name: "pen"
+  code: 7
+}
+status: SHIPPED
+totals {
+  key: "eur"
+  value: 5
+}
+delta: -2
+price: 1.5
+9 (varint): 1
+`)
+}
+
+func (t *MainTest) TestFindMessage(c *C) {
+	c.Assert(findMessage(t.fset, ".shop.Order.Item"), NotNil)
+	c.Assert(findMessage(t.fset, "shop.Item"), IsNil)
+}
+
+func (t *MainTest) TestReadInput(c *C) {
+	want, err := hex.DecodeString("0a024131")
+	c.Assert(err, IsNil)
+
+	for _, in := range []struct{ format, text string }{
+		{"binary", "\x0a\x02A1"},
+		{"hex", "0a02 4131\n"},
+		{"base64", "CgJBMQ==\n"},
+		{"base64", "CgJBMQ"},
+	} {
+		b, err := readInput(strings.NewReader(in.text), in.format)
+		c.Assert(err, IsNil)
+		c.Assert(b, DeepEquals, want)
+	}
+
+	_, err = readInput(strings.NewReader(""), "json")
+	c.Assert(err, ErrorMatches, `unknown format "json"`)
+}
+
+func (t *MainTest) TestBadInput(c *C) {
+	for _, in := range []struct{ hex, err string }{
+		{"0a05 4131", `offset 0: field 1 has length 5, beyond the end of the input`},
+		{"08", `offset 1: invalid varint`},
+		{"0b 0801", `offset 3: group 1 is not terminated`},
+		{"0c", `offset 0: unexpected end of group 1`},
+		{"0f", `offset 0: field 1 has invalid wire type 7`},
+		{"0001", `offset 0: invalid field number 0`},
+	} {
+		b, err := hex.DecodeString(strings.Replace(in.hex, " ", "", -1))
+		c.Assert(err, IsNil)
+		c.Assert(decode(bytes.NewBuffer(nil), b, nil), ErrorMatches, in.err)
+	}
+}
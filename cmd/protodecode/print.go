@@ -0,0 +1,294 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/wire"
+)
+
+// printer prints the fields of messages, indented by their depth
+type printer struct {
+	w      *bytes.Buffer
+	indent int
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	p.w.WriteString(strings.Repeat("  ", p.indent))
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// message prints the fields of the message b, of type m if m is not nil.
+// depth is the number of messages enclosing b.
+func (p *printer) message(b []byte, m *ast.Message, depth int) error {
+	fields, err := wire.Parse(b)
+	if err != nil {
+		return err
+	}
+	p.fields(fields, m, depth)
+	return nil
+}
+
+// fields prints fields, those of a message of type m if m is not nil. Fields
+// unknown to m, or whose wire types do not match their types, are printed
+// as if m were nil.
+func (p *printer) fields(fields []*wire.Field, m *ast.Message, depth int) {
+	for _, f := range fields {
+		if m != nil {
+			if mf := fieldByNumber(m, f.Number); mf != nil && p.typed(f, mf, depth) {
+				continue
+			}
+		}
+		p.raw(f, depth)
+	}
+}
+
+// block prints a block named name holding the output of body
+func (p *printer) block(name string, body func()) {
+	p.printf("%v {\n", name)
+	p.indent++
+	body()
+	p.indent--
+	p.printf("}\n")
+}
+
+// raw prints f with its number and wire type, guessing at its value
+func (p *printer) raw(f *wire.Field, depth int) {
+	switch f.Type {
+	case wire.Varint:
+		p.printf("%d (varint): %s\n", f.Number, guessVarint(f.Value))
+	case wire.Fixed32:
+		p.printf("%d (fixed32): %d (float: %v)\n", f.Number, f.Value, wire.Float32(f.Value))
+	case wire.Fixed64:
+		p.printf("%d (fixed64): %d (double: %v)\n", f.Number, f.Value, wire.Float64(f.Value))
+	case wire.StartGroup:
+		p.block(fmt.Sprintf("%d (group)", f.Number), func() {
+			p.fields(f.Group, nil, depth+1)
+		})
+	case wire.Bytes:
+		b := f.Bytes
+		switch {
+		case isText(b) && b[0] >= ' ':
+			p.printf("%d (bytes): %s\n", f.Number, strconv.Quote(string(b)))
+		case depth < wire.MaxDepth && isMessage(b):
+			fields, _ := wire.Parse(b)
+			p.block(fmt.Sprintf("%d (bytes) message", f.Number), func() {
+				p.fields(fields, nil, depth+1)
+			})
+		case isText(b):
+			p.printf("%d (bytes): %s\n", f.Number, strconv.Quote(string(b)))
+		default:
+			if vs, ok := wire.DecodePacked(b); ok {
+				p.printf("%d (bytes) packed varints: %v\n", f.Number, vs)
+				break
+			}
+			p.printf("%d (bytes): % x\n", f.Number, b)
+		}
+	}
+}
+
+// guessVarint returns the value v of a varint, together with its value as
+// an int64 if that is negative.
+func guessVarint(v uint64) string {
+	if int64(v) < 0 {
+		return fmt.Sprintf("%d (int64: %d)", v, int64(v))
+	}
+	return fmt.Sprint(v)
+}
+
+// isText reports whether b is printable UTF-8 text, as the empty string is.
+func isText(b []byte) bool {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return len(b) == 0
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// isMessage reports whether b is a message with at least one field.
+func isMessage(b []byte) bool {
+	fields, err := wire.Parse(b)
+	return err == nil && len(fields) > 0
+}
+
+// typed prints f, the encoding of mf, by name, in the text format. It
+// reports false, having printed nothing, if the wire type of f does not
+// match the type of mf.
+func (p *printer) typed(f *wire.Field, mf *ast.Field, depth int) bool {
+	name := mf.Name
+	if m, ok := mf.Type.(*ast.Message); ok && m.Group {
+		name = strings.ToLower(name)
+	}
+
+	if mf.KeyTypeName != "" {
+		if f.Type != wire.Bytes {
+			return false
+		}
+		entry, err := wire.Parse(f.Bytes)
+		if err != nil {
+			return false
+		}
+		var key, value []*wire.Field
+		for _, ef := range entry {
+			switch ef.Number {
+			case 1:
+				key = append(key, ef)
+			case 2:
+				value = append(value, ef)
+			}
+		}
+		p.block(name, func() {
+			for _, k := range key {
+				if !p.scalar("key", k, mf.KeyType) {
+					p.raw(k, depth+1)
+				}
+			}
+			for _, v := range value {
+				if !p.value("value", v, mf.Type, depth+1) {
+					p.raw(v, depth+1)
+				}
+			}
+		})
+		return true
+	}
+
+	return p.value(name, f, mf.Type, depth)
+}
+
+// value prints f, whose value is of the resolved type typ, as the field
+// name. It reports false, having printed nothing, if the wire type of f does
+// not match typ.
+func (p *printer) value(name string, f *wire.Field, typ interface{}, depth int) bool {
+	m, ok := typ.(*ast.Message)
+	if !ok {
+		return p.scalar(name, f, typ)
+	}
+	switch {
+	case f.Type == wire.StartGroup:
+		p.block(name, func() {
+			p.fields(f.Group, m, depth+1)
+		})
+	case f.Type == wire.Bytes && depth < wire.MaxDepth:
+		fields, err := wire.Parse(f.Bytes)
+		if err != nil {
+			return false
+		}
+		p.block(name, func() {
+			p.fields(fields, m, depth+1)
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// scalar prints f, whose value is of type typ, a FieldType or *ast.Enum, as
+// the field name; a length-delimited f is a packed repeated field, whose
+// values are each printed. It reports false, having printed nothing, if the
+// wire type of f does not match typ.
+func (p *printer) scalar(name string, f *wire.Field, typ interface{}) bool {
+	want := wireType(typ)
+	if f.Type == wire.Bytes && want != wire.Bytes {
+		var vs []uint64
+		ok := false
+		switch want {
+		case wire.Varint:
+			vs, ok = wire.DecodePacked(f.Bytes)
+		case wire.Fixed32:
+			vs, ok = wire.DecodePackedFixed(f.Bytes, 4)
+		case wire.Fixed64:
+			vs, ok = wire.DecodePackedFixed(f.Bytes, 8)
+		}
+		if !ok {
+			return false
+		}
+		for _, v := range vs {
+			p.printf("%v: %v\n", name, formatValue(typ, v))
+		}
+		return true
+	}
+	if f.Type != want {
+		return false
+	}
+	if want == wire.Bytes {
+		p.printf("%v: %v\n", name, strconv.Quote(string(f.Bytes)))
+		return true
+	}
+	p.printf("%v: %v\n", name, formatValue(typ, f.Value))
+	return true
+}
+
+// wireType returns the wire type of values of typ, a FieldType or *ast.Enum,
+// or -1 if typ is unresolved.
+func wireType(typ interface{}) wire.Type {
+	switch typ {
+	case ast.Fixed32, ast.Sfixed32, ast.Float:
+		return wire.Fixed32
+	case ast.Fixed64, ast.Sfixed64, ast.Double:
+		return wire.Fixed64
+	case ast.String, ast.Bytes:
+		return wire.Bytes
+	}
+	switch typ.(type) {
+	case ast.FieldType, *ast.Enum:
+		return wire.Varint
+	}
+	return -1
+}
+
+// formatValue returns the value v, of a numeric field of type typ, in the
+// text format
+func formatValue(typ interface{}, v uint64) string {
+	switch typ := typ.(type) {
+	case *ast.Enum:
+		for _, ev := range typ.Values {
+			if int64(ev.Number) == int64(int32(v)) {
+				return ev.Name
+			}
+		}
+		return fmt.Sprint(int32(v))
+	case ast.FieldType:
+		switch typ {
+		case ast.Int32, ast.Sfixed32:
+			return fmt.Sprint(int32(v))
+		case ast.Int64, ast.Sfixed64:
+			return fmt.Sprint(int64(v))
+		case ast.Uint32, ast.Fixed32:
+			return fmt.Sprint(uint32(v))
+		case ast.Sint32:
+			return fmt.Sprint(int32(wire.DecodeZigZag(uint64(uint32(v)))))
+		case ast.Sint64:
+			return fmt.Sprint(wire.DecodeZigZag(v))
+		case ast.Bool:
+			return fmt.Sprint(v != 0)
+		case ast.Float:
+			return fmt.Sprint(wire.Float32(v))
+		case ast.Double:
+			return fmt.Sprint(wire.Float64(v))
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// fieldByNumber returns the field of m with the number n, or nil if there
+// is none
+func fieldByNumber(m *ast.Message, n int) *ast.Field {
+	for _, f := range m.Fields {
+		if f.Tag == n {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protodiagram draws class diagrams of the messages, enums and services of
+// proto files
+package main // import "myitcv.io/g/cmd/protodiagram"
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/diagram"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fFormat      = flag.String("format", "mermaid", "Write the diagram in this format: mermaid, plantuml or dot.")
+	fOutput      = flag.String("o", "", "Write the diagram to this file rather than stdout.")
+	fImportPaths = protobuf.ImportPaths{}
+	fRoots       = protobuf.ImportPaths{}
+	fPackages    = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+	flag.Var(&fRoots, "root", "Draw only this message, enum or service, e.g. foo.Bar, and what it refers to (flag can be used multiple times)")
+	flag.Var(&fPackages, "package", "Draw only the definitions of this package and those within it (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	format, ok := diagram.Formats[*fFormat]
+	if !ok {
+		log.Fatalf("Unknown format %q", *fFormat)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	g := &diagram.Generator{
+		Format:   format,
+		Roots:    fRoots,
+		Packages: fPackages,
+	}
+
+	w := os.Stdout
+	if *fOutput != "" {
+		w, err = os.Create(*fOutput)
+		if err != nil {
+			log.Fatalf("Could not create output file: %v", err)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := generate(bw, g, fset, flag.Args()); err != nil {
+		log.Fatalf("Could not generate diagram: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
+
+// generate writes the diagram of the named files within fset to w. Without
+// roots, the diagram starts from the definitions of the named files; the
+// roots may be defined by any file of fset.
+func generate(w io.Writer, g *diagram.Generator, fset *ast.FileSet, filenames []string) error {
+	if len(g.Roots) == 0 {
+		named := make(map[string]bool)
+		for _, fn := range filenames {
+			named[fn] = true
+		}
+		files := fset.Files
+		fset = new(ast.FileSet)
+		for _, f := range files {
+			if named[f.Name] {
+				fset.Files = append(fset.Files, f)
+			}
+		}
+	}
+	return g.Generate(w, fset)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protodiagram writes a class diagram of the messages, enums and services of the
+named files, which are found relative to the import paths, and of the messages
+and enums they refer to. Fields of message type, including map values and the
+fields of oneofs, are drawn as composition; fields of enum type, and the
+requests and responses of methods, as dependencies. -root starts the diagram
+from the named definitions instead, and -package leaves out the definitions of
+other packages.
+`)
+	flag.PrintDefaults()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/diagram"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"shop.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) assertGenerate(c *C, g *diagram.Generator, golden string) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(generate(ob, g, t.fset, []string{"shop.proto"}), IsNil)
+
+	cmpBytes, err := ioutil.ReadFile(golden)
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestMermaid(c *C) {
+	t.assertGenerate(c, &diagram.Generator{Format: diagram.Mermaid}, "_testFiles/shop.mmd")
+}
+
+func (t *MainTest) TestPlantUMLRoot(c *C) {
+	g := &diagram.Generator{
+		Format: diagram.PlantUML,
+		Roots:  []string{"shop.v1.Shop"},
+	}
+	t.assertGenerate(c, g, "_testFiles/shop_service.puml")
+}
+
+func (t *MainTest) TestDOTPackage(c *C) {
+	g := &diagram.Generator{
+		Format:   diagram.DOT,
+		Packages: []string{"shop"},
+	}
+	t.assertGenerate(c, g, "_testFiles/shop_package.dot")
+}
+
+func (t *MainTest) TestUnknownRoot(c *C) {
+	g := &diagram.Generator{Roots: []string{"shop.v1.Missing"}}
+	err := generate(bytes.NewBuffer(nil), g, t.fset, []string{"shop.proto"})
+	c.Assert(err, ErrorMatches, "unknown root type shop.v1.Missing")
+}
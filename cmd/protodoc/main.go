@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protodoc generates Markdown or HTML reference documentation for proto files
+package main // import "myitcv.io/g/cmd/protodoc"
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	protodoc "myitcv.io/g/protobuf/doc"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fHTML        = flag.Bool("html", false, "Generate a standalone HTML page instead of Markdown.")
+	fOutput      = flag.String("o", "", "Write the documentation to this file instead of stdout.")
+	fTitle       = flag.String("title", protodoc.DefaultTitle, "The title of the generated document.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *fOutput != "" {
+		f, err := os.Create(*fOutput)
+		if err != nil {
+			log.Fatalf("Could not create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	bw := bufio.NewWriter(out)
+
+	if err := generate(bw, fset, flag.Args(), *fTitle, *fHTML); err != nil {
+		log.Fatalf("Could not generate documentation: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write documentation: %v", err)
+	}
+}
+
+// generate writes the documentation for the named files within fset to w.
+// The files they import are not documented, although references to them are
+// still written.
+func generate(w io.Writer, fset *ast.FileSet, filenames []string, title string, html bool) error {
+	named := make(map[string]bool)
+	for _, fn := range filenames {
+		named[fn] = true
+	}
+
+	docs := new(ast.FileSet)
+	for _, f := range fset.Files {
+		if named[f.Name] {
+			docs.Files = append(docs.Files, f)
+		}
+	}
+
+	g := &protodoc.Generator{
+		Output: w,
+		Title:  title,
+	}
+
+	if html {
+		return g.HTML(docs)
+	}
+	return g.Markdown(docs)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protodoc writes reference documentation for the named files, which are found
+relative to the import paths. Services, messages and enums are documented,
+grouped by package, together with the comments attached to them. Types
+defined in the named files are cross-linked.
+`)
+	flag.PrintDefaults()
+}
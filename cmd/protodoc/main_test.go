@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	protodoc "myitcv.io/g/protobuf/doc"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"store.proto", "common.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) TestMarkdown(c *C) {
+	ob := bytes.NewBuffer(nil)
+
+	err := generate(ob, t.fset, []string{"store.proto", "common.proto"}, protodoc.DefaultTitle, false)
+	c.Assert(err, IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/store.md")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestHTML(c *C) {
+	ob := bytes.NewBuffer(nil)
+
+	err := generate(ob, t.fset, []string{"store.proto", "common.proto"}, protodoc.DefaultTitle, true)
+	c.Assert(err, IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/store.html")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestImportsNotDocumented(c *C) {
+	ob := bytes.NewBuffer(nil)
+
+	err := generate(ob, t.fset, []string{"store.proto"}, "Store API", false)
+	c.Assert(err, IsNil)
+
+	out := ob.String()
+
+	c.Assert(strings.HasPrefix(out, "# Store API\n"), Equals, true)
+	c.Assert(strings.Contains(out, "Package common"), Equals, false)
+
+	// references to common.Money are still written, but not linked
+	c.Assert(strings.Contains(out, "| price | common.Money |  | 2 |"), Equals, true)
+}
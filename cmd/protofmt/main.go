@@ -4,58 +4,305 @@
 package main // import "myitcv.io/g/cmd/protofmt"
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"myitcv.io/g/protobuf"
 	protofmt "myitcv.io/g/protobuf/fmt"
 )
 
+const (
+	// exitUnformatted is the exit code used when -l or -d find at least one
+	// file whose formatting differs
+	exitUnformatted = 1
+
+	// exitError is the exit code used when at least one file could not be
+	// read, parsed or written
+	exitError = 2
+)
+
 var (
-	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
-	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
-	fImportPaths = protobuf.ImportPaths([]string{"."})
+	fHelpShort = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong  = flag.Bool("help", false, "Show usage text (same as -h).")
+	fWrite     = flag.Bool("w", false, "Write result to (source) file instead of stdout.")
+	fList      = flag.Bool("l", false, "List files whose formatting differs from protofmt's.")
+	fDiff      = flag.Bool("d", false, "Display diffs instead of rewriting files.")
+
+	// fImportPaths is accepted for compatibility; formatting is purely
+	// syntactic, and so imports are not loaded
+	fImportPaths = protobuf.ImportPaths{}
 )
 
 func init() {
-	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+	flag.Var(&fImportPaths, "I", "Deprecated: ignored, as imports are not needed to format a file.")
 }
 
-// TODO - this command should not require import paths etc... should be purely syntactical...
-// for another day
 func main() {
 	flag.Usage = usage
 	flag.Parse()
-	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+	if *fHelpShort || *fHelpLong {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+	if len(fImportPaths) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: -I is deprecated and ignored, as imports are not needed to format a file")
+	}
+
+	r := &runner{
+		write:  *fWrite,
+		list:   *fList,
+		diff:   *fDiff,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+
+	if flag.NArg() == 0 {
+		if r.write {
+			fatalf("Cannot use -w with standard input")
+		}
+		r.processFile("<standard input>", nil, os.Stdin)
+		os.Exit(r.exitCode)
+	}
+
+	r.run(flag.Args())
+
+	os.Exit(r.exitCode)
+}
+
+// runner formats files according to the -w, -l and -d flags, writing its
+// output to stdout and errors to stderr, and recording the exit code
+type runner struct {
+	write, list, diff bool
+
+	stdout, stderr io.Writer
+
+	exitCode int
+}
+
+// run formats each of paths, walking those that are directories
+func (r *runner) run(paths []string) {
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			r.report(err)
+			continue
+		}
+
+		if fi.IsDir() {
+			r.walkDir(path)
+		} else {
+			r.processFile(path, fi, nil)
+		}
+	}
+}
+
+func (r *runner) walkDir(path string) {
+	filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			r.report(err)
+			return nil
+		}
+
+		if isProtoFile(fi) {
+			r.processFile(path, fi, nil)
+		}
+
+		return nil
+	})
+}
+
+// isProtoFile reports whether fi describes a regular .proto file that is not
+// hidden
+func isProtoFile(fi os.FileInfo) bool {
+	n := fi.Name()
+	return !fi.IsDir() && !strings.HasPrefix(n, ".") && strings.HasSuffix(n, ".proto")
+}
+
+// processFile formats the file at path according to the -l, -w and -d flags,
+// writing the formatted result to stdout if none of them is set. If in is
+// non-nil the source is read from it (and fi is nil) instead of from path.
+// Errors are reported to stderr and recorded in exitCode.
+func (r *runner) processFile(path string, fi os.FileInfo, in io.Reader) {
+	var src []byte
+	var err error
+
+	if in != nil {
+		src, err = ioutil.ReadAll(in)
+	} else {
+		src, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		r.report(err)
+		return
+	}
+
+	// the config for stdin is found relative to the working directory
+	dir := "."
+	if in == nil {
+		dir = filepath.Dir(path)
+	}
+
+	config, _, err := protofmt.FindConfig(dir)
+	if err != nil {
+		r.report(err)
+		return
+	}
+
+	res, err := format(path, src, config)
+	if err != nil {
+		r.report(err)
+		return
+	}
+
+	// a file is only printed, rewritten, or its diff shown, if nothing would
+	// be lost
+	if !r.list || r.write || r.diff {
+		if err := checkRoundTrip(path, src, res); err != nil {
+			r.report(err)
+			return
+		}
+	}
+
+	if !r.list && !r.write && !r.diff {
+		if _, err := r.stdout.Write(res); err != nil {
+			r.report(err)
+		}
+		return
+	}
+
+	if bytes.Equal(src, res) {
+		return
+	}
+
+	if r.list {
+		fmt.Fprintln(r.stdout, path)
 	}
 
-	for _, p := range fImportPaths {
-		fi, err := os.Stat(p)
-		if err != nil || !fi.IsDir() {
-			fatalf("Import dir does not exist (as a directory)")
+	if r.write {
+		if err := ioutil.WriteFile(path, res, fi.Mode().Perm()); err != nil {
+			r.report(err)
+			return
 		}
 	}
 
-	if len(flag.Args()) == 0 {
-		fatalf("Need to specify at least one file to parse")
+	if r.diff {
+		d, err := diff(path, src, res)
+		if err != nil {
+			r.report(fmt.Errorf("computing diff: %v", err))
+			return
+		}
+		fmt.Fprintf(r.stdout, "diff -u %v.orig %v\n", path, path)
+		r.stdout.Write(d)
 	}
 
+	if !r.write && r.exitCode == 0 {
+		r.exitCode = exitUnformatted
+	}
+}
+
+// checkRoundTrip checks that the formatted result of a file loses nothing; it
+// is a variable so that tests can exercise a lossy formatter
+var checkRoundTrip = protofmt.CheckRoundTrip
+
+func (r *runner) report(err error) {
+	fmt.Fprintln(r.stderr, err)
+	r.exitCode = exitError
+}
+
+// format parses src, the contents of the file at path, and returns its
+// formatted contents. Formatting is purely syntactic; imports are not loaded.
+func format(path string, src []byte, config protofmt.Config) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
 	f := &protofmt.Formatter{
-		Output: os.Stdout,
+		Output: buf,
+		Config: config,
+	}
+
+	if err := f.FmtSource(path, src); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// diff returns the unified diff between b1 and b2 (the original and
+// formatted contents of path respectively) as computed by the diff command,
+// with the file header lines naming path.orig and path, as gofmt -d does
+func diff(path string, b1, b2 []byte) ([]byte, error) {
+	f1, err := writeTempFile("", "protofmt", b1)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f1)
+
+	f2, err := writeTempFile("", "protofmt", b2)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f2)
+
+	data, err := exec.Command("diff", "-u", f1, f2).CombinedOutput()
+	if len(data) > 0 {
+		// diff exits with a non-zero status when the files don't match;
+		// ignore that failure as long as we get output
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// replace the "---" and "+++" lines, which refer to the temp files
+	for i := 0; i < 2; i++ {
+		j := bytes.IndexByte(data, '\n')
+		if j == -1 {
+			return nil, fmt.Errorf("unexpected diff output for %v", path)
+		}
+		data = data[j+1:]
+	}
+	hdr := fmt.Sprintf("--- %v.orig\n+++ %v\n", path, path)
+
+	return append([]byte(hdr), data...), nil
+}
+
+func writeTempFile(dir, prefix string, data []byte) (string, error) {
+	file, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
 	}
 
-	f.Fmt(flag.Args(), fImportPaths)
+	return file.Name(), nil
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage:  %s [options] <foo.proto> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] [<foo.proto|dir> ...]\n", os.Args[0])
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nWith no arguments, standard input is formatted to standard output.\n")
+	fmt.Fprintf(os.Stderr, "Layout options are read from the first %v found in the directory\n", protofmt.ConfigFileName)
+	fmt.Fprintf(os.Stderr, "of each file (the working directory for standard input) or its parents.\n")
+	fmt.Fprintf(os.Stderr, "Directories are processed recursively. Exit code is %v if -l or -d find unformatted\n", exitUnformatted)
+	fmt.Fprintf(os.Stderr, "files (and -w is not set), %v if any file could not be processed.\n", exitError)
+	fmt.Fprintf(os.Stderr, "A file is not written, printed or diffed if formatting would lose any of\n")
+	fmt.Fprintf(os.Stderr, "its contents; that is reported as an error.\n")
 }
 
 func fatalf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
-	os.Exit(1)
+	os.Exit(exitError)
 }
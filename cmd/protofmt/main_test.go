@@ -10,6 +10,8 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	protofmt "myitcv.io/g/protobuf/fmt"
@@ -19,6 +21,7 @@ import (
 
 type MainTest struct {
 	dir string
+	wd  string // the working directory before setUpDir changes it
 }
 
 var _ = Suite(&MainTest{})
@@ -37,22 +40,18 @@ func (t *MainTest) TearDownTest(c *C) {
 }
 
 func (t *MainTest) TestStdoutOutput(c *C) {
-	eVar := "PROTOBUF_INCLUDE"
-	pbInclude, ok := os.LookupEnv(eVar)
-	if !ok {
-		log.Fatalf("Could not find %v in ENV", eVar)
-	}
-
 	ob := bytes.NewBuffer(nil)
 
 	f := &protofmt.Formatter{
 		Output: ob,
 	}
 
+	// formatting is purely syntactic, so the imports of basic.proto (and
+	// their imports in turn) do not need to be available
 	files := []string{"_testFiles/basic.proto"}
-	importPaths := []string{"_testFiles/", pbInclude}
 
-	f.Fmt(files, importPaths)
+	err := f.FmtFiles(files)
+	c.Assert(err, IsNil)
 
 	cmpBytes, err := ioutil.ReadFile("_testFiles/basic.proto.formatted")
 	if err != nil {
@@ -79,6 +78,225 @@ func (t *MainTest) TestStdoutOutput(c *C) {
 
 }
 
+func (t *MainTest) TestConfigLayout(c *C) {
+	ob := bytes.NewBuffer(nil)
+
+	f := &protofmt.Formatter{
+		Output: ob,
+		Config: protofmt.Config{
+			Indent:         "  ",
+			AlignFields:    true,
+			KeepBlankLines: true,
+			SortImports:    true,
+			GroupImports:   true,
+		},
+	}
+
+	err := f.FmtFiles([]string{"_testFiles/layout.proto"})
+	c.Assert(err, IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/layout.proto.formatted")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestEditions(c *C) {
+	ob := bytes.NewBuffer(nil)
+
+	f := &protofmt.Formatter{
+		Output: ob,
+	}
+
+	err := f.FmtFiles([]string{"_testFiles/editions.proto"})
+	c.Assert(err, IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/editions.proto.formatted")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+}
+
+// TestComments formats a file with comments, reserved and extensions
+// statements, extend blocks and a group, none of which may be lost
+func (t *MainTest) TestComments(c *C) {
+	src, err := ioutil.ReadFile("_testFiles/comments.proto")
+	c.Assert(err, IsNil)
+
+	for _, config := range []protofmt.Config{
+		{},
+		{Indent: "  ", AlignFields: true, KeepBlankLines: true, SortImports: true, GroupImports: true},
+	} {
+		res, err := format("comments.proto", src, config)
+		c.Assert(err, IsNil)
+		c.Assert(protofmt.CheckRoundTrip("comments.proto", src, res), IsNil, Commentf("%+v", config))
+
+		if config == (protofmt.Config{}) {
+			cmpBytes, err := ioutil.ReadFile("_testFiles/comments.proto.formatted")
+			c.Assert(err, IsNil)
+			c.Assert(string(res), Equals, string(cmpBytes))
+		}
+	}
+}
+
+// setUpDir copies fixtures into t.dir, as laid out below, and changes to it;
+// basic.proto and .hidden.proto need formatting, sub/formatted.proto does
+// not, and lossy.proto has a comment, which TestLossy has the formatter drop
+func (t *MainTest) setUpDir(c *C) func() {
+	unformatted, err := ioutil.ReadFile("_testFiles/basic.proto")
+	c.Assert(err, IsNil)
+	formatted, err := ioutil.ReadFile("_testFiles/basic.proto.formatted")
+	c.Assert(err, IsNil)
+
+	files := map[string][]byte{
+		"dir/basic.proto":         unformatted,
+		"dir/.hidden.proto":       unformatted,
+		"dir/notes.txt":           unformatted,
+		"dir/sub/formatted.proto": formatted,
+		"lossy.proto":             []byte("syntax = \"proto3\";\n// a comment\nmessage  Foo {}\n"),
+	}
+	for fn, b := range files {
+		fn = filepath.Join(t.dir, fn)
+		c.Assert(os.MkdirAll(filepath.Dir(fn), 0777), IsNil)
+		c.Assert(ioutil.WriteFile(fn, b, 0666), IsNil)
+	}
+
+	t.wd, err = os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(t.dir), IsNil)
+	return func() { os.Chdir(t.wd) }
+}
+
+// run runs protofmt on paths, and returns its output and exit code
+func run(w, l, d bool, paths ...string) (stdout, stderr string, exitCode int) {
+	var ob, eb bytes.Buffer
+	r := &runner{write: w, list: l, diff: d, stdout: &ob, stderr: &eb}
+	r.run(paths)
+	return ob.String(), eb.String(), r.exitCode
+}
+
+func (t *MainTest) TestList(c *C) {
+	defer t.setUpDir(c)()
+
+	stdout, stderr, code := run(false, true, false, "dir")
+	c.Assert(stderr, Equals, "")
+	c.Assert(stdout, Equals, filepath.Join("dir", "basic.proto")+"\n")
+	c.Assert(code, Equals, exitUnformatted)
+
+	stdout, _, code = run(false, true, false, filepath.Join("dir", "sub", "formatted.proto"))
+	c.Assert(stdout, Equals, "")
+	c.Assert(code, Equals, 0)
+}
+
+func (t *MainTest) TestDiff(c *C) {
+	defer t.setUpDir(c)()
+
+	fn := filepath.Join("dir", "basic.proto")
+	stdout, stderr, code := run(false, false, true, fn)
+	c.Assert(stderr, Equals, "")
+	c.Assert(code, Equals, exitUnformatted)
+
+	hdr := "diff -u " + fn + ".orig " + fn + "\n--- " + fn + ".orig\n+++ " + fn + "\n@@ "
+	c.Assert(strings.HasPrefix(stdout, hdr), Equals, true, Commentf("%v", stdout))
+
+	// the diff is a patch that formats the file
+	if _, err := exec.LookPath("patch"); err != nil {
+		c.Skip("patch not found")
+	}
+	cmd := exec.Command("patch", "-p0")
+	cmd.Stdin = strings.NewReader(stdout)
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", out))
+	t.assertFormatted(c, fn)
+}
+
+func (t *MainTest) TestWrite(c *C) {
+	defer t.setUpDir(c)()
+
+	stdout, stderr, code := run(true, false, false, "dir")
+	c.Assert(stdout, Equals, "")
+	c.Assert(stderr, Equals, "")
+	c.Assert(code, Equals, 0)
+	t.assertFormatted(c, filepath.Join("dir", "basic.proto"))
+	t.assertFormatted(c, filepath.Join("dir", "sub", "formatted.proto"))
+
+	// hidden and non-.proto files are not walked
+	for _, fn := range []string{".hidden.proto", "notes.txt"} {
+		b, err := ioutil.ReadFile(filepath.Join("dir", fn))
+		c.Assert(err, IsNil)
+		want, err := ioutil.ReadFile(filepath.Join(t.wd, "_testFiles", "basic.proto"))
+		c.Assert(err, IsNil)
+		c.Assert(string(b), Equals, string(want), Commentf("%v", fn))
+	}
+
+	stdout, _, code = run(false, true, false, "dir")
+	c.Assert(stdout, Equals, "")
+	c.Assert(code, Equals, 0)
+}
+
+func (t *MainTest) TestLossy(c *C) {
+	defer t.setUpDir(c)()
+
+	// a formatter that drops comments
+	defer func(f func(string, []byte, []byte) error) { checkRoundTrip = f }(checkRoundTrip)
+	checkRoundTrip = func(path string, src, res []byte) error {
+		return protofmt.CheckRoundTrip(path, src, bytes.Replace(res, []byte("// a comment\n"), nil, -1))
+	}
+
+	for _, d := range []bool{true, false} {
+		stdout, stderr, code := run(!d, false, d, "lossy.proto", "missing.proto")
+		c.Assert(stdout, Equals, "")
+		c.Assert(stderr, Equals, "lossy.proto: cannot be formatted without loss: comments: 1 != 0\n"+
+			"stat missing.proto: no such file or directory\n")
+		c.Assert(code, Equals, exitError)
+	}
+
+	b, err := ioutil.ReadFile("lossy.proto")
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "syntax = \"proto3\";\n// a comment\nmessage  Foo {}\n")
+
+	// the file's formatting differs, and so -l lists it
+	stdout, stderr, code := run(false, true, false, "lossy.proto")
+	c.Assert(stdout, Equals, "lossy.proto\n")
+	c.Assert(stderr, Equals, "")
+	c.Assert(code, Equals, exitUnformatted)
+
+	// nor is the result printed without flags
+	stdout, stderr, code = run(false, false, false, "lossy.proto")
+	c.Assert(stdout, Equals, "")
+	c.Assert(stderr, Equals, "lossy.proto: cannot be formatted without loss: comments: 1 != 0\n")
+	c.Assert(code, Equals, exitError)
+}
+
+func (t *MainTest) TestFieldOptions(c *C) {
+	src := []byte(`syntax = "proto2";
+message Foo {
+  optional string a = 1 [default = "x, y", deprecated = true];
+  repeated int32 b = 2 [packed = false, (opt) = 1];
+}
+`)
+	res, err := format("options.proto", src, protofmt.Config{})
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, `syntax = "proto2";
+
+message Foo {
+	optional string a = 1 [default="x, y", deprecated=true];
+	repeated int32 b = 2 [packed=false, (opt)=1];
+}
+`)
+	c.Assert(protofmt.CheckRoundTrip("options.proto", src, res), IsNil)
+}
+
+// assertFormatted asserts that the file fn has the contents of
+// basic.proto.formatted
+func (t *MainTest) assertFormatted(c *C, fn string) {
+	b, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	want, err := ioutil.ReadFile(filepath.Join(t.wd, "_testFiles", "basic.proto.formatted"))
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, string(want), Commentf("%v", fn))
+}
+
 func tmpDir(prefix string) string {
 	outputDir, err := ioutil.TempDir("", prefix)
 	if err != nil {
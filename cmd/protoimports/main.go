@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protoimports checks the imports of proto files, reporting import cycles,
+// unused imports and missing imports, and can write the import graph in DOT
+// format
+package main // import "myitcv.io/g/cmd/protoimports"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/imports"
+	"myitcv.io/g/protobuf/parser"
+)
+
+const (
+	// exitIssues is the exit code used when at least one issue is found
+	exitIssues = 1
+
+	// exitError is the exit code used when the files could not be parsed
+	exitError = 2
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fDOT         = flag.Bool("dot", false, "Write the import graph in DOT format instead of checking it.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Printf("Could not parse files: %v", err)
+		os.Exit(exitError)
+	}
+
+	if *fDOT {
+		if err := imports.NewGraph(fset).WriteDOT(os.Stdout); err != nil {
+			log.Printf("Could not write graph: %v", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	if check(os.Stdout, fset) {
+		os.Exit(exitIssues)
+	}
+}
+
+// check writes the issues found in the import graph of fset to w, one per
+// line, and reports whether there were any
+func check(w io.Writer, fset *ast.FileSet) bool {
+	issues := imports.NewGraph(fset).Check()
+
+	for _, i := range issues {
+		fmt.Fprintln(w, i)
+	}
+
+	return len(issues) > 0
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, `
+protoimports checks the import graph of the named files, which are found
+relative to the import paths, together with everything they import. It
+reports:
+
+  * import cycles, with the path of the cycle
+  * imports that provide nothing used by the importing file
+  * types that are used without importing the file that defines them,
+    which resolve only because that file is imported elsewhere
+
+With -dot, the import graph is written in the DOT language of Graphviz
+instead.
+
+Exit codes:
+
+  0 no issues were found
+  %v at least one issue was found
+  %v the files could not be parsed
+
+`, exitIssues, exitError)
+	flag.PrintDefaults()
+}
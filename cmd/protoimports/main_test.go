@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"myitcv.io/g/protobuf/imports"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct{}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) check(c *C, files ...string) string {
+	fset, err := parser.ParseFiles(files, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+
+	ob := bytes.NewBuffer(nil)
+	check(ob, fset)
+
+	return ob.String()
+}
+
+func (t *MainTest) TestUnusedAndMissing(c *C) {
+	// opts.proto is used only for a custom option, and base.proto is used
+	// through the public import in reexport.proto; deep.proto is imported
+	// only by middle.proto, and is reported once although two of its types
+	// are used
+	c.Assert(t.check(c, "main.proto"), Equals, `main.proto: import "unused.proto" is unused
+main.proto:14: "deep.Deep" is defined in "deep.proto", which is not imported
+`)
+}
+
+func (t *MainTest) TestCycle(c *C) {
+	c.Assert(t.check(c, "cycle_b.proto"), Equals, `cycle_b.proto: import cycle: cycle_b.proto -> cycle_a.proto -> cycle_b.proto
+cycle_b.proto: import "cycle_a.proto" is unused
+`)
+}
+
+func (t *MainTest) TestNoIssues(c *C) {
+	c.Assert(t.check(c, "middle.proto"), Equals, "")
+}
+
+func (t *MainTest) TestExtensionRangeOption(c *C) {
+	// opts.proto is used only for a custom option on an extension range
+	c.Assert(t.check(c, "rangeopt.proto"), Equals, "")
+}
+
+func (t *MainTest) TestDOT(c *C) {
+	fset, err := parser.ParseFiles([]string{"reexport.proto", "cycle_a.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+
+	ob := bytes.NewBuffer(nil)
+	c.Assert(imports.NewGraph(fset).WriteDOT(ob), IsNil)
+
+	c.Assert(ob.String(), Equals, `digraph imports {
+	"reexport.proto";
+	"cycle_a.proto";
+	"base.proto";
+	"cycle_b.proto";
+	"reexport.proto" -> "base.proto" [style=bold];
+	"cycle_a.proto" -> "cycle_b.proto" [color=red];
+	"cycle_b.proto" -> "cycle_a.proto" [color=red];
+}
+`)
+}
+
+func (t *MainTest) TestDOTMissing(c *C) {
+	fset, err := parser.ParseFiles([]string{"reexport.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+
+	// leave out base.proto, so the public import is both bold and dashed
+	fset.Files = fset.Files[:1]
+
+	ob := bytes.NewBuffer(nil)
+	c.Assert(imports.NewGraph(fset).WriteDOT(ob), IsNil)
+
+	c.Assert(ob.String(), Equals, `digraph imports {
+	"reexport.proto";
+	"reexport.proto" -> "base.proto" [style="bold,dashed"];
+}
+`)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protols is a language server for protobuf files, speaking the Language
+// Server Protocol over stdin and stdout
+package main // import "myitcv.io/g/cmd/protols"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"myitcv.io/g/protobuf"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports, in addition to the workspace root (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var paths []string
+	for _, p := range fImportPaths {
+		ap, err := filepath.Abs(p)
+		if err != nil {
+			log.Fatalf("Could not make import path %v absolute: %v", p, err)
+		}
+		paths = append(paths, ap)
+	}
+
+	s := newServer(os.Stdin, os.Stdout, paths)
+
+	if err := s.serve(); err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options]\n", os.Args[0])
+	flag.PrintDefaults()
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	protofmt "myitcv.io/g/protobuf/fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+type ServerTest struct {
+	root   string
+	client *conn
+	cw     io.Closer
+	done   chan error
+	nextID int
+
+	// msgs receives the messages sent by the server; reading them in a
+	// separate goroutine stops the synchronous pipes from deadlocking when
+	// client and server write at the same time
+	msgs chan []byte
+
+	// readDone is closed when the goroutine reading msgs exits
+	readDone chan struct{}
+
+	// notifications holds the params of the diagnostics received so far
+	diagnostics []publishDiagnosticsParams
+}
+
+var _ = Suite(&ServerTest{})
+
+func TestServer(t *testing.T) { TestingT(t) }
+
+func (t *ServerTest) SetUpTest(c *C) {
+	root, err := filepath.Abs("_testFiles")
+	c.Assert(err, IsNil)
+	t.root = root
+
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+
+	client := newConn(cr, cw)
+	done := make(chan error, 1)
+	msgs := make(chan []byte, 100)
+	readDone := make(chan struct{})
+
+	t.client = client
+	t.cw = cw
+	t.diagnostics = nil
+	t.done = done
+	t.msgs = msgs
+	t.readDone = readDone
+
+	// the goroutines use only the locals of this test, not the fields of t,
+	// which the next test sets afresh
+	go func() {
+		defer close(readDone)
+		for {
+			body, err := client.readMessage()
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- body
+		}
+	}()
+
+	s := newServer(sr, sw, nil)
+	go func() {
+		done <- s.serve()
+		sw.Close()
+	}()
+
+	t.call(c, "initialize", map[string]interface{}{"rootUri": filenameToURI(root)}, nil)
+	t.notify(c, "initialized", struct{}{})
+}
+
+func (t *ServerTest) TearDownTest(c *C) {
+	t.call(c, "shutdown", nil, nil)
+	t.notify(c, "exit", nil)
+	c.Assert(<-t.done, IsNil)
+	t.cw.Close()
+
+	// the server has closed its end, so the reader sees EOF; drain any
+	// messages it is still trying to deliver
+	for range t.msgs {
+	}
+	<-t.readDone
+}
+
+func (t *ServerTest) notify(c *C, method string, params interface{}) {
+	c.Assert(t.client.notify(method, params), IsNil)
+}
+
+// call sends a request and waits for its response, which is decoded into
+// result (if non-nil). Notifications received in the meantime are recorded.
+func (t *ServerTest) call(c *C, method string, params interface{}, result interface{}) {
+	c.Assert(t.request(c, method, params, result), IsNil)
+}
+
+// request is as call, but returns the error of the response rather than
+// asserting that there is none
+func (t *ServerTest) request(c *C, method string, params interface{}, result interface{}) *rpcError {
+	t.nextID++
+	id := json.RawMessage(strconv.Itoa(t.nextID))
+
+	req := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      &id,
+		"method":  method,
+		"params":  params,
+	}
+	c.Assert(t.client.write(req), IsNil)
+
+	for {
+		body, ok := <-t.msgs
+		c.Assert(ok, Equals, true)
+
+		var msg struct {
+			ID     *json.RawMessage
+			Method string
+			Params json.RawMessage
+			Result json.RawMessage
+			Error  *rpcError
+		}
+		c.Assert(json.Unmarshal(body, &msg), IsNil)
+
+		if msg.ID == nil {
+			if msg.Method == "textDocument/publishDiagnostics" {
+				var p publishDiagnosticsParams
+				c.Assert(json.Unmarshal(msg.Params, &p), IsNil)
+				t.diagnostics = append(t.diagnostics, p)
+			}
+			continue
+		}
+
+		c.Assert(string(*msg.ID), Equals, string(id))
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			c.Assert(json.Unmarshal(msg.Result, result), IsNil)
+		}
+		return nil
+	}
+}
+
+// open opens the named file from _testFiles with the given text (or its
+// contents on disk if text is empty), returning its URI
+func (t *ServerTest) open(c *C, name, text string) string {
+	fn := filepath.Join(t.root, name)
+	if text == "" {
+		b, err := ioutil.ReadFile(fn)
+		c.Assert(err, IsNil)
+		text = string(b)
+	}
+
+	uri := filenameToURI(fn)
+	t.notify(c, "textDocument/didOpen", &didOpenTextDocumentParams{
+		TextDocument: textDocumentItem{URI: uri, Version: 1, Text: text},
+	})
+
+	// a round trip guarantees the diagnostics have been published
+	t.call(c, "textDocument/documentSymbol", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, nil)
+
+	return uri
+}
+
+func (t *ServerTest) lastDiagnostics(c *C) publishDiagnosticsParams {
+	c.Assert(t.diagnostics, Not(HasLen), 0)
+	return t.diagnostics[len(t.diagnostics)-1]
+}
+
+func positionParams(uri string, line, char int) *textDocumentPositionParams {
+	return &textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		Position:     position{Line: line, Character: char},
+	}
+}
+
+func (t *ServerTest) TestDiagnostics(c *C) {
+	uri := t.open(c, "api.proto", "")
+	c.Assert(t.lastDiagnostics(c).Diagnostics, HasLen, 0)
+
+	// a resolution error is reported on the offending line
+	t.notify(c, "textDocument/didChange", &didChangeTextDocumentParams{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		ContentChanges: []textDocumentContentChangeEvent{
+			{Text: "syntax = \"proto3\";\n\nmessage A {\n  Missing m = 1;\n}\n"},
+		},
+	})
+	t.call(c, "textDocument/hover", positionParams(uri, 0, 0), nil)
+
+	d := t.lastDiagnostics(c)
+	c.Assert(d.URI, Equals, uri)
+	c.Assert(d.Diagnostics, HasLen, 1)
+	c.Assert(d.Diagnostics[0].Range.Start.Line, Equals, 3)
+	c.Assert(d.Diagnostics[0].Message, Equals, `failed to resolve name "Missing"`)
+
+	// as is a parse error
+	t.notify(c, "textDocument/didChange", &didChangeTextDocumentParams{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		ContentChanges: []textDocumentContentChangeEvent{
+			{Text: "syntax = \"proto3\";\n\nmessage A {\n  int32 = 1;\n}\n"},
+		},
+	})
+	t.call(c, "textDocument/hover", positionParams(uri, 0, 0), nil)
+
+	d = t.lastDiagnostics(c)
+	c.Assert(d.Diagnostics, HasLen, 1)
+	c.Assert(d.Diagnostics[0].Range.Start.Line, Equals, 3)
+}
+
+func (t *ServerTest) TestDefinition(c *C) {
+	uri := t.open(c, "api.proto", "")
+
+	// types.Timestamp in Request.when
+	var locs []location
+	t.call(c, "textDocument/definition", positionParams(uri, 8, 10), &locs)
+
+	c.Assert(locs, HasLen, 1)
+	c.Assert(locs[0].URI, Equals, filenameToURI(filepath.Join(t.root, "types.proto")))
+	c.Assert(locs[0].Range.Start, Equals, position{Line: 5, Character: 8})
+
+	// Response in the Greet method
+	t.call(c, "textDocument/definition", positionParams(uri, 17, 32), &locs)
+
+	c.Assert(locs, HasLen, 1)
+	c.Assert(locs[0].URI, Equals, uri)
+	c.Assert(locs[0].Range.Start, Equals, position{Line: 12, Character: 8})
+}
+
+func (t *ServerTest) TestReferences(c *C) {
+	uri := t.open(c, "types.proto", "")
+
+	params := &referenceParams{textDocumentPositionParams: *positionParams(uri, 5, 10)}
+	params.Context.IncludeDeclaration = true
+
+	var locs []location
+	t.call(c, "textDocument/references", params, &locs)
+
+	apiURI := filenameToURI(filepath.Join(t.root, "api.proto"))
+
+	c.Assert(locs, DeepEquals, []location{
+		{URI: apiURI, Range: lspRange{Start: position{Line: 8, Character: 2}, End: position{Line: 8, Character: 17}}},
+		{URI: apiURI, Range: lspRange{Start: position{Line: 13, Character: 2}, End: position{Line: 13, Character: 17}}},
+		{URI: uri, Range: lspRange{Start: position{Line: 5, Character: 8}, End: position{Line: 5, Character: 17}}},
+	})
+
+	// the workspace is loaded afresh once a document changes
+	b, err := ioutil.ReadFile(filepath.Join(t.root, "api.proto"))
+	c.Assert(err, IsNil)
+	t.open(c, "api.proto", strings.Replace(string(b), "message Response {\n  types.Timestamp", "message Response {\n  int64", 1))
+
+	t.call(c, "textDocument/references", params, &locs)
+
+	c.Assert(locs, DeepEquals, []location{
+		{URI: apiURI, Range: lspRange{Start: position{Line: 8, Character: 2}, End: position{Line: 8, Character: 17}}},
+		{URI: uri, Range: lspRange{Start: position{Line: 5, Character: 8}, End: position{Line: 5, Character: 17}}},
+	})
+}
+
+func (t *ServerTest) TestHover(c *C) {
+	uri := t.open(c, "api.proto", "")
+
+	var h hover
+	t.call(c, "textDocument/hover", positionParams(uri, 17, 15), &h)
+
+	c.Assert(h.Contents.Value, Equals, "```proto\nmessage api.Request\n```\n\nRequest asks for something.")
+}
+
+func (t *ServerTest) TestCompletion(c *C) {
+	uri := t.open(c, "api.proto", "")
+
+	var items []completionItem
+	t.call(c, "textDocument/completion", positionParams(uri, 9, 2), &items)
+
+	labels := make(map[string]int)
+	for _, i := range items {
+		labels[i.Label] = i.Kind
+	}
+
+	c.Assert(labels["Request"], Equals, completionKindClass)
+	c.Assert(labels["types.Timestamp"], Equals, completionKindClass)
+	c.Assert(labels["types.Status"], Equals, completionKindEnum)
+	c.Assert(labels["int32"], Equals, completionKindKeyword)
+}
+
+func (t *ServerTest) TestDocumentSymbol(c *C) {
+	uri := t.open(c, "api.proto", "")
+
+	var syms []documentSymbol
+	t.call(c, "textDocument/documentSymbol", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, &syms)
+
+	c.Assert(syms, HasLen, 3)
+	c.Assert(syms[0].Name, Equals, "Request")
+	c.Assert(syms[0].Children, HasLen, 2)
+	c.Assert(syms[0].Children[1].Name, Equals, "status")
+	c.Assert(syms[0].Children[1].Detail, Equals, "types.Status")
+	c.Assert(syms[2].Name, Equals, "Greeter")
+	c.Assert(syms[2].Kind, Equals, symbolKindInterface)
+	c.Assert(syms[2].Children[0].Name, Equals, "Greet")
+}
+
+func (t *ServerTest) TestFormatting(c *C) {
+	uri := t.open(c, "api.proto", "message A {\n    int32 a = 1;\n}\n")
+
+	var edits []textEdit
+	t.call(c, "textDocument/formatting", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, &edits)
+
+	c.Assert(edits, DeepEquals, []textEdit{
+		{
+			Range:   lspRange{End: position{Line: 3}},
+			NewText: "message A {\n\tint32 a = 1;\n}\n",
+		},
+	})
+
+	// a formatter that drops comments
+	defer func(f func(string, []byte, []byte) error) { checkRoundTrip = f }(checkRoundTrip)
+	checkRoundTrip = func(path string, src, res []byte) error {
+		return protofmt.CheckRoundTrip(path, src, bytes.Replace(res, []byte("// A\n"), nil, -1))
+	}
+
+	uri = t.open(c, "lossy.proto", "// A\nmessage A {\n    int32 a = 1;\n}\n")
+	rerr := t.request(c, "textDocument/formatting", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, &edits)
+	c.Assert(rerr, NotNil)
+	c.Assert(rerr.Message, Equals, "lossy.proto: cannot be formatted without loss: comments: 1 != 0")
+}
@@ -0,0 +1,596 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/parser"
+)
+
+const diagnosticSource = "protols"
+
+// document is a file opened by the client
+type document struct {
+	uri      string
+	filename string // absolute path
+	name     string // import name
+	text     string
+
+	// snap is the most recent snapshot for which loading and resolution
+	// succeeded; it is used to answer queries while the document is broken
+	snap *snapshot
+}
+
+type server struct {
+	conn *conn
+
+	// paths are the absolute import paths; the workspace root is added on
+	// initialize
+	paths []string
+
+	docs map[string]*document // keyed by filename
+
+	// cache saves re-parsing unchanged files each time a document is
+	// checked
+	cache *parser.Cache
+
+	// workspace is the snapshot of every file in the workspace, as used to
+	// find references; it is loaded when first needed, and discarded when
+	// a document changes
+	workspace *snapshot
+
+	shutdown bool
+}
+
+func newServer(r io.Reader, w io.Writer, paths []string) *server {
+	return &server{
+		conn:  newConn(r, w),
+		paths: paths,
+		docs:  make(map[string]*document),
+		cache: new(parser.Cache),
+	}
+}
+
+// serve handles messages until the client sends exit or the connection is
+// closed. A nil return means the session ended with a shutdown request.
+func (s *server) serve() error {
+	for {
+		body, err := s.conn.readMessage()
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			if err := s.conn.reply(nil, nil, errorf(codeParseError, "invalid JSON: %v", err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit without shutdown")
+			}
+			return nil
+		}
+
+		result, rerr := s.handle(&req)
+
+		if req.ID == nil {
+			// notifications get no response
+			continue
+		}
+
+		if err := s.conn.reply(req.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) handle(req *request) (interface{}, *rpcError) {
+	unmarshal := func(v interface{}) *rpcError {
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			return errorf(codeInvalidParams, "invalid params for %v: %v", req.Method, err)
+		}
+		return nil
+	}
+
+	switch req.Method {
+	case "initialize":
+		var params initializeParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.initialize(&params)
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenTextDocumentParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return nil, s.didOpen(&params)
+	case "textDocument/didChange":
+		var params didChangeTextDocumentParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return nil, s.didChange(&params)
+	case "textDocument/didSave":
+		s.workspace = nil
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseTextDocumentParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return nil, s.didClose(&params)
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.definition(&params)
+	case "textDocument/references":
+		var params referenceParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.references(&params)
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.hover(&params)
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.completion(&params)
+	case "textDocument/documentSymbol":
+		var params documentFormattingParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.documentSymbol(&params)
+	case "textDocument/formatting":
+		var params documentFormattingParams
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		return s.formatting(&params)
+	}
+
+	if strings.HasPrefix(req.Method, "$/") {
+		// optional notifications and requests may be ignored
+		return nil, nil
+	}
+
+	return nil, errorf(codeMethodNotFound, "method not supported: %v", req.Method)
+}
+
+func (s *server) initialize(params *initializeParams) (interface{}, *rpcError) {
+	root := params.RootPath
+	if params.RootURI != "" {
+		fn, err := uriToFilename(params.RootURI)
+		if err != nil {
+			return nil, errorf(codeInvalidParams, "invalid rootUri: %v", err)
+		}
+		root = fn
+	}
+	if root != "" {
+		s.paths = append(s.paths, root)
+	}
+
+	return &initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:   textDocumentSyncFull,
+			DefinitionProvider: true,
+			ReferencesProvider: true,
+			HoverProvider:      true,
+			CompletionProvider: &completionOptions{
+				TriggerCharacters: []string{"."},
+			},
+			DocumentSymbolProvider:     true,
+			DocumentFormattingProvider: true,
+		},
+	}, nil
+}
+
+func (s *server) didOpen(params *didOpenTextDocumentParams) *rpcError {
+	fn, err := uriToFilename(params.TextDocument.URI)
+	if err != nil {
+		return errorf(codeInvalidParams, "%v", err)
+	}
+
+	d := &document{
+		uri:      params.TextDocument.URI,
+		filename: fn,
+		name:     s.importName(fn),
+		text:     params.TextDocument.Text,
+	}
+	s.docs[fn] = d
+	s.workspace = nil
+
+	return s.check(d)
+}
+
+func (s *server) didChange(params *didChangeTextDocumentParams) *rpcError {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return rerr
+	}
+
+	// we only support full document sync, so the last change holds the
+	// entire text
+	if n := len(params.ContentChanges); n > 0 {
+		d.text = params.ContentChanges[n-1].Text
+	}
+	s.workspace = nil
+
+	return s.check(d)
+}
+
+func (s *server) didClose(params *didCloseTextDocumentParams) *rpcError {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return rerr
+	}
+
+	delete(s.docs, d.filename)
+	s.workspace = nil
+
+	// clear any diagnostics we published
+	if err := s.conn.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+		URI:         d.uri,
+		Diagnostics: []diagnostic{},
+	}); err != nil {
+		return errorf(codeInternalError, "%v", err)
+	}
+
+	return nil
+}
+
+func (s *server) document(uri string) (*document, *rpcError) {
+	fn, err := uriToFilename(uri)
+	if err != nil {
+		return nil, errorf(codeInvalidParams, "%v", err)
+	}
+	d, ok := s.docs[fn]
+	if !ok {
+		return nil, errorf(codeInvalidParams, "document not open: %v", uri)
+	}
+	return d, nil
+}
+
+// check loads and resolves d, publishing the resulting diagnostics
+func (s *server) check(d *document) *rpcError {
+	diags := []diagnostic{}
+
+	snap, err := s.load([]string{d.name})
+	if err == nil {
+		d.snap = snap
+	} else {
+		src := &source{filename: d.filename, text: d.text}
+		diag := diagnostic{
+			Severity: severityError,
+			Source:   diagnosticSource,
+		}
+
+		name, line, off, msg, ok := errorPosition(err)
+		switch {
+		case ok && name == d.name:
+			diag.Range = src.lineRange(line, off)
+		case ok:
+			// an error in an imported file; report it against the start of
+			// this document
+			msg = err.Error()
+			diag.Range = src.lineRange(1, 0)
+		default:
+			diag.Range = src.lineRange(1, 0)
+		}
+		diag.Message = msg
+
+		diags = append(diags, diag)
+	}
+
+	if err := s.conn.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+		URI:         d.uri,
+		Diagnostics: diags,
+	}); err != nil {
+		return errorf(codeInternalError, "%v", err)
+	}
+
+	return nil
+}
+
+// target returns the snapshot of the document at the given position along
+// with the message or enum at that position
+func (s *server) target(params *textDocumentPositionParams) (*snapshot, ast.Node, *rpcError) {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return nil, nil, rerr
+	}
+	if d.snap == nil {
+		return nil, nil, nil
+	}
+
+	f := d.snap.byName[d.name]
+	src := d.snap.sources[f]
+	off := src.offset(params.Position)
+
+	t, _ := d.snap.targetAt(f, params.Position.Line+1, off).(ast.Node)
+	return d.snap, t, nil
+}
+
+func (s *server) definition(params *textDocumentPositionParams) (interface{}, *rpcError) {
+	snap, t, rerr := s.target(params)
+	if rerr != nil || t == nil {
+		return nil, rerr
+	}
+
+	return []location{snap.definitionLocation(t)}, nil
+}
+
+func (s *server) references(params *referenceParams) (interface{}, *rpcError) {
+	snap, t, rerr := s.target(&params.textDocumentPositionParams)
+	if rerr != nil || t == nil {
+		return nil, rerr
+	}
+
+	name := ast.FullName(t)
+
+	// references may be made from anywhere in the workspace, not just from
+	// the files reachable from this document; fall back to the latter
+	if s.workspace == nil {
+		if ws, err := s.load(s.workspaceFiles()); err == nil {
+			s.workspace = ws
+		}
+	}
+	if s.workspace != nil {
+		snap = s.workspace
+	}
+
+	res := []location{}
+
+	for _, f := range snap.fset.Files {
+		src := snap.sources[f]
+
+		for _, n := range allNodes(f) {
+			if params.Context.IncludeDeclaration {
+				switch n.(type) {
+				case *ast.Message, *ast.Enum:
+					if ast.FullName(n) == name {
+						res = append(res, snap.definitionLocation(n))
+					}
+				}
+			}
+
+			for _, r := range ast.References(n) {
+				if ast.FullName(r.Target) == name {
+					res = append(res, location{
+						URI:   filenameToURI(src.filename),
+						Range: src.nameRange(n.Pos(), *r.Name),
+					})
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (s *server) hover(params *textDocumentPositionParams) (interface{}, *rpcError) {
+	_, t, rerr := s.target(params)
+	if rerr != nil || t == nil {
+		return nil, rerr
+	}
+
+	kind := "message"
+	if _, ok := t.(*ast.Enum); ok {
+		kind = "enum"
+	}
+
+	value := fmt.Sprintf("```proto\n%v %v\n```", kind, ast.FullName(t))
+	if c := ast.LeadingComment(t); c != nil {
+		value += "\n\n" + strings.Join(c.Text, "\n")
+	}
+
+	return &hover{
+		Contents: markupContent{
+			Kind:  "markdown",
+			Value: value,
+		},
+	}, nil
+}
+
+type completionSort []completionItem
+
+func (a completionSort) Len() int           { return len(a) }
+func (a completionSort) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a completionSort) Less(i, j int) bool { return a[i].Label < a[j].Label }
+
+func (s *server) completion(params *textDocumentPositionParams) (interface{}, *rpcError) {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	res := []completionItem{}
+
+	for _, ft := range ast.FieldTypeMap {
+		res = append(res, completionItem{
+			Label: ft,
+			Kind:  completionKindKeyword,
+		})
+	}
+
+	if d.snap != nil {
+		// names in the same package as this document can be used unqualified
+		pkg := strings.Join(d.snap.byName[d.name].Package, ".")
+
+		for _, f := range d.snap.fset.Files {
+			for _, n := range allNodes(f) {
+				kind := completionKindClass
+				switch n := n.(type) {
+				case *ast.Message:
+					if n.Group {
+						continue
+					}
+				case *ast.Enum:
+					kind = completionKindEnum
+				default:
+					continue
+				}
+
+				label := ast.FullName(n)
+				if pkg != "" && strings.HasPrefix(label, pkg+".") {
+					label = strings.TrimPrefix(label, pkg+".")
+				}
+
+				res = append(res, completionItem{
+					Label:  label,
+					Kind:   kind,
+					Detail: ast.FullName(n),
+				})
+			}
+		}
+	}
+
+	sort.Sort(completionSort(res))
+
+	return res, nil
+}
+
+func (s *server) documentSymbol(params *documentFormattingParams) (interface{}, *rpcError) {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	// symbols only need a syntactically valid document
+	f, err := parser.ParseFile(d.name, []byte(d.text))
+	if err != nil {
+		return nil, errorf(codeInternalError, "%v", err)
+	}
+
+	src := &source{filename: d.filename, text: d.text}
+
+	res := []documentSymbol{}
+	for _, n := range f.Nodes() {
+		res = append(res, symbol(src, n))
+	}
+
+	return res, nil
+}
+
+// symbol returns the document symbol for n, with the symbols of its
+// definitions as children
+func symbol(src *source, n ast.Node) documentSymbol {
+	var ds documentSymbol
+	var children []ast.Node
+
+	switch n := n.(type) {
+	case *ast.Message:
+		ds.Name, ds.Kind = n.Name, symbolKindClass
+		for _, c := range n.Nodes() {
+			if _, ok := c.(*ast.Oneof); !ok {
+				children = append(children, c)
+			}
+		}
+	case *ast.Enum:
+		ds.Name, ds.Kind = n.Name, symbolKindEnum
+		for _, v := range n.Values {
+			children = append(children, v)
+		}
+	case *ast.EnumValue:
+		ds.Name, ds.Kind = n.Name, symbolKindEnumMember
+	case *ast.Service:
+		ds.Name, ds.Kind = n.Name, symbolKindInterface
+		for _, m := range n.Methods {
+			children = append(children, m)
+		}
+	case *ast.Method:
+		ds.Name, ds.Kind = n.Name, symbolKindMethod
+		ds.Detail = fmt.Sprintf("(%v) returns (%v)", n.InTypeName, n.OutTypeName)
+	case *ast.Field:
+		ds.Name, ds.Kind = n.Name, symbolKindField
+		ds.Detail = n.TypeName
+	}
+
+	ds.SelectionRange = src.nameRange(n.Pos(), ds.Name)
+	ds.Range = src.lineRange(n.Pos().Line, n.Pos().Offset)
+
+	for _, c := range children {
+		cs := symbol(src, c)
+		ds.Children = append(ds.Children, cs)
+
+		// we don't know where a definition ends, so extend its range to
+		// cover its last child
+		ds.Range.End = cs.Range.End
+	}
+
+	return ds
+}
+
+// checkRoundTrip checks that the formatted result of a document loses
+// nothing; it is a variable so that tests can exercise a lossy formatter
+var checkRoundTrip = protofmt.CheckRoundTrip
+
+func (s *server) formatting(params *documentFormattingParams) (interface{}, *rpcError) {
+	d, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	config, _, err := protofmt.FindConfig(filepath.Dir(d.filename))
+	if err != nil {
+		return nil, errorf(codeInternalError, "%v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+
+	f := &protofmt.Formatter{
+		Output: buf,
+		Config: config,
+	}
+
+	if err := f.FmtSource(d.name, []byte(d.text)); err != nil {
+		return nil, errorf(codeInternalError, "%v", err)
+	}
+
+	// the document is only replaced if nothing would be lost
+	if err := checkRoundTrip(d.name, []byte(d.text), buf.Bytes()); err != nil {
+		return nil, errorf(codeInternalError, "%v", err)
+	}
+
+	if buf.String() == d.text {
+		return []textEdit{}, nil
+	}
+
+	src := &source{filename: d.filename, text: d.text}
+	end := src.position(strings.Count(d.text, "\n")+1, len(d.text))
+
+	return []textEdit{
+		{
+			Range:   lspRange{End: end},
+			NewText: buf.String(),
+		},
+	}, nil
+}
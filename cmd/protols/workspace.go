@@ -0,0 +1,377 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+)
+
+// source is the text of a file loaded into a snapshot
+type source struct {
+	filename string // absolute path
+	text     string
+}
+
+// position converts the byte offset off (on the 1-based line) into an LSP
+// position
+func (s *source) position(line, off int) position {
+	if off > len(s.text) {
+		off = len(s.text)
+	}
+	start := strings.LastIndex(s.text[:off], "\n") + 1
+	return position{
+		Line:      line - 1,
+		Character: utf16Len(s.text[start:off]),
+	}
+}
+
+// offset converts an LSP position into a byte offset
+func (s *source) offset(pos position) int {
+	off := 0
+	for i := 0; i < pos.Line; i++ {
+		j := strings.Index(s.text[off:], "\n")
+		if j == -1 {
+			return len(s.text)
+		}
+		off += j + 1
+	}
+
+	for n := 0; n < pos.Character && off < len(s.text) && s.text[off] != '\n'; {
+		r, size := utf8.DecodeRuneInString(s.text[off:])
+		n += len(utf16.Encode([]rune{r}))
+		off += size
+	}
+
+	return off
+}
+
+// lineRange returns the range from off to the end of its line
+func (s *source) lineRange(line, off int) lspRange {
+	end := len(s.text)
+	if off < end {
+		if i := strings.Index(s.text[off:], "\n"); i != -1 {
+			end = off + i
+		}
+	}
+	return lspRange{Start: s.position(line, off), End: s.position(line, end)}
+}
+
+// nameRange returns the range of the first occurrence of name at or after
+// the node position pos, on the same line. If name cannot be found the range
+// of the whole of the rest of the line is returned.
+func (s *source) nameRange(pos ast.Position, name string) lspRange {
+	lr := s.lineRange(pos.Line, pos.Offset)
+	if pos.Offset > len(s.text) {
+		return lr
+	}
+
+	rest := s.text[pos.Offset:]
+	if i := strings.Index(rest, "\n"); i != -1 {
+		rest = rest[:i]
+	}
+
+	i := strings.Index(rest, name)
+	if name == "" || i == -1 {
+		return lr
+	}
+
+	off := pos.Offset + i
+	return lspRange{
+		Start: s.position(pos.Line, off),
+		End:   s.position(pos.Line, off+len(name)),
+	}
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
+
+// snapshot is a resolved set of files
+type snapshot struct {
+	fset    *ast.FileSet
+	sources map[*ast.File]*source
+	byName  map[string]*ast.File
+}
+
+// load parses the files with the given import names and everything they
+// import, then resolves the result. The text of open documents is used in
+// preference to the contents of files on disk.
+func (s *server) load(names []string) (*snapshot, error) {
+	snap := &snapshot{
+		fset:    new(ast.FileSet),
+		sources: make(map[*ast.File]*source),
+		byName:  make(map[string]*ast.File),
+	}
+
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if _, ok := snap.byName[name]; ok {
+			continue
+		}
+
+		filename, ok := s.findFile(name)
+		if !ok {
+			return nil, fmt.Errorf("file not found in import paths: %v", name)
+		}
+
+		text, err := s.readFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := s.cache.ParseFile(name, []byte(text))
+		if err != nil {
+			return nil, err
+		}
+
+		snap.fset.Files = append(snap.fset.Files, f)
+		snap.sources[f] = &source{filename: filename, text: text}
+		snap.byName[name] = f
+
+		names = append(names, f.Imports...)
+	}
+
+	if err := parser.Resolve(snap.fset); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// findFile returns the absolute filename of the file with import name name
+func (s *server) findFile(name string) (string, bool) {
+	for _, p := range s.paths {
+		fn := filepath.Join(p, name)
+		if _, ok := s.docs[fn]; ok {
+			return fn, true
+		}
+		if fi, err := os.Stat(fn); err == nil && !fi.IsDir() {
+			return fn, true
+		}
+	}
+	return "", false
+}
+
+func (s *server) readFile(filename string) (string, error) {
+	if d, ok := s.docs[filename]; ok {
+		return d.text, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// importName returns the name by which the file filename would be imported,
+// i.e. its path relative to the first import path that contains it. If no
+// import path contains it, the directory of filename is added as an import
+// path.
+func (s *server) importName(filename string) string {
+	for _, p := range s.paths {
+		rel, err := filepath.Rel(p, filename)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	s.paths = append(s.paths, filepath.Dir(filename))
+	return filepath.Base(filename)
+}
+
+// workspaceFiles returns the import names of all the .proto files within the
+// import paths
+func (s *server) workspaceFiles() []string {
+	seen := make(map[string]bool)
+	var res []string
+
+	for _, p := range s.paths {
+		filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.IsDir() && path != p && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() && strings.HasSuffix(path, ".proto") && !seen[path] {
+				seen[path] = true
+				res = append(res, s.importName(path))
+			}
+			return nil
+		})
+	}
+
+	return res
+}
+
+func uriToFilename(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI scheme in %q", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func filenameToURI(filename string) string {
+	u := url.URL{
+		Scheme: "file",
+		Path:   filepath.ToSlash(filename),
+	}
+	return u.String()
+}
+
+// errorPosition extracts the position information from an error returned by
+// the parser. ok is false if err carries no position.
+func errorPosition(err error) (name string, line, offset int, msg string, ok bool) {
+	var pos ast.Position
+	switch e := err.(type) {
+	case *parser.SyntaxError:
+		name, pos, msg = e.Filename, e.Pos, e.Msg
+	case *parser.ResolveError:
+		name, pos, msg = e.Filename, e.Pos, e.Msg
+	}
+	if !pos.IsValid() {
+		return "", 0, -1, err.Error(), false
+	}
+
+	return name, pos.Line, pos.Offset, msg, true
+}
+
+// allNodes returns every node in f: messages, enums and services together
+// with their fields, values and methods, and extensions and their fields
+func allNodes(f *ast.File) []ast.Node {
+	var res []ast.Node
+
+	addExt := func(exts []*ast.Extension) {
+		for _, e := range exts {
+			res = append(res, e)
+			for _, fl := range e.Fields {
+				res = append(res, fl)
+			}
+		}
+	}
+
+	addEnums := func(enums []*ast.Enum) {
+		for _, e := range enums {
+			res = append(res, e)
+			for _, v := range e.Values {
+				res = append(res, v)
+			}
+		}
+	}
+
+	var addMsgs func(msgs []*ast.Message)
+	addMsgs = func(msgs []*ast.Message) {
+		for _, m := range msgs {
+			res = append(res, m)
+			for _, fl := range m.Fields {
+				res = append(res, fl)
+			}
+			addExt(m.Extensions)
+			addEnums(m.Enums)
+			addMsgs(m.Messages)
+		}
+	}
+
+	addMsgs(f.Messages)
+	addEnums(f.Enums)
+	addExt(f.Extensions)
+
+	for _, srv := range f.Services {
+		res = append(res, srv)
+		for _, m := range srv.Methods {
+			res = append(res, m)
+		}
+	}
+
+	return res
+}
+
+// wordAt returns the (possibly dotted) identifier in text that spans off
+func wordAt(text string, off int) string {
+	isWordChar := func(c byte) bool {
+		return c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+
+	start, end := off, off
+	for start > 0 && isWordChar(text[start-1]) {
+		start--
+	}
+	for end < len(text) && isWordChar(text[end]) {
+		end++
+	}
+
+	return strings.Trim(text[start:end], ".")
+}
+
+// targetAt returns the message or enum named at the (1-based) line and offset
+// in f: either a reference to it or its definition
+func (snap *snapshot) targetAt(f *ast.File, line, off int) interface{} {
+	src := snap.sources[f]
+	word := wordAt(src.text, off)
+	if word == "" {
+		return nil
+	}
+
+	for _, n := range allNodes(f) {
+		if n.Pos().Line != line {
+			continue
+		}
+
+		switch n := n.(type) {
+		case *ast.Message:
+			if n.Name == word {
+				return n
+			}
+		case *ast.Enum:
+			if n.Name == word {
+				return n
+			}
+		}
+
+		for _, r := range ast.References(n) {
+			if *r.Name == word {
+				return r.Target
+			}
+		}
+	}
+
+	return nil
+}
+
+// definitionLocation returns the location of the definition of x, which must
+// be an *ast.Message or *ast.Enum
+func (snap *snapshot) definitionLocation(x ast.Node) location {
+	src := snap.sources[x.File()]
+
+	var name string
+	switch x := x.(type) {
+	case *ast.Message:
+		name = x.Name
+	case *ast.Enum:
+		name = x.Name
+	}
+
+	return location{
+		URI:   filenameToURI(src.filename),
+		Range: src.nameRange(x.Pos(), name),
+	}
+}
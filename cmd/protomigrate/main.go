@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protomigrate helps migrate proto2 files to proto3
+package main // import "myitcv.io/g/cmd/protomigrate"
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/proto3"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fWrite       = flag.Bool("w", false, "Rewrite the files as proto3 in place, as well as reporting their issues.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	paths := []string(fImportPaths)
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), paths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	named := make(map[string]bool)
+	for _, fn := range flag.Args() {
+		named[fn] = true
+	}
+
+	// every file is migrated, formatted and checked before any is written
+	var fns []string
+	var outs [][]byte
+	bw := bufio.NewWriter(os.Stdout)
+	for _, f := range fset.Files {
+		if !named[f.Name] {
+			continue
+		}
+
+		check := proto3.Check
+		if *fWrite {
+			check = proto3.Migrate
+		}
+		issues, err := check(f)
+		if err != nil {
+			log.Fatalf("Could not migrate %v: %v", f.Name, err)
+		}
+		if err := report(bw, issues); err != nil {
+			log.Fatalf("Could not write output: %v", err)
+		}
+
+		if *fWrite {
+			fn, out, err := format(paths, f)
+			if err != nil {
+				log.Fatalf("Could not format %v: %v", f.Name, err)
+			}
+			fns = append(fns, fn)
+			outs = append(outs, out)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+
+	for i, fn := range fns {
+		if err := ioutil.WriteFile(fn, outs[i], 0666); err != nil {
+			log.Fatalf("Could not write %v: %v", fn, err)
+		}
+	}
+}
+
+// report writes issues to w, each followed by its rewrite and its
+// consequence for the wire format, if any
+func report(w io.Writer, issues []*proto3.Issue) error {
+	for _, i := range issues {
+		if _, err := fmt.Fprintln(w, i); err != nil {
+			return err
+		}
+		if i.Rewrite != "" {
+			if _, err := fmt.Fprintf(w, "\trewrite: %v\n", i.Rewrite); err != nil {
+				return err
+			}
+		}
+		if i.Wire != "" {
+			if _, err := fmt.Fprintf(w, "\twire: %v\n", i.Wire); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkFile checks that the formatted result of a file loses nothing; it is
+// a variable so that tests can exercise a lossy formatter
+var checkFile = protofmt.CheckFile
+
+// format returns the first file of the name of f found relative to paths,
+// and f formatted as protofmt would, unless formatting would lose part of f
+func format(paths []string, f *ast.File) (string, []byte, error) {
+	var fn string
+	for _, p := range paths {
+		fn = filepath.Join(p, filepath.FromSlash(f.Name))
+		if _, err := os.Stat(fn); err == nil {
+			break
+		}
+	}
+
+	config, _, err := protofmt.FindConfig(filepath.Dir(fn))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	pf := &protofmt.Formatter{
+		Output: &buf,
+		Config: config,
+	}
+	pf.FmtFile(f)
+
+	if err := checkFile(f, buf.Bytes()); err != nil {
+		return "", nil, err
+	}
+	return fn, buf.Bytes(), nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protomigrate reports the constructs of the named proto2 files, which are found
+relative to the import paths, that proto3 does not allow, or whose meaning
+changes in proto3: required fields, defaults, groups, extensions, enums whose
+first value is not zero, and so on. Each is followed by the rewrite that -w
+makes, if any, and by its consequence for data written with the proto2 schema.
+With -w, the files are rewritten as proto3, as printed by protofmt, unless
+printing any of them would lose part of it; the issues without a rewrite must
+then be dealt with by hand.
+`)
+	flag.PrintDefaults()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/proto3"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"legacy.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) legacy() *ast.File {
+	for _, f := range t.fset.Files {
+		if f.Name == "legacy.proto" {
+			return f
+		}
+	}
+	panic("legacy.proto not loaded")
+}
+
+func (t *MainTest) TestCheck(c *C) {
+	orig := t.fset.Clone()
+
+	issues, err := proto3.Check(t.legacy())
+	c.Assert(err, IsNil)
+
+	ob := bytes.NewBuffer(nil)
+	c.Assert(report(ob, issues), IsNil)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/legacy.report")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+
+	// checking changes nothing
+	c.Assert(ast.Diff(orig, t.fset, 0), IsNil)
+}
+
+func (t *MainTest) TestMigrate(c *C) {
+	checked, err := proto3.Check(t.legacy())
+	c.Assert(err, IsNil)
+
+	issues, err := proto3.Migrate(t.legacy())
+	c.Assert(err, IsNil)
+
+	// the same issues are reported, whether or not they are rewritten
+	c.Assert(issues, DeepEquals, checked)
+
+	ob := bytes.NewBuffer(nil)
+	f := &protofmt.Formatter{
+		Output: ob,
+		Config: protofmt.Config{Indent: "  "},
+	}
+	f.FmtFile(t.legacy())
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/legacy.proto.migrated")
+	c.Assert(err, IsNil)
+
+	c.Assert(ob.String(), Equals, string(cmpBytes))
+	c.Assert(protofmt.CheckFile(t.legacy(), ob.Bytes()), IsNil)
+
+	// the result is no longer proto2
+	_, err = proto3.Check(t.legacy())
+	c.Assert(err, ErrorMatches, "legacy.proto is not a proto2 file")
+}
+
+func (t *MainTest) TestLossy(c *C) {
+	// a formatter that drops comments
+	defer func(f func(*ast.File, []byte) error) { checkFile = f }(checkFile)
+	checkFile = func(f *ast.File, res []byte) error {
+		return protofmt.CheckFile(f, bytes.Replace(res, []byte("// Order is an order for some items.\n"), nil, -1))
+	}
+
+	_, err := proto3.Migrate(t.legacy())
+	c.Assert(err, IsNil)
+
+	_, _, err = format([]string{"_testFiles"}, t.legacy())
+	c.Assert(err, ErrorMatches, "legacy.proto: cannot be formatted without loss: comments: 5 != 4")
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protomv moves a message, enum or service from one proto file to another
+package main // import "myitcv.io/g/cmd/protomv"
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/move"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fWrite       = flag.Bool("w", false, "Write the changed files in place instead of to stdout.")
+	fPackage     = flag.String("package", "", "The package of the destination file, if it does not exist (default that of the source file).")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	paths := []string(fImportPaths)
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	name, dst := flag.Arg(0), flag.Arg(1)
+	filenames := flag.Args()[2:]
+
+	dstExists := find(paths, dst) != ""
+	if dstExists {
+		filenames = append(filenames, dst)
+	}
+
+	fset, err := parser.ParseFiles(filenames, paths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	if !dstExists {
+		var pkg []string
+		if *fPackage != "" {
+			pkg = strings.Split(*fPackage, ".")
+		}
+		if err := addFile(fset, name, dst, pkg); err != nil {
+			log.Fatalf("Could not create %v: %v", dst, err)
+		}
+	}
+
+	files, err := move.Move(fset, name, dst)
+	if err != nil {
+		log.Fatalf("Could not move %v: %v", name, err)
+	}
+
+	// every file is formatted, and checked, before any is written
+	var fns []string
+	var outs [][]byte
+	for _, f := range files {
+		fn := find(paths, f.Name)
+		if fn == "" {
+			fn = filepath.Join(paths[0], filepath.FromSlash(f.Name))
+		}
+
+		config, _, err := protofmt.FindConfig(filepath.Dir(fn))
+		if err != nil {
+			log.Fatalf("Could not find the format of %v: %v", fn, err)
+		}
+
+		var buf bytes.Buffer
+		if err := format(&buf, f, config); err != nil {
+			log.Fatalf("Could not format %v: %v", fn, err)
+		}
+		fns = append(fns, fn)
+		outs = append(outs, buf.Bytes())
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	for i, fn := range fns {
+		if *fWrite {
+			if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+				log.Fatalf("Could not create directory: %v", err)
+			}
+			if err := ioutil.WriteFile(fn, outs[i], 0666); err != nil {
+				log.Fatalf("Could not write %v: %v", fn, err)
+			}
+			continue
+		}
+		fmt.Fprintf(bw, "==> %v <==\n", fn)
+		bw.Write(outs[i])
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
+
+// addFile adds a new, empty, file called filename to fset, with the syntax of
+// the file defining the top-level definition name, and the package pkg, or
+// that of the defining file if pkg is nil.
+func addFile(fset *ast.FileSet, name, filename string, pkg []string) error {
+	name = strings.TrimPrefix(name, ".")
+	for _, f := range fset.Files {
+		fpkg := strings.Join(f.Package, ".")
+		for _, n := range f.Nodes() {
+			var nn string
+			switch n := n.(type) {
+			case *ast.Message:
+				nn = n.Name
+			case *ast.Enum:
+				nn = n.Name
+			case *ast.Service:
+				nn = n.Name
+			}
+			if fpkg != "" {
+				nn = fpkg + "." + nn
+			}
+			if nn != name {
+				continue
+			}
+			if pkg == nil {
+				pkg = f.Package
+			}
+			fset.Files = append(fset.Files, &ast.File{
+				Name:    filename,
+				Syntax:  f.Syntax,
+				Edition: f.Edition,
+				Package: append([]string{}, pkg...),
+			})
+			return nil
+		}
+	}
+	return fmt.Errorf("no top-level message, enum or service called %v", name)
+}
+
+// checkFile checks that the formatted result of a file loses nothing; it is
+// a variable so that tests can exercise a lossy formatter
+var checkFile = protofmt.CheckFile
+
+// format writes f, formatted according to config, to w, unless formatting
+// would lose part of f
+func format(w io.Writer, f *ast.File, config protofmt.Config) error {
+	var buf bytes.Buffer
+	pf := &protofmt.Formatter{
+		Output: &buf,
+		Config: config,
+	}
+	pf.FmtFile(f)
+
+	if err := checkFile(f, buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// find returns the path of the first file called filename relative to one
+// of paths, or "" if there is none
+func find(paths []string, filename string) string {
+	for _, p := range paths {
+		fn := filepath.Join(p, filepath.FromSlash(filename))
+		if _, err := os.Stat(fn); err == nil {
+			return fn
+		}
+	}
+	return ""
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] name dst.proto file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protomv moves the top-level message, enum or service called name, e.g.
+foo.Bar, to the end of dst.proto, which is created if it does not exist. The
+named files, which are found relative to the import paths, and those they
+import, are loaded; the references they make to the definition, and those it
+makes, are rewritten where they would no longer resolve, and their imports
+are fixed. The changed files are reprinted as by protofmt, and written to
+stdout, each preceded by its name, unless -w is given. Nothing is written if
+reprinting any of them would lose part of it.
+`)
+	flag.PrintDefaults()
+}
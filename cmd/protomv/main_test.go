@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/move"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"shop.proto", "billing.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+// assertMove moves name to dst, and compares the changed files with those of
+// the directory _testFiles/dir
+func (t *MainTest) assertMove(c *C, name, dst, dir string, changed ...string) {
+	files, err := move.Move(t.fset, name, dst)
+	c.Assert(err, IsNil)
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+
+		ob := bytes.NewBuffer(nil)
+		c.Assert(format(ob, f, protofmt.Config{Indent: "  "}), IsNil, Commentf("%v", f.Name))
+
+		cmpBytes, err := ioutil.ReadFile(filepath.Join("_testFiles", dir, f.Name))
+		c.Assert(err, IsNil)
+
+		c.Assert(ob.String(), Equals, string(cmpBytes), Commentf("%v", f.Name))
+	}
+	c.Assert(names, DeepEquals, changed)
+}
+
+func (t *MainTest) TestMoveToNewFile(c *C) {
+	c.Assert(addFile(t.fset, "shop.Address", "address.proto", nil), IsNil)
+	t.assertMove(c, "shop.Address", "address.proto", "address", "shop.proto", "address.proto")
+}
+
+func (t *MainTest) TestMoveToOtherPackage(c *C) {
+	t.assertMove(c, ".shop.Product", "common.proto", "common", "shop.proto", "billing.proto", "common.proto")
+}
+
+func (t *MainTest) TestMoveToNewPackage(c *C) {
+	c.Assert(addFile(t.fset, "shop.Product", "store.proto", []string{"store"}), IsNil)
+	t.assertMove(c, "shop.Product", "store.proto", "store", "shop.proto", "billing.proto", "store.proto")
+
+	// the comments move with the definition
+	p := t.fset.Files[len(t.fset.Files)-1].Messages[0]
+	c.Assert(ast.LeadingComment(p).Text, DeepEquals, []string{"Product is something for sale."})
+}
+
+func (t *MainTest) TestLossy(c *C) {
+	// a formatter that drops comments
+	defer func(f func(*ast.File, []byte) error) { checkFile = f }(checkFile)
+	checkFile = func(f *ast.File, res []byte) error {
+		return protofmt.CheckFile(f, bytes.Replace(res, []byte("// Product is something for sale.\n"), nil, -1))
+	}
+
+	c.Assert(addFile(t.fset, "shop.Product", "store.proto", []string{"store"}), IsNil)
+	files, err := move.Move(t.fset, "shop.Product", "store.proto")
+	c.Assert(err, IsNil)
+
+	ob := bytes.NewBuffer(nil)
+	f := files[len(files)-1]
+	c.Assert(format(ob, f, protofmt.Config{}), ErrorMatches, "store.proto: cannot be formatted without loss: comments: 1 != 0")
+	c.Assert(ob.String(), Equals, "")
+}
+
+func (t *MainTest) TestErrors(c *C) {
+	for _, tc := range []struct{ name, dst, err string }{
+		{"shop.Missing", "common.proto", "no top-level message, enum or service called shop.Missing"},
+		{"shop.Product.Variant", "common.proto", "no top-level message, enum or service called shop.Product.Variant"},
+		{"shop.Product", "other.proto", "other.proto is not in the file set"},
+		{"shop.Product", "shop.proto", "shop.Product is already defined in shop.proto"},
+		{"shop.Order", "common.proto", "moving shop.Order to common.proto creates an import cycle: shop.proto -> common.proto -> shop.proto"},
+	} {
+		_, err := move.Move(t.fset, tc.name, tc.dst)
+		c.Assert(err, ErrorMatches, tc.err)
+	}
+}
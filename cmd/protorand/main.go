@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protorand generates random, valid, protobuf messages
+package main // import "myitcv.io/g/cmd/protorand"
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/random"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fType        = flag.String("type", "", "The full name of the message type to generate, e.g. foo.Bar.")
+	fFormat      = flag.String("format", "text", "The format of the output: binary, hex, base64, text or json.")
+	fSeed        = flag.Int64("seed", 0, "The seed of the generated messages (default the current time).")
+	fCount       = flag.Int("n", 1, "The number of messages to generate.")
+	fDepth       = flag.Int("depth", random.DefaultMaxDepth, "The depth to which messages are nested.")
+	fRepeated    = flag.Int("repeated", random.DefaultMaxRepeated, "The maximum number of elements of a repeated field, or entries of a map.")
+	fLength      = flag.Int("length", random.DefaultMaxLength, "The maximum length of a string or bytes value.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 || *fType == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	seed := *fSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+		log.Printf("seed %v", seed)
+	}
+
+	paths := []string(fImportPaths)
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), paths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+	m := findMessage(fset, *fType)
+	if m == nil {
+		log.Fatalf("Could not find message type %v", *fType)
+	}
+
+	g := random.New(seed)
+	g.MaxDepth = *fDepth
+	g.MaxRepeated = *fRepeated
+	g.MaxLength = *fLength
+
+	bw := bufio.NewWriter(os.Stdout)
+	if err := generate(bw, g, m, *fFormat, *fCount); err != nil {
+		bw.Flush()
+		log.Fatalf("Could not generate messages: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
+
+// generate writes n random instances of m, generated by g, to w in the named
+// format. In the binary format, each message is preceded by its length, as a
+// varint, if n is greater than one; in the text format, messages are
+// separated by blank lines; otherwise each message is written on a line of
+// its own.
+func generate(w io.Writer, g *random.Generator, m *ast.Message, format string, n int) error {
+	switch format {
+	case "binary", "hex", "base64", "text", "json":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	for i := 0; i < n; i++ {
+		msg, err := g.Message(m)
+		if err != nil {
+			return err
+		}
+
+		var out []byte
+		switch format {
+		case "binary":
+			out = msg.Marshal()
+			if n > 1 {
+				var l [binary.MaxVarintLen64]byte
+				out = append(l[:binary.PutUvarint(l[:], uint64(len(out)))], out...)
+			}
+		case "hex":
+			out = []byte(hex.EncodeToString(msg.Marshal()) + "\n")
+		case "base64":
+			out = []byte(base64.StdEncoding.EncodeToString(msg.Marshal()) + "\n")
+		case "text":
+			if out, err = msg.MarshalText(); err != nil {
+				return err
+			}
+			if i > 0 {
+				out = append([]byte("\n"), out...)
+			}
+		case "json":
+			if out, err = msg.MarshalJSON(); err != nil {
+				return err
+			}
+			out = append(out, '\n')
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMessage returns the message with the full name within fset, or nil if
+// there is no such message.
+func findMessage(fset *ast.FileSet, name string) *ast.Message {
+	name = strings.TrimPrefix(name, ".")
+	for _, f := range fset.Files {
+		prefix := ""
+		if len(f.Package) > 0 {
+			prefix = strings.Join(f.Package, ".") + "."
+		}
+		if m := findNested(f.Messages, prefix, name); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func findNested(ms []*ast.Message, prefix, name string) *ast.Message {
+	for _, m := range ms {
+		full := prefix + m.Name
+		if full == name {
+			return m
+		}
+		if strings.HasPrefix(name, full+".") {
+			if res := findNested(m.Messages, full+".", name); res != nil {
+				return res
+			}
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] -type foo.Bar file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protorand generates random, valid, instances of the message type named by
+-type, defined by one of the named files or those they import, which are found
+relative to the import paths. Instances respect the types of fields, the
+values of enums, oneofs, the key types of maps and required fields, and are
+nested at most to -depth. The same seed generates the same messages, which can
+be used to fuzz services, or as test fixtures; the seed is logged if it is not
+given. Messages are written in the binary wire format (each preceded by its
+length, as a varint, if -n is greater than one), as hex or base64 (one per
+line), in the text format (separated by blank lines), or as JSON (one per
+line).
+`)
+	flag.PrintDefaults()
+}
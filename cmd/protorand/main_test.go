@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/random"
+	"myitcv.io/g/protobuf/wire"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"event.proto", "legacy.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) message(c *C, name string) *ast.Message {
+	m := findMessage(t.fset, name)
+	c.Assert(m, NotNil)
+	return m
+}
+
+func (t *MainTest) TestGolden(c *C) {
+	for _, tc := range []struct {
+		typ, format, golden string
+		seed                int64
+		n                   int
+	}{
+		{"audit.Event", "text", "event.txt", 1, 1},
+		{"audit.Event", "json", "event.json", 2, 3},
+		{"audit.Record", "hex", "legacy.hex", 1, 2},
+	} {
+		var buf bytes.Buffer
+		c.Assert(generate(&buf, random.New(tc.seed), t.message(c, tc.typ), tc.format, tc.n), IsNil)
+
+		want, err := ioutil.ReadFile(filepath.Join("_testFiles", tc.golden))
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, string(want), Commentf("%v", tc.golden))
+	}
+}
+
+func (t *MainTest) TestValid(c *C) {
+	event := t.message(c, "audit.Event")
+	target := event.Oneofs[0]
+
+	for seed := int64(1); seed <= 200; seed++ {
+		g := random.New(seed)
+		msg, err := g.Message(event)
+		c.Assert(err, IsNil)
+
+		_, err = wire.Parse(msg.Marshal())
+		c.Assert(err, IsNil, Commentf("%v", seed))
+
+		j, err := msg.MarshalJSON()
+		c.Assert(err, IsNil)
+		c.Assert(json.Valid(j), Equals, true, Commentf("%s", j))
+
+		// at most one field of a oneof is set, at every depth
+		for m := msg; m != nil; {
+			set := 0
+			var parent *random.Message
+			for _, f := range m.Fields {
+				if f.Field.Oneof == target {
+					set++
+				}
+				if f.Field.Name == "parent" {
+					parent = f.Values[0].(*random.Message)
+				}
+			}
+			c.Assert(set <= 1, Equals, true, Commentf("%v", seed))
+			m = parent
+		}
+	}
+}
+
+func (t *MainTest) TestRequired(c *C) {
+	record := t.message(c, "audit.Record")
+
+	for seed := int64(1); seed <= 50; seed++ {
+		msg, err := random.New(seed).Message(record)
+		c.Assert(err, IsNil)
+		c.Assert(msg.Fields[0].Field.Name, Equals, "id")
+
+		for _, f := range msg.Fields {
+			if f.Field.Name != "Entry" {
+				continue
+			}
+			for _, v := range f.Values {
+				entry := v.(*random.Message)
+				c.Assert(entry.Fields[0].Field.Name, Equals, "key")
+			}
+		}
+	}
+}
+
+func (t *MainTest) TestDepth(c *C) {
+	g := random.New(1)
+	g.MaxDepth = 1
+
+	for i := 0; i < 50; i++ {
+		msg, err := g.Message(t.message(c, "audit.Event"))
+		c.Assert(err, IsNil)
+		for _, f := range msg.Fields {
+			if f.Field.Name != "parent" {
+				continue
+			}
+			for _, pf := range f.Values[0].(*random.Message).Fields {
+				_, isMsg := pf.Field.Type.(*ast.Message)
+				c.Assert(isMsg, Equals, false, Commentf("%v", pf.Field.Name))
+			}
+		}
+	}
+}
+
+func (t *MainTest) TestUnknownFormat(c *C) {
+	err := generate(ioutil.Discard, random.New(1), t.message(c, "audit.Event"), "yaml", 1)
+	c.Assert(err, ErrorMatches, `unknown format "yaml"`)
+}
+
+func (t *MainTest) TestFindMessage(c *C) {
+	c.Assert(findMessage(t.fset, ".audit.Event"), NotNil)
+	c.Assert(findMessage(t.fset, "audit.Kind"), IsNil)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protorefs finds the uses of the messages and enums of proto files
+package main // import "myitcv.io/g/cmd/protorefs"
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/refs"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fUses        = flag.String("uses", "", "List the uses of this message or enum, e.g. foo.Bar.")
+	fReachable   = flag.String("reachable", "", "List the messages reachable from this service, e.g. foo.Baz.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 || (*fUses == "") == (*fReachable == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+
+	x := refs.New(fset)
+	if *fUses != "" {
+		err = uses(bw, x, *fUses)
+	} else {
+		err = reachable(bw, x, *fReachable)
+	}
+	if err != nil {
+		log.Fatalf("Could not answer query: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
+
+// uses writes the uses of the message or enum called name to w, one per
+// line, with their positions.
+func uses(w io.Writer, x *refs.Index, name string) error {
+	typ := x.Lookup(name)
+	switch typ.(type) {
+	case *ast.Message, *ast.Enum:
+	case nil:
+		return fmt.Errorf("%v is not defined", name)
+	default:
+		return fmt.Errorf("%v is not a message or enum", name)
+	}
+
+	for _, u := range x.Uses(typ) {
+		desc := ast.FullName(u.Node)
+		if ext, ok := u.Node.(*ast.Extension); ok {
+			// an extend block is described by the fields it defines
+			var names []string
+			for _, f := range ext.Fields {
+				names = append(names, ast.FullName(f))
+			}
+			desc = strings.Join(names, ", ")
+		}
+		if _, err := fmt.Fprintf(w, "%v:%v: %v %v\n", u.File.Name, u.Position.Line, u.Kind, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reachable writes the full names of the messages reachable from the
+// service called name to w, one per line.
+func reachable(w io.Writer, x *refs.Index, name string) error {
+	s, ok := x.Lookup(name).(*ast.Service)
+	if !ok {
+		return fmt.Errorf("%v is not a service", name)
+	}
+
+	for _, m := range x.Reachable(s) {
+		if _, err := fmt.Fprintln(w, ast.FullName(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] -uses name|-reachable name file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protorefs answers questions about the references between the definitions of
+the named files, which are found relative to the import paths, and those they
+import. With -uses, it lists the fields, map values, extensions and methods
+that refer to a message or enum. With -reachable, it lists the messages that a
+service depends on.
+`)
+	flag.PrintDefaults()
+}
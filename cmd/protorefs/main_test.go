@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/refs"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	x *refs.Index
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"shop.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.x = refs.New(fset)
+}
+
+func (t *MainTest) TestUsesMessage(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(uses(ob, t.x, "common.Money"), IsNil)
+
+	c.Assert(ob.String(), Equals, `shop.proto:9: input shop.Shop.Refund
+shop.proto:9: output shop.Shop.Refund
+shop.proto:18: field shop.Product.price
+shop.proto:19: map value shop.Product.prices
+shop.proto:24: field shop.Product.Variant.price
+shop.proto:33: extendee shop.money_status, shop.note
+`)
+}
+
+func (t *MainTest) TestUsesEnum(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(uses(ob, t.x, ".common.Status"), IsNil)
+
+	c.Assert(ob.String(), Equals, `shop.proto:20: field shop.Product.status
+shop.proto:30: field shop.Unused.status
+shop.proto:34: field shop.money_status
+`)
+}
+
+func (t *MainTest) TestUsesUnused(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(uses(ob, t.x, "shop.Unused"), IsNil)
+	c.Assert(ob.String(), Equals, "")
+}
+
+func (t *MainTest) TestReachable(c *C) {
+	ob := bytes.NewBuffer(nil)
+	c.Assert(reachable(ob, t.x, "shop.Shop"), IsNil)
+
+	c.Assert(ob.String(), Equals, `common.Money
+shop.GetProductRequest
+shop.Product
+shop.Product.Variant
+`)
+}
+
+func (t *MainTest) TestBadQueries(c *C) {
+	c.Assert(uses(bytes.NewBuffer(nil), t.x, "shop.Missing"), ErrorMatches, `shop.Missing is not defined`)
+	c.Assert(uses(bytes.NewBuffer(nil), t.x, "shop.Shop"), ErrorMatches, `shop.Shop is not a message or enum`)
+	c.Assert(reachable(bytes.NewBuffer(nil), t.x, "shop.Product"), ErrorMatches, `shop.Product is not a service`)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protoregistry serves a local schema registry of FileDescriptorSets
+package main // import "myitcv.io/g/cmd/protoregistry"
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"myitcv.io/g/protobuf/compat"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/registry"
+)
+
+var (
+	fHelpShort     = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong      = flag.Bool("help", false, "Show usage text (same as -h).")
+	fDir           = flag.String("dir", "protoregistry", "The directory in which the registry is stored.")
+	fAddr          = flag.String("addr", "localhost:8081", "The address on which to serve the registry.")
+	fCompatibility = flag.String("compatibility", "BACKWARD", "The compatibility required of subjects without their own: NONE, BACKWARD, FORWARD or FULL.")
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	mode, err := compat.ParseMode(*fCompatibility)
+	if err != nil {
+		log.Fatalf("Invalid -compatibility: %v", err)
+	}
+
+	r, err := registry.New(*fDir, mode)
+	if err != nil {
+		log.Fatalf("Could not open registry: %v", err)
+	}
+
+	config, _, err := protofmt.FindConfig(*fDir)
+	if err != nil {
+		log.Fatalf("Could not find the format of .proto source: %v", err)
+	}
+
+	log.Printf("serving %v on %v", *fDir, *fAddr)
+	if err := http.ListenAndServe(*fAddr, registry.Handler(r, config)); err != nil {
+		log.Fatalf("Could not serve: %v", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protoregistry serves a schema registry, stored in the directory -dir, for use
+in development and CI in place of a shared registry. The registry holds
+versions of the schemas of subjects, such as Kafka topics; each version is a
+FileDescriptorSet, in the binary wire format, that includes the files imported
+by its files, as written by protoc with --include_imports. A new version is
+accepted only if it is compatible with the previous version of its subject:
+BACKWARD (readers using the new version can read data written with the
+previous one), FORWARD (the reverse), FULL (both) or NONE, as configured for
+the subject, or by -compatibility. The API is:
+
+	GET  /subjects                                 the names of the subjects
+	GET  /subjects/S/versions                      the versions of subject S
+	POST /subjects/S/versions                      register the FileDescriptorSet in the body
+	GET  /subjects/S/versions/V                    the FileDescriptorSet of version V
+	GET  /subjects/S/versions/V/proto[?file=F]     the .proto source of version V
+	GET  /subjects/S/versions/V/diff[?from=W]      the differences from version W to V
+	POST /compatibility/subjects/S                 check the FileDescriptorSet in the body
+	GET  /config/S                                 the compatibility of subject S
+	PUT  /config/S                                 set it, e.g. {"compatibility": "FULL"}
+
+in which V and W may be latest; W defaults to the version before V.
+`)
+	flag.PrintDefaults()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"myitcv.io/g/protobuf/compat"
+	protofmt "myitcv.io/g/protobuf/fmt"
+	"myitcv.io/g/protobuf/gendesc"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/registry"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	r, err := registry.New(c.MkDir(), compat.Backward)
+	c.Assert(err, IsNil)
+	t.server = httptest.NewServer(registry.Handler(r, protofmt.Config{Indent: "  "}))
+}
+
+func (t *MainTest) TearDownTest(c *C) {
+	t.server.Close()
+}
+
+// descriptorSet returns the FileDescriptorSet of the version of orders.proto
+// in the directory _testFiles/version
+func descriptorSet(c *C, version string) []byte {
+	fset, err := parser.ParseFiles([]string{"orders.proto"}, []string{filepath.Join("_testFiles", version)})
+	c.Assert(err, IsNil)
+	fds, err := gendesc.Generate(fset)
+	c.Assert(err, IsNil)
+	b, err := proto.Marshal(fds)
+	c.Assert(err, IsNil)
+	return b
+}
+
+// do makes a request to the server, and returns the status and body of its
+// response
+func (t *MainTest) do(c *C, method, path string, body []byte) (int, string) {
+	req, err := http.NewRequest(method, t.server.URL+path, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(b)
+}
+
+func (t *MainTest) assert(c *C, method, path string, body []byte, status int, want string) {
+	gotStatus, got := t.do(c, method, path, body)
+	c.Assert(got, Equals, want, Commentf("%v %v", method, path))
+	c.Assert(gotStatus, Equals, status, Commentf("%v %v", method, path))
+}
+
+// assertGolden asserts that the response to GET path is the contents of the
+// file golden in _testFiles
+func (t *MainTest) assertGolden(c *C, path, golden string) {
+	want, err := ioutil.ReadFile(filepath.Join("_testFiles", golden))
+	c.Assert(err, IsNil)
+	t.assert(c, "GET", path, nil, http.StatusOK, string(want))
+}
+
+const v3Issues = `["message orders.Order: field 1 (id): no longer required (breaks forward compatibility)",` +
+	`"message orders.Order: field 3 (quantities): changed from repeated to singular (breaks full compatibility)",` +
+	`"message orders.Order: required field 7 (gift) added (breaks backward compatibility)",` +
+	`"enum orders.Order.Status: value 2 (CANCELLED) added (breaks forward compatibility)",` +
+	`"message orders.Money: field 2 (units): type changed from int64 to double (breaks full compatibility)"]`
+
+func (t *MainTest) TestRegister(c *C) {
+	v1, v2, v3 := descriptorSet(c, "v1"), descriptorSet(c, "v2"), descriptorSet(c, "v3")
+
+	t.assert(c, "GET", "/subjects", nil, http.StatusOK, "[]\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", v1, http.StatusOK, `{"version":1}`+"\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", v1, http.StatusOK, `{"version":1}`+"\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", v2, http.StatusOK, `{"version":2}`+"\n")
+	t.assert(c, "GET", "/subjects", nil, http.StatusOK, `["orders-value"]`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions", nil, http.StatusOK, "[1,2]\n")
+
+	// v3 is incompatible, in all modes
+	t.assert(c, "POST", "/subjects/orders-value/versions", v3, http.StatusConflict,
+		`{"error":"schema is not backward compatible with the latest version of subject orders-value: message orders.Order: field 3 (quantities): changed from repeated to singular",`+
+			`"issues":["message orders.Order: field 3 (quantities): changed from repeated to singular (breaks full compatibility)",`+
+			`"message orders.Order: required field 7 (gift) added (breaks backward compatibility)",`+
+			`"message orders.Money: field 2 (units): type changed from int64 to double (breaks full compatibility)"]}`+"\n")
+	t.assert(c, "PUT", "/config/orders-value", []byte(`{"compatibility": "forward"}`), http.StatusOK, `{"compatibility":"FORWARD"}`+"\n")
+	t.assert(c, "POST", "/compatibility/subjects/orders-value", v3, http.StatusOK,
+		`{"compatible":false,"issues":["message orders.Order: field 1 (id): no longer required (breaks forward compatibility)",`+
+			`"message orders.Order: field 3 (quantities): changed from repeated to singular (breaks full compatibility)",`+
+			`"enum orders.Order.Status: value 2 (CANCELLED) added (breaks forward compatibility)",`+
+			`"message orders.Money: field 2 (units): type changed from int64 to double (breaks full compatibility)"]}`+"\n")
+	t.assert(c, "PUT", "/config/orders-value", []byte(`{"compatibility": "NONE"}`), http.StatusOK, `{"compatibility":"NONE"}`+"\n")
+	t.assert(c, "GET", "/config/orders-value", nil, http.StatusOK, `{"compatibility":"NONE"}`+"\n")
+	t.assert(c, "POST", "/compatibility/subjects/orders-value", v3, http.StatusOK, `{"compatible":true}`+"\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", v3, http.StatusOK, `{"version":3}`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions", nil, http.StatusOK, "[1,2,3]\n")
+
+	// the descriptors are served as registered
+	for v, want := range map[string][]byte{"1": v1, "2": v2, "latest": v3} {
+		status, got := t.do(c, "GET", "/subjects/orders-value/versions/"+v, nil)
+		c.Assert(status, Equals, http.StatusOK)
+		wfds, gfds := new(pb.FileDescriptorSet), new(pb.FileDescriptorSet)
+		c.Assert(proto.Unmarshal(want, wfds), IsNil)
+		c.Assert(proto.Unmarshal([]byte(got), gfds), IsNil)
+		c.Assert(proto.Equal(gfds, wfds), Equals, true, Commentf("version %v", v))
+	}
+}
+
+func (t *MainTest) TestCompat(c *C) {
+	a, err := parser.ParseFiles([]string{"orders.proto"}, []string{"_testFiles/v2"})
+	c.Assert(err, IsNil)
+	b, err := parser.ParseFiles([]string{"orders.proto"}, []string{"_testFiles/v3"})
+	c.Assert(err, IsNil)
+
+	var got []string
+	for _, i := range compat.Check(a, b) {
+		got = append(got, `"`+i.String()+`"`)
+	}
+	c.Assert("["+strings.Join(got, ",")+"]", Equals, v3Issues)
+	c.Assert(compat.Check(a, a), HasLen, 0)
+}
+
+func (t *MainTest) TestSourceAndDiff(c *C) {
+	t.assert(c, "PUT", "/config/orders-value", []byte(`{"compatibility": "NONE"}`), http.StatusOK, `{"compatibility":"NONE"}`+"\n")
+	for _, v := range []string{"v1", "v2", "v3"} {
+		status, _ := t.do(c, "POST", "/subjects/orders-value/versions", descriptorSet(c, v))
+		c.Assert(status, Equals, http.StatusOK)
+	}
+
+	t.assertGolden(c, "/subjects/orders-value/versions/2/proto?file=orders.proto", "v2.proto")
+	t.assertGolden(c, "/subjects/orders-value/versions/1/proto", "v1.source")
+	t.assertGolden(c, "/subjects/orders-value/versions/latest/diff", "v3.diff")
+	t.assertGolden(c, "/subjects/orders-value/versions/3/diff?from=1", "v1-v3.diff")
+}
+
+func (t *MainTest) TestErrors(c *C) {
+	t.assert(c, "GET", "/subjects/orders-value/versions", nil, http.StatusNotFound, `{"error":"subject orders-value not found"}`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions/latest", nil, http.StatusNotFound, `{"error":"subject orders-value not found"}`+"\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", descriptorSet(c, "v1"), http.StatusOK, `{"version":1}`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions/2", nil, http.StatusNotFound, `{"error":"version 2 of subject orders-value not found"}`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions/0", nil, http.StatusBadRequest, `{"error":"invalid version \"0\""}`+"\n")
+	t.assert(c, "GET", "/subjects/orders-value/versions/1/proto?file=x.proto", nil, http.StatusBadRequest, `{"error":"version 1 of subject orders-value has no file x.proto"}`+"\n")
+	t.assert(c, "GET", "/subjects/.hidden/versions", nil, http.StatusBadRequest, `{"error":"invalid subject name \".hidden\""}`+"\n")
+	t.assert(c, "POST", "/subjects/orders-value/versions", []byte("junk"), http.StatusBadRequest, `{"error":"invalid FileDescriptorSet: unexpected EOF"}`+"\n")
+	t.assert(c, "PUT", "/config/orders-value", []byte(`{"compatibility": "SOME"}`), http.StatusBadRequest, `{"error":"invalid configuration: unknown compatibility \"SOME\""}`+"\n")
+	t.assert(c, "DELETE", "/subjects/orders-value", nil, http.StatusNotFound, `{"error":"no route for DELETE /subjects/orders-value"}`+"\n")
+}
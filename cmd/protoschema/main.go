@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protoschema generates JSON Schema or OpenAPI documents for proto files
+package main // import "myitcv.io/g/cmd/protoschema"
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/jsonschema"
+	"myitcv.io/g/protobuf/parser"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fOpenAPI     = flag.Bool("openapi", false, "Generate an OpenAPI document for the services instead of a JSON Schema.")
+	fOutput      = flag.String("o", "", "Write the document to this file instead of stdout.")
+	fProtoNames  = flag.Bool("proto_names", false, "Name properties by their field names rather than their JSON names.")
+	fTitle       = flag.String("title", jsonschema.DefaultTitle, "The title of the API described by an OpenAPI document.")
+	fVersion     = flag.String("version", jsonschema.DefaultVersion, "The version of the API described by an OpenAPI document.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *fOutput != "" {
+		f, err := os.Create(*fOutput)
+		if err != nil {
+			log.Fatalf("Could not create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	bw := bufio.NewWriter(out)
+
+	g := &jsonschema.Generator{
+		UseProtoNames: *fProtoNames,
+		Title:         *fTitle,
+		Version:       *fVersion,
+	}
+
+	if err := generate(bw, g, fset, flag.Args(), *fOpenAPI); err != nil {
+		log.Fatalf("Could not generate document: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("Could not write document: %v", err)
+	}
+}
+
+// generate writes the JSON Schema, or OpenAPI, document for the named files
+// within fset to w. The messages and enums of the files they import are
+// included only if they are referred to.
+func generate(w io.Writer, g *jsonschema.Generator, fset *ast.FileSet, filenames []string, openAPI bool) error {
+	named := make(map[string]bool)
+	for _, fn := range filenames {
+		named[fn] = true
+	}
+
+	files := new(ast.FileSet)
+	for _, f := range fset.Files {
+		if named[f.Name] {
+			files.Files = append(files.Files, f)
+		}
+	}
+
+	if !openAPI {
+		return jsonschema.Encode(w, g.Schema(files))
+	}
+
+	doc, err := g.OpenAPI(files)
+	if err != nil {
+		return err
+	}
+	return jsonschema.Encode(w, doc)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protoschema writes a JSON Schema document for the messages and enums of the
+named files, which are found relative to the import paths, following the
+proto3 JSON mapping. With -openapi, it writes an OpenAPI 3.1 document for the
+methods of their services instead, using their google.api.http annotations.
+`)
+	flag.PrintDefaults()
+}
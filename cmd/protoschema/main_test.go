@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/jsonschema"
+	"myitcv.io/g/protobuf/parser"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles([]string{"library.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+func (t *MainTest) generate(c *C, g *jsonschema.Generator, openAPI bool) string {
+	ob := bytes.NewBuffer(nil)
+
+	err := generate(ob, g, t.fset, []string{"library.proto"}, openAPI)
+	c.Assert(err, IsNil)
+
+	return ob.String()
+}
+
+func (t *MainTest) TestSchema(c *C) {
+	out := t.generate(c, new(jsonschema.Generator), false)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/library.schema.json")
+	c.Assert(err, IsNil)
+
+	c.Assert(out, Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestOpenAPI(c *C) {
+	g := &jsonschema.Generator{
+		Title:   "Library API",
+		Version: "1.0.0",
+	}
+	out := t.generate(c, g, true)
+
+	cmpBytes, err := ioutil.ReadFile("_testFiles/library.openapi.json")
+	c.Assert(err, IsNil)
+
+	c.Assert(out, Equals, string(cmpBytes))
+}
+
+func (t *MainTest) TestBadPathTemplate(c *C) {
+	fset, err := parser.ParseFiles([]string{"bad.proto"}, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+
+	err = generate(ioutil.Discard, new(jsonschema.Generator), fset, []string{"bad.proto"}, true)
+	c.Assert(err, ErrorMatches, `bad.proto:6: method Get: message bad.GetRequest has no field "id"`)
+}
@@ -0,0 +1,46 @@
+// Code generated by protots from shop/v1/shop.proto. DO NOT EDIT.
+
+import * as common_money from "../../common/money";
+
+export interface GetProductRequest {
+  name?: string;
+}
+
+/** Product is something for sale. */
+export interface Product {
+  name?: string;
+  price?: common_money.Money;
+  tags?: string[];
+  kind?: Product_Kind;
+  stock?: string;
+  ratings?: (number | "NaN" | "Infinity" | "-Infinity")[];
+  image?: string;
+  variants?: { [key: string]: Product_Variant };
+  create_time?: string;
+  on_sale?: boolean;
+  percent_off?: number | "NaN" | "Infinity" | "-Infinity";
+  amount_off?: common_money.Money;
+}
+
+export interface Product_Variant {
+  label?: string;
+  kind?: Product_Kind;
+}
+
+export type Product_Kind = "KIND_UNSPECIFIED" | "PHYSICAL" | "DIGITAL";
+
+export interface ListProductsRequest {
+  page_size?: number;
+}
+
+export interface ListProductsResponse {
+  products?: Product[];
+  next_page_token?: string;
+}
+
+export interface Empty {}
+
+export interface ShopClient {
+  getProduct(request: GetProductRequest): Promise<Product>;
+  listProducts(request: ListProductsRequest): Promise<ListProductsResponse>;
+}
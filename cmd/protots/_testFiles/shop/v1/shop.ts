@@ -0,0 +1,54 @@
+// Code generated by protots from shop/v1/shop.proto. DO NOT EDIT.
+
+import * as common_money from "../../common/money";
+
+export interface GetProductRequest {
+  /** the name of the product */
+  name?: string;
+}
+
+/**
+ * Product is something for sale.
+ *
+ * Names have the form shops/*\/products/*, e.g. shops/1/products/2.
+ */
+export interface Product {
+  name?: string;
+  price?: common_money.Money;
+  tags?: string[];
+  kind?: Product_Kind;
+  stock?: string;
+  ratings?: (number | "NaN" | "Infinity" | "-Infinity")[];
+  image?: string;
+  variants?: { [key: string]: Product_Variant };
+  createTime?: string;
+  onSale?: boolean;
+  percentOff?: number | "NaN" | "Infinity" | "-Infinity";
+  amountOff?: common_money.Money;
+}
+
+/** Variant is a variant of a product, e.g. a size. */
+export interface Product_Variant {
+  label?: string;
+  kind?: Product_Kind;
+}
+
+export type Product_Kind = "KIND_UNSPECIFIED" | "PHYSICAL" | "DIGITAL";
+
+export interface ListProductsRequest {
+  pageSize?: number;
+}
+
+export interface ListProductsResponse {
+  products?: Product[];
+  nextPageToken?: string;
+}
+
+export interface Empty {}
+
+/** Shop sells products. */
+export interface ShopClient {
+  /** GetProduct returns a single product. */
+  getProduct(request: GetProductRequest): Promise<Product>;
+  listProducts(request: ListProductsRequest): Promise<ListProductsResponse>;
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// protots generates TypeScript definitions for proto files
+package main // import "myitcv.io/g/cmd/protots"
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"myitcv.io/g/protobuf"
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/fromdesc"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/typescript"
+)
+
+var (
+	fHelpShort   = flag.Bool("h", false, "Show usage text (same as --help).")
+	fHelpLong    = flag.Bool("help", false, "Show usage text (same as -h).")
+	fOutput      = flag.String("out", ".", "Write the modules to this directory.")
+	fProtoNames  = flag.Bool("proto_names", false, "Name properties by their field names rather than their JSON names.")
+	fImportPaths = protobuf.ImportPaths{}
+)
+
+func init() {
+	flag.Var(&fImportPaths, "I", "Path to search for imports (flag can be used multiple times)")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix(os.Args[0] + ": ")
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if *fHelpShort || *fHelpLong {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if flag.NArg() == 0 {
+		// protoc runs plugins without arguments, with the request on stdin
+		if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := runPlugin(os.Stdout, os.Stdin); err != nil {
+			log.Fatalf("Could not run as a plugin: %v", err)
+		}
+		return
+	}
+
+	fset, err := parser.ParseFiles(flag.Args(), fImportPaths)
+	if err != nil {
+		log.Fatalf("Could not parse files: %v", err)
+	}
+
+	g := &typescript.Generator{
+		UseProtoNames: *fProtoNames,
+	}
+
+	files, err := generate(g, fset, flag.Args())
+	if err != nil {
+		log.Fatalf("Could not generate modules: %v", err)
+	}
+
+	for _, f := range files {
+		fn := filepath.Join(*fOutput, filepath.FromSlash(f.GetName()))
+		if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			log.Fatalf("Could not create output directory: %v", err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(f.GetContent()), 0666); err != nil {
+			log.Fatalf("Could not write module: %v", err)
+		}
+	}
+}
+
+// generate returns the TypeScript modules of the named files within fset.
+func generate(g *typescript.Generator, fset *ast.FileSet, filenames []string) ([]*plugin.CodeGeneratorResponse_File, error) {
+	named := make(map[string]bool)
+	for _, fn := range filenames {
+		named[fn] = true
+	}
+
+	var res []*plugin.CodeGeneratorResponse_File
+	for _, f := range fset.Files {
+		if !named[f.Name] {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := g.Generate(&buf, f); err != nil {
+			return nil, fmt.Errorf("%v: %v", f.Name, err)
+		}
+		res = append(res, &plugin.CodeGeneratorResponse_File{
+			Name:    proto.String(typescript.Filename(f)),
+			Content: proto.String(buf.String()),
+		})
+	}
+	return res, nil
+}
+
+// runPlugin reads a CodeGeneratorRequest from r and writes the corresponding
+// CodeGeneratorResponse to w. Errors in generating the modules are reported
+// in the response, as protoc expects; the error returned is that of reading
+// or writing.
+func runPlugin(w io.Writer, r io.Reader) error {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req := new(plugin.CodeGeneratorRequest)
+	if err := proto.Unmarshal(in, req); err != nil {
+		return fmt.Errorf("could not decode request: %v", err)
+	}
+
+	resp := new(plugin.CodeGeneratorResponse)
+	files, err := generateRequest(req)
+	if err != nil {
+		resp.Error = proto.String(err.Error())
+	} else {
+		resp.File = files
+	}
+
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("could not encode response: %v", err)
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// generateRequest returns the modules requested by req. Its parameter is a
+// comma-separated list of options, of which proto_names is the only one.
+func generateRequest(req *plugin.CodeGeneratorRequest) ([]*plugin.CodeGeneratorResponse_File, error) {
+	g := new(typescript.Generator)
+	if p := req.GetParameter(); p != "" {
+		for _, opt := range strings.Split(p, ",") {
+			switch opt {
+			case "proto_names":
+				g.UseProtoNames = true
+			default:
+				return nil, fmt.Errorf("unknown parameter %q", opt)
+			}
+		}
+	}
+
+	fset, err := fromdesc.FileSet(req.ProtoFile)
+	if err != nil {
+		return nil, err
+	}
+	return generate(g, fset, req.FileToGenerate)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] file1.proto [file2.proto ...]\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+protots writes a TypeScript module for each of the named files, which are
+found relative to the import paths, defining the proto3 JSON shape of their
+messages and enums and the clients of their services. A module for foo.proto
+is written to foo.ts, within the output directory.
+
+Run without arguments, protots is a protoc plugin, e.g.
+
+	protoc --plugin=protoc-gen-ts=$(which protots) --ts_out=proto_names:. foo.proto
+`)
+	flag.PrintDefaults()
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/gendesc"
+	"myitcv.io/g/protobuf/parser"
+	"myitcv.io/g/protobuf/typescript"
+
+	. "gopkg.in/check.v1"
+)
+
+type MainTest struct {
+	fset *ast.FileSet
+}
+
+var _ = Suite(&MainTest{})
+
+func TestMain(t *testing.T) { TestingT(t) }
+
+var testFiles = []string{"common/money.proto", "shop/v1/shop.proto", "shop/v1/legacy.proto"}
+
+func (t *MainTest) SetUpTest(c *C) {
+	fset, err := parser.ParseFiles(testFiles, []string{"_testFiles"})
+	c.Assert(err, IsNil)
+	t.fset = fset
+}
+
+// checkFiles checks files against the golden files of the same names within
+// dir.
+func checkFiles(c *C, files []*plugin.CodeGeneratorResponse_File, dir string) {
+	c.Assert(files, HasLen, len(testFiles))
+	for _, f := range files {
+		cmpBytes, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.GetName())))
+		c.Assert(err, IsNil)
+
+		c.Assert(f.GetContent(), Equals, string(cmpBytes), Commentf("module %v", f.GetName()))
+	}
+}
+
+func (t *MainTest) TestGenerate(c *C) {
+	files, err := generate(new(typescript.Generator), t.fset, testFiles)
+	c.Assert(err, IsNil)
+
+	checkFiles(c, files, "_testFiles")
+}
+
+func (t *MainTest) request(c *C, param string) *plugin.CodeGeneratorRequest {
+	fds, err := gendesc.Generate(t.fset)
+	c.Assert(err, IsNil)
+
+	// gendesc does not record comments, so give Product one
+	for _, fd := range fds.File {
+		if fd.GetName() == "shop/v1/shop.proto" {
+			fd.SourceCodeInfo = &pb.SourceCodeInfo{
+				Location: []*pb.SourceCodeInfo_Location{{
+					Path:            []int32{4, 1},
+					Span:            []int32{22, 0, 50, 1},
+					LeadingComments: proto.String(" Product is something for sale.\n"),
+				}},
+			}
+		}
+	}
+
+	req := &plugin.CodeGeneratorRequest{
+		FileToGenerate: testFiles,
+		ProtoFile:      fds.File,
+	}
+	if param != "" {
+		req.Parameter = proto.String(param)
+	}
+	return req
+}
+
+func (t *MainTest) runPlugin(c *C, req *plugin.CodeGeneratorRequest) *plugin.CodeGeneratorResponse {
+	in, err := proto.Marshal(req)
+	c.Assert(err, IsNil)
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(runPlugin(out, bytes.NewReader(in)), IsNil)
+
+	resp := new(plugin.CodeGeneratorResponse)
+	c.Assert(proto.Unmarshal(out.Bytes(), resp), IsNil)
+	return resp
+}
+
+func (t *MainTest) TestPlugin(c *C) {
+	resp := t.runPlugin(c, t.request(c, "proto_names"))
+	c.Assert(resp.Error, IsNil)
+
+	checkFiles(c, resp.File, "_testFiles/plugin")
+}
+
+func (t *MainTest) TestPluginBadParameter(c *C) {
+	resp := t.runPlugin(c, t.request(c, "proto_names,enums_as_ints"))
+	c.Assert(resp.GetError(), Equals, `unknown parameter "enums_as_ints"`)
+	c.Assert(resp.File, HasLen, 0)
+}
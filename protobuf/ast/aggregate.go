@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast
+
+import (
+	"bytes"
+)
+
+// An Aggregate is the value of a custom option whose type is a message,
+// written in the protobuf text format, e.g.
+//
+//	option (google.api.http) = { get: "/v1/{name=shelves/*}" };
+//
+// The value recorded in the Options of the definition is the String of the
+// Aggregate, which can be parsed again by parser.ParseAggregate.
+type Aggregate []AggregateField
+
+// An AggregateField is a field of an Aggregate. Exactly one of Value and
+// Aggregate is set. The elements of a list, e.g. foo: [1, 2], are held as
+// repeated fields of the same name.
+type AggregateField struct {
+	Name      string    // a field name, or an extension name in brackets, e.g. [foo.bar]
+	Value     string    // a constant, as held in Options
+	Aggregate Aggregate // the value, if the field is a message
+}
+
+// Get returns the value of the last field named name that is not a message,
+// and whether there is such a field.
+func (a Aggregate) Get(name string) (string, bool) {
+	for i := len(a) - 1; i >= 0; i-- {
+		if f := a[i]; f.Name == name && f.Aggregate == nil {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns a in the text format, normalised to a single line, e.g.
+// {get: "/v1/foo" additional_bindings {post: "/v1/bar" body: "*"}}.
+func (a Aggregate) String() string {
+	var b bytes.Buffer
+	a.write(&b)
+	return b.String()
+}
+
+func (a Aggregate) write(b *bytes.Buffer) {
+	b.WriteString("{")
+	for i, f := range a {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(f.Name)
+		if f.Aggregate != nil {
+			b.WriteString(" ")
+			f.Aggregate.write(b)
+			continue
+		}
+		b.WriteString(": ")
+		b.WriteString(f.Value)
+	}
+	b.WriteString("}")
+}
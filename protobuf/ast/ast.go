@@ -8,7 +8,6 @@ package ast // import "myitcv.io/g/protobuf/ast"
 
 import (
 	"fmt"
-	"log"
 	"sort"
 )
 
@@ -16,6 +15,9 @@ import (
 type Node interface {
 	FileOrNode
 	Pos() Position
+
+	// File returns the file containing the node, or nil if the node is not
+	// (yet) part of a file.
 	File() *File
 }
 
@@ -45,10 +47,12 @@ type FileSet struct {
 
 // File represents a single proto file.
 type File struct {
-	Name    string // filename
-	Syntax  string // "proto2" or "proto3"
-	Package []string
-	Options [][2]string // slice of key/value pairs
+	Name     string // filename
+	Syntax   string // "proto2", "proto3" or "editions"
+	Edition  string // "2023", the only edition supported, if Syntax is "editions"
+	Package  []string
+	Options  [][2]string // slice of key/value pairs; a custom option's key is in parentheses, e.g. (my.opt)
+	Features Features    // set by features.* options
 
 	Imports       []string
 	PublicImports []int // list of indexes in the Imports slice
@@ -97,12 +101,18 @@ type Message struct {
 	Oneofs         []*Oneof
 	ReservedFields []Reserved
 	Options        [][2]string
+	Features       Features // set by features.* options
 
 	Messages []*Message // includes groups
 	Enums    []*Enum
 
 	ExtensionRanges [][2]int // extension ranges (inclusive at both ends)
 
+	// ExtensionRangeOptions holds the options of ExtensionRanges[i] at index
+	// i; the ranges of one extensions statement share the same options.
+	// It, or any of its entries, may be nil. Use RangeOptions to read it.
+	ExtensionRangeOptions []*ExtensionRangeOptions
+
 	Up FileOrMessage // either *File or *Message
 }
 
@@ -121,6 +131,30 @@ type Reserved struct {
 	Start, End int
 }
 
+// ExtensionRangeOptions are the options of an extensions statement, shared
+// by the extension ranges it declares.
+type ExtensionRangeOptions struct {
+	Position     Position // position of the "extensions" token
+	Declarations []ExtensionDeclaration
+	Verification string      // "DECLARATION" or "UNVERIFIED", if set
+	Options      [][2]string // custom options; slice of key/value pairs
+}
+
+// IsEmpty reports whether o, which may be nil, sets no options.
+func (o *ExtensionRangeOptions) IsEmpty() bool {
+	return o == nil || len(o.Declarations) == 0 && o.Verification == "" && len(o.Options) == 0
+}
+
+// ExtensionDeclaration declares an extension that may use a number of an
+// extension range.
+type ExtensionDeclaration struct {
+	Number   int
+	FullName string // e.g. ".my.pkg.ext"
+	Type     string // e.g. ".my.pkg.Msg" or int32
+	Reserved bool
+	Repeated bool
+}
+
 // Nodes returns a slice of the Nodes contained within this message definition
 // i.e. all the fields, enums etc, sorted by their Position.Offset
 func (m *Message) Nodes() []Node {
@@ -150,6 +184,15 @@ func (m *Message) Nodes() []Node {
 	return nodes
 }
 
+// RangeOptions returns the options of the extension range
+// m.ExtensionRanges[i], or nil if it has none.
+func (m *Message) RangeOptions(i int) *ExtensionRangeOptions {
+	if i < len(m.ExtensionRangeOptions) {
+		return m.ExtensionRangeOptions[i]
+	}
+	return nil
+}
+
 func (m *Message) Pos() Position { return m.Position }
 func (m *Message) File() *File {
 	for x := m.Up; ; {
@@ -159,7 +202,7 @@ func (m *Message) File() *File {
 		case *Message:
 			x = up.Up
 		default:
-			log.Panicf("internal error: Message.Up is a %T", up)
+			return nil
 		}
 	}
 }
@@ -195,14 +238,23 @@ type Field struct {
 	KeyTypeName string
 	KeyType     FieldType
 
-	// At most one of {required,repeated} is set.
+	// At most one of {required,optional,repeated} is set. Optional records
+	// an explicit optional label; in proto3 this gives the field explicit
+	// presence.
 	Required bool
+	Optional bool
 	Repeated bool
 	Name     string
 	Tag      int
 
-	HasDefault bool
-	Default    string // e.g. "foo", 7, true
+	// Default is the default value as written, e.g. "foo" (including the
+	// quotes), 0x10, -inf or true. DefaultValue is set during resolution,
+	// once Default has been checked against Type; it is the default in the
+	// normalised form of FieldDescriptorProto.default_value, e.g. foo, 16,
+	// -inf or true.
+	HasDefault   bool
+	Default      string
+	DefaultValue string
 
 	HasPacked bool
 	Packed    bool
@@ -210,7 +262,8 @@ type Field struct {
 	HasDeprecated bool
 	Deprecated    bool
 
-	Options [][2]string // slice of key/value pairs
+	Options  [][2]string // slice of key/value pairs
+	Features Features    // set by features.* options
 
 	Oneof *Oneof
 
@@ -230,10 +283,8 @@ func (f *Field) File() *File {
 		return up.File()
 	case *Extension:
 		return up.File()
-	default:
-		log.Panicf("internal error: Field.Up is a %T", up)
-		return nil
 	}
+	return nil
 }
 
 type FieldType int8
@@ -289,6 +340,8 @@ type Enum struct {
 	Position Position // position of "enum" token
 	Name     string
 	Values   []*EnumValue
+	Options  [][2]string // custom options; slice of key/value pairs
+	Features Features    // set by features.* options
 
 	Up FileOrMessage // either *File or *Message
 }
@@ -306,7 +359,7 @@ func (enum *Enum) File() *File {
 		case *Message:
 			x = up.Up
 		default:
-			log.Panicf("internal error: Enum.Up is a %T", up)
+			return nil
 		}
 	}
 }
@@ -391,15 +444,16 @@ func (e *Extension) File() *File {
 		return up
 	case *Message:
 		return up.File()
-	default:
-		log.Panicf("internal error: Extension.Up is a %T", up)
 	}
-	panic("unreachable")
+	return nil
 }
 
 // Comment represents a comment.
 type Comment struct {
-	Start, End Position // position of first and last "//"
+	// Start is the position of the first "//" or "/*". End is the position
+	// at which the last comment ends: the line it ends on, and the offset of
+	// the byte following it, a newline for a "//" comment.
+	Start, End Position
 	Text       []string
 }
 
@@ -439,9 +493,10 @@ func InlineComment(n Node) *Comment {
 		return nil
 	}
 	c := f.Comments[ci]
-	// Sanity check; it should only be one line.
-	if c.Start != c.End || len(c.Text) != 1 {
-		log.Panicf("internal error: bad inline comment: %+v", c)
+	// A comment that continues onto the following lines is not an inline
+	// comment; it is more likely the leading comment of what follows.
+	if c.Start.Line != c.End.Line || len(c.Text) != 1 {
+		return nil
 	}
 	return c
 }
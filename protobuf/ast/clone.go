@@ -0,0 +1,224 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast
+
+// Clone returns a deep copy of fs. The pointers between the nodes of fs,
+// i.e. the Up links, the Oneofs of fields and the resolved types of fields,
+// methods and extensions, point to the corresponding nodes of the copy.
+// Resolved types defined outside fs are not copied.
+func (fs *FileSet) Clone() *FileSet {
+	c := &cloner{
+		nodes:   make(map[interface{}]interface{}),
+		options: make(map[*ExtensionRangeOptions]*ExtensionRangeOptions),
+	}
+	res := new(FileSet)
+	for _, f := range fs.Files {
+		res.Files = append(res.Files, c.file(f))
+	}
+	for _, fix := range c.fixes {
+		fix()
+	}
+	return res
+}
+
+// cloner holds the state used in cloning a FileSet
+type cloner struct {
+	// nodes maps the nodes of the original to those of the copy
+	nodes map[interface{}]interface{}
+
+	// options maps the options of the extension ranges of the original to
+	// those of the copy, which are shared in the same way
+	options map[*ExtensionRangeOptions]*ExtensionRangeOptions
+
+	// fixes remap the references between nodes, once all the nodes have
+	// been copied
+	fixes []func()
+}
+
+// ref returns the copy of the resolved type typ, or typ itself if it was not
+// copied.
+func (c *cloner) ref(typ interface{}) interface{} {
+	if res, ok := c.nodes[typ]; ok {
+		return res
+	}
+	return typ
+}
+
+func (c *cloner) file(f *File) *File {
+	res := &File{
+		Name:          f.Name,
+		Syntax:        f.Syntax,
+		Edition:       f.Edition,
+		Package:       cloneStrings(f.Package),
+		Options:       cloneOptions(f.Options),
+		Features:      f.Features,
+		Imports:       cloneStrings(f.Imports),
+		PublicImports: cloneInts(f.PublicImports),
+	}
+	for _, m := range f.Messages {
+		res.Messages = append(res.Messages, c.message(m, res))
+	}
+	for _, e := range f.Enums {
+		res.Enums = append(res.Enums, c.enum(e, res))
+	}
+	for _, s := range f.Services {
+		res.Services = append(res.Services, c.service(s, res))
+	}
+	for _, ext := range f.Extensions {
+		res.Extensions = append(res.Extensions, c.extension(ext, res))
+	}
+	for _, cm := range f.Comments {
+		ccm := *cm
+		ccm.Text = cloneStrings(cm.Text)
+		res.Comments = append(res.Comments, &ccm)
+	}
+	return res
+}
+
+func (c *cloner) message(m *Message, up FileOrMessage) *Message {
+	res := &Message{
+		Position: m.Position,
+		Name:     m.Name,
+		Group:    m.Group,
+		Options:  cloneOptions(m.Options),
+		Features: m.Features,
+		Up:       up,
+	}
+	c.nodes[m] = res
+
+	for _, o := range m.Oneofs {
+		co := &Oneof{
+			Position: o.Position,
+			Name:     o.Name,
+			Up:       res,
+		}
+		c.nodes[o] = co
+		res.Oneofs = append(res.Oneofs, co)
+	}
+	for _, f := range m.Fields {
+		res.Fields = append(res.Fields, c.field(f, res))
+	}
+	if m.ReservedFields != nil {
+		res.ReservedFields = append([]Reserved{}, m.ReservedFields...)
+	}
+	if m.ExtensionRanges != nil {
+		res.ExtensionRanges = append([][2]int{}, m.ExtensionRanges...)
+	}
+	for _, o := range m.ExtensionRangeOptions {
+		if o != nil {
+			co, ok := c.options[o]
+			if !ok {
+				co = &ExtensionRangeOptions{
+					Position:     o.Position,
+					Verification: o.Verification,
+					Options:      cloneOptions(o.Options),
+				}
+				if o.Declarations != nil {
+					co.Declarations = append([]ExtensionDeclaration{}, o.Declarations...)
+				}
+				c.options[o] = co
+			}
+			o = co
+		}
+		res.ExtensionRangeOptions = append(res.ExtensionRangeOptions, o)
+	}
+	for _, nm := range m.Messages {
+		res.Messages = append(res.Messages, c.message(nm, res))
+	}
+	for _, e := range m.Enums {
+		res.Enums = append(res.Enums, c.enum(e, res))
+	}
+	for _, ext := range m.Extensions {
+		res.Extensions = append(res.Extensions, c.extension(ext, res))
+	}
+	return res
+}
+
+func (c *cloner) field(f *Field, up MessageOrExtension) *Field {
+	res := *f
+	res.Options = cloneOptions(f.Options)
+	res.Up = up
+	c.fixes = append(c.fixes, func() {
+		res.Type = c.ref(f.Type)
+		if f.Oneof != nil {
+			res.Oneof = c.ref(f.Oneof).(*Oneof)
+		}
+	})
+	return &res
+}
+
+func (c *cloner) enum(e *Enum, up FileOrMessage) *Enum {
+	res := &Enum{
+		Position: e.Position,
+		Name:     e.Name,
+		Options:  cloneOptions(e.Options),
+		Features: e.Features,
+		Up:       up,
+	}
+	c.nodes[e] = res
+	for _, v := range e.Values {
+		cv := *v
+		cv.Up = res
+		res.Values = append(res.Values, &cv)
+	}
+	return res
+}
+
+func (c *cloner) service(s *Service, up *File) *Service {
+	res := &Service{
+		Position: s.Position,
+		Name:     s.Name,
+		Up:       up,
+	}
+	for _, m := range s.Methods {
+		m := m
+		cm := *m
+		cm.Options = cloneOptions(m.Options)
+		cm.Up = res
+		c.fixes = append(c.fixes, func() {
+			cm.InType = c.ref(m.InType)
+			cm.OutType = c.ref(m.OutType)
+		})
+		res.Methods = append(res.Methods, &cm)
+	}
+	return res
+}
+
+func (c *cloner) extension(ext *Extension, up FileOrMessage) *Extension {
+	res := &Extension{
+		Position: ext.Position,
+		Extendee: ext.Extendee,
+		Up:       up,
+	}
+	if ext.ExtendeeType != nil {
+		c.fixes = append(c.fixes, func() {
+			res.ExtendeeType = c.ref(ext.ExtendeeType).(*Message)
+		})
+	}
+	for _, f := range ext.Fields {
+		res.Fields = append(res.Fields, c.field(f, res))
+	}
+	return res
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func cloneInts(s []int) []int {
+	if s == nil {
+		return nil
+	}
+	return append([]int{}, s...)
+}
+
+func cloneOptions(opts [][2]string) [][2]string {
+	if opts == nil {
+		return nil
+	}
+	return append([][2]string{}, opts...)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast_test
+
+import (
+	"reflect"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+)
+
+const src = `syntax = "proto2";
+
+package shop;
+
+// Product is something for sale.
+message Product {
+  optional string name = 1 [default = "pen"];
+  optional Kind kind = 2;
+  map<string, Variant> variants = 3;
+
+  oneof discount {
+    float percent_off = 4;
+    Product bundle = 5;
+  }
+
+  extensions 100 to 199, 300 [verification = UNVERIFIED];
+
+  message Variant {
+    optional string label = 1;
+  }
+
+  enum Kind {
+    PHYSICAL = 0;
+    DIGITAL = 1;
+  }
+}
+
+service Shop {
+  rpc Get (Product) returns (Product.Variant);
+}
+
+extend Product {
+  optional Product.Kind other_kind = 100;
+}
+`
+
+// reformatted is src with different positions and comments
+const reformatted = `syntax = "proto2";
+package shop;
+message Product {
+  optional string name = 1 [default = "pen"];
+  optional Kind kind = 2; // the kind
+  map<string, Variant> variants = 3;
+  oneof discount { float percent_off = 4; Product bundle = 5; }
+  extensions 100 to 199, 300 [verification = UNVERIFIED];
+  message Variant { optional string label = 1; }
+  enum Kind { PHYSICAL = 0; DIGITAL = 1; }
+}
+service Shop { rpc Get (Product) returns (Product.Variant); }
+extend Product { optional Product.Kind other_kind = 100; }
+`
+
+func TestClone(t *testing.T) {
+	fset := parse(t, src)
+	c := fset.Clone()
+
+	if !reflect.DeepEqual(c, fset) {
+		t.Fatalf("clone differs from the original")
+	}
+
+	f, cf := fset.Files[0], c.Files[0]
+	m, cm := f.Messages[0], cf.Messages[0]
+	if cm == m || cm.Up != cf {
+		t.Errorf("message not copied, or Up not remapped")
+	}
+	if cm.Fields[1].Type != cm.Enums[0] {
+		t.Errorf("enum field type not remapped")
+	}
+	if cm.Fields[2].Type != cm.Messages[0] || cm.Fields[2].Up != cm {
+		t.Errorf("map field type or Up not remapped")
+	}
+	if cm.Fields[3].Oneof != cm.Oneofs[0] || cm.Oneofs[0].Up != cm {
+		t.Errorf("oneof not remapped")
+	}
+	if cm.Fields[4].Type != cm {
+		t.Errorf("recursive field type not remapped")
+	}
+	if o := cm.ExtensionRangeOptions; o[0] == m.ExtensionRangeOptions[0] || o[0] != o[1] {
+		t.Errorf("extension range options not copied, or no longer shared")
+	}
+	if mt := cf.Services[0].Methods[0]; mt.InType != cm || mt.OutType != cm.Messages[0] || mt.Up != cf.Services[0] {
+		t.Errorf("method types or Up not remapped")
+	}
+	if ext := cf.Extensions[0]; ext.ExtendeeType != cm || ext.Fields[0].Up != ext || ext.Fields[0].Type != cm.Enums[0] {
+		t.Errorf("extension not remapped")
+	}
+	if cv := cm.Enums[0].Values[0]; cv == m.Enums[0].Values[0] || cv.Up != cm.Enums[0] {
+		t.Errorf("enum value not copied, or Up not remapped")
+	}
+
+	// the copy is independent of the original
+	cf.Package[0] = "changed"
+	cf.Comments[0].Text[0] = "changed"
+	if f.Package[0] == "changed" || f.Comments[0].Text[0] == "changed" {
+		t.Errorf("copy shares slices with the original")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	fset := parse(t, src)
+	if !ast.Equal(fset, fset.Clone(), 0) {
+		t.Errorf("clone is not equal to the original: %v", ast.Diff(fset, fset.Clone(), 0))
+	}
+
+	other := parse(t, reformatted)
+	if ast.Equal(fset, other, 0) {
+		t.Errorf("reformatted file is equal, comparing positions and comments")
+	}
+	if ast.Equal(fset, other, ast.IgnorePositions) {
+		t.Errorf("reformatted file is equal, comparing comments")
+	}
+	if d := ast.Diff(fset, other, ast.IgnorePositions|ast.IgnoreComments); d != nil {
+		t.Errorf("reformatted file differs, ignoring positions and comments:\n%v", d)
+	}
+
+	f, err := parser.ParseFile("shop.proto", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolved := &ast.FileSet{Files: []*ast.File{f}}
+	if ast.Equal(fset, unresolved, 0) {
+		t.Errorf("unresolved file is equal, comparing what resolving fills in")
+	}
+	if d := ast.Diff(fset, unresolved, ast.IgnoreResolved); d != nil {
+		t.Errorf("unresolved file differs, ignoring what resolving fills in:\n%v", d)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fset := parse(t, src)
+	c := fset.Clone()
+	m := c.Files[0].Messages[0]
+	m.Fields[0].Tag = 10
+	m.Fields[1].Type = m.Messages[0]
+	m.Messages[0].Name = "Option"
+	m.Enums[0].Values[0], m.Enums[0].Values[1] = m.Enums[0].Values[1], m.Enums[0].Values[0]
+	c.Files[0].Services[0].Methods[0].Options = [][2]string{{"deprecated", "true"}}
+	c.Files[0].Extensions = nil
+
+	want := []string{
+		`shop.proto: message Product: field name: number: 1 != 10`,
+		`shop.proto: message Product: field kind: type: .shop.Product.Kind != .shop.Product.Option`,
+		`shop.proto: message Product: field variants: type: .shop.Product.Variant != .shop.Product.Option`,
+		`shop.proto: message Product: message Variant: only in a`,
+		`shop.proto: message Product: message Option: only in b`,
+		`shop.proto: message Product: enum Kind: order of values: [PHYSICAL DIGITAL] != [DIGITAL PHYSICAL]`,
+		`shop.proto: service Shop: rpc Get: output type: .shop.Product.Variant != .shop.Product.Option`,
+		`shop.proto: service Shop: rpc Get: options: [] != [[deprecated true]]`,
+		`shop.proto: extensions: 1 != 0`,
+	}
+	if got := ast.Diff(fset, c, ast.IgnorePositions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got diff:\n%q\nwant:\n%q", got, want)
+	}
+}
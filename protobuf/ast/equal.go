@@ -0,0 +1,352 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// CompareMode controls what Equal and Diff compare
+type CompareMode uint
+
+const (
+	IgnorePositions CompareMode = 1 << iota // ignore the positions of nodes and comments
+	IgnoreComments                          // ignore the comments of files
+	IgnoreResolved                          // ignore what resolving fills in, e.g. resolved types
+)
+
+// Equal reports whether a and b are structurally equal, as compared by Diff.
+func Equal(a, b *FileSet, mode CompareMode) bool {
+	return len(Diff(a, b, mode)) == 0
+}
+
+// Diff returns the differences between a and b, one per line, each naming
+// the node that differs, e.g.
+//
+//	foo.proto: message Foo: field bar: number: 1 != 2
+//
+// in which the value of a comes first. Files, and definitions within them,
+// are matched by name; extensions are matched by their order. Resolved types
+// are compared by their fully-qualified names, and Up links are not
+// compared.
+func Diff(a, b *FileSet, mode CompareMode) []string {
+	d := &differ{mode: mode}
+
+	var an, bn []string
+	for _, f := range a.Files {
+		an = append(an, f.Name)
+	}
+	for _, f := range b.Files {
+		bn = append(bn, f.Name)
+	}
+	d.match(nil, "file", an, bn, func(i, j int) {
+		d.file([]string{a.Files[i].Name}, a.Files[i], b.Files[j])
+	})
+	return d.diffs
+}
+
+// differ holds the state used in comparing FileSets
+type differ struct {
+	mode  CompareMode
+	diffs []string
+}
+
+// errorf records a difference within the node named by path
+func (d *differ) errorf(path []string, format string, args ...interface{}) {
+	d.diffs = append(d.diffs, strings.Join(sub(path, fmt.Sprintf(format, args...)), ": "))
+}
+
+// value records a difference in the property name of the node named by path
+// if x and y are not equal. Nil and empty slices are equal.
+func (d *differ) value(path []string, name string, x, y interface{}) {
+	xv, yv := reflect.ValueOf(x), reflect.ValueOf(y)
+	if xv.Kind() == reflect.Slice && xv.Len() == 0 && yv.Len() == 0 {
+		return
+	}
+	if !reflect.DeepEqual(x, y) {
+		d.errorf(path, "%v: %v != %v", name, x, y)
+	}
+}
+
+func (d *differ) position(path []string, x, y Position) {
+	if d.mode&IgnorePositions == 0 {
+		d.value(path, "position", x, y)
+	}
+}
+
+// typ records a difference in the resolved type name of the node named by
+// path, unless resolved types are ignored
+func (d *differ) typ(path []string, name string, x, y interface{}) {
+	if d.mode&IgnoreResolved == 0 {
+		d.value(path, name, TypeName(x), TypeName(y))
+	}
+}
+
+// match matches the elements of two lists of definitions of kind by their
+// names, an and bn, calling each with the indexes of each pair. It records
+// those only in one list, and whether the pairs are in a different order.
+func (d *differ) match(path []string, kind string, an, bn []string, each func(i, j int)) {
+	bi := make(map[string]int)
+	for j, n := range bn {
+		bi[n] = j
+	}
+	ai := make(map[string]bool)
+	last, ordered := -1, true
+	for i, n := range an {
+		ai[n] = true
+		j, ok := bi[n]
+		if !ok {
+			d.errorf(path, "%v %v: only in a", kind, n)
+			continue
+		}
+		if j < last {
+			ordered = false
+		}
+		last = j
+		each(i, j)
+	}
+	for _, n := range bn {
+		if !ai[n] {
+			d.errorf(path, "%v %v: only in b", kind, n)
+		}
+	}
+	if !ordered {
+		d.errorf(path, "order of %vs: %v != %v", kind, an, bn)
+	}
+}
+
+func (d *differ) file(path []string, a, b *File) {
+	d.value(path, "syntax", a.Syntax, b.Syntax)
+	d.value(path, "edition", a.Edition, b.Edition)
+	d.value(path, "package", a.Package, b.Package)
+	d.value(path, "options", a.Options, b.Options)
+	d.value(path, "features", a.Features, b.Features)
+	d.value(path, "imports", a.Imports, b.Imports)
+	d.value(path, "public imports", a.PublicImports, b.PublicImports)
+	d.messages(path, a.Messages, b.Messages)
+	d.enums(path, a.Enums, b.Enums)
+
+	var an, bn []string
+	for _, s := range a.Services {
+		an = append(an, s.Name)
+	}
+	for _, s := range b.Services {
+		bn = append(bn, s.Name)
+	}
+	d.match(path, "service", an, bn, func(i, j int) {
+		d.service(sub(path, "service "+a.Services[i].Name), a.Services[i], b.Services[j])
+	})
+
+	d.extensions(path, a.Extensions, b.Extensions)
+
+	if d.mode&IgnoreComments != 0 {
+		return
+	}
+	if len(a.Comments) != len(b.Comments) {
+		d.errorf(path, "comments: %v != %v", len(a.Comments), len(b.Comments))
+		return
+	}
+	for i, ac := range a.Comments {
+		bc := b.Comments[i]
+		cpath := sub(path, fmt.Sprintf("comment %d", i))
+		d.value(cpath, "text", ac.Text, bc.Text)
+		d.position(cpath, ac.Start, bc.Start)
+		d.position(cpath, ac.End, bc.End)
+	}
+}
+
+func (d *differ) messages(path []string, a, b []*Message) {
+	var an, bn []string
+	for _, m := range a {
+		an = append(an, m.Name)
+	}
+	for _, m := range b {
+		bn = append(bn, m.Name)
+	}
+	d.match(path, "message", an, bn, func(i, j int) {
+		d.message(sub(path, "message "+a[i].Name), a[i], b[j])
+	})
+}
+
+func (d *differ) message(path []string, a, b *Message) {
+	d.position(path, a.Position, b.Position)
+	d.value(path, "group", a.Group, b.Group)
+	d.value(path, "options", a.Options, b.Options)
+	d.value(path, "features", a.Features, b.Features)
+	d.value(path, "reserved", a.ReservedFields, b.ReservedFields)
+
+	if len(a.ExtensionRanges) != len(b.ExtensionRanges) {
+		d.errorf(path, "extension ranges: %v != %v", len(a.ExtensionRanges), len(b.ExtensionRanges))
+	} else {
+		for i, ar := range a.ExtensionRanges {
+			br := b.ExtensionRanges[i]
+			rpath := sub(path, fmt.Sprintf("extensions %v to %v", ar[0], ar[1]))
+			d.value(rpath, "range", ar, br)
+			// missing options are the same as empty ones
+			ao, bo := a.RangeOptions(i), b.RangeOptions(i)
+			if ao == nil {
+				ao = new(ExtensionRangeOptions)
+			}
+			if bo == nil {
+				bo = new(ExtensionRangeOptions)
+			}
+			d.position(rpath, ao.Position, bo.Position)
+			d.value(rpath, "declarations", ao.Declarations, bo.Declarations)
+			d.value(rpath, "verification", ao.Verification, bo.Verification)
+			d.value(rpath, "options", ao.Options, bo.Options)
+		}
+	}
+
+	var an, bn []string
+	for _, o := range a.Oneofs {
+		an = append(an, o.Name)
+	}
+	for _, o := range b.Oneofs {
+		bn = append(bn, o.Name)
+	}
+	d.match(path, "oneof", an, bn, func(i, j int) {
+		d.position(sub(path, "oneof "+a.Oneofs[i].Name), a.Oneofs[i].Position, b.Oneofs[j].Position)
+	})
+
+	d.fields(path, a.Fields, b.Fields)
+	d.messages(path, a.Messages, b.Messages)
+	d.enums(path, a.Enums, b.Enums)
+	d.extensions(path, a.Extensions, b.Extensions)
+}
+
+func (d *differ) fields(path []string, a, b []*Field) {
+	var an, bn []string
+	for _, f := range a {
+		an = append(an, f.Name)
+	}
+	for _, f := range b {
+		bn = append(bn, f.Name)
+	}
+	d.match(path, "field", an, bn, func(i, j int) {
+		d.field(sub(path, "field "+a[i].Name), a[i], b[j])
+	})
+}
+
+func (d *differ) field(path []string, a, b *Field) {
+	d.position(path, a.Position, b.Position)
+	d.value(path, "number", a.Tag, b.Tag)
+	d.value(path, "label", label(a), label(b))
+	d.value(path, "type name", a.TypeName, b.TypeName)
+	d.typ(path, "type", a.Type, b.Type)
+	d.value(path, "key type name", a.KeyTypeName, b.KeyTypeName)
+	d.value(path, "default", [2]interface{}{a.HasDefault, a.Default}, [2]interface{}{b.HasDefault, b.Default})
+	if d.mode&IgnoreResolved == 0 {
+		d.value(path, "key type", a.KeyType, b.KeyType)
+		d.value(path, "default value", a.DefaultValue, b.DefaultValue)
+	}
+	d.value(path, "packed", [2]bool{a.HasPacked, a.Packed}, [2]bool{b.HasPacked, b.Packed})
+	d.value(path, "deprecated", [2]bool{a.HasDeprecated, a.Deprecated}, [2]bool{b.HasDeprecated, b.Deprecated})
+	d.value(path, "options", a.Options, b.Options)
+	d.value(path, "features", a.Features, b.Features)
+
+	var ao, bo string
+	if a.Oneof != nil {
+		ao = a.Oneof.Name
+	}
+	if b.Oneof != nil {
+		bo = b.Oneof.Name
+	}
+	d.value(path, "oneof", ao, bo)
+}
+
+func (d *differ) enums(path []string, a, b []*Enum) {
+	var an, bn []string
+	for _, e := range a {
+		an = append(an, e.Name)
+	}
+	for _, e := range b {
+		bn = append(bn, e.Name)
+	}
+	d.match(path, "enum", an, bn, func(i, j int) {
+		d.enum(sub(path, "enum "+a[i].Name), a[i], b[j])
+	})
+}
+
+func (d *differ) enum(path []string, a, b *Enum) {
+	d.position(path, a.Position, b.Position)
+	d.value(path, "options", a.Options, b.Options)
+	d.value(path, "features", a.Features, b.Features)
+
+	var an, bn []string
+	for _, v := range a.Values {
+		an = append(an, v.Name)
+	}
+	for _, v := range b.Values {
+		bn = append(bn, v.Name)
+	}
+	d.match(path, "value", an, bn, func(i, j int) {
+		vpath := sub(path, "value "+a.Values[i].Name)
+		d.position(vpath, a.Values[i].Position, b.Values[j].Position)
+		d.value(vpath, "number", a.Values[i].Number, b.Values[j].Number)
+	})
+}
+
+func (d *differ) service(path []string, a, b *Service) {
+	d.position(path, a.Position, b.Position)
+
+	var an, bn []string
+	for _, m := range a.Methods {
+		an = append(an, m.Name)
+	}
+	for _, m := range b.Methods {
+		bn = append(bn, m.Name)
+	}
+	d.match(path, "rpc", an, bn, func(i, j int) {
+		am, bm := a.Methods[i], b.Methods[j]
+		mpath := sub(path, "rpc "+am.Name)
+		d.position(mpath, am.Position, bm.Position)
+		d.value(mpath, "input type name", am.InTypeName, bm.InTypeName)
+		d.typ(mpath, "input type", am.InType, bm.InType)
+		d.value(mpath, "output type name", am.OutTypeName, bm.OutTypeName)
+		d.typ(mpath, "output type", am.OutType, bm.OutType)
+		d.value(mpath, "options", am.Options, bm.Options)
+	})
+}
+
+func (d *differ) extensions(path []string, a, b []*Extension) {
+	if len(a) != len(b) {
+		d.errorf(path, "extensions: %v != %v", len(a), len(b))
+		return
+	}
+	for i, ae := range a {
+		be := b[i]
+		epath := sub(path, "extend "+ae.Extendee)
+		d.position(epath, ae.Position, be.Position)
+		d.value(epath, "extendee", ae.Extendee, be.Extendee)
+		var at, bt interface{}
+		if ae.ExtendeeType != nil {
+			at = ae.ExtendeeType
+		}
+		if be.ExtendeeType != nil {
+			bt = be.ExtendeeType
+		}
+		d.typ(epath, "extendee type", at, bt)
+		d.fields(epath, ae.Fields, be.Fields)
+	}
+}
+
+// sub returns the path of the node named name within that named by path
+func sub(path []string, name string) []string {
+	return append(append([]string(nil), path...), name)
+}
+
+// label returns the label of f, if any
+func label(f *Field) string {
+	switch {
+	case f.Required:
+		return "required"
+	case f.Optional:
+		return "optional"
+	case f.Repeated:
+		return "repeated"
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast
+
+import (
+	"fmt"
+)
+
+// Features is a set of edition features, as set by features.* options. Each
+// field is the name of the value of the feature, e.g. "IMPLICIT", or is empty
+// if the feature is not set.
+type Features struct {
+	FieldPresence         string // EXPLICIT, IMPLICIT or LEGACY_REQUIRED
+	EnumType              string // OPEN or CLOSED
+	RepeatedFieldEncoding string // PACKED or EXPANDED
+	Utf8Validation        string // VERIFY or NONE
+	MessageEncoding       string // LENGTH_PREFIXED or DELIMITED
+	JSONFormat            string // ALLOW or LEGACY_BEST_EFFORT
+}
+
+// FeatureValues maps the name of each feature, as used in features.*
+// options, to its valid values.
+var FeatureValues = map[string][]string{
+	"field_presence":          {"EXPLICIT", "IMPLICIT", "LEGACY_REQUIRED"},
+	"enum_type":               {"OPEN", "CLOSED"},
+	"repeated_field_encoding": {"PACKED", "EXPANDED"},
+	"utf8_validation":         {"VERIFY", "NONE"},
+	"message_encoding":        {"LENGTH_PREFIXED", "DELIMITED"},
+	"json_format":             {"ALLOW", "LEGACY_BEST_EFFORT"},
+}
+
+// featureNames lists the names of the features in the order of the fields
+// of Features
+var featureNames = []string{
+	"field_presence",
+	"enum_type",
+	"repeated_field_encoding",
+	"utf8_validation",
+	"message_encoding",
+	"json_format",
+}
+
+func (fs *Features) field(name string) *string {
+	switch name {
+	case "field_presence":
+		return &fs.FieldPresence
+	case "enum_type":
+		return &fs.EnumType
+	case "repeated_field_encoding":
+		return &fs.RepeatedFieldEncoding
+	case "utf8_validation":
+		return &fs.Utf8Validation
+	case "message_encoding":
+		return &fs.MessageEncoding
+	case "json_format":
+		return &fs.JSONFormat
+	}
+	return nil
+}
+
+// Set sets the feature name, e.g. "field_presence", to value. It returns an
+// error if there is no such feature, or if value is not one of its values.
+func (fs *Features) Set(name, value string) error {
+	p := fs.field(name)
+	if p == nil {
+		return fmt.Errorf("unknown feature %q", name)
+	}
+	for _, v := range FeatureValues[name] {
+		if v == value {
+			*p = value
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q for feature %q", value, name)
+}
+
+// IsZero reports whether no feature is set in fs.
+func (fs Features) IsZero() bool { return fs == Features{} }
+
+// Options returns the features set in fs as the key/value pairs of
+// features.* options, e.g. {"features.field_presence", "IMPLICIT"}.
+func (fs Features) Options() [][2]string {
+	var res [][2]string
+	for _, name := range featureNames {
+		if v := *fs.field(name); v != "" {
+			res = append(res, [2]string{"features." + name, v})
+		}
+	}
+	return res
+}
+
+// merge returns fs with the features that it does not set taken from parent
+func (fs Features) merge(parent Features) Features {
+	res := parent
+	for _, name := range featureNames {
+		if v := *fs.field(name); v != "" {
+			*res.field(name) = v
+		}
+	}
+	return res
+}
+
+// EditionDefaults returns the features of a file with the given syntax and
+// edition (see File), before any features.* options are applied.
+func EditionDefaults(syntax, edition string) Features {
+	switch syntax {
+	case "proto3":
+		return Features{
+			FieldPresence:         "IMPLICIT",
+			EnumType:              "OPEN",
+			RepeatedFieldEncoding: "PACKED",
+			Utf8Validation:        "VERIFY",
+			MessageEncoding:       "LENGTH_PREFIXED",
+			JSONFormat:            "ALLOW",
+		}
+	case "editions":
+		// the parser accepts only edition 2023
+		return Features{
+			FieldPresence:         "EXPLICIT",
+			EnumType:              "OPEN",
+			RepeatedFieldEncoding: "PACKED",
+			Utf8Validation:        "VERIFY",
+			MessageEncoding:       "LENGTH_PREFIXED",
+			JSONFormat:            "ALLOW",
+		}
+	}
+	return Features{
+		FieldPresence:         "EXPLICIT",
+		EnumType:              "CLOSED",
+		RepeatedFieldEncoding: "EXPANDED",
+		Utf8Validation:        "NONE",
+		MessageEncoding:       "LENGTH_PREFIXED",
+		JSONFormat:            "LEGACY_BEST_EFFORT",
+	}
+}
+
+// ResolvedFeatures returns the features of f: the defaults of its edition,
+// overridden by those set in f.
+func (f *File) ResolvedFeatures() Features {
+	return f.Features.merge(EditionDefaults(f.Syntax, f.Edition))
+}
+
+// ResolvedFeatures returns the features of m: those set in m, together with
+// those it inherits from its enclosing message or file.
+func (m *Message) ResolvedFeatures() Features {
+	return m.Features.merge(resolvedFeatures(m.Up))
+}
+
+// ResolvedFeatures returns the features of e: those set in e, together with
+// those it inherits from its enclosing message or file.
+func (e *Enum) ResolvedFeatures() Features {
+	return e.Features.merge(resolvedFeatures(e.Up))
+}
+
+// ResolvedFeatures returns the features of f: those set in f, together with
+// those it inherits from its enclosing message or file. Outside of editions,
+// the features implied by required, optional, [packed=...] and groups are
+// included.
+func (f *Field) ResolvedFeatures() Features {
+	var parent Features
+	switch up := f.Up.(type) {
+	case *Message:
+		parent = up.ResolvedFeatures()
+	case *Extension:
+		parent = resolvedFeatures(up.Up)
+	default:
+		parent = EditionDefaults("proto2", "")
+	}
+
+	fs := f.Features
+	if file := f.File(); file != nil && file.Syntax != "editions" {
+		switch {
+		case f.Required:
+			fs.FieldPresence = "LEGACY_REQUIRED"
+		case f.Optional && file.Syntax == "proto3":
+			fs.FieldPresence = "EXPLICIT"
+		}
+		if f.HasPacked {
+			fs.RepeatedFieldEncoding = "EXPANDED"
+			if f.Packed {
+				fs.RepeatedFieldEncoding = "PACKED"
+			}
+		}
+		if m, ok := f.Type.(*Message); ok && m.Group {
+			fs.MessageEncoding = "DELIMITED"
+		}
+	}
+
+	return fs.merge(parent)
+}
+
+func resolvedFeatures(up FileOrMessage) Features {
+	switch up := up.(type) {
+	case *File:
+		return up.ResolvedFeatures()
+	case *Message:
+		return up.ResolvedFeatures()
+	}
+	// not part of a file; assume proto2, the default syntax
+	return EditionDefaults("proto2", "")
+}
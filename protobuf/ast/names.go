@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// FullName returns the fully-qualified name (without a leading dot) of x,
+// which must be a *Message, *Enum, *Service, *Method or *Field. The name of
+// a field of an extension is scoped by that of the message in which the
+// extension is defined, if any.
+func FullName(x interface{}) string {
+	var parts []string
+	for {
+		switch v := x.(type) {
+		case *Message:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *Enum:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *Service:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *Method:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *Field:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *Extension:
+			x = v.Up
+			continue
+		case *File:
+			parts = append(append([]string{}, v.Package...), parts...)
+		}
+		return strings.Join(parts, ".")
+	}
+}
+
+// TypeName returns the name of the resolved type typ, as descriptors record
+// it: the name of a scalar type, e.g. int32, or the fully-qualified name of
+// a message or enum with a leading dot, e.g. .my.pkg.Msg, or "" if typ is
+// unresolved.
+func TypeName(typ interface{}) string {
+	switch typ := typ.(type) {
+	case FieldType:
+		return typ.String()
+	case *Message, *Enum:
+		return "." + FullName(typ)
+	}
+	return ""
+}
+
+// JSONName returns the JSON name of a field called name, as protoc computes
+// it: underscores are removed, and the letter following each is capitalised.
+func JSONName(name string) string {
+	var res []rune
+	upper := false
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		res = append(res, r)
+	}
+	return string(res)
+}
+
+// WrapperTypes maps the full name of each wrapper well-known type to the
+// scalar type it wraps; in JSON a wrapper is written as the value it wraps.
+var WrapperTypes = map[string]FieldType{
+	"google.protobuf.DoubleValue": Double,
+	"google.protobuf.FloatValue":  Float,
+	"google.protobuf.Int64Value":  Int64,
+	"google.protobuf.UInt64Value": Uint64,
+	"google.protobuf.Int32Value":  Int32,
+	"google.protobuf.UInt32Value": Uint32,
+	"google.protobuf.BoolValue":   Bool,
+	"google.protobuf.StringValue": String,
+	"google.protobuf.BytesValue":  Bytes,
+}
+
+// WellKnownJSONTypes maps the full name of each well-known type, other than
+// the wrappers, that is not written in JSON as an ordinary message to the
+// JSON type of the value that represents it: "string", "object", "array",
+// or "" if it may be any JSON value.
+var WellKnownJSONTypes = map[string]string{
+	"google.protobuf.Timestamp": "string",
+	"google.protobuf.Duration":  "string",
+	"google.protobuf.FieldMask": "string",
+	"google.protobuf.Struct":    "object",
+	"google.protobuf.Empty":     "object",
+	"google.protobuf.Any":       "object",
+	"google.protobuf.ListValue": "array",
+	"google.protobuf.Value":     "",
+}
+
+// Reference is a use of a message or enum by name.
+type Reference struct {
+	// Node is the *Field, *Method or *Extension that makes the reference.
+	Node Node
+
+	// Name points to the name as written in Node, i.e. its TypeName,
+	// InTypeName, OutTypeName or Extendee, so that it may be rewritten.
+	Name *string
+
+	// Target is the *Message or *Enum to which the name resolved.
+	Target Node
+}
+
+// References returns the resolved references to messages and enums made
+// directly by n: by the type of a *Field, the input and output types of a
+// *Method, or the extendee of an *Extension. The type of a group field is
+// defined by the field itself, and so is not a reference.
+func References(n Node) []Reference {
+	var res []Reference
+	add := func(name *string, target interface{}) {
+		switch target := target.(type) {
+		case *Message:
+			res = append(res, Reference{Node: n, Name: name, Target: target})
+		case *Enum:
+			res = append(res, Reference{Node: n, Name: name, Target: target})
+		}
+	}
+
+	switch n := n.(type) {
+	case *Field:
+		if m, ok := n.Type.(*Message); !ok || !m.Group {
+			add(&n.TypeName, n.Type)
+		}
+	case *Method:
+		add(&n.InTypeName, n.InType)
+		add(&n.OutTypeName, n.OutType)
+	case *Extension:
+		if n.ExtendeeType != nil {
+			add(&n.Extendee, n.ExtendeeType)
+		}
+	}
+
+	return res
+}
+
+// References returns the resolved references to messages and enums made
+// within f, in source order.
+func (f *File) References() []Reference {
+	var res []Reference
+
+	var addExts func(exts []*Extension)
+	addExts = func(exts []*Extension) {
+		for _, e := range exts {
+			res = append(res, References(e)...)
+			for _, fl := range e.Fields {
+				res = append(res, References(fl)...)
+			}
+		}
+	}
+
+	var addMsgs func(msgs []*Message)
+	addMsgs = func(msgs []*Message) {
+		for _, m := range msgs {
+			for _, fl := range m.Fields {
+				res = append(res, References(fl)...)
+			}
+			addExts(m.Extensions)
+			addMsgs(m.Messages)
+		}
+	}
+
+	addMsgs(f.Messages)
+	addExts(f.Extensions)
+
+	for _, s := range f.Services {
+		for _, m := range s.Methods {
+			res = append(res, References(m)...)
+		}
+	}
+
+	sort.Stable(referenceSort(res))
+
+	return res
+}
+
+type referenceSort []Reference
+
+func (r referenceSort) Len() int      { return len(r) }
+func (r referenceSort) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r referenceSort) Less(i, j int) bool {
+	return r[i].Node.Pos().Before(r[j].Node.Pos())
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package ast_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+)
+
+const namesSrc = `syntax = "proto2";
+
+package shop;
+
+// Product is something for sale.
+message Product {
+  optional string name = 1 [default = "pen"];
+  optional Kind kind = 2;
+  map<string, Variant> variants = 3;
+
+  oneof discount {
+    float percent_off = 4;
+    Product bundle = 5;
+  }
+
+  extensions 100 to 199, 300;
+
+  message Variant {
+    optional string label = 1;
+  }
+
+  enum Kind {
+    PHYSICAL = 0;
+    DIGITAL = 1;
+  }
+}
+
+service Shop {
+  rpc Get (Product) returns (Product.Variant);
+}
+
+extend Product {
+  optional Product.Kind other_kind = 100;
+}
+`
+
+func parse(t *testing.T, src string) *ast.FileSet {
+	f, err := parser.ParseFile("shop.proto", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := &ast.FileSet{Files: []*ast.File{f}}
+	if err := parser.Resolve(fset); err != nil {
+		t.Fatal(err)
+	}
+	return fset
+}
+
+func TestNames(t *testing.T) {
+	f := parse(t, namesSrc).Files[0]
+	m := f.Messages[0]
+	ext := f.Extensions[0]
+
+	names := []struct {
+		got, want string
+	}{
+		{ast.FullName(m), "shop.Product"},
+		{ast.FullName(m.Enums[0]), "shop.Product.Kind"},
+		{ast.FullName(m.Fields[0]), "shop.Product.name"},
+		{ast.FullName(f.Services[0].Methods[0]), "shop.Shop.Get"},
+		{ast.FullName(ext.Fields[0]), "shop.other_kind"},
+		{ast.TypeName(m.Fields[0].Type), "string"},
+		{ast.TypeName(m.Fields[2].Type), ".shop.Product.Variant"},
+		{ast.TypeName(nil), ""},
+		{ast.JSONName("percent_off"), "percentOff"},
+	}
+	for i, n := range names {
+		if n.got != n.want {
+			t.Errorf("%v: got %q, want %q", i, n.got, n.want)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	f := parse(t, namesSrc).Files[0]
+
+	var got []string
+	for _, r := range f.References() {
+		got = append(got, fmt.Sprintf("%v: %v -> %v", r.Node.Pos().Line, *r.Name, ast.FullName(r.Target)))
+	}
+	want := []string{
+		"8: Kind -> shop.Product.Kind",
+		"9: Variant -> shop.Product.Variant",
+		"13: Product -> shop.Product",
+		"29: Product -> shop.Product",
+		"29: Product.Variant -> shop.Product.Variant",
+		"32: Product -> shop.Product",
+		"33: Product.Kind -> shop.Product.Kind",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got references %q, want %q", got, want)
+	}
+}
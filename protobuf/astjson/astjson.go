@@ -0,0 +1,701 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package astjson encodes the AST of a set of proto files as JSON, for tools
+// not written in Go, and decodes it again.
+//
+// The types of this package define the encoding: a FileSet is the document,
+// holding a File for each file, and so on. Unlike the AST, they hold no
+// pointers: the resolved types of fields and methods, and the messages
+// extended by extensions, are the fully-qualified names (with a leading dot)
+// of the messages and enums of the files, or the names of scalar types. The
+// names of JSON properties are stable, and the Version of the document
+// changes with any incompatible change.
+package astjson // import "myitcv.io/g/protobuf/astjson"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// Version is the version of the encoding
+const Version = 1
+
+// A FileSet is the encoding of an ast.FileSet
+type FileSet struct {
+	Version int     `json:"version"`
+	Files   []*File `json:"files"`
+}
+
+// A Position is the encoding of an ast.Position
+type Position struct {
+	Line   int `json:"line"`
+	Offset int `json:"offset"`
+}
+
+// An Option is a key/value pair of the options of a definition
+type Option struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Features is the encoding of ast.Features
+type Features struct {
+	FieldPresence         string `json:"fieldPresence,omitempty"`
+	EnumType              string `json:"enumType,omitempty"`
+	RepeatedFieldEncoding string `json:"repeatedFieldEncoding,omitempty"`
+	Utf8Validation        string `json:"utf8Validation,omitempty"`
+	MessageEncoding       string `json:"messageEncoding,omitempty"`
+	JSONFormat            string `json:"jsonFormat,omitempty"`
+}
+
+type File struct {
+	Name          string       `json:"name"`
+	Syntax        string       `json:"syntax,omitempty"`
+	Edition       string       `json:"edition,omitempty"`
+	Package       []string     `json:"package,omitempty"`
+	Options       []Option     `json:"options,omitempty"`
+	Features      *Features    `json:"features,omitempty"`
+	Imports       []string     `json:"imports,omitempty"`
+	PublicImports []int        `json:"publicImports,omitempty"` // indexes in Imports
+	Messages      []*Message   `json:"messages,omitempty"`
+	Enums         []*Enum      `json:"enums,omitempty"`
+	Services      []*Service   `json:"services,omitempty"`
+	Extensions    []*Extension `json:"extensions,omitempty"`
+	Comments      []*Comment   `json:"comments,omitempty"`
+}
+
+type Message struct {
+	Position        Position          `json:"position"`
+	Name            string            `json:"name"`
+	Group           bool              `json:"group,omitempty"`
+	Fields          []*Field          `json:"fields,omitempty"`
+	Oneofs          []*Oneof          `json:"oneofs,omitempty"`
+	Reserved        []Reserved        `json:"reserved,omitempty"`
+	ExtensionRanges []*ExtensionRange `json:"extensionRanges,omitempty"`
+	Options         []Option          `json:"options,omitempty"`
+	Features        *Features         `json:"features,omitempty"`
+	Messages        []*Message        `json:"messages,omitempty"`
+	Enums           []*Enum           `json:"enums,omitempty"`
+	Extensions      []*Extension      `json:"extensions,omitempty"`
+}
+
+// Reserved is a reserved name, or range of field numbers.
+type Reserved struct {
+	Name  string `json:"name,omitempty"`
+	Start int    `json:"start,omitempty"`
+	End   int    `json:"end,omitempty"` // inclusive
+}
+
+type ExtensionRange struct {
+	Position Position               `json:"position"`
+	Start    int                    `json:"start"`
+	End      int                    `json:"end"` // inclusive
+	Options  *ExtensionRangeOptions `json:"options,omitempty"`
+}
+
+type ExtensionRangeOptions struct {
+	Declarations []ExtensionDeclaration `json:"declarations,omitempty"`
+	Verification string                 `json:"verification,omitempty"`
+	Options      []Option               `json:"options,omitempty"`
+}
+
+type ExtensionDeclaration struct {
+	Number   int    `json:"number"`
+	FullName string `json:"fullName,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Reserved bool   `json:"reserved,omitempty"`
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+type Oneof struct {
+	Position Position `json:"position"`
+	Name     string   `json:"name"`
+}
+
+// A Field is the encoding of an ast.Field. Type and KeyType are the
+// resolved types of the field (its value type, for a map) and of its keys,
+// if it is a map; TypeKind says whether Type is a scalar, message or enum.
+// Oneof is the name of the oneof of the message the field belongs to, if
+// any.
+type Field struct {
+	Position     Position  `json:"position"`
+	Name         string    `json:"name"`
+	Number       int       `json:"number"`
+	Label        string    `json:"label,omitempty"` // required, optional or repeated, if written
+	TypeName     string    `json:"typeName"`
+	Type         string    `json:"type,omitempty"`
+	TypeKind     string    `json:"typeKind,omitempty"`
+	KeyTypeName  string    `json:"keyTypeName,omitempty"`
+	KeyType      string    `json:"keyType,omitempty"`
+	Default      *string   `json:"default,omitempty"`      // as written
+	DefaultValue *string   `json:"defaultValue,omitempty"` // as resolved
+	Packed       *bool     `json:"packed,omitempty"`
+	Deprecated   *bool     `json:"deprecated,omitempty"`
+	Oneof        string    `json:"oneof,omitempty"`
+	Options      []Option  `json:"options,omitempty"`
+	Features     *Features `json:"features,omitempty"`
+}
+
+type Enum struct {
+	Position Position     `json:"position"`
+	Name     string       `json:"name"`
+	Values   []*EnumValue `json:"values"`
+	Options  []Option     `json:"options,omitempty"`
+	Features *Features    `json:"features,omitempty"`
+}
+
+type EnumValue struct {
+	Position Position `json:"position"`
+	Name     string   `json:"name"`
+	Number   int32    `json:"number"`
+}
+
+type Service struct {
+	Position Position  `json:"position"`
+	Name     string    `json:"name"`
+	Methods  []*Method `json:"methods,omitempty"`
+}
+
+// A Method is the encoding of an ast.Method. InType and OutType are the
+// resolved request and response messages.
+type Method struct {
+	Position    Position `json:"position"`
+	Name        string   `json:"name"`
+	InTypeName  string   `json:"inTypeName"`
+	InType      string   `json:"inType,omitempty"`
+	OutTypeName string   `json:"outTypeName"`
+	OutType     string   `json:"outType,omitempty"`
+	Options     []Option `json:"options,omitempty"`
+}
+
+// An Extension is the encoding of an ast.Extension. ExtendeeType is the
+// resolved message being extended.
+type Extension struct {
+	Position     Position `json:"position"`
+	Extendee     string   `json:"extendee"`
+	ExtendeeType string   `json:"extendeeType,omitempty"`
+	Fields       []*Field `json:"fields,omitempty"`
+}
+
+type Comment struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+	Text  []string `json:"text"`
+}
+
+// Encode writes the JSON encoding of fset to w, indented by two spaces.
+func Encode(w io.Writer, fset *ast.FileSet) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(New(fset))
+}
+
+// Decode reads the JSON encoding of a FileSet from r and returns its AST.
+func Decode(r io.Reader) (*ast.FileSet, error) {
+	fs := new(FileSet)
+	if err := json.NewDecoder(r).Decode(fs); err != nil {
+		return nil, err
+	}
+	return fs.AST()
+}
+
+// New returns the encoding of fset.
+func New(fset *ast.FileSet) *FileSet {
+	res := &FileSet{Version: Version}
+	for _, f := range fset.Files {
+		res.Files = append(res.Files, encodeFile(f))
+	}
+	return res
+}
+
+func encodeFile(f *ast.File) *File {
+	res := &File{
+		Name:          f.Name,
+		Syntax:        f.Syntax,
+		Edition:       f.Edition,
+		Package:       f.Package,
+		Options:       encodeOptions(f.Options),
+		Features:      encodeFeatures(f.Features),
+		Imports:       f.Imports,
+		PublicImports: f.PublicImports,
+		Extensions:    encodeExtensions(f.Extensions),
+	}
+	for _, m := range f.Messages {
+		res.Messages = append(res.Messages, encodeMessage(m))
+	}
+	for _, e := range f.Enums {
+		res.Enums = append(res.Enums, encodeEnum(e))
+	}
+	for _, s := range f.Services {
+		es := &Service{
+			Position: encodePosition(s.Position),
+			Name:     s.Name,
+		}
+		for _, m := range s.Methods {
+			es.Methods = append(es.Methods, &Method{
+				Position:    encodePosition(m.Position),
+				Name:        m.Name,
+				InTypeName:  m.InTypeName,
+				InType:      ast.TypeName(m.InType),
+				OutTypeName: m.OutTypeName,
+				OutType:     ast.TypeName(m.OutType),
+				Options:     encodeOptions(m.Options),
+			})
+		}
+		res.Services = append(res.Services, es)
+	}
+	for _, c := range f.Comments {
+		res.Comments = append(res.Comments, &Comment{
+			Start: encodePosition(c.Start),
+			End:   encodePosition(c.End),
+			Text:  c.Text,
+		})
+	}
+	return res
+}
+
+func encodeMessage(m *ast.Message) *Message {
+	res := &Message{
+		Position:   encodePosition(m.Position),
+		Name:       m.Name,
+		Group:      m.Group,
+		Options:    encodeOptions(m.Options),
+		Features:   encodeFeatures(m.Features),
+		Extensions: encodeExtensions(m.Extensions),
+	}
+	for _, f := range m.Fields {
+		res.Fields = append(res.Fields, encodeField(f))
+	}
+	for _, o := range m.Oneofs {
+		res.Oneofs = append(res.Oneofs, &Oneof{
+			Position: encodePosition(o.Position),
+			Name:     o.Name,
+		})
+	}
+	for _, r := range m.ReservedFields {
+		res.Reserved = append(res.Reserved, Reserved{
+			Name:  r.Name,
+			Start: r.Start,
+			End:   r.End,
+		})
+	}
+	for i, r := range m.ExtensionRanges {
+		er := &ExtensionRange{
+			Start: r[0],
+			End:   r[1],
+		}
+		o := m.RangeOptions(i)
+		if o != nil {
+			er.Position = encodePosition(o.Position)
+		}
+		if !o.IsEmpty() {
+			er.Options = &ExtensionRangeOptions{
+				Verification: o.Verification,
+				Options:      encodeOptions(o.Options),
+			}
+			for _, d := range o.Declarations {
+				er.Options.Declarations = append(er.Options.Declarations, ExtensionDeclaration(d))
+			}
+		}
+		res.ExtensionRanges = append(res.ExtensionRanges, er)
+	}
+	for _, nm := range m.Messages {
+		res.Messages = append(res.Messages, encodeMessage(nm))
+	}
+	for _, e := range m.Enums {
+		res.Enums = append(res.Enums, encodeEnum(e))
+	}
+	return res
+}
+
+func encodeField(f *ast.Field) *Field {
+	res := &Field{
+		Position:    encodePosition(f.Position),
+		Name:        f.Name,
+		Number:      f.Tag,
+		TypeName:    f.TypeName,
+		Type:        ast.TypeName(f.Type),
+		KeyTypeName: f.KeyTypeName,
+		Options:     encodeOptions(f.Options),
+		Features:    encodeFeatures(f.Features),
+	}
+	switch {
+	case f.Required:
+		res.Label = "required"
+	case f.Optional:
+		res.Label = "optional"
+	case f.Repeated:
+		res.Label = "repeated"
+	}
+	switch f.Type.(type) {
+	case ast.FieldType:
+		res.TypeKind = "scalar"
+	case *ast.Message:
+		res.TypeKind = "message"
+	case *ast.Enum:
+		res.TypeKind = "enum"
+	}
+	if f.KeyTypeName != "" {
+		res.KeyType = ast.TypeName(f.KeyType)
+	}
+	if f.HasDefault {
+		res.Default = &f.Default
+		if f.Type != nil {
+			res.DefaultValue = &f.DefaultValue
+		}
+	}
+	if f.HasPacked {
+		res.Packed = &f.Packed
+	}
+	if f.HasDeprecated {
+		res.Deprecated = &f.Deprecated
+	}
+	if f.Oneof != nil {
+		res.Oneof = f.Oneof.Name
+	}
+	return res
+}
+
+func encodeEnum(e *ast.Enum) *Enum {
+	res := &Enum{
+		Position: encodePosition(e.Position),
+		Name:     e.Name,
+		Options:  encodeOptions(e.Options),
+		Features: encodeFeatures(e.Features),
+	}
+	for _, v := range e.Values {
+		res.Values = append(res.Values, &EnumValue{
+			Position: encodePosition(v.Position),
+			Name:     v.Name,
+			Number:   v.Number,
+		})
+	}
+	return res
+}
+
+func encodeExtensions(exts []*ast.Extension) []*Extension {
+	var res []*Extension
+	for _, ext := range exts {
+		ee := &Extension{
+			Position: encodePosition(ext.Position),
+			Extendee: ext.Extendee,
+		}
+		if ext.ExtendeeType != nil {
+			ee.ExtendeeType = ast.TypeName(ext.ExtendeeType)
+		}
+		for _, f := range ext.Fields {
+			ee.Fields = append(ee.Fields, encodeField(f))
+		}
+		res = append(res, ee)
+	}
+	return res
+}
+
+func encodePosition(p ast.Position) Position {
+	return Position(p)
+}
+
+func encodeOptions(opts [][2]string) []Option {
+	var res []Option
+	for _, o := range opts {
+		res = append(res, Option{Name: o[0], Value: o[1]})
+	}
+	return res
+}
+
+func encodeFeatures(fs ast.Features) *Features {
+	if fs.IsZero() {
+		return nil
+	}
+	res := Features(fs)
+	return &res
+}
+
+// AST returns the AST encoded by fs, with the Up links of its nodes and
+// the resolved types of its fields, methods and extensions restored. The
+// types must be defined in the files of fs.
+func (fs *FileSet) AST() (*ast.FileSet, error) {
+	if fs.Version != Version {
+		return nil, fmt.Errorf("unsupported version %d (want %d)", fs.Version, Version)
+	}
+
+	d := &decoder{
+		types: make(map[string]interface{}),
+	}
+	res := new(ast.FileSet)
+	for _, f := range fs.Files {
+		res.Files = append(res.Files, d.file(f))
+	}
+	for _, r := range d.refs {
+		if err := r(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// decoder holds the state used in decoding a FileSet
+type decoder struct {
+	// types maps the fully-qualified names of messages and enums, with a
+	// leading dot, to them
+	types map[string]interface{}
+
+	// refs resolve the references between nodes, once they have all been
+	// decoded
+	refs []func() error
+}
+
+func (d *decoder) file(f *File) *ast.File {
+	res := &ast.File{
+		Name:          f.Name,
+		Syntax:        f.Syntax,
+		Edition:       f.Edition,
+		Package:       f.Package,
+		Options:       decodeOptions(f.Options),
+		Features:      decodeFeatures(f.Features),
+		Imports:       f.Imports,
+		PublicImports: f.PublicImports,
+	}
+	prefix := "."
+	if len(f.Package) > 0 {
+		prefix += strings.Join(f.Package, ".") + "."
+	}
+	for _, m := range f.Messages {
+		res.Messages = append(res.Messages, d.message(m, prefix, res))
+	}
+	for _, e := range f.Enums {
+		res.Enums = append(res.Enums, d.enum(e, prefix, res))
+	}
+	for _, s := range f.Services {
+		as := &ast.Service{
+			Position: decodePosition(s.Position),
+			Name:     s.Name,
+			Up:       res,
+		}
+		for _, m := range s.Methods {
+			am := &ast.Method{
+				Position:    decodePosition(m.Position),
+				Name:        m.Name,
+				InTypeName:  m.InTypeName,
+				OutTypeName: m.OutTypeName,
+				Options:     decodeOptions(m.Options),
+				Up:          as,
+			}
+			d.ref(f.Name, m.InType, func(typ interface{}) { am.InType = typ })
+			d.ref(f.Name, m.OutType, func(typ interface{}) { am.OutType = typ })
+			as.Methods = append(as.Methods, am)
+		}
+		res.Services = append(res.Services, as)
+	}
+	res.Extensions = d.extensions(f.Name, f.Extensions, res)
+	for _, c := range f.Comments {
+		res.Comments = append(res.Comments, &ast.Comment{
+			Start: decodePosition(c.Start),
+			End:   decodePosition(c.End),
+			Text:  c.Text,
+		})
+	}
+	return res
+}
+
+// message returns the message m, whose full name is prefix followed by its
+// name, defined in up
+func (d *decoder) message(m *Message, prefix string, up ast.FileOrMessage) *ast.Message {
+	res := &ast.Message{
+		Position: decodePosition(m.Position),
+		Name:     m.Name,
+		Group:    m.Group,
+		Options:  decodeOptions(m.Options),
+		Features: decodeFeatures(m.Features),
+		Up:       up,
+	}
+	name := prefix + m.Name
+	d.types[name] = res
+
+	filename := ""
+	if f := res.File(); f != nil {
+		filename = f.Name
+	}
+
+	for _, o := range m.Oneofs {
+		res.Oneofs = append(res.Oneofs, &ast.Oneof{
+			Position: decodePosition(o.Position),
+			Name:     o.Name,
+			Up:       res,
+		})
+	}
+	for _, f := range m.Fields {
+		af := d.field(filename, f, res)
+		if f.Oneof != "" {
+			for _, o := range res.Oneofs {
+				if o.Name == f.Oneof {
+					af.Oneof = o
+				}
+			}
+		}
+		res.Fields = append(res.Fields, af)
+	}
+	for _, r := range m.Reserved {
+		res.ReservedFields = append(res.ReservedFields, ast.Reserved{
+			Name:  r.Name,
+			Start: r.Start,
+			End:   r.End,
+		})
+	}
+	for i, r := range m.ExtensionRanges {
+		var o *ast.ExtensionRangeOptions
+		switch {
+		case r.Options == nil && r.Position == (Position{}):
+		case i > 0 && m.ExtensionRanges[i-1].Position == r.Position:
+			// the ranges of a statement share its options
+			o = res.ExtensionRangeOptions[i-1]
+		default:
+			o = &ast.ExtensionRangeOptions{Position: decodePosition(r.Position)}
+			if ro := r.Options; ro != nil {
+				o.Verification = ro.Verification
+				o.Options = decodeOptions(ro.Options)
+				for _, decl := range ro.Declarations {
+					o.Declarations = append(o.Declarations, ast.ExtensionDeclaration(decl))
+				}
+			}
+		}
+		res.ExtensionRanges = append(res.ExtensionRanges, [2]int{r.Start, r.End})
+		res.ExtensionRangeOptions = append(res.ExtensionRangeOptions, o)
+	}
+	for _, nm := range m.Messages {
+		res.Messages = append(res.Messages, d.message(nm, name+".", res))
+	}
+	for _, e := range m.Enums {
+		res.Enums = append(res.Enums, d.enum(e, name+".", res))
+	}
+	res.Extensions = d.extensions(filename, m.Extensions, res)
+	return res
+}
+
+func (d *decoder) field(filename string, f *Field, up ast.MessageOrExtension) *ast.Field {
+	res := &ast.Field{
+		Position:    decodePosition(f.Position),
+		Name:        f.Name,
+		Tag:         f.Number,
+		TypeName:    f.TypeName,
+		KeyTypeName: f.KeyTypeName,
+		Required:    f.Label == "required",
+		Optional:    f.Label == "optional",
+		Repeated:    f.Label == "repeated",
+		Options:     decodeOptions(f.Options),
+		Features:    decodeFeatures(f.Features),
+		Up:          up,
+	}
+	d.ref(filename, f.Type, func(typ interface{}) { res.Type = typ })
+	if f.KeyType != "" {
+		d.ref(filename, f.KeyType, func(typ interface{}) {
+			res.KeyType, _ = typ.(ast.FieldType)
+		})
+	}
+	if f.Default != nil {
+		res.HasDefault = true
+		res.Default = *f.Default
+	}
+	if f.DefaultValue != nil {
+		res.DefaultValue = *f.DefaultValue
+	}
+	if f.Packed != nil {
+		res.HasPacked = true
+		res.Packed = *f.Packed
+	}
+	if f.Deprecated != nil {
+		res.HasDeprecated = true
+		res.Deprecated = *f.Deprecated
+	}
+	return res
+}
+
+func (d *decoder) enum(e *Enum, prefix string, up ast.FileOrMessage) *ast.Enum {
+	res := &ast.Enum{
+		Position: decodePosition(e.Position),
+		Name:     e.Name,
+		Options:  decodeOptions(e.Options),
+		Features: decodeFeatures(e.Features),
+		Up:       up,
+	}
+	d.types[prefix+e.Name] = res
+	for _, v := range e.Values {
+		res.Values = append(res.Values, &ast.EnumValue{
+			Position: decodePosition(v.Position),
+			Name:     v.Name,
+			Number:   v.Number,
+			Up:       res,
+		})
+	}
+	return res
+}
+
+func (d *decoder) extensions(filename string, exts []*Extension, up ast.FileOrMessage) []*ast.Extension {
+	var res []*ast.Extension
+	for _, ext := range exts {
+		ae := &ast.Extension{
+			Position: decodePosition(ext.Position),
+			Extendee: ext.Extendee,
+			Up:       up,
+		}
+		d.ref(filename, ext.ExtendeeType, func(typ interface{}) {
+			ae.ExtendeeType, _ = typ.(*ast.Message)
+		})
+		for _, f := range ext.Fields {
+			ae.Fields = append(ae.Fields, d.field(filename, f, ae))
+		}
+		res = append(res, ae)
+	}
+	return res
+}
+
+// ref arranges for set to be called with the type called name, referred to
+// in the named file, once all the types have been decoded. Nothing is set
+// if name is empty, i.e. the reference is unresolved.
+func (d *decoder) ref(filename, name string, set func(typ interface{})) {
+	if name == "" {
+		return
+	}
+	d.refs = append(d.refs, func() error {
+		if strings.HasPrefix(name, ".") {
+			typ, ok := d.types[name]
+			if !ok {
+				return fmt.Errorf("%v: unknown type %v", filename, name)
+			}
+			set(typ)
+			return nil
+		}
+		for ft, n := range ast.FieldTypeMap {
+			if n == name {
+				set(ft)
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: unknown scalar type %v", filename, name)
+	})
+}
+
+func decodePosition(p Position) ast.Position {
+	return ast.Position(p)
+}
+
+func decodeOptions(opts []Option) [][2]string {
+	var res [][2]string
+	for _, o := range opts {
+		res = append(res, [2]string{o.Name, o.Value})
+	}
+	return res
+}
+
+func decodeFeatures(fs *Features) ast.Features {
+	if fs == nil {
+		return ast.Features{}
+	}
+	return ast.Features(*fs)
+}
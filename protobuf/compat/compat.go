@@ -0,0 +1,348 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package compat checks the compatibility of two versions of a schema: whether
+// data written with one version can be read with the other.
+//
+// Messages and enums are matched by their fully-qualified names, so that they
+// may move between files, and fields by their numbers. Only the binary wire
+// format is considered: renaming a field, for example, is compatible.
+// Services and extensions are not compared.
+package compat // import "myitcv.io/g/protobuf/compat"
+
+import (
+	"fmt"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// Mode is the compatibility required of a new version of a schema with the
+// previous version.
+type Mode uint
+
+const (
+	// Backward compatibility: readers using the new version can read data
+	// written with the previous version.
+	Backward Mode = 1 << iota
+
+	// Forward compatibility: readers using the previous version can read
+	// data written with the new version.
+	Forward
+
+	// None requires no compatibility.
+	None Mode = 0
+
+	// Full is both Backward and Forward compatibility.
+	Full = Backward | Forward
+)
+
+var modeNames = map[Mode]string{
+	None:     "NONE",
+	Backward: "BACKWARD",
+	Forward:  "FORWARD",
+	Full:     "FULL",
+}
+
+func (m Mode) String() string {
+	if s, ok := modeNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("Mode(%d)", uint(m))
+}
+
+// ParseMode returns the Mode called s, one of NONE, BACKWARD, FORWARD or
+// FULL, in any case.
+func ParseMode(s string) (Mode, error) {
+	for m, n := range modeNames {
+		if strings.EqualFold(s, n) {
+			return m, nil
+		}
+	}
+	return None, fmt.Errorf("unknown compatibility %q", s)
+}
+
+// An Issue is a change between two versions of a schema that breaks their
+// compatibility.
+type Issue struct {
+	// Breaks is the compatibility that the change breaks: Backward, Forward
+	// or Full
+	Breaks Mode
+
+	// Message describes the change, naming the definition it is in, e.g.
+	// message shop.Order: field 2: type changed from int32 to string
+	Message string
+}
+
+func (i *Issue) String() string {
+	return fmt.Sprintf("%v (breaks %v compatibility)", i.Message, strings.ToLower(i.Breaks.String()))
+}
+
+// Check returns the changes from a to b, both resolved, that break any
+// compatibility between them, in the order of the definitions of a.
+func Check(a, b *ast.FileSet) []*Issue {
+	c := &checker{}
+
+	an, at := definitions(a)
+	_, bt := definitions(b)
+
+	for _, n := range an {
+		switch x := at[n].(type) {
+		case *ast.Message:
+			switch y := bt[n].(type) {
+			case *ast.Message:
+				c.message(n, x, y)
+			case nil:
+				c.add(Full, "message %v removed", n)
+			default:
+				c.add(Full, "message %v changed to an enum", n)
+			}
+		case *ast.Enum:
+			switch y := bt[n].(type) {
+			case *ast.Enum:
+				c.enum(n, x, y)
+			case nil:
+				c.add(Full, "enum %v removed", n)
+			default:
+				c.add(Full, "enum %v changed to a message", n)
+			}
+		}
+	}
+
+	return c.issues
+}
+
+// checker holds the state used in checking compatibility
+type checker struct {
+	issues []*Issue
+}
+
+func (c *checker) add(breaks Mode, format string, args ...interface{}) {
+	c.issues = append(c.issues, &Issue{
+		Breaks:  breaks,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) message(name string, a, b *ast.Message) {
+	bf := make(map[int]*ast.Field)
+	for _, f := range b.Fields {
+		bf[f.Tag] = f
+	}
+	af := make(map[int]*ast.Field)
+	for _, f := range a.Fields {
+		af[f.Tag] = f
+	}
+
+	for _, x := range a.Fields {
+		y, ok := bf[x.Tag]
+		if !ok {
+			if required(x) {
+				c.add(Forward, "message %v: required field %v (%v) removed", name, x.Tag, x.Name)
+			}
+			continue
+		}
+		c.field(name, af, x, y)
+	}
+	for _, y := range b.Fields {
+		if _, ok := af[y.Tag]; !ok && required(y) {
+			c.add(Backward, "message %v: required field %v (%v) added", name, y.Tag, y.Name)
+		}
+	}
+}
+
+// field checks the change of a field from x to y, with the same number; af
+// are the fields of the previous version of the message, by number
+func (c *checker) field(msg string, af map[int]*ast.Field, x, y *ast.Field) {
+	prefix := fmt.Sprintf("message %v: field %v (%v)", msg, x.Tag, y.Name)
+
+	if (x.KeyTypeName == "") != (y.KeyTypeName == "") {
+		c.add(Full, "%v: changed from %v to %v", prefix, fieldTypeName(x), fieldTypeName(y))
+		return
+	}
+	if x.KeyTypeName != "" && !compatible(x.KeyType, y.KeyType) {
+		c.add(Full, "%v: key type changed from %v to %v", prefix, x.KeyType, y.KeyType)
+	}
+
+	if !compatible(x.Type, y.Type) {
+		c.add(Full, "%v: type changed from %v to %v", prefix, fieldTypeName(x), fieldTypeName(y))
+		return
+	}
+	if delimited(x) != delimited(y) {
+		c.add(Full, "%v: changed between a group and a message", prefix)
+	}
+
+	if x.Repeated != y.Repeated && x.KeyTypeName == "" && !lengthDelimited(x.Type) {
+		// a repeated scalar may be packed, which a singular field cannot read
+		c.add(Full, "%v: changed from %v to %v", prefix, label(x), label(y))
+	}
+
+	switch {
+	case !required(x) && required(y):
+		c.add(Backward, "%v: made required", prefix)
+	case required(x) && !required(y):
+		c.add(Forward, "%v: no longer required", prefix)
+	}
+
+	// a field may leave a oneof, but not join one with other existing fields,
+	// whose values it would clear
+	if y.Oneof != nil && (x.Oneof == nil || x.Oneof.Name != y.Oneof.Name) {
+		for _, o := range y.Up.(*ast.Message).Fields {
+			if o.Oneof != y.Oneof || o == y {
+				continue
+			}
+			if old, ok := af[o.Tag]; ok && (old.Oneof == nil || old.Oneof.Name != y.Oneof.Name) {
+				c.add(Full, "%v: moved into oneof %v with field %v (%v)", prefix, y.Oneof.Name, o.Tag, o.Name)
+				break
+			}
+		}
+	}
+}
+
+func (c *checker) enum(name string, a, b *ast.Enum) {
+	// unknown values of an open enum are kept by readers
+	closed := func(e *ast.Enum) bool { return e.ResolvedFeatures().EnumType == "CLOSED" }
+	if !closed(a) && !closed(b) {
+		return
+	}
+
+	an := make(map[int32]bool)
+	for _, v := range a.Values {
+		an[v.Number] = true
+	}
+	bn := make(map[int32]bool)
+	for _, v := range b.Values {
+		bn[v.Number] = true
+	}
+
+	for _, v := range a.Values {
+		if !bn[v.Number] && closed(b) {
+			bn[v.Number] = true
+			c.add(Backward, "enum %v: value %v (%v) removed", name, v.Number, v.Name)
+		}
+	}
+	for _, v := range b.Values {
+		if !an[v.Number] && closed(a) {
+			an[v.Number] = true
+			c.add(Forward, "enum %v: value %v (%v) added", name, v.Number, v.Name)
+		}
+	}
+}
+
+// definitions returns the fully-qualified names of the messages and enums of
+// fset, in the order they are defined, and a map from each name to its
+// *ast.Message or *ast.Enum
+func definitions(fset *ast.FileSet) ([]string, map[string]interface{}) {
+	var names []string
+	defs := make(map[string]interface{})
+
+	add := func(name string, x interface{}) {
+		if _, ok := defs[name]; !ok {
+			names = append(names, name)
+		}
+		defs[name] = x
+	}
+	var message func(prefix string, m *ast.Message)
+	message = func(prefix string, m *ast.Message) {
+		name := prefix + m.Name
+		add(name, m)
+		for _, e := range m.Enums {
+			add(name+"."+e.Name, e)
+		}
+		for _, nm := range m.Messages {
+			message(name+".", nm)
+		}
+	}
+
+	for _, f := range fset.Files {
+		prefix := ""
+		if len(f.Package) > 0 {
+			prefix = strings.Join(f.Package, ".") + "."
+		}
+		for _, e := range f.Enums {
+			add(prefix+e.Name, e)
+		}
+		for _, m := range f.Messages {
+			message(prefix, m)
+		}
+	}
+	return names, defs
+}
+
+// compatible reports whether values of the resolved types x and y are
+// encoded compatibly, as the protobuf language guide describes: within each
+// group of int32, uint32, int64, uint64, bool and enums; sint32 and sint64;
+// fixed32 and sfixed32; fixed64 and sfixed64; and string and bytes. Messages
+// and enums are compatible with those of the same name.
+func compatible(x, y interface{}) bool {
+	gx, gy := group(x), group(y)
+	if gx != gy {
+		return false
+	}
+	if gx == "message" {
+		return ast.FullName(x) == ast.FullName(y)
+	}
+	return true
+}
+
+// group returns the name of the group of compatible types of typ
+func group(typ interface{}) string {
+	switch typ := typ.(type) {
+	case *ast.Message:
+		return "message"
+	case *ast.Enum:
+		return "varint"
+	case ast.FieldType:
+		switch typ {
+		case ast.Int32, ast.Uint32, ast.Int64, ast.Uint64, ast.Bool:
+			return "varint"
+		case ast.Sint32, ast.Sint64:
+			return "zigzag"
+		case ast.Fixed32, ast.Sfixed32:
+			return "fixed32"
+		case ast.Fixed64, ast.Sfixed64:
+			return "fixed64"
+		case ast.String, ast.Bytes:
+			return "bytes"
+		}
+		return typ.String()
+	}
+	return ""
+}
+
+// lengthDelimited reports whether the values of the resolved type typ are
+// length-delimited, so that a singular field can read each element of a
+// repeated field as its last value
+func lengthDelimited(typ interface{}) bool {
+	switch group(typ) {
+	case "message", "bytes":
+		return true
+	}
+	return false
+}
+
+func delimited(f *ast.Field) bool {
+	_, ok := f.Type.(*ast.Message)
+	return ok && f.ResolvedFeatures().MessageEncoding == "DELIMITED"
+}
+
+func required(f *ast.Field) bool {
+	return f.ResolvedFeatures().FieldPresence == "LEGACY_REQUIRED"
+}
+
+func label(f *ast.Field) string {
+	if f.Repeated {
+		return "repeated"
+	}
+	return "singular"
+}
+
+// fieldTypeName returns the type of f as it would be written, but with the
+// fully-qualified names of messages and enums
+func fieldTypeName(f *ast.Field) string {
+	t := strings.TrimPrefix(ast.TypeName(f.Type), ".")
+	if f.KeyTypeName != "" {
+		return fmt.Sprintf("map<%v, %v>", f.KeyType, t)
+	}
+	return t
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package diagram generates class diagrams of the messages, enums and
+// services of a resolved set of proto files, in the Mermaid, PlantUML or DOT
+// (Graphviz) languages.
+//
+// Each message, enum and service is a class, whose members are its fields,
+// values or methods. A message is composed of the messages that are the types
+// of its fields, including the values of map fields and the fields of oneofs,
+// and depends on the enums that are the types of its fields; a service
+// depends on the requests and responses of its methods.
+package diagram // import "myitcv.io/g/protobuf/diagram"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// Format is the language of a diagram
+type Format int
+
+const (
+	Mermaid Format = iota
+	PlantUML
+	DOT
+)
+
+// Formats maps the name of each format to it
+var Formats = map[string]Format{
+	"mermaid":  Mermaid,
+	"plantuml": PlantUML,
+	"dot":      DOT,
+}
+
+// A Generator generates diagrams. The zero Generator generates a Mermaid
+// diagram of every message, enum and service of a FileSet.
+type Generator struct {
+	Format Format
+
+	// Roots, if not empty, limits a diagram to the messages, enums and
+	// services with these full names, e.g. foo.Bar, and the messages and
+	// enums they refer to, transitively.
+	Roots []string
+
+	// Packages, if not empty, limits a diagram to the definitions of these
+	// packages, and those nested within them; e.g. foo includes foo.bar.
+	Packages []string
+}
+
+// Generate writes a diagram of the messages, enums and services defined in
+// the files of fset, and of the messages and enums they refer to, to w. fset
+// must have been resolved, for example by parser.ParseFiles.
+func (g *Generator) Generate(w io.Writer, fset *ast.FileSet) error {
+	d, err := g.diagram(fset)
+	if err != nil {
+		return err
+	}
+
+	var r renderer
+	switch g.Format {
+	case Mermaid:
+		r = mermaid{}
+	case PlantUML:
+		r = plantUML{}
+	case DOT:
+		r = dot{}
+	default:
+		return fmt.Errorf("unknown format %v", g.Format)
+	}
+
+	var buf bytes.Buffer
+	r.render(&buf, d)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// kind is the kind of a class
+type kind int
+
+const (
+	message kind = iota
+	enum
+	service
+)
+
+// class is a message, enum or service
+type class struct {
+	kind    kind
+	name    string // the full name
+	members []member
+}
+
+// member is a field, enum value or method of a class
+type member struct {
+	name  string
+	typ   string // the type of a field, e.g. string[] or map<string, Foo>
+	oneof string // the oneof of a field, if any
+
+	in, out string // the request and response of a method
+}
+
+// edgeKind is the kind of a relationship between classes
+type edgeKind int
+
+const (
+	composition edgeKind = iota // a message field
+	uses                        // an enum field
+	request                     // the request of a method
+	response                    // the response of a method
+)
+
+// edge is a relationship between classes
+type edge struct {
+	kind     edgeKind
+	from, to string // full names
+	label    string
+	many     bool // the field is repeated or a map
+}
+
+// diagram is the diagram of a set of classes
+type diagram struct {
+	classes []*class
+	edges   []edge
+}
+
+// diagram returns the diagram of the definitions within fset selected by g
+func (g *Generator) diagram(fset *ast.FileSet) (*diagram, error) {
+	defs := make(map[string]interface{})
+	var all []interface{}
+	var add func(x interface{})
+	add = func(x interface{}) {
+		defs[ast.FullName(x)] = x
+		all = append(all, x)
+		if m, ok := x.(*ast.Message); ok {
+			for _, nm := range m.Messages {
+				add(nm)
+			}
+			for _, e := range m.Enums {
+				add(e)
+			}
+		}
+	}
+	for _, f := range fset.Files {
+		for _, m := range f.Messages {
+			add(m)
+		}
+		for _, e := range f.Enums {
+			add(e)
+		}
+		for _, s := range f.Services {
+			add(s)
+		}
+	}
+
+	start := all
+	if len(g.Roots) > 0 {
+		start = nil
+		for _, r := range g.Roots {
+			x, ok := defs[strings.TrimPrefix(r, ".")]
+			if !ok {
+				return nil, fmt.Errorf("unknown root type %v", r)
+			}
+			start = append(start, x)
+		}
+	}
+
+	// the classes are those reachable from start, breadth first
+	seen := make(map[interface{}]bool)
+	var order []interface{}
+	visit := func(x interface{}) {
+		switch x.(type) {
+		case *ast.Message, *ast.Enum, *ast.Service:
+			if !seen[x] {
+				seen[x] = true
+				order = append(order, x)
+			}
+		}
+	}
+	for _, x := range start {
+		visit(x)
+	}
+	for i := 0; i < len(order); i++ {
+		switch x := order[i].(type) {
+		case *ast.Message:
+			for _, f := range x.Fields {
+				visit(f.Type)
+			}
+		case *ast.Service:
+			for _, m := range x.Methods {
+				visit(m.InType)
+				visit(m.OutType)
+			}
+		}
+	}
+
+	d := new(diagram)
+	included := make(map[string]bool)
+	for _, x := range order {
+		if g.inPackages(x) {
+			included[ast.FullName(x)] = true
+		}
+	}
+	for _, x := range order {
+		name := ast.FullName(x)
+		if !included[name] {
+			continue
+		}
+		c := &class{name: name}
+		switch x := x.(type) {
+		case *ast.Message:
+			c.kind = message
+			for _, f := range x.Fields {
+				mb := member{
+					name: f.Name,
+					typ:  fieldType(f),
+				}
+				if f.Oneof != nil {
+					mb.oneof = f.Oneof.Name
+				}
+				c.members = append(c.members, mb)
+
+				to := ast.FullName(f.Type)
+				if !included[to] {
+					continue
+				}
+				e := edge{
+					from:  name,
+					to:    to,
+					label: f.Name,
+					many:  f.Repeated || f.KeyTypeName != "",
+				}
+				if f.Oneof != nil {
+					e.label += fmt.Sprintf(" (oneof %v)", f.Oneof.Name)
+				}
+				if _, ok := f.Type.(*ast.Enum); ok {
+					e.kind = uses
+				}
+				d.edges = append(d.edges, e)
+			}
+		case *ast.Enum:
+			c.kind = enum
+			for _, v := range x.Values {
+				c.members = append(c.members, member{name: v.Name})
+			}
+		case *ast.Service:
+			c.kind = service
+			for _, m := range x.Methods {
+				c.members = append(c.members, member{
+					name: m.Name,
+					in:   m.InTypeName,
+					out:  m.OutTypeName,
+				})
+				if in := ast.FullName(m.InType); included[in] {
+					d.edges = append(d.edges, edge{kind: request, from: name, to: in, label: m.Name})
+				}
+				if out := ast.FullName(m.OutType); included[out] {
+					d.edges = append(d.edges, edge{kind: response, from: name, to: out, label: m.Name})
+				}
+			}
+		}
+		d.classes = append(d.classes, c)
+	}
+	return d, nil
+}
+
+// inPackages reports whether the definition x is in one of the packages of
+// g, or g has none
+func (g *Generator) inPackages(x interface{}) bool {
+	if len(g.Packages) == 0 {
+		return true
+	}
+	pkg := packageOf(x)
+	for _, p := range g.Packages {
+		if pkg == p || strings.HasPrefix(pkg, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldType returns the type of f as shown in a diagram: its type name as
+// written, with [] appended if it is repeated, or map<K, V> if it is a map.
+func fieldType(f *ast.Field) string {
+	switch {
+	case f.KeyTypeName != "":
+		return fmt.Sprintf("map<%v, %v>", f.KeyTypeName, f.TypeName)
+	case f.Repeated:
+		return f.TypeName + "[]"
+	}
+	return f.TypeName
+}
+
+// packageOf returns the package of the file defining x, which must be an
+// *ast.Message, *ast.Enum or *ast.Service
+func packageOf(x interface{}) string {
+	var f *ast.File
+	switch x := x.(type) {
+	case *ast.Message:
+		f = x.File()
+	case *ast.Enum:
+		f = x.File()
+	case *ast.Service:
+		f = x.File()
+	}
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.Package, ".")
+}
+
+// id returns an identifier for the class called name, valid in all the
+// formats
+func id(name string) string {
+	return strings.Replace(name, ".", "_", -1)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package diagram
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// renderer writes a diagram in some format
+type renderer interface {
+	render(b *bytes.Buffer, d *diagram)
+}
+
+// mermaid renders a Mermaid classDiagram
+type mermaid struct{}
+
+func (mermaid) render(b *bytes.Buffer, d *diagram) {
+	// Mermaid writes generic types with tildes, and reserves braces
+	generic := strings.NewReplacer("<", "~", ">", "~", "{", "", "}", "")
+
+	b.WriteString("classDiagram\n")
+	for _, c := range d.classes {
+		fmt.Fprintf(b, "  class %v[\"%v\"] {\n", id(c.name), c.name)
+		switch c.kind {
+		case enum:
+			b.WriteString("    <<enumeration>>\n")
+		case service:
+			b.WriteString("    <<service>>\n")
+		}
+		for _, m := range c.members {
+			switch c.kind {
+			case message:
+				fmt.Fprintf(b, "    +%v %v", generic.Replace(m.typ), m.name)
+				if m.oneof != "" {
+					fmt.Fprintf(b, " «oneof %v»", m.oneof)
+				}
+				b.WriteString("\n")
+			case enum:
+				fmt.Fprintf(b, "    %v\n", m.name)
+			case service:
+				fmt.Fprintf(b, "    +%v(%v) %v\n", m.name, m.in, m.out)
+			}
+		}
+		b.WriteString("  }\n")
+	}
+	for _, e := range d.edges {
+		switch e.kind {
+		case composition:
+			card := ""
+			if e.many {
+				card = ` "*"`
+			}
+			fmt.Fprintf(b, "  %v *--%v %v : %v\n", id(e.from), card, id(e.to), e.label)
+		default:
+			fmt.Fprintf(b, "  %v ..> %v : %v\n", id(e.from), id(e.to), edgeLabel(e))
+		}
+	}
+}
+
+// plantUML renders a PlantUML class diagram
+type plantUML struct{}
+
+func (plantUML) render(b *bytes.Buffer, d *diagram) {
+	b.WriteString("@startuml\n")
+	for _, c := range d.classes {
+		switch c.kind {
+		case message:
+			fmt.Fprintf(b, "class \"%v\" as %v {\n", c.name, id(c.name))
+		case enum:
+			fmt.Fprintf(b, "enum \"%v\" as %v {\n", c.name, id(c.name))
+		case service:
+			fmt.Fprintf(b, "interface \"%v\" as %v <<service>> {\n", c.name, id(c.name))
+		}
+		for _, m := range c.members {
+			switch c.kind {
+			case message:
+				fmt.Fprintf(b, "  +%v : %v", m.name, m.typ)
+				if m.oneof != "" {
+					fmt.Fprintf(b, " {oneof %v}", m.oneof)
+				}
+				b.WriteString("\n")
+			case enum:
+				fmt.Fprintf(b, "  %v\n", m.name)
+			case service:
+				fmt.Fprintf(b, "  +%v(%v) : %v\n", m.name, m.in, m.out)
+			}
+		}
+		b.WriteString("}\n")
+	}
+	for _, e := range d.edges {
+		switch e.kind {
+		case composition:
+			card := ""
+			if e.many {
+				card = ` "*"`
+			}
+			fmt.Fprintf(b, "%v *--%v %v : %v\n", id(e.from), card, id(e.to), e.label)
+		default:
+			fmt.Fprintf(b, "%v ..> %v : %v\n", id(e.from), id(e.to), edgeLabel(e))
+		}
+	}
+	b.WriteString("@enduml\n")
+}
+
+// dot renders a Graphviz digraph of record-shaped nodes
+type dot struct{}
+
+func (dot) render(b *bytes.Buffer, d *diagram) {
+	// the characters with special meaning in a record label
+	record := strings.NewReplacer(
+		`\`, `\\`, `"`, `\"`, "{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`,
+	)
+
+	b.WriteString("digraph protos {\n")
+	b.WriteString("  node [shape=record];\n")
+	for _, c := range d.classes {
+		var lines []string
+		for _, m := range c.members {
+			switch c.kind {
+			case message:
+				l := fmt.Sprintf("%v: %v", m.name, m.typ)
+				if m.oneof != "" {
+					l += fmt.Sprintf(" (oneof %v)", m.oneof)
+				}
+				lines = append(lines, l)
+			case enum:
+				lines = append(lines, m.name)
+			case service:
+				lines = append(lines, fmt.Sprintf("%v(%v): %v", m.name, m.in, m.out))
+			}
+		}
+		title := record.Replace(c.name)
+		switch c.kind {
+		case enum:
+			title = `«enumeration»\n` + title
+		case service:
+			title = `«service»\n` + title
+		}
+		body := ""
+		for _, l := range lines {
+			body += record.Replace(l) + `\l`
+		}
+		fmt.Fprintf(b, "  %v [label=\"{%v|%v}\"];\n", id(c.name), title, body)
+	}
+	for _, e := range d.edges {
+		switch e.kind {
+		case composition:
+			label := e.label
+			if e.many {
+				label += " *"
+			}
+			fmt.Fprintf(b, "  %v -> %v [label=\"%v\", arrowtail=diamond, dir=both];\n", id(e.from), id(e.to), label)
+		default:
+			fmt.Fprintf(b, "  %v -> %v [label=\"%v\", style=dashed];\n", id(e.from), id(e.to), edgeLabel(e))
+		}
+	}
+	b.WriteString("}\n")
+}
+
+// edgeLabel returns the label of a dependency edge e
+func edgeLabel(e edge) string {
+	switch e.kind {
+	case request:
+		return e.label + " request"
+	case response:
+		return e.label + " response"
+	}
+	return e.label
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package doc generates reference documentation, in Markdown or HTML, from a
+// resolved set of proto files.
+package doc // import "myitcv.io/g/protobuf/doc"
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// A Generator writes reference documentation for the files of a FileSet. The
+// FileSet must have been resolved, for example by parser.ParseFiles.
+//
+// Messages, enums and services are grouped by package. References to
+// messages and enums defined in the FileSet are cross-linked; references to
+// types defined elsewhere (for example in an import that is not itself part
+// of the FileSet) are written as plain names.
+type Generator struct {
+	Output io.Writer
+
+	// Title is the title of the generated document. If empty, DefaultTitle
+	// is used.
+	Title string
+}
+
+// DefaultTitle is the title used when Generator.Title is empty.
+const DefaultTitle = "Protocol Documentation"
+
+// Markdown writes the documentation for the files of fset to g.Output as
+// Markdown.
+func (g *Generator) Markdown(fset *ast.FileSet) error {
+	return markdownTmpl.Execute(g.Output, g.build(fset))
+}
+
+// HTML writes the documentation for the files of fset to g.Output as a
+// standalone HTML page.
+func (g *Generator) HTML(fset *ast.FileSet) error {
+	return htmlTmpl.Execute(g.Output, g.build(fset))
+}
+
+// document is the model from which both the Markdown and HTML output are
+// generated
+type document struct {
+	Title    string
+	Packages []*docPackage
+}
+
+type docPackage struct {
+	Name     string // empty if the files declare no package
+	Files    []string
+	Services []*docService
+	Messages []*docMessage
+	Enums    []*docEnum
+}
+
+type docService struct {
+	Name    string
+	Anchor  string
+	Comment string
+	Methods []*docMethod
+}
+
+type docMethod struct {
+	Name     string
+	Comment  string
+	Request  docType
+	Response docType
+}
+
+type docMessage struct {
+	Name    string // fully qualified
+	Anchor  string
+	Comment string
+	Fields  []*docField
+}
+
+type docField struct {
+	Name    string
+	Label   string
+	KeyType string // set for map fields, in which case Type is the value type
+	Type    docType
+	Tag     int
+	Comment string
+}
+
+type docEnum struct {
+	Name    string // fully qualified
+	Anchor  string
+	Comment string
+	Values  []*docValue
+}
+
+type docValue struct {
+	Name    string
+	Number  int32
+	Comment string
+}
+
+// docType is a reference to a type. Anchor is empty if the type is not
+// documented, i.e. it is a scalar type or is defined outside the FileSet.
+type docType struct {
+	Name   string
+	Anchor string
+}
+
+// builder holds the state used when building a document
+type builder struct {
+	// anchors holds the anchor of every message and enum being documented
+	anchors map[interface{}]string
+}
+
+func (g *Generator) build(fset *ast.FileSet) *document {
+	doc := &document{
+		Title: g.Title,
+	}
+	if doc.Title == "" {
+		doc.Title = DefaultTitle
+	}
+
+	b := &builder{
+		anchors: make(map[interface{}]string),
+	}
+
+	var addMsgs func(msgs []*ast.Message)
+	addMsgs = func(msgs []*ast.Message) {
+		for _, m := range msgs {
+			b.anchors[m] = ast.FullName(m)
+			addMsgs(m.Messages)
+			for _, e := range m.Enums {
+				b.anchors[e] = ast.FullName(e)
+			}
+		}
+	}
+	for _, f := range fset.Files {
+		addMsgs(f.Messages)
+		for _, e := range f.Enums {
+			b.anchors[e] = ast.FullName(e)
+		}
+	}
+
+	pkgs := make(map[string]*docPackage)
+
+	for _, f := range fset.Files {
+		name := strings.Join(f.Package, ".")
+
+		p, ok := pkgs[name]
+		if !ok {
+			p = &docPackage{Name: name}
+			pkgs[name] = p
+			doc.Packages = append(doc.Packages, p)
+		}
+
+		p.Files = append(p.Files, f.Name)
+
+		for _, s := range f.Services {
+			p.Services = append(p.Services, b.service(s))
+		}
+
+		var addMsgs func(msgs []*ast.Message)
+		addMsgs = func(msgs []*ast.Message) {
+			for _, m := range msgs {
+				p.Messages = append(p.Messages, b.message(m))
+				for _, e := range m.Enums {
+					p.Enums = append(p.Enums, b.enum(e))
+				}
+				addMsgs(m.Messages)
+			}
+		}
+		addMsgs(f.Messages)
+
+		for _, e := range f.Enums {
+			p.Enums = append(p.Enums, b.enum(e))
+		}
+	}
+
+	sort.Sort(packageSort(doc.Packages))
+
+	return doc
+}
+
+func (b *builder) service(s *ast.Service) *docService {
+	res := &docService{
+		Name:    s.Name,
+		Anchor:  serviceAnchor(s),
+		Comment: Comment(s, nil),
+	}
+
+	var prev ast.Node
+	for _, m := range s.Methods {
+		res.Methods = append(res.Methods, &docMethod{
+			Name:     m.Name,
+			Comment:  Comment(m, prev),
+			Request:  b.typeRef(m.InTypeName, m.InType),
+			Response: b.typeRef(m.OutTypeName, m.OutType),
+		})
+		prev = m
+	}
+
+	return res
+}
+
+func (b *builder) message(m *ast.Message) *docMessage {
+	res := &docMessage{
+		Name:    ast.FullName(m),
+		Anchor:  b.anchors[m],
+		Comment: Comment(m, nil),
+	}
+
+	var prev ast.Node
+	for _, f := range m.Fields {
+		df := &docField{
+			Name:    f.Name,
+			Label:   label(f),
+			Type:    b.typeRef(f.TypeName, f.Type),
+			Tag:     f.Tag,
+			Comment: Comment(f, prev),
+		}
+		if f.KeyTypeName != "" {
+			df.KeyType = f.KeyType.String()
+		}
+		res.Fields = append(res.Fields, df)
+		prev = f
+	}
+
+	return res
+}
+
+func (b *builder) enum(e *ast.Enum) *docEnum {
+	res := &docEnum{
+		Name:    ast.FullName(e),
+		Anchor:  b.anchors[e],
+		Comment: Comment(e, nil),
+	}
+
+	var prev ast.Node
+	for _, v := range e.Values {
+		res.Values = append(res.Values, &docValue{
+			Name:    v.Name,
+			Number:  v.Number,
+			Comment: Comment(v, prev),
+		})
+		prev = v
+	}
+
+	return res
+}
+
+// typeRef returns a reference to the resolved type typ, which was written as
+// name
+func (b *builder) typeRef(name string, typ interface{}) docType {
+	switch typ := typ.(type) {
+	case ast.FieldType:
+		return docType{Name: typ.String()}
+	case *ast.Message, *ast.Enum:
+		return docType{Name: ast.FullName(typ), Anchor: b.anchors[typ]}
+	}
+	return docType{Name: strings.TrimPrefix(name, ".")}
+}
+
+func label(f *ast.Field) string {
+	switch {
+	case f.Oneof != nil:
+		return "oneof " + f.Oneof.Name
+	case f.KeyTypeName != "":
+		return ""
+	case f.Repeated:
+		return "repeated"
+	}
+	switch f.ResolvedFeatures().FieldPresence {
+	case "LEGACY_REQUIRED":
+		return "required"
+	case "EXPLICIT":
+		return "optional"
+	}
+	return ""
+}
+
+// Comment returns the text of the leading comment of n or, failing that,
+// its inline comment. prev is the node defined immediately before n, if any,
+// so that the inline comment of prev is not mistaken for the leading comment
+// of n.
+func Comment(n, prev ast.Node) string {
+	c := ast.LeadingComment(n)
+	if c != nil && prev != nil && c == ast.InlineComment(prev) {
+		c = nil
+	}
+	if c == nil {
+		c = ast.InlineComment(n)
+	}
+	if c == nil {
+		return ""
+	}
+
+	var lines []string
+	for _, l := range c.Text {
+		lines = append(lines, strings.Split(l, "\n")...)
+	}
+
+	// a /* */ comment is held as a single line of text. Its lines after the
+	// first may each be decorated with a leading "*", as may the first if
+	// the comment opened with "/**"; if they all are, strip the decoration,
+	// and a space after it, as gofmt does. A one-line comment is taken to be
+	// a /** */ comment if it starts with "*".
+	block := len(c.Text) == 1 && (c.Start.Line != c.End.Line || strings.HasPrefix(lines[0], "*"))
+	if block {
+		decorated := true
+		for _, l := range lines[1:] {
+			if t := strings.TrimSpace(l); t != "" && !strings.HasPrefix(t, "*") {
+				decorated = false
+			}
+		}
+		for i, l := range lines {
+			t := strings.TrimLeft(l, " \t")
+			if (decorated || i == 0) && strings.HasPrefix(t, "*") {
+				t = t[1:]
+				if strings.HasPrefix(t, " ") {
+					t = t[1:]
+				}
+				lines[i] = t
+			}
+		}
+		lines[0] = strings.TrimSpace(lines[0])
+	}
+
+	// the parser only strips the whitespace prefix common to all lines,
+	// which an empty line defeats; strip the prefix common to the non-empty
+	// lines instead. The first line of a /* */ comment follows the "/*", and
+	// so has no prefix.
+	rest := lines
+	if block {
+		rest = lines[1:]
+	}
+	prefix := ""
+	first := true
+	for _, l := range rest {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		ws := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if first {
+			prefix, first = ws, false
+		}
+		for !strings.HasPrefix(ws, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, l := range rest {
+		rest[i] = strings.TrimPrefix(l, prefix)
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func serviceAnchor(s *ast.Service) string {
+	return strings.Join(append(append([]string{}, s.Up.Package...), s.Name), ".")
+}
+
+type packageSort []*docPackage
+
+func (p packageSort) Len() int           { return len(p) }
+func (p packageSort) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p packageSort) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package doc
+
+import (
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+)
+
+// mdCell escapes s for use within a Markdown table cell
+func mdCell(s string) string {
+	s = strings.Replace(s, "|", `\|`, -1)
+	s = strings.Replace(s, "\n\n", "<br><br>", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+func mdType(t docType) string {
+	if t.Anchor == "" {
+		return t.Name
+	}
+	return "[" + t.Name + "](#" + t.Anchor + ")"
+}
+
+func pkgName(name string) string {
+	if name == "" {
+		return "(no package)"
+	}
+	return name
+}
+
+var markdownTmpl = template.Must(template.New("markdown").Funcs(template.FuncMap{
+	"cell":    mdCell,
+	"type":    mdType,
+	"pkgName": pkgName,
+}).Parse(`# {{.Title}}
+
+## Table of Contents
+{{range .Packages}}
+- [{{pkgName .Name}}](#package-{{.Name}})
+{{- range .Services}}
+  - [{{.Name}}](#{{.Anchor}})
+{{- end}}
+{{- range .Messages}}
+  - [{{.Name}}](#{{.Anchor}})
+{{- end}}
+{{- range .Enums}}
+  - [{{.Name}}](#{{.Anchor}})
+{{- end}}
+{{- end}}
+{{range .Packages}}
+<a name="package-{{.Name}}"></a>
+## Package {{pkgName .Name}}
+
+Files: {{range $i, $f := .Files}}{{if $i}}, {{end}}` + "`{{$f}}`" + `{{end}}
+{{range .Services}}
+<a name="{{.Anchor}}"></a>
+### Service {{.Name}}
+{{with .Comment}}
+{{.}}
+{{end}}
+| Method | Request | Response | Description |
+| ------ | ------- | -------- | ----------- |
+{{range .Methods -}}
+| {{.Name}} | {{type .Request}} | {{type .Response}} | {{cell .Comment}} |
+{{end}}
+{{- end}}
+{{- range .Messages}}
+<a name="{{.Anchor}}"></a>
+### Message {{.Name}}
+{{with .Comment}}
+{{.}}
+{{end}}
+{{- if .Fields}}
+| Field | Type | Label | Tag | Description |
+| ----- | ---- | ----- | --- | ----------- |
+{{range .Fields -}}
+| {{.Name}} | {{if .KeyType}}map&lt;{{.KeyType}}, {{type .Type}}&gt;{{else}}{{type .Type}}{{end}} | {{.Label}} | {{.Tag}} | {{cell .Comment}} |
+{{end}}
+{{- end}}
+{{- end}}
+{{- range .Enums}}
+<a name="{{.Anchor}}"></a>
+### Enum {{.Name}}
+{{with .Comment}}
+{{.}}
+{{end}}
+| Name | Number | Description |
+| ---- | ------ | ----------- |
+{{range .Values -}}
+| {{.Name}} | {{.Number}} | {{cell .Comment}} |
+{{end}}
+{{- end}}
+{{- end}}`))
+
+func htmlType(t docType) htmltemplate.HTML {
+	name := htmltemplate.HTMLEscapeString(t.Name)
+	if t.Anchor == "" {
+		return htmltemplate.HTML(name)
+	}
+	return htmltemplate.HTML(`<a href="#` + htmltemplate.HTMLEscapeString(t.Anchor) + `">` + name + `</a>`)
+}
+
+var htmlTmpl = htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+	"type":    htmlType,
+	"pkgName": pkgName,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+code, td.type { font-family: monospace; }
+.comment { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+
+<h2>Table of Contents</h2>
+<ul>
+{{- range .Packages}}
+<li><a href="#package-{{.Name}}">{{pkgName .Name}}</a>
+<ul>
+{{- range .Services}}
+<li><a href="#{{.Anchor}}">{{.Name}}</a></li>
+{{- end}}
+{{- range .Messages}}
+<li><a href="#{{.Anchor}}">{{.Name}}</a></li>
+{{- end}}
+{{- range .Enums}}
+<li><a href="#{{.Anchor}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</li>
+{{- end}}
+</ul>
+{{range .Packages}}
+<h2 id="package-{{.Name}}">Package {{pkgName .Name}}</h2>
+<p>Files: {{range $i, $f := .Files}}{{if $i}}, {{end}}<code>{{$f}}</code>{{end}}</p>
+{{range .Services}}
+<h3 id="{{.Anchor}}">Service {{.Name}}</h3>
+{{- with .Comment}}
+<p class="comment">{{.}}</p>
+{{- end}}
+<table>
+<tr><th>Method</th><th>Request</th><th>Response</th><th>Description</th></tr>
+{{- range .Methods}}
+<tr><td>{{.Name}}</td><td class="type">{{type .Request}}</td><td class="type">{{type .Response}}</td><td class="comment">{{.Comment}}</td></tr>
+{{- end}}
+</table>
+{{end}}
+{{- range .Messages}}
+<h3 id="{{.Anchor}}">Message {{.Name}}</h3>
+{{- with .Comment}}
+<p class="comment">{{.}}</p>
+{{- end}}
+{{- if .Fields}}
+<table>
+<tr><th>Field</th><th>Type</th><th>Label</th><th>Tag</th><th>Description</th></tr>
+{{- range .Fields}}
+<tr><td>{{.Name}}</td><td class="type">{{if .KeyType}}map&lt;{{.KeyType}}, {{type .Type}}&gt;{{else}}{{type .Type}}{{end}}</td><td>{{.Label}}</td><td>{{.Tag}}</td><td class="comment">{{.Comment}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{end}}
+{{- range .Enums}}
+<h3 id="{{.Anchor}}">Enum {{.Name}}</h3>
+{{- with .Comment}}
+<p class="comment">{{.}}</p>
+{{- end}}
+<table>
+<tr><th>Name</th><th>Number</th><th>Description</th></tr>
+{{- range .Values}}
+<tr><td>{{.Name}}</td><td>{{.Number}}</td><td class="comment">{{.Comment}}</td></tr>
+{{- end}}
+</table>
+{{end}}
+{{- end}}
+</body>
+</html>
+`))
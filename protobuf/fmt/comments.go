@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package fmt
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// The comments of a file are printed in order, each before the first thing
+// printed whose position follows it, or, if it is the only comment on the
+// line of what was just printed, at the end of that line.
+
+// endOfFile is a position that follows every other
+var endOfFile = ast.Position{Line: math.MaxInt32, Offset: math.MaxInt32}
+
+// commentsBefore prints, on lines of their own, the comments yet to be
+// printed that precede pos, a position of the source. A blank line follows a
+// comment if another comment follows it, so that the two are not read as
+// one, or if the author left one between it and pos. Nothing is printed if
+// pos is unknown.
+func (f *Formatter) commentsBefore(pos ast.Position) {
+	if !pos.IsValid() {
+		return
+	}
+	for len(f.comments) > 0 && before(f.comments[0].Start, pos) {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+
+		// the comment separates any run of fields that precedes it
+		f.flushFields()
+
+		for _, l := range commentLines(c) {
+			f.println(l)
+		}
+		if len(f.comments) > 0 && before(f.comments[0].Start, pos) || pos != endOfFile && c.End.Line < pos.Line-1 {
+			f.println()
+		}
+	}
+}
+
+// trailingComment returns, and removes from those yet to be printed, the
+// comment that follows pos on its line, if it is the only comment on that
+// line and is to be printed at its end.
+func (f *Formatter) trailingComment(pos ast.Position) *ast.Comment {
+	if !pos.IsValid() || len(f.comments) == 0 {
+		return nil
+	}
+	c := f.comments[0]
+	if c.Start.Line != pos.Line || c.End.Line != pos.Line || !before(pos, c.Start) {
+		return nil
+	}
+	if len(c.Text) != 1 || strings.Contains(c.Text[0], "\n") {
+		return nil
+	}
+	if len(f.comments) > 1 && f.comments[1].Start.Line == pos.Line {
+		return nil
+	}
+	f.comments = f.comments[1:]
+	return c
+}
+
+// endLine ends the current line, with the comment that follows pos on its
+// line, if there is one
+func (f *Formatter) endLine(pos ast.Position) {
+	if c := f.trailingComment(pos); c != nil {
+		f.noIndentPrintf(" %v", commentLines(c)[0])
+	}
+	f.noIndentPrintf("\n")
+}
+
+// commentLines returns the lines of c as they are printed. Each line of its
+// text follows "// ", unless that would change the text as the parser reads
+// it, in which case the text is printed as written; text that spans lines
+// must be printed in a /* */ comment.
+func commentLines(c *ast.Comment) []string {
+	for _, sep := range []string{" ", ""} {
+		var lines, read []string
+		for _, t := range c.Text {
+			if strings.Contains(t, "\n") {
+				lines = append(lines, "/*"+sep+t+sep+"*/")
+				read = append(read, sep+t+sep)
+			} else {
+				lines = append(lines, "//"+sep+t)
+				read = append(read, sep+t)
+			}
+		}
+		if sep == "" || reflect.DeepEqual(commentText(read), c.Text) {
+			return lines
+		}
+	}
+	panic("unreachable")
+}
+
+// commentText returns the text of a comment whose lines, less their "//",
+// or each the contents of a /* */ comment, are lines, as the parser does:
+// the whitespace at the end of each line, and that common to the start of
+// every line, is removed
+func commentText(lines []string) []string {
+	res := append([]string(nil), lines...)
+	var prefix string
+	for i, line := range res {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		res[i] = line
+		trim := len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
+		if i == 0 {
+			prefix = line[:trim]
+		} else {
+			for !strings.HasPrefix(line, prefix) {
+				prefix = prefix[:len(prefix)-1]
+			}
+		}
+		if prefix == "" {
+			break
+		}
+	}
+	if prefix != "" {
+		for i, line := range res {
+			res[i] = strings.TrimPrefix(line, prefix)
+		}
+	}
+	return res
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package fmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ConfigFileName is the name of the file from which a Config is read.
+	// See FindConfig
+	ConfigFileName = ".protofmtconfig.json"
+
+	// DefaultIndent is used when Config.Indent is empty
+	DefaultIndent = "\t"
+)
+
+// Config controls the layout choices made by a Formatter. The zero value
+// gives the default layout.
+type Config struct {
+	// Indent is the string used for each level of indentation. If empty,
+	// DefaultIndent is used.
+	Indent string
+
+	// AlignFields aligns the names, "=" and tags of consecutive fields in a
+	// message. A blank line or any other definition ends a run of fields.
+	AlignFields bool
+
+	// KeepBlankLines preserves (at most) one blank line where the author
+	// had one or more between definitions.
+	KeepBlankLines bool
+
+	// SortImports sorts imports by path.
+	SortImports bool
+
+	// GroupImports separates imports into blank-line-separated groups:
+	// well-known "google/protobuf/" imports, then other imports, then
+	// public imports.
+	GroupImports bool
+}
+
+// FindConfig looks for ConfigFileName in dir and then in each of its parent
+// directories in turn. The Config decoded from the first file found is
+// returned along with the path of that file. If no such file exists the zero
+// Config and an empty path are returned.
+func FindConfig(dir string) (Config, string, error) {
+	var res Config
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return res, "", err
+	}
+
+	for {
+		fp := filepath.Join(dir, ConfigFileName)
+
+		fi, err := os.Open(fp)
+		if err == nil {
+			dec := json.NewDecoder(fi)
+			err = dec.Decode(&res)
+			fi.Close()
+
+			if err != nil {
+				return res, "", fmt.Errorf("unable to decode config from %v: %v", fp, err)
+			}
+
+			return res, fp, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return res, "", err
+		}
+
+		p := filepath.Dir(dir)
+
+		if p == dir {
+			return res, "", nil
+		}
+
+		dir = p
+	}
+}
@@ -4,23 +4,37 @@
 package fmt
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"myitcv.io/g/protobuf/ast"
 )
 
-// TODO
-//
-// We lose spacing (or no spacing) between fields in a message; it should be at most 1 space
-// not an enforced 1 space;
+// maxTag is the largest field number, written "max" in a range
+const maxTag = 1<<29 - 1
 
 func (f *Formatter) FmtFile(file *ast.File) {
-	f.fmtSyntax(file.Syntax)
-	f.fmtPackage(file.Package)
-	f.fmtOptions(file.Options)
-	f.fmtImports(file.Imports)
+	f.comments = append([]*ast.Comment(nil), file.Comments...)
+	defer func() { f.comments = nil }()
+
+	var top block
+	if f.src != "" {
+		top = scanFile(f.src)
+	}
+
+	f.fmtSyntax(file, top)
+	f.fmtPackage(file.Package, top)
+	f.fmtOptions(append(file.Features.Options(), file.Options...), top)
+	f.fmtImports(file, top)
+
+	for i, n := range fileNodes(file) {
+		if i > 0 && f.blankBefore(n.Pos()) {
+			f.println()
+		}
+		f.commentsBefore(n.Pos())
 
-	for _, n := range file.Nodes() {
 		switch n := n.(type) {
 		case *ast.Message:
 			f.fmtMessage(n)
@@ -28,26 +42,97 @@ func (f *Formatter) FmtFile(file *ast.File) {
 			f.fmtEnum(n)
 		case *ast.Service:
 			f.fmtService(n)
+		case *ast.Extension:
+			f.fmtExtension(n)
 		}
 	}
+
+	f.commentsBefore(endOfFile)
 }
 
-func (f *Formatter) fmtSyntax(syntax string) {
-	f.printf("syntax = \"%v\";\n", syntax)
-	f.println()
+// fileNodes returns the definitions of file, extend blocks included, in the
+// order they appear in its source
+func fileNodes(file *ast.File) []ast.Node {
+	nodes := file.Nodes()
+	for _, e := range file.Extensions {
+		nodes = append(nodes, e)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return before(nodes[i].Pos(), nodes[j].Pos()) })
+	return nodes
 }
 
-func (f *Formatter) fmtPackage(pkg []string) {
-	f.printf("package %v;\n", strings.Join(pkg, "."))
+// blankBefore reports whether the author left a blank line immediately
+// before pos (or before the comments that precede it, if there are any yet
+// to be printed). It always returns false unless Config.KeepBlankLines is set
+// and the source is known.
+func (f *Formatter) blankBefore(pos ast.Position) bool {
+	if !f.Config.KeepBlankLines || f.src == "" || !pos.IsValid() {
+		return false
+	}
 
-	if len(pkg) > 0 {
-		f.println()
+	off := pos.Offset
+	if len(f.comments) > 0 && before(f.comments[0].Start, pos) {
+		off = f.comments[0].Start.Offset
+	}
+	if off > len(f.src) {
+		return false
+	}
+
+	// i is the end of the previous line, j the end of the line before that
+	i := strings.LastIndex(f.src[:off], "\n")
+	if i == -1 {
+		return false
 	}
+	j := strings.LastIndex(f.src[:i], "\n")
+
+	return strings.TrimSpace(f.src[j+1:i]) == ""
+}
+
+// position returns the position of the first statement of b whose first
+// word is one of words, or the zero Position if there is none
+func (b block) position(words ...string) ast.Position {
+	for _, st := range b.stmts {
+		for _, w := range words {
+			if st.word == w {
+				return st.pos
+			}
+		}
+	}
+	return ast.Position{}
 }
 
-func (f *Formatter) fmtOptions(options [][2]string) {
+func (f *Formatter) fmtSyntax(file *ast.File, top block) {
+	pos := top.position("syntax", "edition")
+	f.commentsBefore(pos)
+
+	switch file.Syntax {
+	case "":
+		return
+	case "editions":
+		f.printf("edition = \"%v\";", file.Edition)
+	default:
+		f.printf("syntax = \"%v\";", file.Syntax)
+	}
+	f.endLine(pos)
+	f.println()
+}
+
+func (f *Formatter) fmtPackage(pkg []string, top block) {
+	if len(pkg) == 0 {
+		return
+	}
+
+	pos := top.position("package")
+	f.commentsBefore(pos)
+	f.printf("package %v;", strings.Join(pkg, "."))
+	f.endLine(pos)
+	f.println()
+}
+
+func (f *Formatter) fmtOptions(options [][2]string, top block) {
+	positions := top.optionPositions()
 	for _, o := range options {
-		f.printf("option %v = %v;\n", o[0], o[1])
+		f.fmtOption(o[0], o[1], takePosition(positions, o[0]))
 	}
 
 	if len(options) > 0 {
@@ -55,123 +140,593 @@ func (f *Formatter) fmtOptions(options [][2]string) {
 	}
 }
 
-func (f *Formatter) fmtImports(imports []string) {
-	for _, i := range imports {
-		f.printf("import \"%v\";\n", i)
+// fmtOption prints the option statement that sets name to value, and the
+// comments that belong with it, pos being its position in the source
+func (f *Formatter) fmtOption(name, value string, pos ast.Position) {
+	f.commentsBefore(pos)
+	f.printf("option %v = %v;", name, value)
+	f.endLine(pos)
+}
+
+type importDecl struct {
+	path   string
+	public bool
+	pos    ast.Position
+}
+
+type importSort []importDecl
+
+func (a importSort) Len() int           { return len(a) }
+func (a importSort) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a importSort) Less(i, j int) bool { return a[i].path < a[j].path }
+
+const wellKnownImportPrefix = "google/protobuf/"
+
+func (f *Formatter) fmtImports(file *ast.File, top block) {
+	if len(file.Imports) == 0 {
+		return
 	}
 
-	if len(imports) > 0 {
-		f.println()
+	public := make(map[int]bool)
+	for _, i := range file.PublicImports {
+		public[i] = true
+	}
+
+	// the import statements of the source are those of file.Imports, in
+	// the same order
+	stmts := top.find("import")
+
+	var imports []importDecl
+	for i, path := range file.Imports {
+		d := importDecl{path: path, public: public[i]}
+		if len(stmts) == len(file.Imports) {
+			d.pos = stmts[i].pos
+		}
+		imports = append(imports, d)
 	}
+
+	var groups [][]importDecl
+
+	if f.Config.GroupImports {
+		var wellKnown, other, pub []importDecl
+
+		for _, i := range imports {
+			switch {
+			case i.public:
+				pub = append(pub, i)
+			case strings.HasPrefix(i.path, wellKnownImportPrefix):
+				wellKnown = append(wellKnown, i)
+			default:
+				other = append(other, i)
+			}
+		}
+
+		for _, g := range [][]importDecl{wellKnown, other, pub} {
+			if len(g) > 0 {
+				groups = append(groups, g)
+			}
+		}
+	} else {
+		groups = [][]importDecl{imports}
+	}
+
+	for i, g := range groups {
+		if f.Config.SortImports {
+			sort.Stable(importSort(g))
+		}
+
+		if i > 0 {
+			f.println()
+		}
+
+		for _, imp := range g {
+			f.commentsBefore(imp.pos)
+			if imp.public {
+				f.printf("import public \"%v\";", imp.path)
+			} else {
+				f.printf("import \"%v\";", imp.path)
+			}
+			f.endLine(imp.pos)
+		}
+	}
+
+	f.println()
 }
 
 func (f *Formatter) fmtService(svc *ast.Service) {
-	f.printf("service %v {\n", svc.Name)
+	body, _ := scanBody(f.src, svc.Position)
+
+	f.printf("service %v {", svc.Name)
+	f.endLine(svc.Position)
 	f.indent++
 
-	for _, m := range svc.Methods {
+	for i, m := range svc.Methods {
+		if i > 0 && f.blankBefore(m.Position) {
+			f.println()
+		}
+		f.commentsBefore(m.Position)
 		f.fmtMethod(m)
 	}
 
+	f.endBlock(body)
+}
+
+// endBlock prints the comments that remain at the end of body, a block
+// whose contents have been printed, and the "}" that ends it
+func (f *Formatter) endBlock(body block) {
+	f.flushFields()
+	f.commentsBefore(body.end)
 	f.indent--
-	f.println("}")
+	f.printf("}")
+	f.endLine(body.end)
 }
 
 func (f *Formatter) fmtMethod(meth *ast.Method) {
 	f.printf("rpc %v (%v) returns (%v)", meth.Name, meth.InTypeName, meth.OutTypeName)
 	if len(meth.Options) > 0 {
-		f.noIndentPrintf(" {\n")
+		body, _ := scanBody(f.src, meth.Position)
+		stmts := body.find("option")
+
+		f.noIndentPrintf(" {")
+		f.endLine(meth.Position)
 		f.indent++
 
-		for _, o := range meth.Options {
-			f.printf("option (%v) = %v;\n", o[0], o[1])
+		for i, o := range meth.Options {
+			var pos ast.Position
+			if len(stmts) == len(meth.Options) {
+				pos = stmts[i].pos
+			}
+			f.fmtOption("("+o[0]+")", o[1], pos)
 		}
 
-		f.indent--
-		f.println("}")
+		f.endBlock(body)
 	} else {
-		f.noIndentPrintf(";\n")
+		f.noIndentPrintf(";")
+		f.endLine(meth.Position)
+	}
+}
+
+// An item is something printed in the body of a message: a node, or a
+// reserved or extensions statement, which the AST does not hold as nodes.
+type item struct {
+	pos     ast.Position // the position of the item in the source, if known
+	sortPos ast.Position // the position by which items are ordered
+
+	node      ast.Node
+	reserved  []ast.Reserved
+	ranges    [][2]int
+	rangeOpts *ast.ExtensionRangeOptions
+}
+
+// messageItems returns the items of message, whose body in the source is
+// body, in the order they appear there. Reserved statements whose positions
+// are unknown come first, and extensions statements last.
+func messageItems(message *ast.Message, body block) []item {
+	items := reservedItems(message.ReservedFields, body.find("reserved"))
+
+	for _, n := range message.Nodes() {
+		if m, ok := n.(*ast.Message); ok && m.Group {
+			// printed with its field
+			continue
+		}
+		items = append(items, item{pos: n.Pos(), sortPos: n.Pos(), node: n})
+	}
+	for _, e := range message.Extensions {
+		items = append(items, item{pos: e.Position, sortPos: e.Position, node: e})
+	}
+
+	// the ranges of an extensions statement share their options
+	for i := 0; i < len(message.ExtensionRanges); {
+		opts := message.RangeOptions(i)
+		j := i + 1
+		for j < len(message.ExtensionRanges) && message.RangeOptions(j) == opts {
+			j++
+		}
+		it := item{sortPos: endOfFile, ranges: message.ExtensionRanges[i:j], rangeOpts: opts}
+		if opts != nil && opts.Position.IsValid() {
+			it.pos, it.sortPos = opts.Position, opts.Position
+		}
+		items = append(items, it)
+		i = j
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return before(items[i].sortPos, items[j].sortPos) })
+
+	return items
+}
+
+// reservedItems returns the reserved statements that declare rs: those of
+// stmts, the reserved statements of the source, if they account for rs, or
+// else one for each run of numbers or of names.
+func reservedItems(rs []ast.Reserved, stmts []stmt) []item {
+	var items []item
+
+	// the names of a reserved statement are identifiers, and so each comma
+	// separates two of its entries
+	n := 0
+	for _, st := range stmts {
+		n += strings.Count(st.text, ",") + 1
 	}
+	if n == len(rs) {
+		for _, st := range stmts {
+			k := strings.Count(st.text, ",") + 1
+			items = append(items, item{pos: st.pos, sortPos: st.pos, reserved: rs[:k]})
+			rs = rs[k:]
+		}
+		return items
+	}
+
+	for len(rs) > 0 {
+		k := 1
+		for k < len(rs) && (rs[k].Name == "") == (rs[0].Name == "") {
+			k++
+		}
+		items = append(items, item{reserved: rs[:k]})
+		rs = rs[k:]
+	}
+	return items
 }
 
 func (f *Formatter) fmtMessage(message *ast.Message) {
-	f.printf("message %v {\n", message.Name)
+	f.printf("message %v {", message.Name)
+	f.fmtMessageBody(message)
+}
+
+// fmtMessageBody prints the body of message, whose "{" has just been
+// printed, and the "}" that ends it
+func (f *Formatter) fmtMessageBody(message *ast.Message) {
+	body, _ := scanBody(f.src, message.Position)
+
+	f.endLine(message.Position)
 	f.indent++
 
-	for _, o := range message.Options {
-		f.printf("option (%v) = %v;\n", o[0], o[1])
+	// a nested message (e.g. a group) may appear within a oneof of its
+	// parent; that oneof is none of this message's business
+	outerOneOf, outerOneOfEnd := f.oneOf, f.oneOfEnd
+	f.oneOf = nil
+	defer func() { f.oneOf, f.oneOfEnd = outerOneOf, outerOneOfEnd }()
 
+	positions := body.optionPositions()
+	features := message.Features.Options()
+	for _, o := range features {
+		f.fmtOption(o[0], o[1], takePosition(positions, o[0]))
+	}
+	for _, o := range message.Options {
+		name := "(" + o[0] + ")"
+		f.fmtOption(name, o[1], takePosition(positions, name))
 	}
 
-	for _, n := range message.Nodes() {
-		switch n := n.(type) {
+	// first is true while nothing has yet been printed in the current block,
+	// in which case a blank line is never kept
+	first := len(features) == 0 && len(message.Options) == 0
+
+	opened := make(map[*ast.Oneof]bool)
+
+	for _, it := range messageItems(message, body) {
+		if o, ok := it.node.(*ast.Oneof); ok && opened[o] {
+			continue
+		}
+
+		field, isField := it.node.(*ast.Field)
+		var oneof *ast.Oneof
+		var group *ast.Message
+		if isField {
+			oneof = field.Oneof
+			group = groupOf(message, field)
+		}
+
+		// the oneof is closed first, so that the comments at its end are
+		// not taken to precede the item
+		if f.oneOf != nil && oneof != f.oneOf {
+			f.closeOneof()
+		}
+
+		blank := !first && f.blankBefore(it.pos)
+		first = false
+
+		// a run of aligned fields is broken by anything other than another
+		// field in the same oneof on the following line
+		if len(f.fields) > 0 && (blank || !isField || group != nil || oneof != f.fields[0].Oneof) {
+			f.flushFields()
+		}
+
+		if blank {
+			f.println()
+		}
+
+		if oneof != nil && oneof != f.oneOf {
+			// the positions of the fields of the oneof are unknown, and so
+			// it is opened by the first of them
+			f.openOneof(oneof)
+			opened[oneof] = true
+		}
+
+		f.commentsBefore(it.pos)
+
+		switch n := it.node.(type) {
 		case *ast.Message:
 			f.fmtMessage(n)
 		case *ast.Enum:
 			f.fmtEnum(n)
+		case *ast.Extension:
+			f.fmtExtension(n)
+		case *ast.Oneof:
+			f.openOneof(n)
+			opened[n] = true
+			first = true
 		case *ast.Field:
-			f.fmtField(n)
+			if group != nil {
+				f.printf("%vgroup %v = %v {", fieldLabel(n), group.Name, n.Tag)
+				f.fmtMessageBody(group)
+			} else {
+				f.addField(n)
+			}
+		default:
+			if it.reserved != nil {
+				f.fmtReserved(it.reserved, it.pos)
+			} else {
+				f.fmtExtensionRanges(it.ranges, it.rangeOpts, it.pos)
+			}
 		}
 	}
 
-	// TODO: hack; if a one-of field was the last field in a message
-	// we need to close out the one-of group
+	f.flushFields()
+
+	// if a one-of field was the last field in a message we need to close
+	// out the one-of group
 	if f.oneOf != nil {
-		f.oneOf = nil
-		f.println("}")
+		f.closeOneof()
 	}
 
-	f.indent--
-	f.println("}")
+	f.endBlock(body)
 }
 
-func (f *Formatter) fmtEnum(enum *ast.Enum) {
-	f.printf("enum %v {\n", enum.Name)
+// groupOf returns the group whose field in message is field, or nil if field
+// is not that of a group
+func groupOf(message *ast.Message, field *ast.Field) *ast.Message {
+	if m, ok := field.Type.(*ast.Message); ok {
+		if m.Group {
+			return m
+		}
+		return nil
+	}
+	for _, m := range message.Messages {
+		if m.Group && m.Name == field.TypeName {
+			return m
+		}
+	}
+	return nil
+}
+
+func (f *Formatter) openOneof(oneof *ast.Oneof) {
+	body, _ := scanBody(f.src, oneof.Position)
+
+	f.commentsBefore(oneof.Position)
+	f.printf("oneof %v {", oneof.Name)
+	f.endLine(oneof.Position)
 	f.indent++
+	f.oneOf, f.oneOfEnd = oneof, body.end
+}
 
-	for _, v := range enum.Values {
-		f.printf("%v = %v;\n", v.Name, v.Number)
+func (f *Formatter) closeOneof() {
+	f.endBlock(block{end: f.oneOfEnd})
+	f.oneOf, f.oneOfEnd = nil, ast.Position{}
+}
+
+func (f *Formatter) fmtReserved(rs []ast.Reserved, pos ast.Position) {
+	var entries []string
+	for _, r := range rs {
+		switch {
+		case r.Name != "":
+			entries = append(entries, strconv.Quote(r.Name))
+		case r.Start == r.End:
+			entries = append(entries, strconv.Itoa(r.Start))
+		default:
+			entries = append(entries, rangeString(r.Start, r.End))
+		}
 	}
+	f.printf("reserved %v;", strings.Join(entries, ", "))
+	f.endLine(pos)
+}
 
-	f.indent--
-	f.println("}")
+func (f *Formatter) fmtExtensionRanges(ranges [][2]int, opts *ast.ExtensionRangeOptions, pos ast.Position) {
+	var entries []string
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			entries = append(entries, strconv.Itoa(r[0]))
+		} else {
+			entries = append(entries, rangeString(r[0], r[1]))
+		}
+	}
+	f.printf("extensions %v", strings.Join(entries, ", "))
+
+	if !opts.IsEmpty() {
+		var options []string
+		for _, d := range opts.Declarations {
+			options = append(options, "declaration="+declarationString(d))
+		}
+		if opts.Verification != "" {
+			options = append(options, "verification="+opts.Verification)
+		}
+		for _, o := range opts.Options {
+			options = append(options, "("+o[0]+")="+o[1])
+		}
+		f.noIndentPrintf(" [%v]", strings.Join(options, ", "))
+	}
+
+	f.noIndentPrintf(";")
+	f.endLine(pos)
 }
 
-func (f *Formatter) fmtField(field *ast.Field) {
-	if field.Oneof != nil && f.oneOf == nil {
-		f.oneOf = field.Oneof
-		f.printf("oneof %v {\n", field.Oneof.Name)
-	} else if field.Oneof == nil && f.oneOf != nil {
-		f.oneOf = nil
-		f.println("}")
+// rangeString returns the range of numbers from start to end as it is
+// written in a reserved or extensions statement
+func rangeString(start, end int) string {
+	if end == maxTag {
+		return fmt.Sprintf("%v to max", start)
 	}
+	return fmt.Sprintf("%v to %v", start, end)
+}
 
-	if field.Oneof != nil {
-		f.indent++
+// declarationString returns d in the protocol buffers text format, as it is
+// written as the value of a declaration option
+func declarationString(d ast.ExtensionDeclaration) string {
+	fields := []string{fmt.Sprintf("number: %v", d.Number)}
+	if d.FullName != "" {
+		fields = append(fields, "full_name: "+strconv.Quote(d.FullName))
+	}
+	if d.Type != "" {
+		fields = append(fields, "type: "+strconv.Quote(d.Type))
+	}
+	if d.Reserved {
+		fields = append(fields, "reserved: true")
+	}
+	if d.Repeated {
+		fields = append(fields, "repeated: true")
 	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
 
-	if field.KeyTypeName != "" {
-		f.printf("map<%v, %v> %v = %v", field.KeyTypeName, field.TypeName, field.Name, field.Tag)
-	} else if field.Repeated {
-		f.printf("repeated %v %v = %v", field.TypeName, field.Name, field.Tag)
-	} else {
-		f.printf("%v %v = %v", field.TypeName, field.Name, field.Tag)
+func (f *Formatter) fmtExtension(ext *ast.Extension) {
+	body, _ := scanBody(f.src, ext.Position)
+
+	f.printf("extend %v {", ext.Extendee)
+	f.endLine(ext.Position)
+	f.indent++
+
+	for i, field := range ext.Fields {
+		if i > 0 && f.blankBefore(field.Position) {
+			f.flushFields()
+			f.println()
+		}
+		f.commentsBefore(field.Position)
+		f.addField(field)
+	}
+
+	f.endBlock(body)
+}
+
+func (f *Formatter) fmtEnum(enum *ast.Enum) {
+	body, _ := scanBody(f.src, enum.Position)
+
+	f.printf("enum %v {", enum.Name)
+	f.endLine(enum.Position)
+	f.indent++
+
+	positions := body.optionPositions()
+	for _, o := range enum.Features.Options() {
+		f.fmtOption(o[0], o[1], takePosition(positions, o[0]))
+	}
+	for _, o := range enum.Options {
+		name := "(" + o[0] + ")"
+		f.fmtOption(name, o[1], takePosition(positions, name))
+	}
+
+	for i, v := range enum.Values {
+		if i > 0 && f.blankBefore(v.Position) {
+			f.println()
+		}
+		f.commentsBefore(v.Position)
+		f.printf("%v = %v;", v.Name, v.Number)
+		f.endLine(v.Position)
+	}
+
+	f.endBlock(body)
+}
+
+// addField adds field to the current run of fields, with the comment at the
+// end of its line
+func (f *Formatter) addField(field *ast.Field) {
+	f.fields = append(f.fields, field)
+	f.fieldComments = append(f.fieldComments, f.trailingComment(field.Position))
+}
+
+// flushFields prints the current run of fields, aligning them, and the
+// comments at the end of their lines, if Config.AlignFields is set
+func (f *Formatter) flushFields() {
+	var typeWidth, nameWidth, lineWidth int
+
+	if f.Config.AlignFields {
+		for _, field := range f.fields {
+			if w := len(fieldType(field)); w > typeWidth {
+				typeWidth = w
+			}
+			if w := len(field.Name); w > nameWidth {
+				nameWidth = w
+			}
+		}
 	}
 
-	if len(field.Options) > 0 {
-		f.noIndentPrintf(" [")
-		for i, o := range field.Options {
-			if i > 0 {
-				f.noIndentPrintf(", ")
+	var lines []string
+	for _, field := range f.fields {
+		line := fmt.Sprintf("%-*v %-*v = %v", typeWidth, fieldType(field), nameWidth, field.Name, field.Tag)
+
+		opts := append(fieldOptions(field), field.Features.Options()...)
+		for _, o := range field.Options {
+			opts = append(opts, [2]string{"(" + o[0] + ")", o[1]})
+		}
+		if len(opts) > 0 {
+			var s []string
+			for _, o := range opts {
+				s = append(s, o[0]+"="+o[1])
 			}
-			f.noIndentPrintf("(%v)=%v", o[0], o[1])
+			line += " [" + strings.Join(s, ", ") + "]"
 		}
-		f.noIndentPrintf("];\n")
-	} else {
-		f.noIndentPrintf(";\n")
+		line += ";"
+
+		lines = append(lines, line)
+		if f.Config.AlignFields && len(line) > lineWidth {
+			lineWidth = len(line)
+		}
+	}
+
+	for i, line := range lines {
+		if c := f.fieldComments[i]; c != nil {
+			f.printf("%-*v %v\n", lineWidth, line, commentLines(c)[0])
+		} else {
+			f.printf("%v\n", line)
+		}
+	}
+
+	f.fields = nil
+	f.fieldComments = nil
+}
+
+// fieldOptions returns the default, packed and deprecated options of field,
+// which the parser records apart from its other options
+func fieldOptions(field *ast.Field) [][2]string {
+	var res [][2]string
+	if field.HasDefault {
+		res = append(res, [2]string{"default", field.Default})
+	}
+	if field.HasPacked {
+		res = append(res, [2]string{"packed", fmt.Sprint(field.Packed)})
 	}
+	if field.HasDeprecated {
+		res = append(res, [2]string{"deprecated", fmt.Sprint(field.Deprecated)})
+	}
+	return res
+}
+
+// fieldType returns the label and type of field as they should be printed
+// before the field's name
+func fieldType(field *ast.Field) string {
+	if field.KeyTypeName != "" {
+		return fmt.Sprintf("map<%v, %v>", field.KeyTypeName, field.TypeName)
+	}
+	return fieldLabel(field) + field.TypeName
+}
 
-	if field.Oneof != nil {
-		f.indent--
+// fieldLabel returns the label of field, followed by a space, or "" if it
+// has none
+func fieldLabel(field *ast.Field) string {
+	switch {
+	case field.Repeated:
+		return "repeated "
+	case field.Required:
+		return "required "
+	case field.Optional:
+		return "optional "
+	default:
+		return ""
 	}
 }
@@ -6,6 +6,8 @@ package fmt // import "myitcv.io/g/protobuf/fmt"
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
 
 	"myitcv.io/g/protobuf/ast"
@@ -14,42 +16,151 @@ import (
 
 type Formatter struct {
 	Output io.Writer
+	Config Config
 
 	// TODO this is a bit gross - we can only be in one oneOf at any
 	// point in time... seems hacky to store the state here (for indenting)
-	indent int
-	oneOf  *ast.Oneof
+	indent   int
+	oneOf    *ast.Oneof
+	oneOfEnd ast.Position // the position of the "}" that ends oneOf, if known
+
+	// src is the source of the file being formatted, if known; it is used to
+	// find the blank lines the author left between definitions
+	src string
+
+	// comments is the comments of the file being formatted that are yet to
+	// be printed, in order
+	comments []*ast.Comment
+
+	// fields is the current run of fields, buffered so that they can be
+	// aligned, and fieldComments the comment at the end of the line of each
+	fields        []*ast.Field
+	fieldComments []*ast.Comment
 }
 
+// Fmt writes the formatted result of each of files to f.Output, as FmtFiles
+// does, and panics if there is an error.
+//
+// Deprecated: formatting is purely syntactic, and so importPaths is ignored;
+// use FmtFiles instead.
 func (f *Formatter) Fmt(files []string, importPaths []string) {
-
-	fs, err := parser.ParseFiles(files, importPaths)
-	if err != nil {
+	if err := f.FmtFiles(files); err != nil {
 		panic(err)
 	}
+}
 
-	var fmtFiles []*ast.File
+// FmtFiles parses each of files and writes its formatted result to f.Output.
+// Formatting is purely syntactic: imports are not loaded, and so no import
+// paths are required. The first error encountered is returned.
+func (f *Formatter) FmtFiles(files []string) error {
+	for _, fn := range files {
+		src, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
 
-	for _, astFile := range fs.Files {
-		for _, file := range files {
-			if file == astFile.Name {
-				fmtFiles = append(fmtFiles, astFile)
-			}
+		if err := f.FmtSource(fn, src); err != nil {
+			return err
 		}
 	}
 
-	for _, file := range fmtFiles {
-		f.FmtFile(file)
+	return nil
+}
+
+// FmtSource parses src, the contents of the file filename, and writes the
+// formatted result to f.Output. Unlike FmtFile, FmtSource has access to the
+// source and so can honour f.Config.KeepBlankLines.
+func (f *Formatter) FmtSource(filename string, src []byte) error {
+	file, err := parser.ParseFile(filename, src)
+	if err != nil {
+		return err
+	}
+
+	f.src = string(src)
+	defer func() { f.src = "" }()
+
+	f.FmtFile(file)
+
+	return nil
+}
+
+// CheckRoundTrip returns an error unless res, the formatted result of src,
+// the contents of the file filename, parses to the same AST, positions and
+// the order of imports aside. It guards against a formatter that loses part of
+// a file: a file should not be replaced by its formatted result unless
+// CheckRoundTrip succeeds.
+func CheckRoundTrip(filename string, src, res []byte) error {
+	a, err := parser.ParseFile(filename, src)
+	if err != nil {
+		return err
+	}
+	b, err := parser.ParseFile(filename, res)
+	if err != nil {
+		return fmt.Errorf("%v: the formatted result does not parse: %v", filename, err)
+	}
+
+	for _, f := range []*ast.File{a, b} {
+		sortImports(f)
+	}
+
+	d := ast.Diff(&ast.FileSet{Files: []*ast.File{a}}, &ast.FileSet{Files: []*ast.File{b}}, ast.IgnorePositions)
+	if len(d) > 0 {
+		return fmt.Errorf("%v: cannot be formatted without loss: %v", filename, strings.TrimPrefix(d[0], filename+": "))
+	}
+
+	return nil
+}
+
+// CheckFile is CheckRoundTrip for a file held only as an AST, e.g. one that
+// a tool has changed: it returns an error unless res, the formatted result of
+// file, parses to the same AST as file, positions, the order of imports and
+// what resolving fills in aside.
+func CheckFile(file *ast.File, res []byte) error {
+	a := (&ast.FileSet{Files: []*ast.File{file}}).Clone().Files[0]
+	b, err := parser.ParseFile(file.Name, res)
+	if err != nil {
+		return fmt.Errorf("%v: the formatted result does not parse: %v", file.Name, err)
+	}
+
+	for _, f := range []*ast.File{a, b} {
+		sortImports(f)
 	}
+
+	d := ast.Diff(&ast.FileSet{Files: []*ast.File{a}}, &ast.FileSet{Files: []*ast.File{b}}, ast.IgnorePositions|ast.IgnoreResolved)
+	if len(d) > 0 {
+		return fmt.Errorf("%v: cannot be formatted without loss: %v", file.Name, strings.TrimPrefix(d[0], file.Name+": "))
+	}
+
+	return nil
+}
+
+// sortImports sorts the imports of f, marking those that are public by name
+// rather than by index
+func sortImports(f *ast.File) {
+	for _, i := range f.PublicImports {
+		f.Imports[i] = "public " + f.Imports[i]
+	}
+	f.PublicImports = nil
+	sort.Strings(f.Imports)
+}
+
+func (f *Formatter) indentation() string {
+	i := f.Config.Indent
+	if i == "" {
+		i = DefaultIndent
+	}
+	return strings.Repeat(i, f.indent)
 }
 
 func (f *Formatter) println(a ...interface{}) {
-	fmt.Fprintf(f.Output, strings.Repeat("\t", f.indent))
+	if len(a) > 0 {
+		fmt.Fprint(f.Output, f.indentation())
+	}
 	fmt.Fprintln(f.Output, a...)
 }
 
 func (f *Formatter) printf(format string, a ...interface{}) {
-	fmt.Fprintf(f.Output, strings.Repeat("\t", f.indent)+format, a...)
+	fmt.Fprintf(f.Output, f.indentation()+format, a...)
 }
 
 func (f *Formatter) noIndentPrintf(format string, a ...interface{}) {
@@ -0,0 +1,246 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package fmt
+
+import (
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// The AST does not record the position of every statement: not those of
+// the syntax, package, import and option statements, of reserved
+// statements, or of the "}" that ends a block. Where the source of a file is
+// known, they are found by scanning it, so that the comments about them stay
+// with them.
+
+// A stmt is a statement of a block found by scanning its source.
+type stmt struct {
+	pos  ast.Position
+	word string // the first word of the statement, e.g. "option"
+	text string // the source of the statement, including its first word
+}
+
+// A block is the statements of a block, and the position of the "}" that
+// ends it; that of a file ends at the end of the source.
+type block struct {
+	stmts []stmt
+	end   ast.Position
+}
+
+// scanner scans the source of a file a byte at a time, skipping the
+// contents of strings and comments.
+type scanner struct {
+	src  string
+	off  int
+	line int
+}
+
+func (s *scanner) pos() ast.Position {
+	return ast.Position{Line: s.line, Offset: s.off}
+}
+
+func (s *scanner) done() bool { return s.off >= len(s.src) }
+
+// skip skips whitespace and comments
+func (s *scanner) skip() {
+	for !s.done() {
+		switch {
+		case s.src[s.off] == '\n':
+			s.line++
+			s.off++
+		case s.src[s.off] == ' ' || s.src[s.off] == '\t' || s.src[s.off] == '\r' || s.src[s.off] == '\f' || s.src[s.off] == '\v':
+			s.off++
+		case strings.HasPrefix(s.src[s.off:], "//"):
+			for !s.done() && s.src[s.off] != '\n' {
+				s.off++
+			}
+		case strings.HasPrefix(s.src[s.off:], "/*"):
+			s.advance(2)
+			for !s.done() && !strings.HasPrefix(s.src[s.off:], "*/") {
+				s.advance(1)
+			}
+			s.advance(2)
+		default:
+			return
+		}
+	}
+}
+
+// advance moves n bytes forward, counting lines
+func (s *scanner) advance(n int) {
+	for ; n > 0 && !s.done(); n-- {
+		if s.src[s.off] == '\n' {
+			s.line++
+		}
+		s.off++
+	}
+}
+
+// next moves past the token at the current offset, which must not be
+// whitespace or a comment, and returns it; a string is returned whole, and
+// any other symbol alone
+func (s *scanner) next() string {
+	start := s.off
+	switch c := s.src[s.off]; {
+	case c == '"' || c == '\'':
+		s.off++
+		for !s.done() && s.src[s.off] != c && s.src[s.off] != '\n' {
+			if s.src[s.off] == '\\' {
+				s.off++
+			}
+			s.off++
+		}
+		s.advance(1)
+	case isWordByte(c):
+		for !s.done() && isWordByte(s.src[s.off]) {
+			s.off++
+		}
+	default:
+		s.off++
+	}
+	return s.src[start:s.off]
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// scanFile returns the top-level statements of src
+func scanFile(src string) block {
+	s := &scanner{src: src, line: 1}
+	b, _ := s.block()
+	return b
+}
+
+// scanBody returns the block that follows pos in src: the body of the
+// definition at pos, or, if pos is that of a "{", the block it starts. ok is
+// false if src is unknown or pos does not lie within it.
+func scanBody(src string, pos ast.Position) (b block, ok bool) {
+	if src == "" || !pos.IsValid() || pos.Offset >= len(src) {
+		return block{}, false
+	}
+	s := &scanner{src: src, off: pos.Offset, line: pos.Line}
+	for {
+		s.skip()
+		if s.done() {
+			return block{}, false
+		}
+		switch s.next() {
+		case "{":
+			return s.block()
+		case ";", "}":
+			return block{}, false
+		}
+	}
+}
+
+// block scans the statements up to the "}" that ends the current block, and
+// moves past it; ok is false if the source ends first, in which case the end
+// of the block is the end of the source.
+func (s *scanner) block() (b block, ok bool) {
+	for {
+		s.skip()
+		if s.done() {
+			b.end = s.pos()
+			return b, false
+		}
+		if s.src[s.off] == '}' {
+			b.end = s.pos()
+			s.off++
+			return b, true
+		}
+
+		st := stmt{pos: s.pos()}
+		st.word = s.next()
+		if st.word == ";" {
+			// an empty statement
+			continue
+		}
+
+		// a statement ends at a ";", or the "}" of a block it contains,
+		// outside of any brackets
+		depth, brackets := 0, 0
+	Stmt:
+		for {
+			s.skip()
+			if s.done() {
+				break
+			}
+			switch s.next() {
+			case "[", "(", "<":
+				brackets++
+			case "]", ")", ">":
+				brackets--
+			case "{":
+				depth++
+			case "}":
+				depth--
+				if depth < 0 {
+					// the end of the enclosing block; leave it to be seen
+					s.off--
+					break Stmt
+				}
+				if depth == 0 && brackets == 0 {
+					break Stmt
+				}
+			case ";":
+				if depth == 0 && brackets == 0 {
+					break Stmt
+				}
+			}
+		}
+		st.text = s.src[st.pos.Offset:s.off]
+		b.stmts = append(b.stmts, st)
+	}
+}
+
+// find returns the statements of b whose first word is word, in order
+func (b block) find(word string) []stmt {
+	var res []stmt
+	for _, st := range b.stmts {
+		if st.word == word {
+			res = append(res, st)
+		}
+	}
+	return res
+}
+
+// optionPositions returns the position of each option statement of b, keyed
+// by the name of the option as written, e.g. "java_package" or
+// "(my.option)", spaces aside. The positions of options of the same name
+// are in order.
+func (b block) optionPositions() map[string][]ast.Position {
+	res := make(map[string][]ast.Position)
+	for _, st := range b.find("option") {
+		name := strings.TrimPrefix(st.text, "option")
+		if i := strings.Index(name, "="); i != -1 {
+			name = name[:i]
+		}
+		name = strings.Join(strings.Fields(name), "")
+		res[name] = append(res[name], st.pos)
+	}
+	return res
+}
+
+// takePosition returns the first of the positions of the option name in
+// opts, and removes it, or returns the zero Position if there is none
+func takePosition(opts map[string][]ast.Position, name string) ast.Position {
+	ps := opts[name]
+	if len(ps) == 0 {
+		return ast.Position{}
+	}
+	opts[name] = ps[1:]
+	return ps[0]
+}
+
+// before reports whether a precedes b in the source. Positions are compared
+// by line first, as those of an AST built from a descriptor have lines but
+// not offsets.
+func before(a, b ast.Position) bool {
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Offset < b.Offset
+}
@@ -0,0 +1,493 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package fromdesc builds a resolved AST from FileDescriptorProtos, such as
+// those passed to protoc plugins, so that the tools built on the AST can also
+// run as plugins. It is the inverse of gendesc, as far as descriptors record
+// the source.
+//
+// Positions in the AST are those recorded by the SourceCodeInfo of a file,
+// if any, which is also the source of the leading comments of its
+// definitions. Without SourceCodeInfo, positions are invalid and there are no
+// comments. Options other than default, packed and deprecated are not
+// recorded.
+package fromdesc // import "myitcv.io/g/protobuf/fromdesc"
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// FileSet returns the AST of fds, which must include the files imported
+// (directly or transitively) by each of its files, as in a
+// CodeGeneratorRequest. The files of the result are in the order of fds.
+func FileSet(fds []*pb.FileDescriptorProto) (*ast.FileSet, error) {
+	b := &builder{
+		types:   make(map[string]interface{}),
+		entries: make(map[string]*pb.DescriptorProto),
+	}
+
+	fset := new(ast.FileSet)
+	for _, fd := range fds {
+		fset.Files = append(fset.Files, b.declare(fd))
+	}
+	for i, fd := range fds {
+		if err := b.define(fset.Files[i], fd); err != nil {
+			return nil, fmt.Errorf("%v: %v", fd.GetName(), err)
+		}
+	}
+
+	return fset, nil
+}
+
+// builder holds the state used in building an AST
+type builder struct {
+	// types maps the fully-qualified name (with a leading dot) of each
+	// message and enum to its *ast.Message or *ast.Enum
+	types map[string]interface{}
+
+	// entries maps the fully-qualified name of each map entry message to
+	// its descriptor; map entries are not messages in the AST
+	entries map[string]*pb.DescriptorProto
+
+	// locs maps the path of each location in the SourceCodeInfo of the file
+	// being defined to the location
+	locs map[string]*pb.SourceCodeInfo_Location
+
+	// offset is the offset given to the next node, so that nodes sort in
+	// the order they are defined
+	offset int
+}
+
+// declare returns the file described by fd, with its messages and enums,
+// which it adds to b.types; their contents are added by define.
+func (b *builder) declare(fd *pb.FileDescriptorProto) *ast.File {
+	f := &ast.File{
+		Name:    fd.GetName(),
+		Syntax:  fd.GetSyntax(),
+		Imports: fd.Dependency,
+	}
+	if f.Syntax == "" {
+		f.Syntax = "proto2"
+	}
+	if fd.GetPackage() != "" {
+		f.Package = strings.Split(fd.GetPackage(), ".")
+	}
+	for _, i := range fd.PublicDependency {
+		f.PublicImports = append(f.PublicImports, int(i))
+	}
+
+	prefix := "."
+	if fd.GetPackage() != "" {
+		prefix += fd.GetPackage() + "."
+	}
+	for _, md := range fd.MessageType {
+		if m := b.declareMessage(md, prefix, f); m != nil {
+			f.Messages = append(f.Messages, m)
+		}
+	}
+	for _, ed := range fd.EnumType {
+		f.Enums = append(f.Enums, b.declareEnum(ed, prefix, f))
+	}
+	return f
+}
+
+// declareMessage returns the message described by md, whose full name is
+// prefix followed by its name, or nil if md is a map entry.
+func (b *builder) declareMessage(md *pb.DescriptorProto, prefix string, up ast.FileOrMessage) *ast.Message {
+	name := prefix + md.GetName()
+	if md.GetOptions().GetMapEntry() {
+		b.entries[name] = md
+		return nil
+	}
+
+	m := &ast.Message{
+		Name: md.GetName(),
+		Up:   up,
+	}
+	b.types[name] = m
+
+	for _, nd := range md.NestedType {
+		if nm := b.declareMessage(nd, name+".", m); nm != nil {
+			m.Messages = append(m.Messages, nm)
+		}
+	}
+	for _, ed := range md.EnumType {
+		m.Enums = append(m.Enums, b.declareEnum(ed, name+".", m))
+	}
+	return m
+}
+
+func (b *builder) declareEnum(ed *pb.EnumDescriptorProto, prefix string, up ast.FileOrMessage) *ast.Enum {
+	e := &ast.Enum{
+		Name: ed.GetName(),
+		Up:   up,
+	}
+	b.types[prefix+ed.GetName()] = e
+	return e
+}
+
+// define adds the contents of the messages and enums of fd, which have been
+// declared in f, together with its services and extensions.
+func (b *builder) define(f *ast.File, fd *pb.FileDescriptorProto) error {
+	b.locs = make(map[string]*pb.SourceCodeInfo_Location)
+	for _, loc := range fd.GetSourceCodeInfo().GetLocation() {
+		b.locs[pathKey(loc.Path)] = loc
+	}
+	if f.Syntax == "editions" {
+		e, err := edition(fd)
+		if err != nil {
+			return err
+		}
+		f.Edition = e
+	}
+
+	mi := 0
+	for i, md := range fd.MessageType {
+		if md.GetOptions().GetMapEntry() {
+			continue
+		}
+		if err := b.defineMessage(f, f.Messages[mi], md, path(4, int32(i))); err != nil {
+			return err
+		}
+		mi++
+	}
+	for i, ed := range fd.EnumType {
+		b.defineEnum(f, f.Enums[i], ed, path(5, int32(i)))
+	}
+	for i, sd := range fd.Service {
+		s := &ast.Service{
+			Name: sd.GetName(),
+			Up:   f,
+		}
+		b.position(f, s, &s.Position, path(6, int32(i)))
+		for j, md := range sd.Method {
+			m := &ast.Method{
+				Name:        md.GetName(),
+				InTypeName:  md.GetInputType(),
+				OutTypeName: md.GetOutputType(),
+				Up:          s,
+			}
+			b.position(f, m, &m.Position, path(6, int32(i), 2, int32(j)))
+			var err error
+			if m.InType, err = b.message(m.InTypeName); err != nil {
+				return err
+			}
+			if m.OutType, err = b.message(m.OutTypeName); err != nil {
+				return err
+			}
+			s.Methods = append(s.Methods, m)
+		}
+		f.Services = append(f.Services, s)
+	}
+	exts, err := b.extensions(f, f, fd.Extension, path(7))
+	if err != nil {
+		return err
+	}
+	f.Extensions = exts
+
+	sort.Sort(commentSort(f.Comments))
+
+	return nil
+}
+
+func (b *builder) defineMessage(f *ast.File, m *ast.Message, md *pb.DescriptorProto, p []int32) error {
+	b.position(f, m, &m.Position, p)
+
+	for _, od := range md.OneofDecl {
+		m.Oneofs = append(m.Oneofs, &ast.Oneof{
+			Name: od.GetName(),
+			Up:   m,
+		})
+	}
+	// the synthetic oneofs of proto3 optional fields are not in the AST
+	synthetic := make(map[int32]bool)
+	for _, fd := range md.Field {
+		opt, err := proto3Optional(fd)
+		if err != nil {
+			return err
+		}
+		if opt {
+			synthetic[fd.GetOneofIndex()] = true
+		}
+	}
+
+	for i, fd := range md.Field {
+		field, err := b.field(f, m, fd, append(p, 2, int32(i)))
+		if err != nil {
+			return err
+		}
+		if fd.OneofIndex != nil && !synthetic[fd.GetOneofIndex()] {
+			if int(fd.GetOneofIndex()) >= len(m.Oneofs) {
+				return fmt.Errorf("field %v has a bad oneof index %v", fd.GetName(), fd.GetOneofIndex())
+			}
+			field.Oneof = m.Oneofs[fd.GetOneofIndex()]
+			field.Optional = false
+		}
+		m.Fields = append(m.Fields, field)
+	}
+	var oneofs []*ast.Oneof
+	for i, o := range m.Oneofs {
+		if !synthetic[int32(i)] {
+			oneofs = append(oneofs, o)
+		}
+	}
+	m.Oneofs = oneofs
+
+	mi := 0
+	for i, nd := range md.NestedType {
+		if nd.GetOptions().GetMapEntry() {
+			continue
+		}
+		if err := b.defineMessage(f, m.Messages[mi], nd, append(p, 3, int32(i))); err != nil {
+			return err
+		}
+		mi++
+	}
+	for i, ed := range md.EnumType {
+		b.defineEnum(f, m.Enums[i], ed, append(p, 4, int32(i)))
+	}
+	exts, err := b.extensions(f, m, md.Extension, append(p, 6))
+	if err != nil {
+		return err
+	}
+	m.Extensions = exts
+
+	for _, r := range md.ExtensionRange {
+		m.ExtensionRanges = append(m.ExtensionRanges, [2]int{int(r.GetStart()), int(r.GetEnd()) - 1})
+	}
+	for _, r := range md.ReservedRange {
+		m.ReservedFields = append(m.ReservedFields, ast.Reserved{
+			Start: int(r.GetStart()),
+			End:   int(r.GetEnd()) - 1,
+		})
+	}
+	for _, n := range md.ReservedName {
+		m.ReservedFields = append(m.ReservedFields, ast.Reserved{Name: n})
+	}
+
+	return nil
+}
+
+func (b *builder) defineEnum(f *ast.File, e *ast.Enum, ed *pb.EnumDescriptorProto, p []int32) {
+	b.position(f, e, &e.Position, p)
+	for i, vd := range ed.Value {
+		v := &ast.EnumValue{
+			Name:   vd.GetName(),
+			Number: vd.GetNumber(),
+			Up:     e,
+		}
+		b.position(f, v, &v.Position, append(p, 2, int32(i)))
+		e.Values = append(e.Values, v)
+	}
+}
+
+// extensions returns the extend blocks of the extension fields fds, which
+// are defined in up; consecutive fields with the same extendee are grouped
+// in a block.
+func (b *builder) extensions(f *ast.File, up ast.FileOrMessage, fds []*pb.FieldDescriptorProto, p []int32) ([]*ast.Extension, error) {
+	var res []*ast.Extension
+	var ext *ast.Extension
+	for i, fd := range fds {
+		if ext == nil || ext.Extendee != fd.GetExtendee() {
+			ext = &ast.Extension{
+				Extendee: fd.GetExtendee(),
+				Up:       up,
+			}
+			typ, err := b.message(ext.Extendee)
+			if err != nil {
+				return nil, err
+			}
+			ext.ExtendeeType = typ
+			res = append(res, ext)
+		}
+		field, err := b.field(f, ext, fd, append(p, int32(i)))
+		if err != nil {
+			return nil, err
+		}
+		if ext.Position == (ast.Position{}) {
+			ext.Position = field.Position
+		}
+		ext.Fields = append(ext.Fields, field)
+	}
+	return res, nil
+}
+
+// field returns the field described by fd, which is defined in up
+func (b *builder) field(f *ast.File, up ast.MessageOrExtension, fd *pb.FieldDescriptorProto, p []int32) (*ast.Field, error) {
+	field := &ast.Field{
+		Name: fd.GetName(),
+		Tag:  int(fd.GetNumber()),
+		Up:   up,
+	}
+	b.position(f, field, &field.Position, p)
+
+	switch fd.GetLabel() {
+	case pb.FieldDescriptorProto_LABEL_REQUIRED:
+		field.Required = true
+	case pb.FieldDescriptorProto_LABEL_REPEATED:
+		field.Repeated = true
+	case pb.FieldDescriptorProto_LABEL_OPTIONAL:
+		// an explicit label is required in proto2, and gives explicit
+		// presence in proto3
+		opt, err := proto3Optional(fd)
+		if err != nil {
+			return nil, err
+		}
+		field.Optional = f.Syntax == "proto2" || opt
+	}
+
+	switch fd.GetType() {
+	case pb.FieldDescriptorProto_TYPE_MESSAGE, pb.FieldDescriptorProto_TYPE_GROUP, pb.FieldDescriptorProto_TYPE_ENUM:
+		field.TypeName = fd.GetTypeName()
+		if entry, ok := b.entries[field.TypeName]; ok {
+			if err := b.mapField(field, entry); err != nil {
+				return nil, err
+			}
+			break
+		}
+		typ, ok := b.types[field.TypeName]
+		if !ok {
+			return nil, fmt.Errorf("field %v has unknown type %v", fd.GetName(), field.TypeName)
+		}
+		field.Type = typ
+		if m, ok := typ.(*ast.Message); ok && fd.GetType() == pb.FieldDescriptorProto_TYPE_GROUP {
+			// the field of a group is named after it in the AST
+			m.Group = true
+			field.Name = m.Name
+			field.TypeName = m.Name
+		}
+	default:
+		typ, ok := fieldTypes[fd.GetType()]
+		if !ok {
+			return nil, fmt.Errorf("field %v has unknown type %v", fd.GetName(), fd.GetType())
+		}
+		field.TypeName = typ.String()
+		field.Type = typ
+	}
+
+	if fd.DefaultValue != nil {
+		field.HasDefault = true
+		field.DefaultValue = fd.GetDefaultValue()
+		field.Default = field.DefaultValue
+		if field.Type == ast.String || field.Type == ast.Bytes {
+			field.Default = strconv.Quote(field.DefaultValue)
+		}
+	}
+	if o := fd.GetOptions(); o != nil {
+		if o.Packed != nil {
+			field.HasPacked = true
+			field.Packed = o.GetPacked()
+		}
+		if o.Deprecated != nil {
+			field.HasDeprecated = true
+			field.Deprecated = o.GetDeprecated()
+		}
+	}
+
+	return field, nil
+}
+
+// mapField makes field, whose type is the map entry message entry, a map
+func (b *builder) mapField(field *ast.Field, entry *pb.DescriptorProto) error {
+	if len(entry.Field) != 2 {
+		return fmt.Errorf("map entry %v does not have two fields", entry.GetName())
+	}
+	key, value := entry.Field[0], entry.Field[1]
+
+	kt, ok := fieldTypes[key.GetType()]
+	if !ok {
+		return fmt.Errorf("map entry %v has a bad key type %v", entry.GetName(), key.GetType())
+	}
+	field.KeyTypeName = kt.String()
+	field.KeyType = kt
+	field.Repeated = false
+
+	if vt, ok := fieldTypes[value.GetType()]; ok {
+		field.TypeName = vt.String()
+		field.Type = vt
+		return nil
+	}
+	typ, ok := b.types[value.GetTypeName()]
+	if !ok {
+		return fmt.Errorf("map entry %v has unknown value type %v", entry.GetName(), value.GetTypeName())
+	}
+	field.TypeName = value.GetTypeName()
+	field.Type = typ
+	return nil
+}
+
+// message returns the message with the fully-qualified name
+func (b *builder) message(name string) (*ast.Message, error) {
+	m, ok := b.types[name].(*ast.Message)
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %v", name)
+	}
+	return m, nil
+}
+
+// position sets *pos, the position of n in f, from the location with the
+// path p, adding the leading comments of the location to f.
+func (b *builder) position(f *ast.File, n ast.Node, pos *ast.Position, p []int32) {
+	pos.Offset = b.offset
+	b.offset++
+
+	loc, ok := b.locs[pathKey(p)]
+	if !ok || len(loc.Span) < 3 {
+		return
+	}
+	pos.Line = int(loc.Span[0]) + 1
+
+	text := strings.TrimSuffix(loc.GetLeadingComments(), "\n")
+	if loc.LeadingComments == nil || pos.Line == 1 {
+		return
+	}
+	lines := strings.Split(text, "\n")
+	// the comment ends on the line before n
+	f.Comments = append(f.Comments, &ast.Comment{
+		Start: ast.Position{Line: pos.Line - len(lines)},
+		End:   ast.Position{Line: pos.Line - 1},
+		Text:  lines,
+	})
+}
+
+// path returns a copy of the path p, so that paths built by appending to it
+// do not share storage
+func path(p ...int32) []int32 {
+	return append([]int32(nil), p...)
+}
+
+func pathKey(p []int32) string {
+	return fmt.Sprint(p)
+}
+
+// fieldTypes maps the scalar types of descriptors to those of the AST
+var fieldTypes = map[pb.FieldDescriptorProto_Type]ast.FieldType{
+	pb.FieldDescriptorProto_TYPE_DOUBLE:   ast.Double,
+	pb.FieldDescriptorProto_TYPE_FLOAT:    ast.Float,
+	pb.FieldDescriptorProto_TYPE_INT64:    ast.Int64,
+	pb.FieldDescriptorProto_TYPE_UINT64:   ast.Uint64,
+	pb.FieldDescriptorProto_TYPE_INT32:    ast.Int32,
+	pb.FieldDescriptorProto_TYPE_FIXED64:  ast.Fixed64,
+	pb.FieldDescriptorProto_TYPE_FIXED32:  ast.Fixed32,
+	pb.FieldDescriptorProto_TYPE_BOOL:     ast.Bool,
+	pb.FieldDescriptorProto_TYPE_STRING:   ast.String,
+	pb.FieldDescriptorProto_TYPE_BYTES:    ast.Bytes,
+	pb.FieldDescriptorProto_TYPE_UINT32:   ast.Uint32,
+	pb.FieldDescriptorProto_TYPE_SFIXED32: ast.Sfixed32,
+	pb.FieldDescriptorProto_TYPE_SFIXED64: ast.Sfixed64,
+	pb.FieldDescriptorProto_TYPE_SINT32:   ast.Sint32,
+	pb.FieldDescriptorProto_TYPE_SINT64:   ast.Sint64,
+}
+
+type commentSort []*ast.Comment
+
+func (c commentSort) Len() int           { return len(c) }
+func (c commentSort) Less(i, j int) bool { return c[i].Start.Line < c[j].Start.Line }
+func (c commentSort) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
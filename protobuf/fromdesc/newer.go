@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package fromdesc
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// The vendored descriptor package predates some of the fields of
+// descriptor.proto, which it therefore keeps as unknown fields of the
+// messages to which they belong. The types below decode them.
+
+// fileExtra holds the fields of FileDescriptorProto that the descriptor
+// package lacks
+type fileExtra struct {
+	Edition *int32 `protobuf:"varint,14,opt,name=edition"`
+}
+
+func (m *fileExtra) Reset()         { *m = fileExtra{} }
+func (m *fileExtra) String() string { return proto.CompactTextString(m) }
+func (*fileExtra) ProtoMessage()    {}
+
+// editionNames maps the values of the Edition enum to the editions they
+// represent
+var editionNames = map[int32]string{
+	1000: "2023",
+}
+
+// fieldExtra holds the fields of FieldDescriptorProto that the descriptor
+// package lacks
+type fieldExtra struct {
+	Proto3Optional *bool `protobuf:"varint,17,opt,name=proto3_optional"`
+}
+
+func (m *fieldExtra) Reset()         { *m = fieldExtra{} }
+func (m *fieldExtra) String() string { return proto.CompactTextString(m) }
+func (*fieldExtra) ProtoMessage()    {}
+
+// edition returns the edition of fd, a file whose syntax is "editions"
+func edition(fd *pb.FileDescriptorProto) (string, error) {
+	var x fileExtra
+	if err := proto.Unmarshal(fd.XXX_unrecognized, &x); err != nil {
+		return "", err
+	}
+	if x.Edition == nil {
+		return "", nil
+	}
+	return editionNames[*x.Edition], nil
+}
+
+// proto3Optional reports whether fd is a proto3 optional field
+func proto3Optional(fd *pb.FieldDescriptorProto) (bool, error) {
+	var x fieldExtra
+	if err := proto.Unmarshal(fd.XXX_unrecognized, &x); err != nil {
+		return false, err
+	}
+	return x.Proto3Optional != nil && *x.Proto3Optional, nil
+}
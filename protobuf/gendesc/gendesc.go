@@ -3,6 +3,10 @@
 
 /*
 Package gendesc generates descriptor protos from an AST.
+
+The descriptor of a file that declares an edition records the edition, and
+the options of the file and of each of its messages, fields and enums record
+their resolved features.
 */
 package gendesc // import "myitcv.io/g/protobuf/gendesc"
 
@@ -74,31 +78,30 @@ func genFile(f *ast.File) (*pb.FileDescriptorProto, error) {
 			fdp.Options = new(pb.FileOptions)
 		}
 		// TODO: interpret common options
-		uo := new(pb.UninterpretedOption)
-		for _, part := range strings.Split(opt[0], ".") {
-			// TODO: support IsExtension
-			uo.Name = append(uo.Name, &pb.UninterpretedOption_NamePart{
-				NamePart:    proto.String(part),
-				IsExtension: proto.Bool(false),
-			})
-			// TODO: need to handle more types
-			if strings.HasPrefix(opt[1], `"`) {
-				// TODO: doesn't handle single quote strings, etc.
-				unq, err := strconv.Unquote(opt[1])
-				if err != nil {
-					return nil, err
-				}
-				uo.StringValue = []byte(unq)
-			} else {
-				uo.IdentifierValue = proto.String(opt[1])
-			}
+		name := strings.TrimSuffix(strings.TrimPrefix(opt[0], "("), ")")
+		uo, err := genUninterpretedOption(name, opt[1], name != opt[0])
+		if err != nil {
+			return nil, err
 		}
 		fdp.Options.UninterpretedOption = append(fdp.Options.UninterpretedOption, uo)
 	}
+	if fs := genFeatures(f, f); fs != nil {
+		if fdp.Options == nil {
+			fdp.Options = new(pb.FileOptions)
+		}
+		if err := setUnknown(&fdp.Options.XXX_unrecognized, &fileOptionsExtra{Features: fs}); err != nil {
+			return nil, err
+		}
+	}
 	// TODO: SourceCodeInfo
 	switch f.Syntax {
 	case "proto2", "":
 		// "proto2" is considered the default; don't set anything.
+	case "editions":
+		fdp.Syntax = proto.String(f.Syntax)
+		if err := setUnknown(&fdp.XXX_unrecognized, &fileExtra{Edition: proto.Int32(editionNumbers[f.Edition])}); err != nil {
+			return nil, err
+		}
 	default:
 		fdp.Syntax = proto.String(f.Syntax)
 	}
@@ -110,6 +113,12 @@ func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 	dp := &pb.DescriptorProto{
 		Name: proto.String(m.Name),
 	}
+	if fs := genFeatures(m.File(), m); fs != nil {
+		dp.Options = new(pb.MessageOptions)
+		if err := setUnknown(&dp.Options.XXX_unrecognized, &messageOptionsExtra{Features: fs}); err != nil {
+			return nil, err
+		}
+	}
 	for _, f := range m.Fields {
 		fdp, xdp, err := genField(f)
 		if err != nil {
@@ -141,21 +150,133 @@ func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 		}
 		dp.EnumType = append(dp.EnumType, edp)
 	}
-	for _, r := range m.ExtensionRanges {
+	for i, r := range m.ExtensionRanges {
 		// DescriptorProto.ExtensionRange uses a half-open interval.
-		dp.ExtensionRange = append(dp.ExtensionRange, &pb.DescriptorProto_ExtensionRange{
+		rp := &pb.DescriptorProto_ExtensionRange{
 			Start: proto.Int32(int32(r[0])),
 			End:   proto.Int32(int32(r[1] + 1)),
-		})
+		}
+		o, err := genExtensionRangeOptions(m.RangeOptions(i))
+		if err != nil {
+			return nil, err
+		}
+		if o != nil {
+			if err := setUnknown(&rp.XXX_unrecognized, &extensionRangeExtra{Options: o}); err != nil {
+				return nil, err
+			}
+		}
+		dp.ExtensionRange = append(dp.ExtensionRange, rp)
 	}
 	for _, oo := range m.Oneofs {
 		dp.OneofDecl = append(dp.OneofDecl, &pb.OneofDescriptorProto{
 			Name: proto.String(oo.Name),
 		})
 	}
+	genSyntheticOneofs(dp, m)
 	return dp, nil
 }
 
+// genSyntheticOneofs adds a oneof for each proto3 optional field of dp, the
+// descriptor of m, after the oneofs declared in the message, in the same way
+// as protoc. The name of the oneof is the name of the field with a leading
+// underscore, prefixed by as many Xs as are needed to make it unique within
+// the message.
+func genSyntheticOneofs(dp *pb.DescriptorProto, m *ast.Message) {
+	names := make(map[string]bool)
+	for _, fdp := range dp.Field {
+		names[fdp.GetName()] = true
+	}
+	for _, odp := range dp.OneofDecl {
+		names[odp.GetName()] = true
+	}
+	for i, fdp := range dp.Field {
+		if !proto3Optional(m.Fields[i]) {
+			continue
+		}
+		name := fdp.GetName()
+		if !strings.HasPrefix(name, "_") {
+			name = "_" + name
+		}
+		for names[name] {
+			name = "X" + name
+		}
+		names[name] = true
+
+		fdp.OneofIndex = proto.Int(len(dp.OneofDecl))
+		dp.OneofDecl = append(dp.OneofDecl, &pb.OneofDescriptorProto{
+			Name: proto.String(name),
+		})
+	}
+}
+
+// genUninterpretedOption returns the option name, set to value, as an
+// UninterpretedOption; custom reports whether name is that of a custom option,
+// written in parentheses.
+func genUninterpretedOption(name, value string, custom bool) (*pb.UninterpretedOption, error) {
+	uo := new(pb.UninterpretedOption)
+	if custom {
+		uo.Name = []*pb.UninterpretedOption_NamePart{{
+			NamePart:    proto.String(name),
+			IsExtension: proto.Bool(true),
+		}}
+	} else {
+		for _, part := range strings.Split(name, ".") {
+			uo.Name = append(uo.Name, &pb.UninterpretedOption_NamePart{
+				NamePart:    proto.String(part),
+				IsExtension: proto.Bool(false),
+			})
+		}
+	}
+	// TODO: need to handle more types
+	switch {
+	case strings.HasPrefix(value, `"`):
+		// TODO: doesn't handle single quote strings, etc.
+		unq, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, err
+		}
+		uo.StringValue = []byte(unq)
+	case strings.HasPrefix(value, "{"):
+		// an aggregate, held as the text between its braces, as protoc does
+		uo.AggregateValue = proto.String(strings.TrimSpace(value[1 : len(value)-1]))
+	default:
+		uo.IdentifierValue = proto.String(value)
+	}
+	return uo, nil
+}
+
+func genExtensionRangeOptions(o *ast.ExtensionRangeOptions) (*extensionRangeOptions, error) {
+	if o.IsEmpty() {
+		return nil, nil
+	}
+	res := new(extensionRangeOptions)
+	for _, d := range o.Declarations {
+		dp := &declaration{
+			Number:   proto.Int32(int32(d.Number)),
+			FullName: maybeString(d.FullName),
+			Type:     maybeString(d.Type),
+		}
+		if d.Reserved {
+			dp.Reserved = proto.Bool(true)
+		}
+		if d.Repeated {
+			dp.Repeated = proto.Bool(true)
+		}
+		res.Declaration = append(res.Declaration, dp)
+	}
+	if v := o.Verification; v != "" {
+		res.Verification = proto.Int32(verificationNumbers[v])
+	}
+	for _, opt := range o.Options {
+		uo, err := genUninterpretedOption(opt[0], opt[1], true)
+		if err != nil {
+			return nil, err
+		}
+		res.UninterpretedOption = append(res.UninterpretedOption, uo)
+	}
+	return res, nil
+}
+
 func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, error) {
 	fdp := &pb.FieldDescriptorProto{
 		Name:   proto.String(f.Name),
@@ -170,6 +291,12 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		// default is optional
 		fdp.Label = pb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
 	}
+	if fs := genFeatures(f.File(), f); fs != nil {
+		fdp.Options = new(pb.FieldOptions)
+		if err := setUnknown(&fdp.Options.XXX_unrecognized, &fieldOptionsExtra{Features: fs}); err != nil {
+			return nil, nil, err
+		}
+	}
 	if f.KeyTypeName != "" {
 		mname := camelCase(f.Name) + "Entry"
 		vmsg := &ast.Message{
@@ -196,9 +323,11 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		if err != nil {
 			return nil, nil, fmt.Errorf("internal error: %v", err)
 		}
-		xdp.Options = &pb.MessageOptions{
-			MapEntry: proto.Bool(true),
+		// the entry may have options already, i.e. its resolved features
+		if xdp.Options == nil {
+			xdp.Options = new(pb.MessageOptions)
 		}
+		xdp.Options.MapEntry = proto.Bool(true)
 		fdp.Type = pb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
 		fdp.TypeName = proto.String(qualifiedName(vmsg))
 		return fdp, xdp, nil
@@ -229,7 +358,13 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		fdp.Extendee = proto.String(qualifiedName(ext.ExtendeeType))
 	}
 	if f.HasDefault {
-		fdp.DefaultValue = proto.String(f.Default)
+		fdp.DefaultValue = proto.String(f.DefaultValue)
+	}
+	if proto3Optional(f) {
+		// the synthetic oneof is added by genMessage
+		if err := setUnknown(&fdp.XXX_unrecognized, &fieldExtra{Proto3Optional: proto.Bool(true)}); err != nil {
+			return nil, nil, err
+		}
 	}
 	if f.Oneof != nil {
 		n := 0
@@ -245,10 +380,22 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 	return fdp, nil, nil
 }
 
+// proto3Optional reports whether f is a proto3 optional field
+func proto3Optional(f *ast.Field) bool {
+	_, ok := f.Up.(*ast.Message)
+	return ok && f.Optional && f.File().Syntax == "proto3"
+}
+
 func genEnum(enum *ast.Enum) (*pb.EnumDescriptorProto, error) {
 	edp := &pb.EnumDescriptorProto{
 		Name: proto.String(enum.Name),
 	}
+	if fs := genFeatures(enum.File(), enum); fs != nil {
+		edp.Options = new(pb.EnumOptions)
+		if err := setUnknown(&edp.Options.XXX_unrecognized, &enumOptionsExtra{Features: fs}); err != nil {
+			return nil, err
+		}
+	}
 	for _, ev := range enum.Values {
 		edp.Value = append(edp.Value, &pb.EnumValueDescriptorProto{
 			Name:   proto.String(ev.Name),
@@ -346,6 +493,33 @@ var fieldTypeMap = map[ast.FieldType]pb.FieldDescriptorProto_Type{
 	ast.Sint64:   pb.FieldDescriptorProto_TYPE_SINT64,
 }
 
+// genFeatures returns the resolved features of n, a definition in f, for the
+// options of its descriptor: those of the edition of f, overridden by those
+// set in n and the definitions enclosing it. Outside of editions, where
+// features cannot be set, it returns nil.
+func genFeatures(f *ast.File, n interface {
+	ResolvedFeatures() ast.Features
+}) *featureSet {
+	if f == nil || f.Syntax != "editions" {
+		return nil
+	}
+	fs := n.ResolvedFeatures()
+	value := func(v string) *int32 {
+		if v == "" {
+			return nil
+		}
+		return proto.Int32(featureNumbers[v])
+	}
+	return &featureSet{
+		FieldPresence:         value(fs.FieldPresence),
+		EnumType:              value(fs.EnumType),
+		RepeatedFieldEncoding: value(fs.RepeatedFieldEncoding),
+		Utf8Validation:        value(fs.Utf8Validation),
+		MessageEncoding:       value(fs.MessageEncoding),
+		JsonFormat:            value(fs.JSONFormat),
+	}
+}
+
 func maybeString(s string) *string {
 	if s != "" {
 		return &s
@@ -0,0 +1,158 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package gendesc
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// The vendored descriptor package predates some of the fields of
+// descriptor.proto. Generate records those fields as unknown fields of the
+// messages to which they belong, encoded from the types below, so that they
+// are kept when the descriptors are marshalled.
+
+// fieldExtra holds the fields of FieldDescriptorProto that the descriptor
+// package lacks
+type fieldExtra struct {
+	Proto3Optional *bool `protobuf:"varint,17,opt,name=proto3_optional"`
+}
+
+func (m *fieldExtra) Reset()         { *m = fieldExtra{} }
+func (m *fieldExtra) String() string { return proto.CompactTextString(m) }
+func (*fieldExtra) ProtoMessage()    {}
+
+// setUnknown appends the encoding of x to *b, the unknown fields of a
+// descriptor
+func setUnknown(b *[]byte, x proto.Message) error {
+	buf, err := proto.Marshal(x)
+	if err != nil {
+		return err
+	}
+	*b = append(*b, buf...)
+	return nil
+}
+
+// fileExtra holds the fields of FileDescriptorProto that the descriptor
+// package lacks
+type fileExtra struct {
+	Edition *int32 `protobuf:"varint,14,opt,name=edition"`
+}
+
+func (m *fileExtra) Reset()         { *m = fileExtra{} }
+func (m *fileExtra) String() string { return proto.CompactTextString(m) }
+func (*fileExtra) ProtoMessage()    {}
+
+// editionNumbers maps each edition to its value of the Edition enum
+var editionNumbers = map[string]int32{
+	"2023": 1000,
+}
+
+// featureSet is FeatureSet, each field holding the value of its enum
+type featureSet struct {
+	FieldPresence         *int32 `protobuf:"varint,1,opt,name=field_presence"`
+	EnumType              *int32 `protobuf:"varint,2,opt,name=enum_type"`
+	RepeatedFieldEncoding *int32 `protobuf:"varint,3,opt,name=repeated_field_encoding"`
+	Utf8Validation        *int32 `protobuf:"varint,4,opt,name=utf8_validation"`
+	MessageEncoding       *int32 `protobuf:"varint,5,opt,name=message_encoding"`
+	JsonFormat            *int32 `protobuf:"varint,6,opt,name=json_format"`
+}
+
+func (m *featureSet) Reset()         { *m = featureSet{} }
+func (m *featureSet) String() string { return proto.CompactTextString(m) }
+func (*featureSet) ProtoMessage()    {}
+
+// featureNumbers maps the values of each feature, as held by ast.Features,
+// to their values in the enums of FeatureSet
+var featureNumbers = map[string]int32{
+	"EXPLICIT":           1,
+	"IMPLICIT":           2,
+	"LEGACY_REQUIRED":    3,
+	"OPEN":               1,
+	"CLOSED":             2,
+	"PACKED":             1,
+	"EXPANDED":           2,
+	"VERIFY":             2,
+	"NONE":               3,
+	"LENGTH_PREFIXED":    1,
+	"DELIMITED":          2,
+	"ALLOW":              1,
+	"LEGACY_BEST_EFFORT": 2,
+}
+
+// The features field of each of the options messages that has one; its
+// number differs between them.
+
+type fileOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,50,opt,name=features"`
+}
+
+func (m *fileOptionsExtra) Reset()         { *m = fileOptionsExtra{} }
+func (m *fileOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*fileOptionsExtra) ProtoMessage()    {}
+
+type messageOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,12,opt,name=features"`
+}
+
+func (m *messageOptionsExtra) Reset()         { *m = messageOptionsExtra{} }
+func (m *messageOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*messageOptionsExtra) ProtoMessage()    {}
+
+type fieldOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,21,opt,name=features"`
+}
+
+func (m *fieldOptionsExtra) Reset()         { *m = fieldOptionsExtra{} }
+func (m *fieldOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*fieldOptionsExtra) ProtoMessage()    {}
+
+type enumOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,7,opt,name=features"`
+}
+
+func (m *enumOptionsExtra) Reset()         { *m = enumOptionsExtra{} }
+func (m *enumOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*enumOptionsExtra) ProtoMessage()    {}
+
+// extensionRangeExtra holds the fields of DescriptorProto.ExtensionRange
+// that the descriptor package lacks
+type extensionRangeExtra struct {
+	Options *extensionRangeOptions `protobuf:"bytes,3,opt,name=options"`
+}
+
+func (m *extensionRangeExtra) Reset()         { *m = extensionRangeExtra{} }
+func (m *extensionRangeExtra) String() string { return proto.CompactTextString(m) }
+func (*extensionRangeExtra) ProtoMessage()    {}
+
+// extensionRangeOptions is ExtensionRangeOptions
+type extensionRangeOptions struct {
+	Declaration         []*declaration            `protobuf:"bytes,2,rep,name=declaration"`
+	Verification        *int32                    `protobuf:"varint,3,opt,name=verification"`
+	UninterpretedOption []*pb.UninterpretedOption `protobuf:"bytes,999,rep,name=uninterpreted_option"`
+}
+
+func (m *extensionRangeOptions) Reset()         { *m = extensionRangeOptions{} }
+func (m *extensionRangeOptions) String() string { return proto.CompactTextString(m) }
+func (*extensionRangeOptions) ProtoMessage()    {}
+
+// declaration is ExtensionRangeOptions.Declaration
+type declaration struct {
+	Number   *int32  `protobuf:"varint,1,opt,name=number"`
+	FullName *string `protobuf:"bytes,2,opt,name=full_name"`
+	Type     *string `protobuf:"bytes,3,opt,name=type"`
+	Reserved *bool   `protobuf:"varint,5,opt,name=reserved"`
+	Repeated *bool   `protobuf:"varint,6,opt,name=repeated"`
+}
+
+func (m *declaration) Reset()         { *m = declaration{} }
+func (m *declaration) String() string { return proto.CompactTextString(m) }
+func (*declaration) ProtoMessage()    {}
+
+// verificationNumbers maps each verification state to its value of the
+// VerificationState enum
+var verificationNumbers = map[string]int32{
+	"DECLARATION": 0,
+	"UNVERIFIED":  1,
+}
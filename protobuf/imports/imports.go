@@ -0,0 +1,421 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package imports analyses the import graph of a resolved set of proto
+// files, reporting import cycles, unused imports and types that are only
+// visible transitively.
+package imports // import "myitcv.io/g/protobuf/imports"
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// An Issue is a problem found in the import graph.
+type Issue struct {
+	Kind     Kind
+	Filename string
+	Pos      ast.Position // the position of the offending reference, if any
+
+	// Import is the import (for UnusedImport) or the file that should be
+	// imported (for MissingImport)
+	Import string
+
+	// Cycle is the path of the import cycle, starting and ending with
+	// Filename (for ImportCycle)
+	Cycle []string
+
+	Message string
+}
+
+func (i *Issue) String() string {
+	if i.Pos.IsValid() {
+		return fmt.Sprintf("%v:%v: %v", i.Filename, i.Pos.Line, i.Message)
+	}
+	return fmt.Sprintf("%v: %v", i.Filename, i.Message)
+}
+
+// Kind is the kind of an Issue.
+type Kind int
+
+const (
+	ImportCycle Kind = iota
+	UnusedImport
+	MissingImport
+)
+
+// A Graph is the import graph of a FileSet. Its nodes are the files of the
+// FileSet; imports of files outside the FileSet are ignored.
+type Graph struct {
+	fset   *ast.FileSet
+	byName map[string]*ast.File
+}
+
+// NewGraph returns the import graph of fset, which must have been resolved,
+// for example by parser.ParseFiles.
+func NewGraph(fset *ast.FileSet) *Graph {
+	g := &Graph{
+		fset:   fset,
+		byName: make(map[string]*ast.File),
+	}
+	for _, f := range fset.Files {
+		g.byName[f.Name] = f
+	}
+	return g
+}
+
+// Check returns all the issues found in g: import cycles, then unused
+// imports, then missing imports.
+func (g *Graph) Check() []*Issue {
+	var res []*Issue
+	res = append(res, g.Cycles()...)
+	res = append(res, g.Unused()...)
+	res = append(res, g.Missing()...)
+	return res
+}
+
+// imports returns the files of g directly imported by f
+func (g *Graph) imports(f *ast.File) []*ast.File {
+	var res []*ast.File
+	for _, imp := range f.Imports {
+		if i, ok := g.byName[imp]; ok {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// Cycles returns an issue for each import cycle in g. Each cycle is reported
+// once, starting at the first of its files in FileSet order.
+func (g *Graph) Cycles() []*Issue {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[*ast.File]int)
+	var stack []*ast.File
+	seen := make(map[string]bool)
+
+	order := make(map[*ast.File]int)
+	for i, f := range g.fset.Files {
+		order[f] = i
+	}
+
+	var res []*Issue
+
+	var visit func(f *ast.File)
+	visit = func(f *ast.File) {
+		state[f] = visiting
+		stack = append(stack, f)
+
+		for _, i := range g.imports(f) {
+			switch state[i] {
+			case unvisited:
+				visit(i)
+			case visiting:
+				// a back edge; the cycle is the stack from i onwards
+				var cycle []*ast.File
+				for j := len(stack) - 1; ; j-- {
+					if stack[j] == i {
+						cycle = append(cycle, stack[j:]...)
+						break
+					}
+				}
+
+				// rotate the cycle to start at its first file
+				start := 0
+				for j, cf := range cycle {
+					if order[cf] < order[cycle[start]] {
+						start = j
+					}
+				}
+				cycle = append(cycle[start:], cycle[:start]...)
+
+				var path []string
+				for _, cf := range cycle {
+					path = append(path, cf.Name)
+				}
+				path = append(path, cycle[0].Name)
+
+				key := strings.Join(path, "\x00")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				res = append(res, &Issue{
+					Kind:     ImportCycle,
+					Filename: path[0],
+					Cycle:    path,
+					Message:  "import cycle: " + strings.Join(path, " -> "),
+				})
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[f] = visited
+	}
+
+	for _, f := range g.fset.Files {
+		if state[f] == unvisited {
+			visit(f)
+		}
+	}
+
+	return res
+}
+
+// Unused returns an issue for each import that provides none of the types or
+// custom options used by the importing file, either itself or through the
+// files it publicly imports. Public imports are never reported; they exist
+// for the benefit of the files that import the importing file.
+func (g *Graph) Unused() []*Issue {
+	var res []*Issue
+
+	for _, f := range g.fset.Files {
+		used := make(map[*ast.File]bool)
+		for _, r := range f.References() {
+			used[r.Target.File()] = true
+		}
+
+		opts := optionNames(f)
+
+		public := make(map[int]bool)
+		for _, i := range f.PublicImports {
+			public[i] = true
+		}
+
+		for n, imp := range f.Imports {
+			i, ok := g.byName[imp]
+			if public[n] || !ok {
+				continue
+			}
+
+			isUsed := false
+			for _, vf := range g.publicClosure(i) {
+				if used[vf] || definesOption(vf, opts) {
+					isUsed = true
+					break
+				}
+			}
+
+			if !isUsed {
+				res = append(res, &Issue{
+					Kind:     UnusedImport,
+					Filename: f.Name,
+					Import:   imp,
+					Message:  fmt.Sprintf("import %q is unused", imp),
+				})
+			}
+		}
+	}
+
+	return res
+}
+
+// Missing returns an issue for each reference to a type defined in a file
+// that the referring file does not import, either directly or through a
+// public import. Such references resolve only because the defining file
+// happens to be part of the FileSet, for example because it is imported by
+// some other file.
+func (g *Graph) Missing() []*Issue {
+	var res []*Issue
+
+	for _, f := range g.fset.Files {
+		visible := map[*ast.File]bool{f: true}
+		for _, i := range g.imports(f) {
+			for _, vf := range g.publicClosure(i) {
+				visible[vf] = true
+			}
+		}
+
+		reported := make(map[*ast.File]bool)
+
+		for _, r := range f.References() {
+			tf := r.Target.File()
+			if visible[tf] || reported[tf] {
+				continue
+			}
+			reported[tf] = true
+
+			res = append(res, &Issue{
+				Kind:     MissingImport,
+				Filename: f.Name,
+				Pos:      r.Node.Pos(),
+				Import:   tf.Name,
+				Message:  fmt.Sprintf("%q is defined in %q, which is not imported", *r.Name, tf.Name),
+			})
+		}
+	}
+
+	return res
+}
+
+// publicClosure returns f together with the files it publicly imports,
+// transitively
+func (g *Graph) publicClosure(f *ast.File) []*ast.File {
+	seen := make(map[*ast.File]bool)
+	var res []*ast.File
+
+	var add func(f *ast.File)
+	add = func(f *ast.File) {
+		if seen[f] {
+			return
+		}
+		seen[f] = true
+		res = append(res, f)
+		for _, pi := range f.PublicImports {
+			if i, ok := g.byName[f.Imports[pi]]; ok {
+				add(i)
+			}
+		}
+	}
+	add(f)
+
+	return res
+}
+
+// WriteDOT writes the import graph of g to w in the DOT language of
+// Graphviz. Public imports are drawn bold, and imports that form part of a
+// cycle are drawn red. Imports of files outside the graph are drawn dashed.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	inCycle := make(map[[2]string]bool)
+	for _, c := range g.Cycles() {
+		for i := 1; i < len(c.Cycle); i++ {
+			inCycle[[2]string{c.Cycle[i-1], c.Cycle[i]}] = true
+		}
+	}
+
+	var lines []string
+	for _, f := range g.fset.Files {
+		lines = append(lines, fmt.Sprintf("\t%q;", f.Name))
+	}
+
+	for _, f := range g.fset.Files {
+		public := make(map[int]bool)
+		for _, i := range f.PublicImports {
+			public[i] = true
+		}
+
+		for n, imp := range f.Imports {
+			var attrs, styles []string
+			if public[n] {
+				styles = append(styles, "bold")
+			}
+			if _, ok := g.byName[imp]; !ok {
+				styles = append(styles, "dashed")
+			}
+			switch len(styles) {
+			case 0:
+			case 1:
+				attrs = append(attrs, "style="+styles[0])
+			default:
+				attrs = append(attrs, fmt.Sprintf("style=%q", strings.Join(styles, ",")))
+			}
+			if inCycle[[2]string{f.Name, imp}] {
+				attrs = append(attrs, "color=red")
+			}
+
+			l := fmt.Sprintf("\t%q -> %q", f.Name, imp)
+			if len(attrs) > 0 {
+				l += " [" + strings.Join(attrs, ", ") + "]"
+			}
+			lines = append(lines, l+";")
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "digraph imports {\n%v\n}\n", strings.Join(lines, "\n"))
+	return err
+}
+
+// optionNames returns the names of the options used by f, wherever they are
+// set: on f itself, its messages, fields, extension ranges, enums and methods.
+// The parser records options by name alone, e.g. "my.pkg.opt" for the option
+// (my.pkg.opt), except on a file; it supports no custom options on oneofs or
+// services.
+func optionNames(f *ast.File) map[string]bool {
+	res := make(map[string]bool)
+
+	addOpts := func(opts [][2]string) {
+		for _, o := range opts {
+			res[strings.Trim(o[0], "()")] = true
+		}
+	}
+
+	addExts := func(exts []*ast.Extension) {
+		for _, e := range exts {
+			for _, fl := range e.Fields {
+				addOpts(fl.Options)
+			}
+		}
+	}
+
+	addEnums := func(enums []*ast.Enum) {
+		for _, e := range enums {
+			addOpts(e.Options)
+		}
+	}
+
+	var addMsgs func(msgs []*ast.Message)
+	addMsgs = func(msgs []*ast.Message) {
+		for _, m := range msgs {
+			addOpts(m.Options)
+			for _, fl := range m.Fields {
+				addOpts(fl.Options)
+			}
+			for _, o := range m.ExtensionRangeOptions {
+				if o != nil {
+					addOpts(o.Options)
+				}
+			}
+			addExts(m.Extensions)
+			addMsgs(m.Messages)
+			addEnums(m.Enums)
+		}
+	}
+
+	addOpts(f.Options)
+	addMsgs(f.Messages)
+	addExts(f.Extensions)
+	addEnums(f.Enums)
+
+	for _, s := range f.Services {
+		for _, m := range s.Methods {
+			addOpts(m.Options)
+		}
+	}
+
+	return res
+}
+
+// definesOption reports whether f defines an extension field, at the top
+// level of f, named by any of opts. A name matches either the full name of
+// the field or a suffix of it, as options may be named relative to the
+// package of the file that uses them.
+func definesOption(f *ast.File, opts map[string]bool) bool {
+	if len(opts) == 0 {
+		return false
+	}
+
+	pkg := strings.Join(f.Package, ".")
+	for _, e := range f.Extensions {
+		for _, fl := range e.Fields {
+			full := fl.Name
+			if pkg != "" {
+				full = pkg + "." + full
+			}
+			for o := range opts {
+				if o == full || strings.HasSuffix(full, "."+o) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package jsonschema
+
+// This file implements the reading of google.api.http annotations, which map
+// methods to HTTP requests as in the HttpRule message of
+// google/api/http.proto.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/parser"
+)
+
+// httpRule is a binding of a method to an HTTP request
+type httpRule struct {
+	method       string // e.g. GET
+	path         string // the path template
+	body         string // "", "*" or a field path
+	responseBody string // "" or a field path
+}
+
+// httpRules returns the HTTP bindings of m, as given by its google.api.http
+// option, or nil if it has none.
+func httpRules(m *ast.Method) ([]httpRule, error) {
+	for _, o := range m.Options {
+		if strings.TrimPrefix(o[0], ".") != "google.api.http" {
+			continue
+		}
+		a, err := parser.ParseAggregate(o[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid google.api.http option: %v", err)
+		}
+		r, err := readHTTPRule(a)
+		if err != nil {
+			return nil, err
+		}
+		res := []httpRule{r}
+		for _, f := range a {
+			if f.Name != "additional_bindings" {
+				continue
+			}
+			if f.Aggregate == nil {
+				return nil, fmt.Errorf("additional_bindings must be a message")
+			}
+			r, err := readHTTPRule(f.Aggregate)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, r)
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+func readHTTPRule(a ast.Aggregate) (httpRule, error) {
+	var r httpRule
+	str := func(v string) (string, error) {
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("want a string, got %s", v)
+		}
+		return s, nil
+	}
+	for _, f := range a {
+		var err error
+		switch f.Name {
+		case "get", "put", "post", "delete", "patch":
+			if r.method != "" {
+				return r, fmt.Errorf("HTTP rule has more than one pattern")
+			}
+			r.method = strings.ToUpper(f.Name)
+			r.path, err = str(f.Value)
+		case "custom":
+			if r.method != "" {
+				return r, fmt.Errorf("HTTP rule has more than one pattern")
+			}
+			kind, _ := f.Aggregate.Get("kind")
+			path, _ := f.Aggregate.Get("path")
+			if r.method, err = str(kind); err == nil {
+				r.path, err = str(path)
+			}
+		case "body":
+			r.body, err = str(f.Value)
+		case "response_body":
+			r.responseBody, err = str(f.Value)
+		case "selector", "additional_bindings":
+		default:
+			err = fmt.Errorf("unknown field %q", f.Name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid HTTP rule: %v: %v", f.Name, err)
+		}
+	}
+	if r.method == "" {
+		return r, fmt.Errorf("HTTP rule has no pattern")
+	}
+	return r, nil
+}
+
+// pathVar is a variable of a path template
+type pathVar struct {
+	field   string // the field path, e.g. book.name
+	pattern string // a regular expression matching its values; empty if any segment
+}
+
+// pathTemplate parses the path template of an HTTP rule, e.g.
+// /v1/{name=shelves/*}/books:get, and returns the corresponding OpenAPI
+// path, e.g. /v1/{name}/books:get, and its variables.
+func pathTemplate(tmpl string) (string, []pathVar, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return "", nil, fmt.Errorf("path template %q does not start with /", tmpl)
+	}
+	var path []byte
+	var vars []pathVar
+	for i := 0; i < len(tmpl); i++ {
+		switch c := tmpl[i]; c {
+		case '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end == -1 {
+				return "", nil, fmt.Errorf("path template %q has an unterminated variable", tmpl)
+			}
+			v := pathVar{field: tmpl[i+1 : i+end]}
+			if eq := strings.IndexByte(v.field, '='); eq != -1 {
+				v.pattern = segmentsPattern(v.field[eq+1:])
+				v.field = v.field[:eq]
+			}
+			for _, p := range strings.Split(v.field, ".") {
+				if !isIdent(p) {
+					return "", nil, fmt.Errorf("path template %q has an invalid variable %q", tmpl, v.field)
+				}
+			}
+			vars = append(vars, v)
+			path = append(path, "{"+v.field+"}"...)
+			i += end
+		case '}':
+			return "", nil, fmt.Errorf("path template %q has an unexpected }", tmpl)
+		default:
+			path = append(path, c)
+		}
+	}
+	return string(path), vars, nil
+}
+
+// segmentsPattern returns a regular expression matching the path segments
+// segs of a variable, e.g. shelves/*, in which * matches a single segment
+// and ** any number.
+func segmentsPattern(segs string) string {
+	parts := strings.Split(segs, "/")
+	for i, p := range parts {
+		switch p {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".+"
+		default:
+			parts[i] = regexp.QuoteMeta(p)
+		}
+	}
+	return "^" + strings.Join(parts, "/") + "$"
+}
+
+func isIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
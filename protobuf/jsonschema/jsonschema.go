@@ -0,0 +1,309 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package jsonschema generates JSON Schema documents for the messages and
+// enums of a resolved set of proto files, following the proto3 JSON mapping,
+// and OpenAPI documents for their services.
+//
+// A schema describes the JSON written by a conforming printer: 64-bit
+// integers are strings, bytes are base64-encoded strings, enum values are
+// their names, and the well-known types of google/protobuf have their special
+// representations, e.g. a google.protobuf.Timestamp is an RFC 3339 string.
+// Parsers accept more than this, e.g. numbers as strings, which the schemas
+// do not describe.
+package jsonschema // import "myitcv.io/g/protobuf/jsonschema"
+
+import (
+	"encoding/json"
+	"io"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/doc"
+)
+
+// Draft is the JSON Schema dialect of the generated schemas, which is also
+// that of OpenAPI 3.1.
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// A Schema is a JSON Schema, or a subschema of one. Only the keywords used by
+// the generator are represented.
+type Schema struct {
+	Schema          string             `json:"$schema,omitempty"`
+	Ref             string             `json:"$ref,omitempty"`
+	Title           string             `json:"title,omitempty"`
+	Description     string             `json:"description,omitempty"`
+	Type            string             `json:"type,omitempty"`
+	Format          string             `json:"format,omitempty"`
+	Pattern         string             `json:"pattern,omitempty"`
+	ContentEncoding string             `json:"contentEncoding,omitempty"`
+	Enum            []string           `json:"enum,omitempty"`
+	Properties      map[string]*Schema `json:"properties,omitempty"`
+	Required        []string           `json:"required,omitempty"`
+	PropertyNames   *Schema            `json:"propertyNames,omitempty"`
+	Additional      *Schema            `json:"additionalProperties,omitempty"`
+	Items           *Schema            `json:"items,omitempty"`
+	AnyOf           []*Schema          `json:"anyOf,omitempty"`
+	Deprecated      bool               `json:"deprecated,omitempty"`
+	Defs            map[string]*Schema `json:"$defs,omitempty"`
+}
+
+// A Generator generates JSON Schema and OpenAPI documents for the files of a
+// FileSet. The FileSet must have been resolved, for example by
+// parser.ParseFiles.
+type Generator struct {
+	// UseProtoNames, if set, names properties by their field names rather
+	// than by their lowerCamelCase JSON names.
+	UseProtoNames bool
+
+	// Title and Version are those of the API described by an OpenAPI
+	// document. If empty, DefaultTitle and DefaultVersion are used.
+	Title   string
+	Version string
+}
+
+// DefaultTitle and DefaultVersion are used when Generator.Title and
+// Generator.Version are empty.
+const (
+	DefaultTitle   = "API"
+	DefaultVersion = "0.0.0"
+)
+
+// Schema returns a JSON Schema document whose $defs hold a schema for every
+// message and enum defined in the files of fset, keyed by full name (e.g.
+// library.Book), together with the messages and enums they refer to.
+func (g *Generator) Schema(fset *ast.FileSet) *Schema {
+	b := g.newBuilder("#/$defs/")
+	b.addFiles(fset)
+	return &Schema{
+		Schema: Draft,
+		Defs:   b.defs,
+	}
+}
+
+// builder holds the state used when building a document
+type builder struct {
+	*Generator
+
+	prefix  string             // the prefix of references to defs
+	defs    map[string]*Schema // keyed by full name
+	pending []interface{}      // messages and enums referred to but not in defs
+}
+
+func (g *Generator) newBuilder(prefix string) *builder {
+	return &builder{
+		Generator: g,
+		prefix:    prefix,
+		defs:      make(map[string]*Schema),
+	}
+}
+
+// addFiles adds the messages and enums of the files of fset to b.defs, and
+// then those they refer to
+func (b *builder) addFiles(fset *ast.FileSet) {
+	var addMsgs func(msgs []*ast.Message)
+	addMsgs = func(msgs []*ast.Message) {
+		for _, m := range msgs {
+			b.pending = append(b.pending, m)
+			for _, e := range m.Enums {
+				b.pending = append(b.pending, e)
+			}
+			addMsgs(m.Messages)
+		}
+	}
+	for _, f := range fset.Files {
+		addMsgs(f.Messages)
+		for _, e := range f.Enums {
+			b.pending = append(b.pending, e)
+		}
+	}
+	b.flush()
+}
+
+// flush adds the pending messages and enums to b.defs, until there are no
+// more
+func (b *builder) flush() {
+	for len(b.pending) > 0 {
+		x := b.pending[0]
+		b.pending = b.pending[1:]
+
+		name := ast.FullName(x)
+		if _, ok := b.defs[name]; ok {
+			continue
+		}
+		switch x := x.(type) {
+		case *ast.Message:
+			// reserve the name first, as the message may refer to itself
+			b.defs[name] = nil
+			b.defs[name] = b.message(x)
+		case *ast.Enum:
+			b.defs[name] = b.enum(x)
+		}
+	}
+}
+
+// ref returns a reference to the schema of x, a message or enum, which is
+// added to b.defs by flush if necessary
+func (b *builder) ref(x interface{}) *Schema {
+	name := ast.FullName(x)
+	if _, ok := b.defs[name]; !ok {
+		b.pending = append(b.pending, x)
+	}
+	return &Schema{Ref: b.prefix + name}
+}
+
+func (b *builder) message(m *ast.Message) *Schema {
+	res := &Schema{
+		Title:       m.Name,
+		Description: doc.Comment(m, nil),
+		Type:        "object",
+		Properties:  make(map[string]*Schema),
+	}
+
+	var prev ast.Node
+	for _, f := range m.Fields {
+		s := b.field(f)
+		s.Description = doc.Comment(f, prev)
+		prev = f
+
+		name := b.propertyName(f)
+		res.Properties[name] = s
+		if f.ResolvedFeatures().FieldPresence == "LEGACY_REQUIRED" {
+			res.Required = append(res.Required, name)
+		}
+	}
+
+	return res
+}
+
+func (b *builder) enum(e *ast.Enum) *Schema {
+	res := &Schema{
+		Title:       e.Name,
+		Description: doc.Comment(e, nil),
+		Type:        "string",
+	}
+	for _, v := range e.Values {
+		res.Enum = append(res.Enum, v.Name)
+	}
+	return res
+}
+
+// field returns the schema of the value of f, a fresh Schema that the caller
+// may modify
+func (b *builder) field(f *ast.Field) *Schema {
+	s := b.typ(f.Type)
+	switch {
+	case f.KeyTypeName != "":
+		s = &Schema{
+			Type:          "object",
+			PropertyNames: keySchema(f.KeyType),
+			Additional:    s,
+		}
+	case f.Repeated:
+		s = &Schema{
+			Type:  "array",
+			Items: s,
+		}
+	}
+	s.Deprecated = f.HasDeprecated && f.Deprecated
+	return s
+}
+
+// propertyName returns the name of the JSON property of f
+func (b *builder) propertyName(f *ast.Field) string {
+	if b.UseProtoNames {
+		return f.Name
+	}
+	return ast.JSONName(f.Name)
+}
+
+// typ returns a fresh schema for values of the resolved type typ
+func (b *builder) typ(typ interface{}) *Schema {
+	switch typ := typ.(type) {
+	case ast.FieldType:
+		return scalarSchema(typ)
+	case *ast.Enum:
+		if ast.FullName(typ) == "google.protobuf.NullValue" {
+			return &Schema{Type: "null"}
+		}
+		return b.ref(typ)
+	case *ast.Message:
+		if s := wellKnownSchema(ast.FullName(typ)); s != nil {
+			return s
+		}
+		return b.ref(typ)
+	}
+	// unresolved; anything goes
+	return &Schema{}
+}
+
+func scalarSchema(typ ast.FieldType) *Schema {
+	switch typ {
+	case ast.Int32, ast.Sint32, ast.Sfixed32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case ast.Uint32, ast.Fixed32:
+		return &Schema{Type: "integer", Format: "uint32"}
+	case ast.Int64, ast.Sint64, ast.Sfixed64:
+		return &Schema{Type: "string", Format: "int64", Pattern: "^-?[0-9]+$"}
+	case ast.Uint64, ast.Fixed64:
+		return &Schema{Type: "string", Format: "uint64", Pattern: "^[0-9]+$"}
+	case ast.Float, ast.Double:
+		// NaN and the infinities are written as strings
+		return &Schema{AnyOf: []*Schema{
+			{Type: "number", Format: typ.String()},
+			{Type: "string", Enum: []string{"NaN", "Infinity", "-Infinity"}},
+		}}
+	case ast.Bool:
+		return &Schema{Type: "boolean"}
+	case ast.String:
+		return &Schema{Type: "string"}
+	case ast.Bytes:
+		return &Schema{Type: "string", ContentEncoding: "base64"}
+	}
+	return &Schema{}
+}
+
+// keySchema returns the schema of the property names of a map with keys of
+// type typ
+func keySchema(typ ast.FieldType) *Schema {
+	switch typ {
+	case ast.Int32, ast.Sint32, ast.Sfixed32, ast.Int64, ast.Sint64, ast.Sfixed64:
+		return &Schema{Pattern: "^-?[0-9]+$"}
+	case ast.Uint32, ast.Fixed32, ast.Uint64, ast.Fixed64:
+		return &Schema{Pattern: "^[0-9]+$"}
+	case ast.Bool:
+		return &Schema{Enum: []string{"true", "false"}}
+	}
+	return nil
+}
+
+// wellKnownSchema returns a fresh schema for the well-known type name, or
+// nil if name is not a well-known type with a special JSON representation
+func wellKnownSchema(name string) *Schema {
+	if typ, ok := ast.WrapperTypes[name]; ok {
+		return scalarSchema(typ)
+	}
+	typ, ok := ast.WellKnownJSONTypes[name]
+	if !ok {
+		return nil
+	}
+	res := &Schema{Type: typ}
+	switch name {
+	case "google.protobuf.Timestamp":
+		res.Format = "date-time"
+	case "google.protobuf.Duration":
+		res.Pattern = `^-?[0-9]+(\.[0-9]+)?s$`
+	case "google.protobuf.Any":
+		res.Properties = map[string]*Schema{"@type": {Type: "string"}}
+		res.Required = []string{"@type"}
+	}
+	return res
+}
+
+// Encode writes the JSON encoding of v, a Schema or OpenAPI document, to w,
+// indented by two spaces.
+func Encode(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
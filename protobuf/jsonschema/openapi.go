@@ -0,0 +1,337 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package jsonschema
+
+import (
+	"fmt"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/doc"
+)
+
+// OpenAPIVersion is the version of the generated OpenAPI documents.
+const OpenAPIVersion = "3.1.0"
+
+// An OpenAPI is an OpenAPI document. Only the fields used by the generator
+// are represented.
+type OpenAPI struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Tags       []*Tag               `json:"tags,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// A Tag groups the operations of a service.
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type PathItem struct {
+	Get     *Operation `json:"get,omitempty"`
+	Put     *Operation `json:"put,omitempty"`
+	Post    *Operation `json:"post,omitempty"`
+	Delete  *Operation `json:"delete,omitempty"`
+	Options *Operation `json:"options,omitempty"`
+	Head    *Operation `json:"head,omitempty"`
+	Patch   *Operation `json:"patch,omitempty"`
+	Trace   *Operation `json:"trace,omitempty"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path or query
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas,omitempty"`
+}
+
+// OpenAPI returns an OpenAPI document describing the methods of the services
+// defined in the files of fset. Its components hold the schemas of the
+// messages and enums of those files, as returned by Schema.
+//
+// A method with google.api.http annotations has an operation for each of its
+// bindings, whose parameters and request body follow the HttpRule mapping.
+// Fields of the request that are bound neither by the path nor the body are
+// query parameters; fields of messages are named by field paths, e.g.
+// book.author. A method with no annotation is a POST of the request to
+// /package.Service/Method, as in gRPC-Web and Connect.
+func (g *Generator) OpenAPI(fset *ast.FileSet) (*OpenAPI, error) {
+	b := g.newBuilder("#/components/schemas/")
+
+	res := &OpenAPI{
+		OpenAPI: OpenAPIVersion,
+		Info: Info{
+			Title:   g.Title,
+			Version: g.Version,
+		},
+		Paths: make(map[string]*PathItem),
+	}
+	if res.Info.Title == "" {
+		res.Info.Title = DefaultTitle
+	}
+	if res.Info.Version == "" {
+		res.Info.Version = DefaultVersion
+	}
+
+	for _, f := range fset.Files {
+		for _, s := range f.Services {
+			res.Tags = append(res.Tags, &Tag{
+				Name:        ast.FullName(s),
+				Description: doc.Comment(s, nil),
+			})
+
+			var prev ast.Node
+			for _, m := range s.Methods {
+				if err := b.method(res, m, prev); err != nil {
+					pos := m.Pos()
+					return nil, fmt.Errorf("%v:%v: method %v: %v", f.Name, pos.Line, m.Name, err)
+				}
+				prev = m
+			}
+		}
+	}
+
+	b.addFiles(fset)
+	res.Components.Schemas = b.defs
+
+	return res, nil
+}
+
+// method adds the operations of m to api. prev is the method defined
+// immediately before m, if any.
+func (b *builder) method(api *OpenAPI, m *ast.Method, prev ast.Node) error {
+	in, ok := m.InType.(*ast.Message)
+	if !ok {
+		return fmt.Errorf("request type %v is not resolved", m.InTypeName)
+	}
+	out, ok := m.OutType.(*ast.Message)
+	if !ok {
+		return fmt.Errorf("response type %v is not resolved", m.OutTypeName)
+	}
+
+	rules, err := httpRules(m)
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		rules = []httpRule{{
+			method: "POST",
+			path:   "/" + ast.FullName(m.Up) + "/" + m.Name,
+			body:   "*",
+		}}
+	}
+
+	for i, r := range rules {
+		path, vars, err := pathTemplate(r.path)
+		if err != nil {
+			return err
+		}
+
+		op := &Operation{
+			OperationID: m.Up.Name + "_" + m.Name,
+			Description: doc.Comment(m, prev),
+			Tags:        []string{ast.FullName(m.Up)},
+			Responses:   make(map[string]*Response),
+		}
+		if i > 0 {
+			op.OperationID += fmt.Sprint(i + 1)
+		}
+
+		// bound holds the field paths bound by the path or body
+		bound := make(map[string]bool)
+		for _, v := range vars {
+			f, err := fieldByPath(in, v.field)
+			if err != nil {
+				return err
+			}
+			bound[v.field] = true
+			s := b.typ(f.Type)
+			s.Pattern = v.pattern
+			op.Parameters = append(op.Parameters, &Parameter{
+				Name:        v.field,
+				In:          "path",
+				Description: doc.Comment(f, nil),
+				Required:    true,
+				Schema:      s,
+			})
+		}
+
+		switch r.body {
+		case "":
+		case "*":
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content:  jsonContent(b.typ(in)),
+			}
+		default:
+			f, err := fieldByPath(in, r.body)
+			if err != nil {
+				return err
+			}
+			bound[r.body] = true
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content:  jsonContent(b.field(f)),
+			}
+		}
+		if r.body != "*" {
+			op.Parameters = append(op.Parameters, b.queryParams(in, "", bound, nil)...)
+		}
+
+		resp := b.typ(out)
+		if r.responseBody != "" {
+			f, err := fieldByPath(out, r.responseBody)
+			if err != nil {
+				return err
+			}
+			resp = b.field(f)
+		}
+		op.Responses["200"] = &Response{
+			Description: "A successful response.",
+			Content:     jsonContent(resp),
+		}
+
+		item := api.Paths[path]
+		if item == nil {
+			item = new(PathItem)
+			api.Paths[path] = item
+		}
+		var slot **Operation
+		switch r.method {
+		case "GET":
+			slot = &item.Get
+		case "PUT":
+			slot = &item.Put
+		case "POST":
+			slot = &item.Post
+		case "DELETE":
+			slot = &item.Delete
+		case "OPTIONS":
+			slot = &item.Options
+		case "HEAD":
+			slot = &item.Head
+		case "PATCH":
+			slot = &item.Patch
+		case "TRACE":
+			slot = &item.Trace
+		default:
+			return fmt.Errorf("unsupported HTTP method %v", r.method)
+		}
+		if *slot != nil {
+			return fmt.Errorf("%v %v is also bound to %v", r.method, path, (*slot).OperationID)
+		}
+		*slot = op
+	}
+
+	return nil
+}
+
+// queryParams returns the query parameters of the fields of m that are not
+// bound, named by their field paths relative to prefix. Fields of messages
+// are included, except for maps and messages already being expanded (in
+// outer).
+func (b *builder) queryParams(m *ast.Message, prefix string, bound map[string]bool, outer []*ast.Message) []*Parameter {
+	for _, o := range outer {
+		if o == m {
+			return nil
+		}
+	}
+	outer = append(outer, m)
+
+	var res []*Parameter
+	var prev ast.Node
+	for _, f := range m.Fields {
+		path := prefix + f.Name
+		name := prefix + b.propertyName(f)
+		comment := doc.Comment(f, prev)
+		prev = f
+
+		if bound[path] || f.KeyTypeName != "" {
+			continue
+		}
+		if fm, ok := f.Type.(*ast.Message); ok && !f.Repeated && wellKnownSchema(ast.FullName(fm)) == nil {
+			res = append(res, b.queryParams(fm, path+".", bound, outer)...)
+			continue
+		}
+		if _, ok := f.Type.(*ast.Message); ok && f.Repeated {
+			// repeated messages can't be written as query parameters
+			continue
+		}
+		res = append(res, &Parameter{
+			Name:        name,
+			In:          "query",
+			Description: comment,
+			Required:    f.ResolvedFeatures().FieldPresence == "LEGACY_REQUIRED",
+			Schema:      b.field(f),
+		})
+	}
+	return res
+}
+
+// fieldByPath returns the field of m named by path, e.g. book.author.
+func fieldByPath(m *ast.Message, path string) (*ast.Field, error) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		f, err := fieldNamed(m, p)
+		if err != nil {
+			return nil, err
+		}
+		next, ok := f.Type.(*ast.Message)
+		if !ok || f.Repeated {
+			return nil, fmt.Errorf("field %q of %v is not a singular message", p, ast.FullName(m))
+		}
+		m = next
+	}
+	return fieldNamed(m, parts[len(parts)-1])
+}
+
+func fieldNamed(m *ast.Message, name string) (*ast.Field, error) {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("message %v has no field %q", ast.FullName(m), name)
+}
+
+func jsonContent(s *Schema) map[string]*MediaType {
+	return map[string]*MediaType{
+		"application/json": {Schema: s},
+	}
+}
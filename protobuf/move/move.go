@@ -0,0 +1,356 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package move moves the top-level definitions of proto files from one file
+// to another, rewriting the references to them and fixing the imports of the
+// files involved.
+package move // import "myitcv.io/g/protobuf/move"
+
+import (
+	"fmt"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/imports"
+	"myitcv.io/g/protobuf/parser"
+)
+
+// Move moves the top-level message, enum or service with the full name name,
+// e.g. foo.Bar, to the end of the file of fset called dst, which may be in
+// another package. fset must have been resolved, for example by
+// parser.ParseFiles.
+//
+// The references to the definition, and those it makes, are rewritten where
+// they would otherwise no longer resolve, using the shortest name that does.
+// Imports are added to the files that need them, and those that the move
+// leaves unused are removed. The comments of the definition move with it.
+//
+// Move returns the files that changed, in FileSet order. If it fails, fset
+// may have been partly changed and should be discarded.
+func Move(fset *ast.FileSet, name, dst string) ([]*ast.File, error) {
+	name = strings.TrimPrefix(name, ".")
+
+	var def ast.Node
+	var src, to *ast.File
+	for _, f := range fset.Files {
+		if f.Name == dst {
+			to = f
+		}
+		for _, n := range f.Nodes() {
+			if ast.FullName(n) == name {
+				def, src = n, f
+			}
+		}
+	}
+	switch {
+	case def == nil:
+		return nil, fmt.Errorf("no top-level message, enum or service called %v", name)
+	case to == nil:
+		return nil, fmt.Errorf("%v is not in the file set", dst)
+	case to == src:
+		return nil, fmt.Errorf("%v is already defined in %v", name, dst)
+	}
+
+	if newName := qualified(to.Package, nodeName(def)); newName != name && defined(fset)[newName] {
+		return nil, fmt.Errorf("%v is already defined", newName)
+	}
+
+	g := imports.NewGraph(fset)
+	cycles := issueSet(g.Cycles())
+	missing := issueSet(g.Missing())
+	unused := issueSet(g.Unused())
+
+	var refs []ast.Reference
+	for _, f := range fset.Files {
+		refs = append(refs, f.References()...)
+	}
+
+	changed := map[*ast.File]bool{src: true, to: true}
+
+	detach(src, def)
+	attach(to, def)
+	moveComments(src, to, def)
+
+	// rewrite the references to the definition, and those it makes, that no
+	// longer resolve as they are written
+	defs := defined(fset)
+	for _, r := range refs {
+		from := referrer(r)
+		if topLevel(r.Target) != def && topLevel(from) != def {
+			continue
+		}
+		scope := scopeOf(from)
+		target := ast.FullName(r.Target)
+		if resolve(defs, scope, *r.Name) == target {
+			continue
+		}
+		*r.Name = shortest(defs, scope, target)
+		changed[r.Node.File()] = true
+	}
+
+	// add the imports the move makes necessary, then remove those it leaves
+	// unused
+	g = imports.NewGraph(fset)
+	for _, i := range g.Missing() {
+		if missing[key(i)] {
+			continue
+		}
+		f := file(fset, i.Filename)
+		if !hasImport(f, i.Import) {
+			f.Imports = append(f.Imports, i.Import)
+			changed[f] = true
+		}
+	}
+	g = imports.NewGraph(fset)
+	for _, i := range g.Unused() {
+		if unused[key(i)] {
+			continue
+		}
+		f := file(fset, i.Filename)
+		removeImport(f, i.Import)
+		changed[f] = true
+	}
+
+	g = imports.NewGraph(fset)
+	for _, i := range g.Cycles() {
+		if !cycles[key(i)] {
+			return nil, fmt.Errorf("moving %v to %v creates an %v", name, dst, i.Message)
+		}
+	}
+
+	if err := parser.Resolve(fset); err != nil {
+		return nil, fmt.Errorf("moving %v to %v breaks resolution: %v", name, dst, err)
+	}
+
+	var res []*ast.File
+	for _, f := range fset.Files {
+		if changed[f] {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+// detach removes the top-level definition n from f
+func detach(f *ast.File, n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Message:
+		for i, m := range f.Messages {
+			if m == n {
+				f.Messages = append(f.Messages[:i:i], f.Messages[i+1:]...)
+				break
+			}
+		}
+	case *ast.Enum:
+		for i, e := range f.Enums {
+			if e == n {
+				f.Enums = append(f.Enums[:i:i], f.Enums[i+1:]...)
+				break
+			}
+		}
+	case *ast.Service:
+		for i, s := range f.Services {
+			if s == n {
+				f.Services = append(f.Services[:i:i], f.Services[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// attach adds the top-level definition n to f
+func attach(f *ast.File, n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Message:
+		n.Up = f
+		f.Messages = append(f.Messages, n)
+	case *ast.Enum:
+		n.Up = f
+		f.Enums = append(f.Enums, n)
+	case *ast.Service:
+		n.Up = f
+		f.Services = append(f.Services, n)
+	}
+}
+
+// moveComments moves the comments of the top-level definition n, now
+// attached to to, from src to to, and shifts the positions of n and of its
+// comments to follow everything in to. The comments of n are those from its
+// leading comment up to the next definition of src, or its leading comment.
+func moveComments(src, to *ast.File, n ast.Node) {
+	start := n.Pos()
+	if c := leadingComment(src, n); c != nil {
+		start = c.Start
+	}
+	end := -1
+	for _, o := range topLevelNodes(src) {
+		p := o.Pos()
+		if c := leadingComment(src, o); c != nil {
+			p = c.Start
+		}
+		if p.Offset > start.Offset && (end == -1 || p.Offset < end) {
+			end = p.Offset
+		}
+	}
+
+	var keep, moved []*ast.Comment
+	for _, c := range src.Comments {
+		if c.Start.Offset >= start.Offset && (end == -1 || c.Start.Offset < end) {
+			moved = append(moved, c)
+		} else {
+			keep = append(keep, c)
+		}
+	}
+	src.Comments = keep
+
+	// everything moved starts two lines after the last position of to
+	var last ast.Position
+	for _, o := range topLevelNodes(to) {
+		if o == n {
+			continue
+		}
+		positions(o, func(p *ast.Position) {
+			if last.Before(*p) {
+				last = *p
+			}
+		})
+	}
+	for _, c := range to.Comments {
+		if last.Before(c.End) {
+			last = c.End
+		}
+	}
+	lines, offset := last.Line+2-start.Line, last.Offset+2-start.Offset
+
+	shift := func(p *ast.Position) {
+		p.Line += lines
+		p.Offset += offset
+	}
+	positions(n, shift)
+	for _, c := range moved {
+		shift(&c.Start)
+		shift(&c.End)
+	}
+	to.Comments = append(to.Comments, moved...)
+}
+
+// leadingComment is ast.LeadingComment for a node n of f, which need not be
+// the file n is now attached to
+func leadingComment(f *ast.File, n ast.Node) *ast.Comment {
+	for _, c := range f.Comments {
+		if c.End.Line == n.Pos().Line-1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// topLevelNodes returns the top-level definitions of f, including its
+// extensions
+func topLevelNodes(f *ast.File) []ast.Node {
+	res := f.Nodes()
+	for _, e := range f.Extensions {
+		res = append(res, e)
+	}
+	return res
+}
+
+// positions calls fn with each of the positions within the definition n
+func positions(n ast.Node, fn func(p *ast.Position)) {
+	switch n := n.(type) {
+	case *ast.Message:
+		fn(&n.Position)
+		for _, f := range n.Fields {
+			fn(&f.Position)
+		}
+		for _, o := range n.Oneofs {
+			fn(&o.Position)
+		}
+		for i, o := range n.ExtensionRangeOptions {
+			// the ranges of a statement share its options
+			if o != nil && (i == 0 || o != n.ExtensionRangeOptions[i-1]) {
+				fn(&o.Position)
+			}
+		}
+		for _, m := range n.Messages {
+			positions(m, fn)
+		}
+		for _, e := range n.Enums {
+			positions(e, fn)
+		}
+		for _, e := range n.Extensions {
+			positions(e, fn)
+		}
+	case *ast.Enum:
+		fn(&n.Position)
+		for _, v := range n.Values {
+			fn(&v.Position)
+		}
+	case *ast.Service:
+		fn(&n.Position)
+		for _, m := range n.Methods {
+			fn(&m.Position)
+		}
+	case *ast.Extension:
+		fn(&n.Position)
+		for _, f := range n.Fields {
+			fn(&f.Position)
+		}
+	}
+}
+
+// issueSet returns the set of the keys of issues
+func issueSet(issues []*imports.Issue) map[string]bool {
+	res := make(map[string]bool)
+	for _, i := range issues {
+		res[key(i)] = true
+	}
+	return res
+}
+
+// key identifies an issue independently of positions, which a move changes
+func key(i *imports.Issue) string {
+	return fmt.Sprintf("%v\x00%v\x00%v\x00%v", i.Kind, i.Filename, i.Import, strings.Join(i.Cycle, "\x00"))
+}
+
+// file returns the file of fset called name
+func file(fset *ast.FileSet, name string) *ast.File {
+	for _, f := range fset.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// hasImport reports whether f imports name
+func hasImport(f *ast.File, name string) bool {
+	for _, i := range f.Imports {
+		if i == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeImport removes the import name from f, renumbering its public
+// imports
+func removeImport(f *ast.File, name string) {
+	for i, imp := range f.Imports {
+		if imp != name {
+			continue
+		}
+		f.Imports = append(f.Imports[:i:i], f.Imports[i+1:]...)
+		var public []int
+		for _, p := range f.PublicImports {
+			switch {
+			case p < i:
+				public = append(public, p)
+			case p > i:
+				public = append(public, p-1)
+			}
+		}
+		f.PublicImports = public
+		return
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package move
+
+import (
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// referrer returns the *ast.Message, *ast.Extension or *ast.Service in whose
+// scope the name of r is resolved
+func referrer(r ast.Reference) interface{} {
+	switch n := r.Node.(type) {
+	case *ast.Field:
+		return n.Up
+	case *ast.Method:
+		return n.Up
+	}
+	return r.Node
+}
+
+// topLevel returns the top-level definition enclosing x, which may be x
+// itself
+func topLevel(x interface{}) interface{} {
+	for {
+		var up interface{}
+		switch v := x.(type) {
+		case *ast.Message:
+			up = v.Up
+		case *ast.Enum:
+			up = v.Up
+		case *ast.Extension:
+			up = v.Up
+		}
+		if _, ok := up.(*ast.Message); !ok {
+			return x
+		}
+		x = up
+	}
+}
+
+// scopeOf returns the components of the scope in which the names used by
+// from are resolved: its package, followed by the messages enclosing its
+// references
+func scopeOf(from interface{}) []string {
+	var parts []string
+	x := from
+	if e, ok := from.(*ast.Extension); ok {
+		x = e.Up
+	}
+	for {
+		switch v := x.(type) {
+		case *ast.Message:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *ast.Service:
+			x = v.Up
+			continue
+		case *ast.File:
+			parts = append(append([]string{}, v.Package...), parts...)
+		}
+		return parts
+	}
+}
+
+// nodeName returns the name of the message, enum or service n
+func nodeName(n ast.Node) string {
+	switch n := n.(type) {
+	case *ast.Message:
+		return n.Name
+	case *ast.Enum:
+		return n.Name
+	case *ast.Service:
+		return n.Name
+	}
+	return ""
+}
+
+// qualified returns name qualified by the package pkg
+func qualified(pkg []string, name string) string {
+	return strings.Join(append(append([]string{}, pkg...), name), ".")
+}
+
+// defined returns the set of the full names of the messages, enums and
+// services of fset, together with its packages and their prefixes
+func defined(fset *ast.FileSet) map[string]bool {
+	res := make(map[string]bool)
+
+	var addMsgs func(msgs []*ast.Message)
+	addMsgs = func(msgs []*ast.Message) {
+		for _, m := range msgs {
+			res[ast.FullName(m)] = true
+			for _, e := range m.Enums {
+				res[ast.FullName(e)] = true
+			}
+			addMsgs(m.Messages)
+		}
+	}
+
+	for _, f := range fset.Files {
+		for i := range f.Package {
+			res[strings.Join(f.Package[:i+1], ".")] = true
+		}
+		addMsgs(f.Messages)
+		for _, e := range f.Enums {
+			res[ast.FullName(e)] = true
+		}
+		for _, s := range f.Services {
+			res[ast.FullName(s)] = true
+		}
+	}
+
+	return res
+}
+
+// resolve returns the full name to which name refers within scope, given
+// the defined names defs, or "" if it refers to nothing. As in protoc, the
+// first component of name is looked for in scope and then in each enclosing
+// scope in turn, and the rest of name is then resolved relative to the first
+// match alone.
+func resolve(defs map[string]bool, scope []string, name string) string {
+	if strings.HasPrefix(name, ".") {
+		if n := name[1:]; defs[n] {
+			return n
+		}
+		return ""
+	}
+	first := strings.SplitN(name, ".", 2)[0]
+	for i := len(scope); i >= 0; i-- {
+		if defs[qualified(scope[:i], first)] {
+			if n := qualified(scope[:i], name); defs[n] {
+				return n
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// shortest returns the shortest name that refers to the full name target
+// within scope, falling back to the fully-qualified .target
+func shortest(defs map[string]bool, scope []string, target string) string {
+	parts := strings.Split(target, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if n := strings.Join(parts[i:], "."); resolve(defs, scope, n) == target {
+			return n
+		}
+	}
+	return "." + target
+}
@@ -0,0 +1,379 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package parser
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// DefaultMaxDepth is the maximum nesting depth of messages used by ParseFile,
+// and by a Config whose MaxDepth is zero.
+const DefaultMaxDepth = 100
+
+// A Config controls how files are loaded and parsed by ParseFiles. The zero
+// value is ready to use.
+//
+// The limits MaxFileSize, MaxDepth, MaxFiles and MaxTokens bound the
+// resources used in parsing untrusted input. A file that exceeds a limit
+// results in a *SyntaxError: at the token at which the limit was reached,
+// or, if the limit applies to the file as a whole, at the start of the file.
+type Config struct {
+	// ImportPaths are the paths searched for files and their imports. If
+	// empty, the current directory is used.
+	ImportPaths []string
+
+	// Concurrency is the maximum number of files parsed at any one time. If
+	// zero, runtime.NumCPU() is used.
+	Concurrency int
+
+	// Cache, if non-nil, holds files parsed by previous calls. A file whose
+	// contents are unchanged is not parsed again.
+	Cache *Cache
+
+	// MaxFileSize is the maximum size of a file in bytes. If zero, there is
+	// no limit.
+	MaxFileSize int
+
+	// MaxDepth is the maximum nesting depth of messages, counting groups and
+	// the messages of extend blocks. If zero, DefaultMaxDepth is used; if
+	// negative, there is no limit.
+	MaxDepth int
+
+	// MaxFiles is the maximum number of files loaded by ParseFiles,
+	// including imports. If zero, there is no limit.
+	MaxFiles int
+
+	// MaxTokens is the maximum total number of tokens in the files loaded by
+	// ParseFiles, or in the file parsed by ParseFile. If zero, there is no
+	// limit.
+	MaxTokens int
+
+	// RequireImports, if set, makes ParseFiles resolve a name only to a
+	// definition in the file that refers to it or in the files it imports,
+	// as protoc requires. Otherwise a name may resolve to a definition in
+	// any of the files loaded.
+	RequireImports bool
+}
+
+// limits returns the limits of c for a parser, counting tokens in *tokens.
+func (c *Config) limits(tokens *int64) limits {
+	lim := limits{
+		maxDepth:  c.MaxDepth,
+		maxTokens: int64(c.MaxTokens),
+		tokens:    tokens,
+	}
+	if lim.maxDepth == 0 {
+		lim.maxDepth = DefaultMaxDepth
+	}
+	return lim
+}
+
+// ParseFile is like the package-level ParseFile, except that the limits of c
+// other than MaxFiles apply, and c.Cache is used if set.
+func (c *Config) ParseFile(filename string, src []byte) (*ast.File, error) {
+	f, _, err := c.parseFile(filename, src, c.limits(new(int64)))
+	return f, err
+}
+
+func (c *Config) parseFile(filename string, src []byte, lim limits) (*ast.File, usage, error) {
+	if c.MaxFileSize > 0 && len(src) > c.MaxFileSize {
+		return nil, usage{}, fileError(filename, "file too large (%d bytes, the limit is %d)", len(src), c.MaxFileSize)
+	}
+
+	if c.Cache == nil {
+		f := &ast.File{Name: filename}
+		u, pe := parseFile(f, string(src), lim)
+		if pe != nil {
+			return nil, usage{}, pe
+		}
+		return f, u, nil
+	}
+
+	return c.Cache.parseFile(filename, src, lim)
+}
+
+// ParseFiles parses the named files, and all the files they import, and
+// resolves the result. The files of the returned FileSet are in breadth-first
+// order starting with filenames. Files that do not depend on each other are
+// parsed concurrently. As for ParseFile and Resolve, an error in the source of
+// a file is returned as a *SyntaxError, and an error in resolving its names,
+// or an import that cannot be found, as a *ResolveError; other errors, for
+// example a named file that cannot be found, carry no position.
+func (c *Config) ParseFiles(filenames []string) (*ast.FileSet, error) {
+	paths := c.ImportPaths
+
+	// Force importPaths to have at least one element.
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var absImportPaths []string
+	for _, p := range paths {
+		f, err := filepath.Abs(p)
+		if err != nil {
+			// TODO could return a better error here
+			return nil, err
+		}
+		absImportPaths = append(absImportPaths, f)
+	}
+
+	conc := c.Concurrency
+	if conc <= 0 {
+		conc = runtime.NumCPU()
+	}
+
+	fset := new(ast.FileSet)
+
+	seen := make(map[string]bool)
+	lim := c.limits(new(int64))
+
+	// importedAt holds the first import statement of each imported file
+	importedAt := make(map[string]*importStmt)
+
+	// Parse a breadth-first frontier of files at a time; the files of a
+	// frontier cannot depend on each other having been parsed.
+	for len(filenames) > 0 {
+		var frontier []string
+		for _, fn := range filenames {
+			if !seen[fn] {
+				seen[fn] = true
+				frontier = append(frontier, fn)
+				if c.MaxFiles > 0 && len(seen) > c.MaxFiles {
+					return nil, fileError(fn, "too many files (the limit is %d)", c.MaxFiles)
+				}
+			}
+		}
+
+		files := make([]*ast.File, len(frontier))
+		us := make([]usage, len(frontier))
+		errs := make([]error, len(frontier))
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, conc)
+
+		for i, fn := range frontier {
+			wg.Add(1)
+			sem <- struct{}{}
+
+			go func(i int, fn string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				files[i], us[i], errs[i] = c.loadFile(fn, paths, absImportPaths, lim, importedAt[fn])
+			}(i, fn)
+		}
+
+		wg.Wait()
+
+		// report the first error in frontier order, so that errors are
+		// deterministic
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		filenames = nil
+		for i, f := range files {
+			fset.Files = append(fset.Files, f)
+
+			// enqueue unparsed imports
+			for j, imp := range f.Imports {
+				if !seen[imp] {
+					filenames = append(filenames, imp)
+					if importedAt[imp] == nil {
+						importedAt[imp] = &importStmt{filename: f.Name, pos: us[i].imports[j]}
+					}
+				}
+			}
+		}
+	}
+
+	if err := resolveSymbols(fset, c.RequireImports); err != nil {
+		return nil, err
+	}
+	return fset, nil
+}
+
+// loadFile reads and parses filename, consulting c.Cache if set. If filename
+// is imported, at is the first import statement of it; a file that cannot be
+// found is then reported as an error at that statement.
+func (c *Config) loadFile(filename string, paths, absImportPaths []string, lim limits, at *importStmt) (*ast.File, usage, error) {
+	buf, err := readImport(filename, absImportPaths)
+	if err != nil {
+		return nil, usage{}, err
+	}
+	if buf == nil {
+		if at != nil {
+			return nil, usage{}, &ResolveError{
+				Filename: at.filename,
+				Pos:      at.pos,
+				Msg:      fmt.Sprintf("import %q not found in import paths %v", filename, paths),
+			}
+		}
+		return nil, usage{}, fmt.Errorf("file not found in import paths: %s, paths %v", filename, paths)
+	}
+
+	return c.parseFile(filename, buf, lim)
+}
+
+// importStmt is the position of an import statement of a file
+type importStmt struct {
+	filename string
+	pos      ast.Position
+}
+
+// A Cache holds parsed files for reuse by calls to Config.ParseFiles, keyed by
+// file name and checked against a hash of the file's contents. The zero value
+// is an empty cache ready to use. A Cache is safe for concurrent use.
+//
+// A Cache holds files as parsed, before they are resolved, and returns a copy
+// of a file each time it is used; the FileSets returned by calls using the
+// same Cache therefore share nothing.
+//
+// A file whose contents have changed is dropped when it is next used, whether
+// or not it then parses.
+type Cache struct {
+	// MaxFiles is the maximum number of files held. If the cache is full,
+	// the least recently used file makes way for a new one. If zero, there
+	// is no limit.
+	MaxFiles int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	clock   uint64 // counts uses, to order entries by their last use
+}
+
+type cacheEntry struct {
+	sum   [sha256.Size]byte
+	file  *ast.File
+	usage usage  // checked against the limits of later calls
+	used  uint64 // the value of clock when the entry was last used
+}
+
+// ParseFile is like the package-level ParseFile, except that if c holds a
+// file with the same name and contents a copy of that file is returned
+// instead. The file returned is the caller's own to resolve or modify.
+func (c *Cache) ParseFile(filename string, src []byte) (*ast.File, error) {
+	f, _, err := c.parseFile(filename, src, limits{maxDepth: DefaultMaxDepth})
+	return f, err
+}
+
+func (c *Cache) parseFile(filename string, src []byte, lim limits) (*ast.File, usage, error) {
+	sum := sha256.Sum256(src)
+
+	if e, ok := c.get(filename, sum); ok {
+		// the file was parsed under other limits; check it against ours
+		if lim.maxDepth > 0 && e.usage.depth > lim.maxDepth {
+			return nil, usage{}, fileError(filename, "messages nested too deeply (the limit is %d)", lim.maxDepth)
+		}
+		n := e.usage.tokens
+		if lim.tokens != nil {
+			n = atomic.AddInt64(lim.tokens, n)
+		}
+		if lim.maxTokens > 0 && n > lim.maxTokens {
+			return nil, usage{}, fileError(filename, "too many tokens (the limit is %d)", lim.maxTokens)
+		}
+		return cloneFile(e.file), e.usage, nil
+	}
+
+	f := &ast.File{Name: filename}
+	u, pe := parseFile(f, string(src), lim)
+	if pe != nil {
+		return nil, usage{}, pe
+	}
+
+	c.put(filename, cacheEntry{sum: sum, file: cloneFile(f), usage: u})
+
+	return f, u, nil
+}
+
+// cloneFile returns a deep copy of f, so that callers cannot change the
+// file held by the cache
+func cloneFile(f *ast.File) *ast.File {
+	return (&ast.FileSet{Files: []*ast.File{f}}).Clone().Files[0]
+}
+
+func (c *Cache) get(filename string, sum [sha256.Size]byte) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[filename]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if e.sum != sum {
+		delete(c.entries, filename)
+		return cacheEntry{}, false
+	}
+	c.clock++
+	e.used = c.clock
+	c.entries[filename] = e
+	return e, true
+}
+
+func (c *Cache) put(filename string, e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	if _, ok := c.entries[filename]; !ok && c.MaxFiles > 0 {
+		for len(c.entries) >= c.MaxFiles {
+			c.evict()
+		}
+	}
+	c.clock++
+	e.used = c.clock
+	c.entries[filename] = e
+}
+
+// evict removes the least recently used entry of c; c.mu must be held.
+func (c *Cache) evict() {
+	var oldest string
+	var used uint64
+	first := true
+	for name, e := range c.entries {
+		if first || e.used < used {
+			oldest, used, first = name, e.used, false
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// Len returns the number of files held by c.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Forget removes the named file from c, if present.
+func (c *Cache) Forget(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, filename)
+}
+
+// fileError returns an error for a limit exceeded by the file filename as a
+// whole, positioned at its start.
+func fileError(filename, format string, a ...interface{}) *SyntaxError {
+	return &SyntaxError{
+		Filename: filename,
+		Pos:      ast.Position{Line: 1},
+		Msg:      fmt.Sprintf(format, a...),
+	}
+}
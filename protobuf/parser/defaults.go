@@ -0,0 +1,236 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package parser
+
+// This file implements the checking of field default values against the
+// resolved field type, and their normalisation to the form protoc uses for
+// FieldDescriptorProto.default_value.
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// checkDefault checks the default value of f, if any, against its resolved
+// type, and sets f.DefaultValue.
+func checkDefault(f *ast.Field) *ResolveError {
+	if !f.HasDefault {
+		return nil
+	}
+	if f.File().Syntax == "proto3" {
+		return errorAt(f, "explicit default values are not allowed in proto3")
+	}
+	if f.Repeated {
+		return errorAt(f, "repeated fields can't have default values")
+	}
+	if f.ResolvedFeatures().FieldPresence == "IMPLICIT" {
+		return errorAt(f, "implicit presence fields can't specify defaults")
+	}
+
+	v, err := normaliseDefault(f.Type, f.Default)
+	if err != nil {
+		return errorAt(f, "invalid default value %v for field %q: %v", f.Default, f.Name, err)
+	}
+	f.DefaultValue = v
+
+	return nil
+}
+
+// normaliseDefault checks the default value lit, as written, against the
+// field type typ and returns it in normalised form.
+func normaliseDefault(typ interface{}, lit string) (string, error) {
+	if strings.HasPrefix(lit, `"`) {
+		s, err := strconv.Unquote(lit)
+		if err != nil {
+			return "", err
+		}
+		switch typ {
+		case ast.String:
+			return s, nil
+		case ast.Bytes:
+			return cEscape(s), nil
+		}
+		return "", fmt.Errorf("a string is not a valid %v", strings.TrimPrefix(ast.TypeName(typ), "."))
+	}
+
+	neg := strings.HasPrefix(lit, "-")
+	abs := strings.TrimPrefix(lit, "-")
+
+	var kind tokenKind
+	switch {
+	case isIdent(abs):
+		kind = tokenIdent
+	case abs != "":
+		var n int
+		var ok bool
+		kind, n, ok = scanNumber(abs)
+		if !ok || n != len(abs) {
+			return "", fmt.Errorf("malformed number")
+		}
+	}
+
+	switch typ := typ.(type) {
+	case ast.FieldType:
+		switch typ {
+		case ast.Int32, ast.Sint32, ast.Sfixed32:
+			return normaliseInt(kind, neg, abs, math.MinInt32, math.MaxInt32)
+		case ast.Int64, ast.Sint64, ast.Sfixed64:
+			return normaliseInt(kind, neg, abs, math.MinInt64, math.MaxInt64)
+		case ast.Uint32, ast.Fixed32:
+			return normaliseUint(kind, neg, abs, math.MaxUint32)
+		case ast.Uint64, ast.Fixed64:
+			return normaliseUint(kind, neg, abs, math.MaxUint64)
+		case ast.Float:
+			return normaliseFloat(kind, neg, abs, 32)
+		case ast.Double:
+			return normaliseFloat(kind, neg, abs, 64)
+		case ast.Bool:
+			if kind == tokenIdent && !neg && (abs == "true" || abs == "false") {
+				return abs, nil
+			}
+			return "", fmt.Errorf("expected true or false")
+		case ast.String, ast.Bytes:
+			return "", fmt.Errorf("expected a string")
+		}
+	case *ast.Enum:
+		if kind != tokenIdent || neg {
+			return "", fmt.Errorf("expected a value of enum %v", typ.Name)
+		}
+		for _, ev := range typ.Values {
+			if ev.Name == abs {
+				return abs, nil
+			}
+		}
+		return "", fmt.Errorf("enum %v has no value named %v", typ.Name, abs)
+	case *ast.Message:
+		return "", fmt.Errorf("message fields can't have default values")
+	}
+
+	return "", fmt.Errorf("unexpected field type %v", strings.TrimPrefix(ast.TypeName(typ), "."))
+}
+
+func normaliseInt(kind tokenKind, neg bool, abs string, min, max int64) (string, error) {
+	if kind != tokenInt {
+		return "", fmt.Errorf("expected an integer")
+	}
+	u, err := parseInt(abs)
+	if err != nil {
+		return "", fmt.Errorf("integer out of range")
+	}
+
+	// compare magnitudes, as -min does not fit in an int64
+	if neg && u > uint64(-(min+1))+1 || !neg && u > uint64(max) {
+		return "", fmt.Errorf("integer out of range [%v, %v]", min, max)
+	}
+
+	if neg && u != 0 {
+		return "-" + strconv.FormatUint(u, 10), nil
+	}
+	return strconv.FormatUint(u, 10), nil
+}
+
+func normaliseUint(kind tokenKind, neg bool, abs string, max uint64) (string, error) {
+	if kind != tokenInt {
+		return "", fmt.Errorf("expected an integer")
+	}
+	if neg {
+		return "", fmt.Errorf("unsigned fields can't have negative default values")
+	}
+	u, err := parseInt(abs)
+	if err != nil || u > max {
+		return "", fmt.Errorf("integer out of range [0, %v]", max)
+	}
+	return strconv.FormatUint(u, 10), nil
+}
+
+// normaliseFloat normalises a floating point default in the same way as
+// protoc's SimpleDtoa and SimpleFtoa: the shortest of the %g forms with
+// DBL_DIG (or FLT_DIG) and maximum precision that reads back as the same
+// value. inf and nan are written as such.
+func normaliseFloat(kind tokenKind, neg bool, abs string, bitSize int) (string, error) {
+	var v float64
+
+	switch kind {
+	case tokenIdent:
+		switch abs {
+		case "inf":
+			if neg {
+				return "-inf", nil
+			}
+			return "inf", nil
+		case "nan":
+			return "nan", nil
+		}
+		return "", fmt.Errorf("expected a number, inf or nan")
+	case tokenInt:
+		u, err := parseInt(abs)
+		if err != nil {
+			return "", fmt.Errorf("integer out of range")
+		}
+		v = float64(u)
+	case tokenFloat:
+		f, err := strconv.ParseFloat(abs, 64)
+		if err != nil {
+			return "", fmt.Errorf("number out of range")
+		}
+		v = f
+	default:
+		return "", fmt.Errorf("expected a number")
+	}
+
+	if neg {
+		v = -v
+	}
+
+	digits := [...]int{15, 17}
+	if bitSize == 32 {
+		digits = [...]int{6, 9}
+		v = float64(float32(v))
+	}
+	if math.IsInf(v, 0) {
+		return "", fmt.Errorf("number out of range")
+	}
+
+	s := strconv.FormatFloat(v, 'g', digits[0], bitSize)
+	if r, _ := strconv.ParseFloat(s, bitSize); r != v {
+		s = strconv.FormatFloat(v, 'g', digits[1], bitSize)
+	}
+
+	return s, nil
+}
+
+// cEscape escapes the bytes of s in the same way as protoc's CEscape, which
+// is how default values of bytes fields are recorded in descriptors.
+func cEscape(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&b, `\%03o`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package parser
+
+import (
+	"testing"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// FuzzParseFile checks that parsing and resolving arbitrary input never
+// panics, that the limits of a Config are respected, and that resolution
+// fails only with a *ResolveError. The seed corpus is
+// the input of the parse tests, together with the crashers found so far in
+// testdata/fuzz/FuzzParseFile.
+func FuzzParseFile(f *testing.F) {
+	for _, tt := range parseTests {
+		f.Add([]byte(tt.input))
+	}
+	for _, tt := range parseErrorTests {
+		f.Add([]byte(tt.input))
+	}
+	for _, tt := range resolveErrorTests {
+		f.Add([]byte(tt.input))
+	}
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		c := &Config{
+			MaxFileSize: 1 << 16,
+			MaxDepth:    10,
+			MaxTokens:   1 << 12,
+		}
+		file, err := c.ParseFile("fuzz.proto", src)
+		if err != nil {
+			if file != nil {
+				t.Fatalf("got a file and error %v", err)
+			}
+			return
+		}
+		// the file's imports are missing, and so any type it refers to
+		// that they would define is unresolved; that, like any other
+		// failure to resolve the file, must be reported as a *ResolveError
+		if err := Resolve(&ast.FileSet{Files: []*ast.File{file}}); err != nil {
+			if _, ok := err.(*ResolveError); !ok {
+				t.Fatalf("got error %v of type %T, want a *ResolveError", err, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package parser
+
+// This file implements the lexical grammar of identifiers, numbers and
+// strings, as described in the protocol buffers language specification.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func isLetter(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || c == '_'
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isOctalDigit(c byte) bool { return '0' <= c && c <= '7' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// isIdent reports whether s is an identifier: a letter followed by letters,
+// digits and underscores.
+func isIdent(s string) bool {
+	if s == "" || !isLetter(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isLetter(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isQualifiedName reports whether s is a fully-qualified name: a sequence of
+// identifiers, each preceded by a dot.
+func isQualifiedName(s string) bool {
+	if !strings.HasPrefix(s, ".") {
+		return false
+	}
+	for _, part := range strings.Split(s[1:], ".") {
+		if !isIdent(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanNumber scans the integer or floating point literal at the start of s,
+// which starts with a digit or a dot. It returns the kind of the literal and
+// its length. If the literal is malformed, ok is false and n is the length of
+// the malformed text.
+func scanNumber(s string) (kind tokenKind, n int, ok bool) {
+	// the end of a literal must not be followed by anything that could
+	// continue it, e.g. 1.2.3 or 0x1g
+	bad := func(i int) (tokenKind, int, bool) {
+		for i < len(s) && (isLetter(s[i]) || isDigit(s[i]) || s[i] == '.') {
+			i++
+		}
+		return 0, i, false
+	}
+	done := func(kind tokenKind, i int) (tokenKind, int, bool) {
+		if i < len(s) && (isLetter(s[i]) || isDigit(s[i]) || s[i] == '.') {
+			return bad(i)
+		}
+		return kind, i, true
+	}
+
+	i := 0
+
+	if len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		i = 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+		if i == 2 {
+			return bad(i)
+		}
+		return done(tokenInt, i)
+	}
+
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	intPart := s[:i]
+
+	kind = tokenInt
+	if i < len(s) && s[i] == '.' {
+		kind = tokenFloat
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		kind = tokenFloat
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		j := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == j {
+			return bad(i)
+		}
+	}
+
+	if kind == tokenInt && len(intPart) > 1 && intPart[0] == '0' {
+		// octal
+		for j := 1; j < len(intPart); j++ {
+			if !isOctalDigit(intPart[j]) {
+				return bad(i)
+			}
+		}
+	}
+
+	return done(kind, i)
+}
+
+// parseInt parses the value of the integer literal s, which may be decimal,
+// octal (with a leading 0) or hexadecimal (with a leading 0x or 0X).
+func parseInt(s string) (uint64, error) {
+	switch {
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		return strconv.ParseUint(s[2:], 16, 64)
+	case len(s) > 1 && s[0] == '0':
+		return strconv.ParseUint(s[1:], 8, 64)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// unquote returns the value of the string literal lit, which is enclosed in
+// single or double quotes, interpreting the escape sequences of the protocol
+// buffers language:
+//
+//	\a \b \f \n \r \t \v \\ \' \" \?
+//	\ooo   an octal byte value (1 to 3 digits)
+//	\xhh   a hexadecimal byte value (1 or 2 digits; also \X)
+//	\uhhhh a Unicode code point, encoded as UTF-8
+//	\Uhhhhhhhh
+func unquote(lit string) (string, error) {
+	if len(lit) < 2 || lit[0] != lit[len(lit)-1] || lit[0] != '"' && lit[0] != '\'' {
+		return "", errors.New("not a quoted string")
+	}
+	s := lit[1 : len(lit)-1]
+
+	var b bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == lit[0]:
+			return "", errors.New("unescaped quote")
+		case c == '\n' || c == 0:
+			return "", fmt.Errorf("invalid character %q", c)
+		case c != '\\':
+			b.WriteByte(c)
+			i++
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", errors.New("unterminated escape sequence")
+		}
+		c = s[i]
+		i++
+
+		switch c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '\'', '"', '?':
+			b.WriteByte(c)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			v := int(c - '0')
+			for n := 1; n < 3 && i < len(s) && isOctalDigit(s[i]); n++ {
+				v = v*8 + int(s[i]-'0')
+				i++
+			}
+			if v > 0xff {
+				return "", fmt.Errorf("octal escape value %o out of range", v)
+			}
+			b.WriteByte(byte(v))
+		case 'x', 'X':
+			j := i
+			for i < len(s) && i-j < 2 && isHexDigit(s[i]) {
+				i++
+			}
+			if i == j {
+				return "", fmt.Errorf(`\%c used with no following hex digits`, c)
+			}
+			v, _ := strconv.ParseUint(s[j:i], 16, 8)
+			b.WriteByte(byte(v))
+		case 'u', 'U':
+			n := 4
+			if c == 'U' {
+				n = 8
+			}
+			if i+n > len(s) {
+				return "", fmt.Errorf(`\%c requires %v hex digits`, c, n)
+			}
+			for j := i; j < i+n; j++ {
+				if !isHexDigit(s[j]) {
+					return "", fmt.Errorf(`\%c requires %v hex digits`, c, n)
+				}
+			}
+			v, _ := strconv.ParseUint(s[i:i+n], 16, 32)
+			i += n
+			if v > utf8.MaxRune || 0xd800 <= v && v < 0xe000 {
+				return "", fmt.Errorf(`\%c%0*x is not a valid Unicode code point`, c, n, v)
+			}
+			b.WriteRune(rune(v))
+		default:
+			return "", fmt.Errorf(`unknown escape sequence \%c`, c)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// quote returns lit, a (possibly concatenated) string literal whose value is
+// unq, if it is a single double-quoted literal that strconv.Unquote
+// interprets as unq. Otherwise it returns a double-quoted literal for unq that
+// strconv.Unquote does accept. The string values recorded in the AST can
+// therefore always be interpreted by strconv.Unquote, while keeping the
+// author's spelling where possible.
+func quote(lit, unq string) string {
+	if v, err := strconv.Unquote(lit); err == nil && v == unq && lit[0] == '"' {
+		return lit
+	}
+	return strconv.Quote(unq)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// The vendored descriptor package predates some of the fields of
+// descriptor.proto, which gendesc records as unknown fields. The types below
+// decode them.
+
+type fieldExtra struct {
+	Proto3Optional *bool `protobuf:"varint,17,opt,name=proto3_optional"`
+}
+
+func (m *fieldExtra) Reset()         { *m = fieldExtra{} }
+func (m *fieldExtra) String() string { return proto.CompactTextString(m) }
+func (*fieldExtra) ProtoMessage()    {}
+
+type fileExtra struct {
+	Edition *edition `protobuf:"varint,14,opt,name=edition"`
+}
+
+func (m *fileExtra) Reset()         { *m = fileExtra{} }
+func (m *fileExtra) String() string { return proto.CompactTextString(m) }
+func (*fileExtra) ProtoMessage()    {}
+
+type featureSet struct {
+	FieldPresence         *fieldPresence         `protobuf:"varint,1,opt,name=field_presence"`
+	EnumType              *enumType              `protobuf:"varint,2,opt,name=enum_type"`
+	RepeatedFieldEncoding *repeatedFieldEncoding `protobuf:"varint,3,opt,name=repeated_field_encoding"`
+	Utf8Validation        *utf8Validation        `protobuf:"varint,4,opt,name=utf8_validation"`
+	MessageEncoding       *messageEncoding       `protobuf:"varint,5,opt,name=message_encoding"`
+	JsonFormat            *jsonFormat            `protobuf:"varint,6,opt,name=json_format"`
+}
+
+func (m *featureSet) Reset()         { *m = featureSet{} }
+func (m *featureSet) String() string { return proto.CompactTextString(m) }
+func (*featureSet) ProtoMessage()    {}
+
+type edition int32
+
+func (x edition) String() string {
+	return proto.EnumName(map[int32]string{1000: "EDITION_2023"}, int32(x))
+}
+
+type fieldPresence int32
+
+func (x fieldPresence) String() string {
+	return proto.EnumName(map[int32]string{1: "EXPLICIT", 2: "IMPLICIT", 3: "LEGACY_REQUIRED"}, int32(x))
+}
+
+type enumType int32
+
+func (x enumType) String() string {
+	return proto.EnumName(map[int32]string{1: "OPEN", 2: "CLOSED"}, int32(x))
+}
+
+type repeatedFieldEncoding int32
+
+func (x repeatedFieldEncoding) String() string {
+	return proto.EnumName(map[int32]string{1: "PACKED", 2: "EXPANDED"}, int32(x))
+}
+
+type utf8Validation int32
+
+func (x utf8Validation) String() string {
+	return proto.EnumName(map[int32]string{2: "VERIFY", 3: "NONE"}, int32(x))
+}
+
+type messageEncoding int32
+
+func (x messageEncoding) String() string {
+	return proto.EnumName(map[int32]string{1: "LENGTH_PREFIXED", 2: "DELIMITED"}, int32(x))
+}
+
+type jsonFormat int32
+
+func (x jsonFormat) String() string {
+	return proto.EnumName(map[int32]string{1: "ALLOW", 2: "LEGACY_BEST_EFFORT"}, int32(x))
+}
+
+type fileOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,50,opt,name=features"`
+}
+
+func (m *fileOptionsExtra) Reset()         { *m = fileOptionsExtra{} }
+func (m *fileOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*fileOptionsExtra) ProtoMessage()    {}
+
+type messageOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,12,opt,name=features"`
+}
+
+func (m *messageOptionsExtra) Reset()         { *m = messageOptionsExtra{} }
+func (m *messageOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*messageOptionsExtra) ProtoMessage()    {}
+
+type fieldOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,21,opt,name=features"`
+}
+
+func (m *fieldOptionsExtra) Reset()         { *m = fieldOptionsExtra{} }
+func (m *fieldOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*fieldOptionsExtra) ProtoMessage()    {}
+
+type enumOptionsExtra struct {
+	Features *featureSet `protobuf:"bytes,7,opt,name=features"`
+}
+
+func (m *enumOptionsExtra) Reset()         { *m = enumOptionsExtra{} }
+func (m *enumOptionsExtra) String() string { return proto.CompactTextString(m) }
+func (*enumOptionsExtra) ProtoMessage()    {}
+
+type extensionRangeExtra struct {
+	Options *extensionRangeOptions `protobuf:"bytes,3,opt,name=options"`
+}
+
+func (m *extensionRangeExtra) Reset()         { *m = extensionRangeExtra{} }
+func (m *extensionRangeExtra) String() string { return proto.CompactTextString(m) }
+func (*extensionRangeExtra) ProtoMessage()    {}
+
+type extensionRangeOptions struct {
+	Declaration         []*declaration            `protobuf:"bytes,2,rep,name=declaration"`
+	Verification        *verificationState        `protobuf:"varint,3,opt,name=verification"`
+	UninterpretedOption []*pb.UninterpretedOption `protobuf:"bytes,999,rep,name=uninterpreted_option"`
+}
+
+func (m *extensionRangeOptions) Reset()         { *m = extensionRangeOptions{} }
+func (m *extensionRangeOptions) String() string { return proto.CompactTextString(m) }
+func (*extensionRangeOptions) ProtoMessage()    {}
+
+type declaration struct {
+	Number   *int32  `protobuf:"varint,1,opt,name=number"`
+	FullName *string `protobuf:"bytes,2,opt,name=full_name"`
+	Type     *string `protobuf:"bytes,3,opt,name=type"`
+	Reserved *bool   `protobuf:"varint,5,opt,name=reserved"`
+	Repeated *bool   `protobuf:"varint,6,opt,name=repeated"`
+}
+
+func (m *declaration) Reset()         { *m = declaration{} }
+func (m *declaration) String() string { return proto.CompactTextString(m) }
+func (*declaration) ProtoMessage()    {}
+
+type verificationState int32
+
+func (x verificationState) String() string {
+	return proto.EnumName(map[int32]string{0: "DECLARATION", 1: "UNVERIFIED"}, int32(x))
+}
+
+// newerExtras maps the name of each descriptor type to a func returning the
+// type that decodes its unknown fields
+var newerExtras = map[string]func() proto.Message{
+	"FileDescriptorProto":            func() proto.Message { return new(fileExtra) },
+	"FieldDescriptorProto":           func() proto.Message { return new(fieldExtra) },
+	"DescriptorProto_ExtensionRange": func() proto.Message { return new(extensionRangeExtra) },
+	"FileOptions":                    func() proto.Message { return new(fileOptionsExtra) },
+	"MessageOptions":                 func() proto.Message { return new(messageOptionsExtra) },
+	"FieldOptions":                   func() proto.Message { return new(fieldOptionsExtra) },
+	"EnumOptions":                    func() proto.Message { return new(enumOptionsExtra) },
+}
+
+// newerFields removes the unknown fields from m, a descriptor, returning
+// them in text format, each prefixed by the path to the message holding it
+func newerFields(t *testing.T, m proto.Message) []string {
+	var res []string
+
+	var walk func(path string, v reflect.Value)
+	walk = func(path string, v reflect.Value) {
+		if v.IsNil() {
+			return
+		}
+		s := v.Elem()
+		if u := s.FieldByName("XXX_unrecognized"); u.IsValid() && u.Len() > 0 {
+			extra, ok := newerExtras[s.Type().Name()]
+			if !ok {
+				t.Fatalf("%v: unexpected unknown fields in a %v", path, s.Type().Name())
+			}
+			x := extra()
+			if err := proto.Unmarshal(u.Bytes(), x); err != nil {
+				t.Fatalf("%v: could not decode unknown fields: %v", path, err)
+			}
+			res = append(res, fmt.Sprintf("%v: %v", path, strings.TrimSpace(proto.CompactTextString(x))))
+			u.SetBytes(nil)
+		}
+
+		for i := 0; i < s.NumField(); i++ {
+			f := s.Type().Field(i)
+			name := f.Name
+			for _, p := range strings.Split(f.Tag.Get("protobuf"), ",") {
+				if strings.HasPrefix(p, "name=") {
+					name = strings.TrimPrefix(p, "name=")
+				}
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+
+			switch fv := s.Field(i); {
+			case fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct:
+				walk(name, fv)
+			case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Ptr:
+				for j := 0; j < fv.Len(); j++ {
+					walk(fmt.Sprintf("%v[%v]", name, j), fv.Index(j))
+				}
+			}
+		}
+	}
+	walk("", reflect.ValueOf(m))
+
+	return res
+}
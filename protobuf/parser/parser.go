@@ -10,10 +10,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"unicode"
 
 	"myitcv.io/g/protobuf/ast"
@@ -27,130 +29,188 @@ func debugf(format string, args ...interface{}) {
 	}
 }
 
+// ParseFiles parses the named files, and all the files they import, searching
+// for each in paths, and resolves the result. It is shorthand for a Config
+// with ImportPaths set to paths.
 func ParseFiles(filenames []string, paths []string) (*ast.FileSet, error) {
-	// Force importPaths to have at least one element.
-	if len(paths) == 0 {
-		paths = []string{"."}
-	}
+	c := &Config{ImportPaths: paths}
+	return c.ParseFiles(filenames)
+}
 
-	var absImportPaths []string
-	for _, p := range paths {
-		f, err := filepath.Abs(p)
+// readImport reads the first existing file relative to an element of
+// absImportPaths.
+func readImport(filename string, absImportPaths []string) ([]byte, error) {
+	for _, impPath := range absImportPaths {
+		if !filepath.IsAbs(filename) {
+			// try and join the filename to the import path
+			b, err := ioutil.ReadFile(filepath.Join(impPath, filename))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return nil, err
+				}
+			} else {
+				return b, nil
+			}
+		}
+		absFilename, err := filepath.Abs(filename)
 		if err != nil {
-			// TODO could return a better error here
 			return nil, err
 		}
-		absImportPaths = append(absImportPaths, f)
-	}
+		rel, err := filepath.Rel(impPath, absFilename)
+		if err != nil || strings.HasPrefix(rel, ".") {
+			// in this case we either couldn't make it relative
+			// or this import path does not 'contain' the file
+			continue
+		}
 
-	fset := new(ast.FileSet)
+		// otherwise this file exists within the import path
+		// read it
+		b, err := ioutil.ReadFile(absFilename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		return b, nil
+	}
+	return nil, nil
+}
 
-	index := make(map[string]int) // filename => index in fset.Files
+// ParseFile parses the proto source src, reporting any errors against
+// filename. Unlike ParseFiles, imports are neither loaded nor resolved: the
+// Type, KeyType, InType, OutType and ExtendeeType fields of the returned AST
+// are left unset. This is sufficient for purely syntactic tools like protofmt;
+// other tools may collect files parsed by ParseFile in a FileSet, and then
+// call Resolve. An error in src is returned as a *SyntaxError.
+//
+// Messages may be nested to a depth of at most DefaultMaxDepth; use
+// Config.ParseFile to set other limits.
+func ParseFile(filename string, src []byte) (*ast.File, error) {
+	f := &ast.File{Name: filename}
+	if _, pe := parseFile(f, string(src), limits{maxDepth: DefaultMaxDepth}); pe != nil {
+		return nil, pe
+	}
+	return f, nil
+}
 
-	for len(filenames) > 0 {
-		filename := filenames[0]
-		filenames = filenames[1:]
-		if _, ok := index[filename]; ok {
-			continue // already parsed this one
+// ParseAggregate parses the value of an option that is an aggregate, as
+// held in the Options of a definition, e.g. {get: "/v1/foo" body: "*"}.
+func ParseAggregate(value string) (ast.Aggregate, error) {
+	p := newParser("aggregate", value)
+	p.limits = limits{maxDepth: DefaultMaxDepth}
+	a, pe := p.readAggregate()
+	if pe == nil {
+		if tok := p.next(); tok.err != eof {
+			pe = p.errorf("unexpected %q after aggregate", tok.value)
 		}
+	}
+	if pe != nil {
+		return nil, pe
+	}
+	return a, nil
+}
 
-		f := &ast.File{Name: filename}
-		index[filename] = len(fset.Files)
-		fset.Files = append(fset.Files, f)
+// Resolve resolves the type references in fset, setting the Type, KeyType,
+// InType, OutType and ExtendeeType fields of its AST. fset must contain the
+// files imported (directly or transitively) by each of its files; the files
+// may have been resolved before. An error in resolving, or checking, the
+// names of a file is returned as a *ResolveError.
+func Resolve(fset *ast.FileSet) error {
+	return resolveSymbols(fset, false)
+}
 
-		// Read the first existing file relative to an element of importPaths.
-		var buf []byte
-		for _, impPath := range absImportPaths {
-			if !filepath.IsAbs(filename) {
-				// try and join the filename to the import path
-				b, err := ioutil.ReadFile(filepath.Join(impPath, filename))
-				if err != nil {
-					if !os.IsNotExist(err) {
-						return nil, err
-					}
-				} else {
-					buf = b
-				}
-			}
-			if buf == nil {
-				absFilename, err := filepath.Abs(filename)
-				if err != nil {
-					return nil, err
-				}
-				rel, err := filepath.Rel(impPath, absFilename)
-				if err != nil || strings.HasPrefix(rel, ".") {
-					// in this case we either couldn't make it relative
-					// or this import path does not 'contain' the file
-					continue
-				}
+// limits bounds the resources used by a parser.
+type limits struct {
+	maxDepth  int    // maximum nesting depth of messages; no limit if <= 0
+	maxTokens int64  // maximum number of tokens; no limit if <= 0
+	tokens    *int64 // if non-nil, tokens read by this and other parsers
+}
 
-				// otherwise this file exists within the import path
-				// read it
-				b, err := ioutil.ReadFile(absFilename)
-				if err != nil {
-					if os.IsNotExist(err) {
-						continue
-					}
-					return nil, err
-				}
-				buf = b
-			}
-			if buf != nil {
-				break
-			}
-		}
-		if buf == nil {
-			return nil, fmt.Errorf("file not found in import paths: %s, paths %v", filename, paths)
-		}
+// usage records the resources used in parsing a file, as bounded by limits,
+// and the positions of its imports, which are kept with it in a Cache.
+type usage struct {
+	depth  int   // maximum nesting depth of messages
+	tokens int64 // number of tokens
 
-		p := newParser(filename, string(buf))
-		if pe := p.readFile(f); pe != nil {
-			return nil, pe
-		}
-		if p.s != "" {
-			return nil, p.errorf("input was not all consumed")
-		}
+	imports []ast.Position // of the import statements, in the order of Imports
+}
 
-		// enqueue unparsed imports
-		for _, imp := range f.Imports {
-			if _, ok := index[imp]; !ok {
-				filenames = append(filenames, imp)
-			}
-		}
+// parseFile parses src into f, which must have its Name set.
+func parseFile(f *ast.File, src string, lim limits) (usage, *SyntaxError) {
+	p := newParser(f.Name, src)
+	p.limits = lim
+	pe := p.readFile(f)
+	if pe == eof {
+		// the shared eof error carries no position information
+		pe = p.errorf("unexpected EOF")
+	}
+	if pe == nil && p.s != "" {
+		pe = p.errorf("input was not all consumed")
 	}
+	return p.usage, pe
+}
 
-	if err := resolveSymbols(fset); err != nil {
-		return nil, err
+// A SyntaxError is an error in the source of a file, as returned by
+// ParseFile, and by ParseFiles for the files it loads.
+type SyntaxError struct {
+	Filename string
+	Pos      ast.Position // of the token at which the error was found
+	Msg      string
+}
+
+func (e *SyntaxError) Error() string {
+	if e == nil {
+		return "<nil>"
 	}
-	return fset, nil
+	return errorString(e.Filename, e.Pos, e.Msg)
 }
 
-type parseError struct {
-	message  string
-	filename string
-	line     int // 1-based line number
-	offset   int // 0-based byte offset from start of input
+// A ResolveError is an error in resolving the names of a file, or in
+// checking them once resolved, such as an unknown type or an invalid default
+// value, as returned by Resolve, and by ParseFiles.
+type ResolveError struct {
+	Filename string
+	Pos      ast.Position // of the definition in error
+	Msg      string
 }
 
-func (pe *parseError) Error() string {
-	if pe == nil {
+func (e *ResolveError) Error() string {
+	if e == nil {
 		return "<nil>"
 	}
-	if pe.line == 1 {
-		return fmt.Sprintf("%s:1.%d: %v", pe.filename, pe.offset, pe.message)
+	return errorString(e.Filename, e.Pos, e.Msg)
+}
+
+// errorString returns the text of an error at pos in filename: the line of
+// pos, or, on the first line, its offset
+func errorString(filename string, pos ast.Position, msg string) string {
+	if pos.Line == 1 {
+		return fmt.Sprintf("%s:1.%d: %v", filename, pos.Offset, msg)
 	}
-	return fmt.Sprintf("%s:%d: %v", pe.filename, pe.line, pe.message)
+	return fmt.Sprintf("%s:%d: %v", filename, pos.Line, msg)
 }
 
-var eof = &parseError{message: "EOF"}
+var eof = &SyntaxError{Msg: "EOF"}
 
 type token struct {
+	kind         tokenKind
 	value        string
-	err          *parseError
+	err          *SyntaxError
 	line, offset int
-	unquoted     string // unquoted version of value
+	unquoted     string // unquoted version of value, for string literals
 }
 
+type tokenKind int
+
+const (
+	tokenSymbol tokenKind = iota // a single punctuation character
+	tokenIdent                   // an identifier, possibly dotted, e.g. foo.Bar or .foo.Bar
+	tokenInt                     // a decimal, octal or hexadecimal integer literal
+	tokenFloat                   // a floating point literal other than inf and nan
+	tokenString                  // a single or double quoted string literal
+)
+
 func (t *token) astPosition() ast.Position {
 	return ast.Position{
 		Line:   t.line,
@@ -166,12 +226,26 @@ type parser struct {
 	offset, line int
 	cur          token
 
+	editions bool // whether the file declares an edition
+	proto3   bool // whether the file declares syntax proto3
+
+	limits limits
+	usage  usage
+	depth  int // current nesting depth of messages
+
+	// lexErr is an error in the input itself, e.g. an unterminated comment,
+	// which unlike other errors can't be recovered from by backing off.
+	lexErr *SyntaxError
+
 	comments []comment // accumulated during parse
 }
 
 type comment struct {
 	text         string
 	line, offset int
+	endLine      int  // line on which the comment ends
+	endOffset    int  // offset of the byte following the comment
+	trailing     bool // whether the comment follows a token on its line
 }
 
 func newParser(filename, s string) *parser {
@@ -183,7 +257,7 @@ func newParser(filename, s string) *parser {
 	}
 }
 
-func (p *parser) readFile(f *ast.File) *parseError {
+func (p *parser) readFile(f *ast.File) *SyntaxError {
 	// Parse top-level things.
 	for !p.done {
 		tok := p.next()
@@ -204,10 +278,10 @@ func (p *parser) readFile(f *ast.File) *parseError {
 				if tok.err != nil {
 					return tok.err
 				}
-				if tok.value == ";" {
+				if tok.value == ";" && tok.kind == tokenSymbol {
 					break
 				}
-				if tok.value == "." {
+				if tok.value == "." && tok.kind == tokenSymbol {
 					// okay if we already have at least one package component,
 					// and didn't just read a dot.
 					if pkg == "" || strings.HasSuffix(pkg, ".") {
@@ -219,29 +293,73 @@ func (p *parser) readFile(f *ast.File) *parseError {
 					if pkg != "" && !strings.HasSuffix(pkg, ".") {
 						return p.errorf(`got %q, want "." or ";"`, tok.value)
 					}
-					// TODO: validate more
+					if tok.kind != tokenIdent || strings.HasPrefix(tok.value, ".") {
+						return p.errorf("invalid package name %q", tok.value)
+					}
 				}
 				pkg += tok.value
 			}
+			if pkg == "" || strings.HasSuffix(pkg, ".") {
+				return p.errorf("invalid package name %q", pkg)
+			}
 			f.Package = strings.Split(pkg, ".")
 		case "option":
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
+			// a file option; either a feature, a built-in option, or a
+			// custom option, whose key keeps its parentheses
+			custom := true
+			if err := p.readToken("("); err != nil {
+				p.back()
+				custom = false
+			}
+			key, err := p.readFullIdent("option")
+			if err != nil {
+				return err
+			}
+			if custom {
+				if err := p.readToken(")"); err != nil {
+					return err
+				}
+				key = "(" + key + ")"
 			}
-			key := tok.value
 			if err := p.readToken("="); err != nil {
 				return err
 			}
-			tok = p.next()
-			if tok.err != nil {
-				return tok.err
+			value, err := p.readOptionValue()
+			if err != nil {
+				return err
 			}
-			value := tok.value
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
+			if !custom && strings.HasPrefix(key, "features.") {
+				if err := p.setFeature(&f.Features, "file", key, value); err != nil {
+					return err
+				}
+				continue
+			}
 			f.Options = append(f.Options, [2]string{key, value})
+		case "edition":
+			if f.Syntax != "" {
+				return p.errorf("duplicate syntax statement")
+			}
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			s, err := p.readString()
+			if err != nil {
+				return err
+			}
+			switch s {
+			case "2023":
+				f.Syntax = "editions"
+				f.Edition = s
+				p.editions = true
+			default:
+				return p.errorf("invalid edition %q", s)
+			}
+			if err := p.readToken(";"); err != nil {
+				return err
+			}
 		case "syntax":
 			if f.Syntax != "" {
 				return p.errorf("duplicate syntax statement")
@@ -249,13 +367,14 @@ func (p *parser) readFile(f *ast.File) *parseError {
 			if err := p.readToken("="); err != nil {
 				return err
 			}
-			tok, err := p.readString()
+			s, err := p.readString()
 			if err != nil {
 				return err
 			}
-			switch s := tok.unquoted; s {
+			switch s {
 			case "proto2", "proto3":
 				f.Syntax = s
+				p.proto3 = s == "proto3"
 			default:
 				return p.errorf("invalid syntax value %q", s)
 			}
@@ -263,16 +382,17 @@ func (p *parser) readFile(f *ast.File) *parseError {
 				return err
 			}
 		case "import":
+			p.usage.imports = append(p.usage.imports, p.cur.astPosition())
 			if err := p.readToken("public"); err == nil {
 				f.PublicImports = append(f.PublicImports, len(f.Imports))
 			} else {
 				p.back()
 			}
-			tok, err := p.readString()
+			imp, err := p.readString()
 			if err != nil {
 				return err
 			}
-			f.Imports = append(f.Imports, tok.unquoted)
+			f.Imports = append(f.Imports, imp)
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
@@ -313,11 +433,14 @@ func (p *parser) readFile(f *ast.File) *parseError {
 		}
 	}
 
-	// Handle comments.
+	// Handle comments. Comments on consecutive lines are grouped, unless
+	// they follow a token on their line; such a trailing comment is grouped
+	// alone.
 	for len(p.comments) > 0 {
 		n := 1
 		for ; n < len(p.comments); n++ {
-			if p.comments[n].line != p.comments[n-1].line+1 {
+			prev, c := p.comments[n-1], p.comments[n]
+			if prev.trailing || c.trailing || c.line != prev.endLine+1 {
 				break
 			}
 		}
@@ -327,8 +450,8 @@ func (p *parser) readFile(f *ast.File) *parseError {
 				Offset: p.comments[0].offset,
 			},
 			End: ast.Position{
-				Line:   p.comments[n-1].line,
-				Offset: p.comments[n-1].offset,
+				Line:   p.comments[n-1].endLine,
+				Offset: p.comments[n-1].endOffset,
 			},
 		}
 		for _, comm := range p.comments[:n] {
@@ -369,17 +492,17 @@ func (p *parser) readFile(f *ast.File) *parseError {
 	return nil
 }
 
-func (p *parser) readMessage(msg *ast.Message) *parseError {
+func (p *parser) readMessage(msg *ast.Message) *SyntaxError {
 	if err := p.readToken("message"); err != nil {
 		return err
 	}
 	msg.Position = p.cur.astPosition()
 
-	tok := p.next()
-	if tok.err != nil {
-		return tok.err
+	name, err := p.readName("message")
+	if err != nil {
+		return err
 	}
-	msg.Name = tok.value // TODO: validate
+	msg.Name = name
 
 	if err := p.readToken("{"); err != nil {
 		return err
@@ -392,7 +515,12 @@ func (p *parser) readMessage(msg *ast.Message) *parseError {
 	return p.readToken("}")
 }
 
-func (p *parser) readMessageContents(msg *ast.Message) *parseError {
+func (p *parser) readMessageContents(msg *ast.Message) *SyntaxError {
+	if err := p.nest(); err != nil {
+		return err
+	}
+	defer func() { p.depth-- }()
+
 	// Parse message fields and other things inside a message.
 	var oneof *ast.Oneof // set while inside a oneof
 	for !p.done {
@@ -419,11 +547,11 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 			msg.Oneofs = append(msg.Oneofs, oneof)
 			oneof.Position = p.cur.astPosition()
 
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
+			name, err := p.readName("oneof")
+			if err != nil {
+				return err
 			}
-			oneof.Name = tok.value // TODO: validate
+			oneof.Name = name
 			oneof.Up = msg
 
 			if err := p.readToken("{"); err != nil {
@@ -439,29 +567,43 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 			}
 			nmsg.Up = msg
 		case "option":
-			// message option
+			if oneof != nil {
+				return p.errorf("options in a oneof are not supported")
+			}
+			// message option; either a feature or a custom option
+			custom := true
 			if err := p.readToken("("); err != nil {
+				p.back()
+				custom = false
+			}
+			key, err := p.readFullIdent("option")
+			if err != nil {
 				return err
 			}
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
+			if !custom && !strings.HasPrefix(key, "features.") {
+				return p.errorf("unsupported message option %q", key)
 			}
-			key := tok.value
-			if err := p.readToken(")"); err != nil {
-				return err
+			if custom {
+				if err := p.readToken(")"); err != nil {
+					return err
+				}
 			}
 			if err := p.readToken("="); err != nil {
 				return err
 			}
-			tok = p.next()
-			if tok.err != nil {
-				return tok.err
+			value, err := p.readOptionValue()
+			if err != nil {
+				return err
 			}
-			value := tok.value
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
+			if !custom {
+				if err := p.setFeature(&msg.Features, "message", key, value); err != nil {
+					return err
+				}
+				continue
+			}
 			msg.Options = append(msg.Options, [2]string{key, value})
 		case "enum":
 			// nested enum
@@ -475,11 +617,14 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 		case "extensions":
 			// extension range
 			p.back()
-			r, err := p.readExtensionRange()
+			r, opts, err := p.readExtensionRange()
 			if err != nil {
 				return err
 			}
 			msg.ExtensionRanges = append(msg.ExtensionRanges, r...)
+			for range r {
+				msg.ExtensionRangeOptions = append(msg.ExtensionRangeOptions, opts)
+			}
 		case "reserved":
 			// reserved field name/tag list
 			p.back()
@@ -513,7 +658,7 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 	return p.errorf("unexpected EOF while parsing message")
 }
 
-func (p *parser) readField(f *ast.Field) *parseError {
+func (p *parser) readField(f *ast.Field) *SyntaxError {
 	_, inMsg := f.Up.(*ast.Message)
 
 	// TODO: enforce type limitations if f.Oneof != nil
@@ -524,11 +669,26 @@ func (p *parser) readField(f *ast.Field) *parseError {
 		return tok.err
 	}
 	f.Position = p.cur.astPosition()
+	if f.Oneof != nil {
+		switch tok.value {
+		case "required", "optional", "repeated":
+			return p.errorf("fields in oneofs must not have labels (required / optional / repeated)")
+		}
+	}
+	if p.editions {
+		switch tok.value {
+		case "required", "optional":
+			return p.errorf("label %q is not supported in editions; use features.field_presence instead", tok.value)
+		}
+	}
+	if p.proto3 && tok.value == "required" {
+		return p.errorf(`label "required" is not supported in proto3`)
+	}
 	switch tok.value {
 	case "required":
 		f.Required = true
 	case "optional":
-		// nothing to do
+		f.Optional = true
 	case "repeated":
 		f.Repeated = true
 	case "map":
@@ -536,41 +696,41 @@ func (p *parser) readField(f *ast.Field) *parseError {
 		if err := p.readToken("<"); err != nil {
 			return err
 		}
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		ktn, err := p.readTypeName()
+		if err != nil {
+			return err
 		}
-		f.KeyTypeName = tok.value // checked during resolution
+		f.KeyTypeName = ktn // checked during resolution
 		if err := p.readToken(","); err != nil {
 			return err
 		}
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		tn, err := p.readTypeName()
+		if err != nil {
+			return err
 		}
-		f.TypeName = tok.value // checked during resolution
+		f.TypeName = tn // checked during resolution
 		if err := p.readToken(">"); err != nil {
 			return err
 		}
 		f.Repeated = true // maps are repeated
-		goto parseFromFieldName
 	default:
 		// assume this is a type name
 		p.back()
 	}
 
-	tok = p.next()
-	if tok.err != nil {
-		return tok.err
+	if f.KeyTypeName == "" {
+		tn, err := p.readTypeName()
+		if err != nil {
+			return err
+		}
+		f.TypeName = tn // checked during resolution
 	}
-	f.TypeName = tok.value // checked during resolution
 
-parseFromFieldName:
-	tok = p.next()
-	if tok.err != nil {
-		return tok.err
+	name, err := p.readName("field")
+	if err != nil {
+		return err
 	}
-	f.Name = tok.value // TODO: validate
+	f.Name = name
 
 	if err := p.readToken("="); err != nil {
 		return err
@@ -583,6 +743,9 @@ parseFromFieldName:
 	f.Tag = tag
 
 	if f.TypeName == "group" && inMsg {
+		if p.editions {
+			return p.errorf("groups are not supported in editions; use features.message_encoding = DELIMITED instead")
+		}
 		if err := p.readToken("{"); err != nil {
 			return err
 		}
@@ -625,7 +788,7 @@ parseFromFieldName:
 	return nil
 }
 
-func (p *parser) readFieldOptions(f *ast.Field) *parseError {
+func (p *parser) readFieldOptions(f *ast.Field) *SyntaxError {
 	if err := p.readToken("["); err != nil {
 		return err
 	}
@@ -641,17 +804,11 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 			if err := p.readToken("="); err != nil {
 				return err
 			}
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
-			}
-			// TODO: check type
-			switch f.TypeName {
-			case "string":
-				f.Default = tok.unquoted
-			default:
-				f.Default = tok.value
+			val, err := p.readConstant()
+			if err != nil {
+				return err
 			}
+			f.Default = val // checked during resolution
 		case "packed":
 			f.HasPacked = true
 			if err := p.readToken("="); err != nil {
@@ -674,25 +831,36 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 			f.Deprecated = deprecated
 		case "(":
 			// TODO test cases needed here
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
+			key, err := p.readFullIdent("option")
+			if err != nil {
+				return err
 			}
-			key := tok.value
 			if err := p.readToken(")"); err != nil {
 				return err
 			}
 			if err := p.readToken("="); err != nil {
 				return err
 			}
-			tok = p.next()
-			if tok.err != nil {
-				return tok.err
+			val, err := p.readOptionValue()
+			if err != nil {
+				return err
 			}
-			val := tok.value
 			f.Options = append(f.Options, [2]string{key, val})
 		default:
-			return p.errorf(`got %q, want "default" or "packed"`, tok.value)
+			if !strings.HasPrefix(tok.value, "features.") {
+				return p.errorf(`unknown field option %q, want "default", "packed", "deprecated", "features.*" or a custom option in parentheses`, tok.value)
+			}
+			key := tok.value
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			val, err := p.readConstant()
+			if err != nil {
+				return err
+			}
+			if err := p.setFeature(&f.Features, "field", key, val); err != nil {
+				return err
+			}
 		}
 		// next should be a comma or ]
 		tok = p.next()
@@ -710,111 +878,274 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 	return p.errorf("unexpected EOF while parsing field options")
 }
 
-func (p *parser) readExtensionRange() ([][2]int, *parseError) {
+// readExtensionRange reads an extensions statement, returning its ranges and
+// their options.
+func (p *parser) readExtensionRange() ([][2]int, *ast.ExtensionRangeOptions, *SyntaxError) {
 	if err := p.readToken("extensions"); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	opts := &ast.ExtensionRangeOptions{Position: p.cur.astPosition()}
 
 	var rs [][2]int
 	for {
 		// next token must be a number,
-		// followed by a comma, semicolon or "to".
+		// followed by a comma, semicolon, "[" or "to".
 		start, err := p.readTagNumber(false)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		end := start
 		tok := p.next()
 		if tok.err != nil {
-			return nil, err
+			return nil, nil, tok.err
 		}
 		if tok.value == "to" {
 			end, err = p.readTagNumber(true) // allow "max"
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			if start > end {
-				return nil, p.errorf("bad extension range order: %d > %d", start, end)
+				return nil, nil, p.errorf("bad extension range order: %d > %d", start, end)
 			}
 			tok = p.next()
 			if tok.err != nil {
-				return nil, err
+				return nil, nil, tok.err
 			}
 		}
 		rs = append(rs, [2]int{start, end})
+		if tok.value == "[" {
+			// the options apply to all the ranges of the statement
+			if err := p.readExtensionRangeOptions(opts, rs); err != nil {
+				return nil, nil, err
+			}
+			if err := p.readToken(";"); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
 		if tok.value != "," && tok.value != ";" {
-			return nil, p.errorf(`got %q, want ",", ";" or "to"`, tok.value)
+			return nil, nil, p.errorf(`got %q, want ",", ";", "[" or "to"`, tok.value)
 		}
 		if tok.value == ";" {
 			break
 		}
 	}
-	return rs, nil
+	return rs, opts, nil
 }
 
-func (p *parser) readReservedRange() ([]ast.Reserved, *parseError) {
-	if err := p.readToken("reserved"); err != nil {
-		return nil, err
-	}
-
-	first := true
-	tagList := false
-	var rs []ast.Reserved
-
-	for {
-		// sequence of reserved values must be either all tags (ints)
-		// or all names (string). Tags may be ranges
-		nameOrTag := p.next()
-		if nameOrTag.err != nil {
-			return nil, nameOrTag.err
-		}
-		start, err := strconv.ParseInt(nameOrTag.value, 10, 32)
-		if first {
-			if err == nil {
-				tagList = true
-			}
-		} else {
-			if tagList && err != nil || !tagList && err == nil {
-				return nil, p.errorf("reserved lists must be all tags or all names, not a mix")
-			}
-		}
-
-		end := start
-		first = false
+// readExtensionRangeOptions reads the options of the extension ranges rs into
+// opts, following the "[" that introduces them.
+func (p *parser) readExtensionRangeOptions(opts *ast.ExtensionRangeOptions, rs [][2]int) *SyntaxError {
+	declared := make(map[int]bool)
 
+	for !p.done {
 		tok := p.next()
 		if tok.err != nil {
-			return nil, tok.err
+			return tok.err
 		}
-
-		if tok.value == "to" {
-			if !tagList {
-				return nil, p.errorf("reserved range used on name")
+		switch tok.value {
+		case "declaration":
+			if err := p.readToken("="); err != nil {
+				return err
 			}
-
-			tok = p.next()
+			d, err := p.readExtensionDeclaration()
+			if err != nil {
+				return err
+			}
+			inRange := false
+			for _, r := range rs {
+				inRange = inRange || r[0] <= d.Number && d.Number <= r[1]
+			}
+			if !inRange {
+				return p.errorf("extension declaration number %d is not in the extension range", d.Number)
+			}
+			if declared[d.Number] {
+				return p.errorf("extension number %d is declared more than once", d.Number)
+			}
+			declared[d.Number] = true
+			opts.Declarations = append(opts.Declarations, d)
+		case "verification":
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			tok := p.next()
 			if tok.err != nil {
-				return nil, tok.err
+				return tok.err
+			}
+			if tok.value != "DECLARATION" && tok.value != "UNVERIFIED" {
+				return p.errorf(`got %q, want "DECLARATION" or "UNVERIFIED"`, tok.value)
 			}
-			end, err := strconv.ParseInt(tok.value, 10, 32)
+			opts.Verification = tok.value
+		case "(":
+			key, err := p.readFullIdent("option")
 			if err != nil {
-				return nil, p.errorf("reserved range does not end with number")
+				return err
 			}
-
-			if start > end {
-				return nil, p.errorf("bad reserved range order: %d > %d", start, end)
+			if err := p.readToken(")"); err != nil {
+				return err
 			}
-
-			tok = p.next()
-			if tok.err != nil {
-				return nil, tok.err
+			if err := p.readToken("="); err != nil {
+				return err
 			}
+			val, err := p.readOptionValue()
+			if err != nil {
+				return err
+			}
+			opts.Options = append(opts.Options, [2]string{key, val})
+		default:
+			return p.errorf(`got %q, want "declaration", "verification" or a custom option`, tok.value)
+		}
+
+		// next should be a comma or ]
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "," {
+			continue
+		}
+		if tok.value != "]" {
+			return p.errorf(`got %q, want "," or "]"`, tok.value)
+		}
+		if len(opts.Declarations) > 0 && opts.Verification == "UNVERIFIED" {
+			return p.errorf("an extension range with declarations can't be UNVERIFIED")
+		}
+		return nil
+	}
+	return p.errorf("unexpected EOF while parsing extension range options")
+}
+
+// readExtensionDeclaration reads the value of a declaration option, in the
+// protocol buffers text format, e.g.
+//
+//	{ number: 4, full_name: ".my.pkg.ext", type: ".my.pkg.Msg" }
+func (p *parser) readExtensionDeclaration() (ast.ExtensionDeclaration, *SyntaxError) {
+	var d ast.ExtensionDeclaration
+
+	if err := p.readToken("{"); err != nil {
+		return d, err
+	}
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return d, tok.err
+		}
+		if tok.value == "}" {
+			switch {
+			case d.Number == 0:
+				return d, p.errorf("extension declaration must have a number")
+			case !d.Reserved && (d.FullName == "" || d.Type == ""):
+				return d, p.errorf("extension declaration %d must have a full_name and type, unless it is reserved", d.Number)
+			}
+			return d, nil
+		}
+
+		field := tok.value
+		if err := p.readToken(":"); err != nil {
+			return d, err
+		}
+
+		var err *SyntaxError
+		switch field {
+		case "number":
+			d.Number, err = p.readTagNumber(false)
+		case "full_name":
+			d.FullName, err = p.readString()
+			if err == nil && !isQualifiedName(d.FullName) {
+				err = p.errorf("invalid extension full_name %q; it must be fully qualified, with a leading dot", d.FullName)
+			}
+		case "type":
+			d.Type, err = p.readString()
+		case "reserved":
+			d.Reserved, err = p.readBool()
+		case "repeated":
+			d.Repeated, err = p.readBool()
+		default:
+			err = p.errorf("unknown extension declaration field %q", field)
+		}
+		if err != nil {
+			return d, err
+		}
+
+		// fields may be separated by commas or semicolons
+		tok = p.next()
+		if tok.err != nil {
+			return d, tok.err
+		}
+		if tok.value != "," && tok.value != ";" {
+			p.back()
+		}
+	}
+	return d, p.errorf("unexpected EOF while parsing extension declaration")
+}
+
+func (p *parser) readReservedRange() ([]ast.Reserved, *SyntaxError) {
+	if err := p.readToken("reserved"); err != nil {
+		return nil, err
+	}
+
+	// sequence of reserved values must be either all tags (ints)
+	// or all names (strings). Tags may be ranges
+	tok := p.next()
+	if tok.err != nil {
+		return nil, tok.err
+	}
+	tagList := tok.kind != tokenString
+	p.back()
+
+	var rs []ast.Reserved
+
+	for {
+		if !tagList {
+			tok := p.next()
+			if tok.err != nil {
+				return nil, tok.err
+			}
+			if tok.kind != tokenString {
+				return nil, p.errorf("reserved lists must be all tags or all names, not a mix")
+			}
+			p.back()
+			name, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			if !isIdent(name) {
+				return nil, p.errorf("reserved name %q is not a valid identifier", name)
+			}
+			rs = append(rs, ast.Reserved{Name: name})
+		} else {
+			tok := p.next()
+			if tok.err != nil {
+				return nil, tok.err
+			}
+			if tok.kind == tokenString {
+				return nil, p.errorf("reserved lists must be all tags or all names, not a mix")
+			}
+			p.back()
+			start, err := p.readTagNumber(false)
+			if err != nil {
+				return nil, err
+			}
+			end := start
+
+			if err := p.readToken("to"); err == nil {
+				end, err = p.readTagNumber(true) // allow "max"
+				if err != nil {
+					return nil, err
+				}
+				if start > end {
+					return nil, p.errorf("bad reserved range order: %d > %d", start, end)
+				}
+			} else {
+				p.back()
+			}
+			rs = append(rs, ast.Reserved{Start: start, End: end})
+		}
+
+		tok := p.next()
+		if tok.err != nil {
+			return nil, tok.err
 		}
-		if tagList {
-			rs = append(rs, ast.Reserved{Start: int(start), End: int(end)})
-		} else {
-			rs = append(rs, ast.Reserved{Name: nameOrTag.value})
-		}
 		if tok.value != "," && tok.value != ";" {
 			return nil, p.errorf(`got %q, want ",", ";" or "to"`, tok.value)
 		}
@@ -825,20 +1156,20 @@ func (p *parser) readReservedRange() ([]ast.Reserved, *parseError) {
 	return rs, nil
 }
 
-func (p *parser) readTagNumber(allowMax bool) (int, *parseError) {
+func (p *parser) readTagNumber(allowMax bool) (int, *SyntaxError) {
 	tok := p.next()
 	if tok.err != nil {
 		return 0, tok.err
 	}
-	if allowMax && tok.value == "max" {
+	if allowMax && tok.kind == tokenIdent && tok.value == "max" {
 		return 1<<29 - 1, nil
 	}
-	n, err := strconv.ParseInt(tok.value, 10, 32)
-	if err != nil {
-		return 0, p.errorf("bad field number %q: %v", tok.value, err)
+	if tok.kind != tokenInt {
+		return 0, p.errorf("bad field number %q", tok.value)
 	}
-	if n < 1 || n >= 1<<29 {
-		return 0, p.errorf("field number %v out of range", n)
+	n, err := parseInt(tok.value)
+	if err != nil || n < 1 || n >= 1<<29 {
+		return 0, p.errorf("field number %v out of range", tok.value)
 	}
 	if 19000 <= n && n <= 19999 { // TODO: still relevant?
 		return 0, p.errorf("field number %v in reserved range [19000, 19999]", n)
@@ -846,17 +1177,17 @@ func (p *parser) readTagNumber(allowMax bool) (int, *parseError) {
 	return int(n), nil
 }
 
-func (p *parser) readEnum(enum *ast.Enum) *parseError {
+func (p *parser) readEnum(enum *ast.Enum) *SyntaxError {
 	if err := p.readToken("enum"); err != nil {
 		return err
 	}
 	enum.Position = p.cur.astPosition()
 
-	tok := p.next()
-	if tok.err != nil {
-		return tok.err
+	name, err := p.readName("enum")
+	if err != nil {
+		return err
 	}
-	enum.Name = tok.value // TODO: validate
+	enum.Name = name
 
 	if err := p.readToken("{"); err != nil {
 		return err
@@ -876,27 +1207,71 @@ func (p *parser) readEnum(enum *ast.Enum) *parseError {
 			}
 			return nil
 		}
-		// TODO: verify tok.value is a valid enum value name.
+		name := *tok // tok is overwritten by the lookahead below
+
+		// an option, unless this is a value named option
+		isOption := false
+		if name.kind == tokenIdent && name.value == "option" {
+			isOption = p.readToken("=") != nil
+			p.back()
+		}
+		if isOption {
+			// either a feature or a custom option
+			custom := true
+			if err := p.readToken("("); err != nil {
+				p.back()
+				custom = false
+			}
+			key, err := p.readFullIdent("option")
+			if err != nil {
+				return err
+			}
+			if !custom && !strings.HasPrefix(key, "features.") {
+				return p.errorf("unsupported enum option %q", key)
+			}
+			if custom {
+				if err := p.readToken(")"); err != nil {
+					return err
+				}
+			}
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			value, err := p.readOptionValue()
+			if err != nil {
+				return err
+			}
+			if err := p.readToken(";"); err != nil {
+				return err
+			}
+			if !custom {
+				if err := p.setFeature(&enum.Features, "enum", key, value); err != nil {
+					return err
+				}
+				continue
+			}
+			enum.Options = append(enum.Options, [2]string{key, value})
+			continue
+		}
+
+		if name.kind != tokenIdent || !isIdent(name.value) {
+			return p.errorf("invalid enum value name %q", name.value)
+		}
 		ev := new(ast.EnumValue)
 		enum.Values = append(enum.Values, ev)
-		ev.Position = tok.astPosition()
-		ev.Name = tok.value // TODO: validate
+		ev.Position = name.astPosition()
+		ev.Name = name.value
 		ev.Up = enum
 
 		if err := p.readToken("="); err != nil {
 			return err
 		}
 
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
-		}
-		// TODO: check that tok.value is a valid enum value number.
-		num, err := strconv.ParseInt(tok.value, 10, 32)
+		num, err := p.readInt("enum number", math.MinInt32, math.MaxInt32)
 		if err != nil {
-			return p.errorf("bad enum number %q: %v", tok.value, err)
+			return err
 		}
-		ev.Number = int32(num) // TODO: validate
+		ev.Number = int32(num)
 
 		if err := p.readToken(";"); err != nil {
 			return err
@@ -906,17 +1281,17 @@ func (p *parser) readEnum(enum *ast.Enum) *parseError {
 	return p.errorf("unexpected EOF while parsing enum")
 }
 
-func (p *parser) readService(srv *ast.Service) *parseError {
+func (p *parser) readService(srv *ast.Service) *SyntaxError {
 	if err := p.readToken("service"); err != nil {
 		return err
 	}
 	srv.Position = p.cur.astPosition()
 
-	tok := p.next()
-	if tok.err != nil {
-		return tok.err
+	name, err := p.readName("service")
+	if err != nil {
+		return err
 	}
-	srv.Name = tok.value // TODO: validate
+	srv.Name = name
 
 	if err := p.readToken("{"); err != nil {
 		return err
@@ -938,25 +1313,25 @@ func (p *parser) readService(srv *ast.Service) *parseError {
 			return p.errorf(`got %q, want "rpc" or "}"`, tok.value)
 		}
 
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		name, err := p.readName("method")
+		if err != nil {
+			return err
 		}
 		mth := new(ast.Method)
 		srv.Methods = append(srv.Methods, mth)
-		mth.Position = tok.astPosition()
-		mth.Name = tok.value // TODO: validate
+		mth.Position = p.cur.astPosition()
+		mth.Name = name
 		mth.Up = srv
 
 		if err := p.readToken("("); err != nil {
 			return err
 		}
 
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		in, err := p.readTypeName()
+		if err != nil {
+			return err
 		}
-		mth.InTypeName = tok.value // TODO: validate
+		mth.InTypeName = in
 		if err := p.readToken(")"); err != nil {
 			return err
 		}
@@ -966,11 +1341,11 @@ func (p *parser) readService(srv *ast.Service) *parseError {
 		if err := p.readToken("("); err != nil {
 			return err
 		}
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		out, err := p.readTypeName()
+		if err != nil {
+			return err
 		}
-		mth.OutTypeName = tok.value // TODO: validate
+		mth.OutTypeName = out
 
 		if err := p.readToken(")"); err != nil {
 			return err
@@ -992,12 +1367,15 @@ func (p *parser) readService(srv *ast.Service) *parseError {
 	return p.errorf("unexpected EOF while parsing service")
 }
 
-func (p *parser) readMethodOptions(mth *ast.Method) *parseError {
+func (p *parser) readMethodOptions(mth *ast.Method) *SyntaxError {
 	if err := p.readToken("{"); err != nil {
 		return err
 	}
 	for !p.done {
 		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
 		switch tok.value {
 		case "}":
 			// End of Options
@@ -1010,22 +1388,20 @@ func (p *parser) readMethodOptions(mth *ast.Method) *parseError {
 		if err := p.readToken("("); err != nil {
 			return err
 		}
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		key, err := p.readFullIdent("option")
+		if err != nil {
+			return err
 		}
-		key := tok.value
 		if err := p.readToken(")"); err != nil {
 			return err
 		}
 		if err := p.readToken("="); err != nil {
 			return err
 		}
-		tok = p.next()
-		if tok.err != nil {
-			return tok.err
+		val, err := p.readOptionValue()
+		if err != nil {
+			return err
 		}
-		val := tok.value
 		if err := p.readToken(";"); err != nil {
 			return err
 		}
@@ -1034,17 +1410,17 @@ func (p *parser) readMethodOptions(mth *ast.Method) *parseError {
 	return nil
 }
 
-func (p *parser) readExtension(ext *ast.Extension) *parseError {
+func (p *parser) readExtension(ext *ast.Extension) *SyntaxError {
 	if err := p.readToken("extend"); err != nil {
 		return err
 	}
 	ext.Position = p.cur.astPosition()
 
-	tok := p.next()
-	if tok.err != nil {
-		return tok.err
+	extendee, err := p.readTypeName()
+	if err != nil {
+		return err
 	}
-	ext.Extendee = tok.value // checked during resolution
+	ext.Extendee = extendee // checked during resolution
 
 	if err := p.readToken("{"); err != nil {
 		return err
@@ -1070,18 +1446,330 @@ func (p *parser) readExtension(ext *ast.Extension) *parseError {
 	return p.errorf("unexpected EOF while parsing extension")
 }
 
-func (p *parser) readString() (*token, *parseError) {
+// readString reads a string literal, or a sequence of adjacent string
+// literals, which are concatenated, and returns its value.
+func (p *parser) readString() (string, *SyntaxError) {
+	lit, err := p.readStringLit()
+	if err != nil {
+		return "", err
+	}
+	unq, _ := strconv.Unquote(lit)
+	return unq, nil
+}
+
+// readStringLit is like readString, except that it returns a double-quoted
+// literal for the value, as returned by quote.
+func (p *parser) readStringLit() (string, *SyntaxError) {
 	tok := p.next()
 	if tok.err != nil {
-		return nil, tok.err
+		return "", tok.err
+	}
+	if tok.kind != tokenString {
+		return "", p.errorf("got %q, want string", tok.value)
+	}
+	lit, unq := tok.value, tok.unquoted
+
+	for {
+		tok := p.next()
+		if tok.err != nil || tok.kind != tokenString {
+			p.back()
+			break
+		}
+		lit += " " + tok.value
+		unq += tok.unquoted
 	}
-	if tok.value[0] != '"' {
-		return nil, p.errorf("got %q, want string", tok.value)
+
+	return quote(lit, unq), nil
+}
+
+// readName reads an identifier naming a definition of the given kind, e.g.
+// a message or field.
+func (p *parser) readName(what string) (string, *SyntaxError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", tok.err
 	}
-	return tok, nil
+	if tok.kind != tokenIdent || !isIdent(tok.value) {
+		return "", p.errorf("invalid %v name %q", what, tok.value)
+	}
+	return tok.value, nil
 }
 
-func (p *parser) readBool() (bool, *parseError) {
+// readFullIdent reads a dot-separated list of identifiers, e.g. the name of
+// an option.
+func (p *parser) readFullIdent(what string) (string, *SyntaxError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", tok.err
+	}
+	if tok.kind != tokenIdent || strings.HasPrefix(tok.value, ".") {
+		return "", p.errorf("invalid %v name %q", what, tok.value)
+	}
+	return tok.value, nil
+}
+
+// readTypeName reads a reference to a type: a dot-separated list of
+// identifiers, with a leading dot if the name is fully qualified.
+func (p *parser) readTypeName() (string, *SyntaxError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", tok.err
+	}
+	if tok.kind != tokenIdent {
+		return "", p.errorf("invalid type name %q", tok.value)
+	}
+	return tok.value, nil
+}
+
+// readInt reads an integer literal, optionally preceded by a sign, whose
+// value must lie in [min, max].
+func (p *parser) readInt(what string, min, max int64) (int64, *SyntaxError) {
+	tok := p.next()
+	if tok.err != nil {
+		return 0, tok.err
+	}
+	neg := false
+	if tok.kind == tokenSymbol && (tok.value == "-" || tok.value == "+") {
+		neg = tok.value == "-"
+		tok = p.next()
+		if tok.err != nil {
+			return 0, tok.err
+		}
+	}
+	if tok.kind != tokenInt {
+		return 0, p.errorf("bad %v %q", what, tok.value)
+	}
+
+	u, err := parseInt(tok.value)
+	if err != nil || u > 1<<63 {
+		return 0, p.errorf("%v %v out of range", what, tok.value)
+	}
+	var n int64
+	switch {
+	case !neg && u == 1<<63:
+		return 0, p.errorf("%v %v out of range", what, tok.value)
+	case neg:
+		n = -int64(u)
+	default:
+		n = int64(u)
+	}
+	if n < min || n > max {
+		return 0, p.errorf("%v %v out of range", what, n)
+	}
+	return n, nil
+}
+
+// readConstant reads the value of an option: an identifier (including true,
+// false, inf and nan), a number optionally preceded by a sign, or a string.
+// Numbers are returned as written, less any "+" sign; strings are returned as
+// double-quoted literals, as returned by quote.
+func (p *parser) readConstant() (string, *SyntaxError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", tok.err
+	}
+
+	switch tok.kind {
+	case tokenString:
+		p.back()
+		return p.readStringLit()
+	case tokenIdent, tokenInt, tokenFloat:
+		return tok.value, nil
+	case tokenSymbol:
+		if tok.value != "-" && tok.value != "+" {
+			break
+		}
+		sign := tok.value
+		tok := p.next()
+		if tok.err != nil {
+			return "", tok.err
+		}
+		switch {
+		case tok.kind == tokenInt, tok.kind == tokenFloat:
+		case tok.kind == tokenIdent && (tok.value == "inf" || tok.value == "nan"):
+		default:
+			return "", p.errorf("got %q, want number after %q", tok.value, sign)
+		}
+		return strings.TrimPrefix(sign, "+") + tok.value, nil
+	}
+
+	return "", p.errorf("got %q, want constant", tok.value)
+}
+
+// readOptionValue reads the value of a custom option, which is either a
+// constant, as read by readConstant, or an aggregate, which is returned as
+// the String of an ast.Aggregate.
+func (p *parser) readOptionValue() (string, *SyntaxError) {
+	if err := p.readToken("{"); err != nil {
+		p.back()
+		return p.readConstant()
+	}
+	p.back()
+	a, err := p.readAggregate()
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
+// readAggregate reads a message value in the text format, including its
+// braces. Fields may be separated by commas or semicolons, and lists of
+// values, e.g. foo: [1, 2], are read as repeated fields.
+func (p *parser) readAggregate() (ast.Aggregate, *SyntaxError) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+
+	if err := p.readToken("{"); err != nil {
+		return nil, err
+	}
+	a := ast.Aggregate{}
+	for {
+		tok := p.next()
+		if tok.err != nil {
+			return nil, tok.err
+		}
+		var name string
+		switch {
+		case tok.value == "}" && tok.kind == tokenSymbol:
+			return a, nil
+		case tok.value == "[" && tok.kind == tokenSymbol:
+			ext, err := p.readFullIdent("extension")
+			if err != nil {
+				return nil, err
+			}
+			if err := p.readToken("]"); err != nil {
+				return nil, err
+			}
+			name = "[" + ext + "]"
+		case tok.kind == tokenIdent && isIdent(tok.value):
+			name = tok.value
+		default:
+			return nil, p.errorf(`got %q, want field name or "}"`, tok.value)
+		}
+
+		colon := p.readToken(":") == nil
+		if !colon {
+			p.back()
+		}
+		tok = p.next()
+		if tok.err != nil {
+			return nil, tok.err
+		}
+		p.back()
+		switch {
+		case tok.value == "{" && tok.kind == tokenSymbol:
+			v, err := p.readAggregate()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, ast.AggregateField{Name: name, Aggregate: v})
+		case !colon:
+			return nil, p.errorf(`got %q, want ":" or "{"`, tok.value)
+		case tok.value == "[" && tok.kind == tokenSymbol:
+			p.next()
+			if err := p.readToken("]"); err == nil {
+				// an empty list
+				break
+			}
+			p.back()
+			for {
+				f := ast.AggregateField{Name: name}
+				if err := p.readToken("{"); err == nil {
+					p.back()
+					v, err := p.readAggregate()
+					if err != nil {
+						return nil, err
+					}
+					f.Aggregate = v
+				} else {
+					p.back()
+					v, err := p.readConstant()
+					if err != nil {
+						return nil, err
+					}
+					f.Value = v
+				}
+				a = append(a, f)
+				tok := p.next()
+				if tok.err != nil {
+					return nil, tok.err
+				}
+				if tok.value == "]" && tok.kind == tokenSymbol {
+					break
+				}
+				if tok.value != "," || tok.kind != tokenSymbol {
+					return nil, p.errorf(`got %q, want "," or "]"`, tok.value)
+				}
+			}
+		default:
+			v, err := p.readConstant()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, ast.AggregateField{Name: name, Value: v})
+		}
+
+		// fields may be separated by a comma or semicolon
+		if tok := p.next(); tok.err != nil || tok.kind != tokenSymbol || tok.value != "," && tok.value != ";" {
+			p.back()
+		}
+	}
+}
+
+// nest increments the nesting depth of messages, and message values in
+// aggregates, checking it against p.limits. If nest succeeds, the caller must
+// decrement p.depth once done.
+func (p *parser) nest() *SyntaxError {
+	p.depth++
+	if p.depth > p.usage.depth {
+		p.usage.depth = p.depth
+	}
+	if max := p.limits.maxDepth; max > 0 && p.depth > max {
+		p.depth--
+		return p.errorf("messages nested too deeply (the limit is %d)", max)
+	}
+	return nil
+}
+
+// featureTargets lists the definitions, other than files, on which each
+// feature may be set.
+var featureTargets = map[string][]string{
+	"field_presence":          {"field"},
+	"enum_type":               {"enum"},
+	"repeated_field_encoding": {"field"},
+	"utf8_validation":         {"field"},
+	"message_encoding":        {"field"},
+	"json_format":             {"message", "enum"},
+}
+
+// setFeature sets the feature named by the option key, e.g.
+// features.field_presence, to value in fs, which belongs to a definition of
+// the given kind: file, message, field or enum.
+func (p *parser) setFeature(fs *ast.Features, kind, key, value string) *SyntaxError {
+	if !p.editions {
+		return p.errorf("features are only valid under editions")
+	}
+	name := strings.TrimPrefix(key, "features.")
+	targets, ok := featureTargets[name]
+	if !ok {
+		return p.errorf("unknown feature %q", name)
+	}
+	valid := kind == "file"
+	for _, t := range targets {
+		valid = valid || t == kind
+	}
+	if !valid {
+		return p.errorf("feature %q can't be set on a %v", name, kind)
+	}
+	if err := fs.Set(name, value); err != nil {
+		return p.errorf("%v", err)
+	}
+	return nil
+}
+
+func (p *parser) readBool() (bool, *SyntaxError) {
 	tok := p.next()
 	if tok.err != nil {
 		return false, tok.err
@@ -1097,7 +1785,7 @@ func (p *parser) readBool() (bool, *parseError) {
 	}
 }
 
-func (p *parser) readToken(want string) *parseError {
+func (p *parser) readToken(want string) *SyntaxError {
 	tok := p.next()
 	if tok.err != nil {
 		return tok.err
@@ -1114,9 +1802,9 @@ func (p *parser) back() {
 	p.done = false // in case this was the last token
 	p.backed = true
 	// In case an error was being recovered, ignore any error.
-	// Don't do this for EOF, though, since we know that's what
-	// we'll return next.
-	if p.cur.err != eof {
+	// Don't do this for EOF or errors in the input itself, though, since
+	// we know that's what we'll return next.
+	if p.cur.err != eof && p.cur.err != p.lexErr {
 		p.cur.err = nil // in case an error was being recovered
 	}
 }
@@ -1132,11 +1820,26 @@ func (p *parser) next() *token {
 			p.cur.value = ""
 			p.cur.err = eof
 		}
+		if p.cur.err == nil {
+			p.countToken()
+		}
 	}
 	debugf("parser·next(): returning %q [err: %v]", p.cur.value, p.cur.err)
 	return &p.cur
 }
 
+// countToken counts the current token against p.limits.maxTokens.
+func (p *parser) countToken() {
+	p.usage.tokens++
+	n := p.usage.tokens
+	if p.limits.tokens != nil {
+		n = atomic.AddInt64(p.limits.tokens, 1)
+	}
+	if max := p.limits.maxTokens; max > 0 && n > max {
+		p.lexErr = p.errorf("too many tokens (the limit is %d)", max)
+	}
+}
+
 func (p *parser) advance() {
 	// Skip whitespace
 	p.skipWhitespaceAndComments()
@@ -1147,15 +1850,19 @@ func (p *parser) advance() {
 	// Start of non-whitespace
 	p.cur.err = nil
 	p.cur.offset, p.cur.line = p.offset, p.line
-	switch p.s[0] {
-	// TODO: more cases, like punctuation.
-	case ';', '{', '}', '=', '[', ']', ',', '<', '>', '(', ')':
-		// Single symbol
-		p.cur.value, p.s = p.s[:1], p.s[1:]
-	case '"', '\'':
-		// Quoted string
-		i := 1
-		for i < len(p.s) && p.s[i] != p.s[0] {
+	p.cur.unquoted = ""
+
+	c := p.s[0]
+	var i int
+	switch {
+	case c == '"' || c == '\'':
+		p.cur.kind = tokenString
+		i = 1
+		for i < len(p.s) && p.s[i] != c {
+			if p.s[i] == '\n' {
+				p.lexErrorf("newline in string")
+				return
+			}
 			if p.s[i] == '\\' && i+1 < len(p.s) {
 				// skip escaped character
 				i++
@@ -1163,29 +1870,38 @@ func (p *parser) advance() {
 			i++
 		}
 		if i >= len(p.s) {
-			p.errorf("encountered EOF inside string")
+			p.lexErrorf("encountered EOF inside string")
 			return
 		}
 		i++
-		p.cur.value, p.s = p.s[:i], p.s[i:]
-		// TODO: This doesn't work for single quote strings;
-		// quotes will be mangled.
-		unq, err := strconv.Unquote(p.cur.value)
+		unq, err := unquote(p.s[:i])
 		if err != nil {
-			p.errorf("invalid quoted string [%s]: %v", p.cur.value, err)
+			p.lexErrorf("invalid quoted string [%s]: %v", p.s[:i], err)
+			return
 		}
 		p.cur.unquoted = unq
-	default:
-		i := 0
-		for i < len(p.s) && isIdentOrNumberChar(p.s[i]) {
+	case isLetter(c) || c == '.' && len(p.s) > 1 && isLetter(p.s[1]):
+		// a dot continues an identifier only if it is followed by another
+		p.cur.kind = tokenIdent
+		i = 1
+		for i < len(p.s) && (isLetter(p.s[i]) || isDigit(p.s[i]) || p.s[i] == '.' && i+1 < len(p.s) && isLetter(p.s[i+1])) {
 			i++
 		}
-		if i == 0 {
-			p.errorf("unexpected byte 0x%02x (%q)", p.s[0], string(p.s[:1]))
+	case isDigit(c) || c == '.' && len(p.s) > 1 && isDigit(p.s[1]):
+		var ok bool
+		p.cur.kind, i, ok = scanNumber(p.s)
+		if !ok {
+			p.lexErrorf("invalid number %q", p.s[:i])
 			return
 		}
-		p.cur.value, p.s = p.s[:i], p.s[i:]
+	case strings.IndexByte(";:{}=[],<>()-+.", c) != -1:
+		p.cur.kind = tokenSymbol
+		i = 1
+	default:
+		p.lexErrorf("unexpected byte 0x%02x (%q)", c, string(p.s[:1]))
+		return
 	}
+	p.cur.value, p.s = p.s[:i], p.s[i:]
 	p.offset += len(p.cur.value)
 }
 
@@ -1201,13 +1917,13 @@ func (p *parser) skipWhitespaceAndComments() {
 		}
 		if i+1 < len(p.s) && p.s[i] == '/' && p.s[i+1] == '/' {
 			si := i + 2
-			c := comment{line: p.line, offset: p.offset + i}
-			// XXX: set c.text
+			c := p.newComment(i)
 			// comment; skip to end of line or input
 			for i < len(p.s) && p.s[i] != '\n' {
 				i++
 			}
 			c.text = p.s[si:i]
+			c.endLine, c.endOffset = p.line, p.offset+i
 			p.comments = append(p.comments, c)
 			if i < len(p.s) {
 				// end of line; keep going
@@ -1219,10 +1935,11 @@ func (p *parser) skipWhitespaceAndComments() {
 		}
 		if i+1 < len(p.s) && p.s[i] == '/' && p.s[i+1] == '*' {
 			si := i + 2
-			c := comment{line: p.line, offset: p.offset + i}
-			// comment; skip to end of comment or input
+			c := p.newComment(i)
+			// comment; skip to end of comment or input. The "*" of "/*"
+			// can't also start the "*/", as in "/*/".
 			found := false
-			for i < len(p.s) {
+			for i = si; i < len(p.s); {
 				if p.s[i] == '\n' {
 					p.line++
 				} else if strings.HasPrefix(p.s[i:], "*/") {
@@ -1232,14 +1949,14 @@ func (p *parser) skipWhitespaceAndComments() {
 				i++
 			}
 			if !found {
-				p.errorf("encountered EOF inside multi-line comment")
+				p.cur.line, p.cur.offset = c.line, c.offset
+				p.lexErrorf("encountered EOF inside multi-line comment")
 				return
 			}
 			c.text = p.s[si:i]
-			p.comments = append(p.comments, c)
-
-			//
 			i = i + len("*/")
+			c.endLine, c.endOffset = p.line, p.offset+i
+			p.comments = append(p.comments, c)
 			continue
 		}
 		break
@@ -1251,34 +1968,33 @@ func (p *parser) skipWhitespaceAndComments() {
 	}
 }
 
-func (p *parser) errorf(format string, a ...interface{}) *parseError {
-	pe := &parseError{
-		message:  fmt.Sprintf(format, a...),
-		filename: p.filename,
-		line:     p.cur.line,
-		offset:   p.cur.offset,
+// newComment returns a comment starting i bytes into the remaining input
+func (p *parser) newComment(i int) comment {
+	return comment{
+		line:     p.line,
+		offset:   p.offset + i,
+		trailing: p.cur.value != "" && p.cur.line == p.line,
+	}
+}
+
+func (p *parser) errorf(format string, a ...interface{}) *SyntaxError {
+	pe := &SyntaxError{
+		Filename: p.filename,
+		Pos:      p.cur.astPosition(),
+		Msg:      fmt.Sprintf(format, a...),
 	}
 	p.cur.err = pe
 	p.done = true
 	return pe
 }
 
+// lexErrorf is like errorf, for errors in the input itself.
+func (p *parser) lexErrorf(format string, a ...interface{}) *SyntaxError {
+	p.lexErr = p.errorf(format, a...)
+	return p.lexErr
+}
+
 func isWhitespace(c byte) bool {
 	// TODO: do more accurately
 	return unicode.IsSpace(rune(c))
 }
-
-// Numbers and identifiers are matched by [-+._A-Za-z0-9]
-func isIdentOrNumberChar(c byte) bool {
-	switch {
-	case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z':
-		return true
-	case '0' <= c && c <= '9':
-		return true
-	}
-	switch c {
-	case '-', '+', '.', '_':
-		return true
-	}
-	return false
-}
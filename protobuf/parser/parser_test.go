@@ -4,6 +4,12 @@
 package parser
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -13,8 +19,10 @@ import (
 )
 
 // tryParse attempts to parse the input, and verifies that it matches
-// the FileDescriptorProto represented in text format.
-func tryParse(t *testing.T, input, output string) {
+// the FileDescriptorProto represented in text format, together with the
+// fields newer than the vendored descriptor package, which are listed in
+// newer.
+func tryParse(t *testing.T, input, output string, newer []string) {
 	want := new(pb.FileDescriptorProto)
 	if err := proto.UnmarshalText(output, want); err != nil {
 		t.Fatalf("Test failure parsing a wanted proto: %v", err)
@@ -27,7 +35,7 @@ func tryParse(t *testing.T, input, output string) {
 		return
 	}
 	fset := &ast.FileSet{Files: []*ast.File{f}}
-	if err := resolveSymbols(fset); err != nil {
+	if err := resolveSymbols(fset, false); err != nil {
 		t.Errorf("Resolving symbols: %v", err)
 		return
 	}
@@ -43,6 +51,9 @@ func tryParse(t *testing.T, input, output string) {
 	}
 	got := fds.File[0]
 
+	if got := newerFields(t, got); !reflect.DeepEqual(got, newer) {
+		t.Errorf("got newer fields %q, want %q", got, newer)
+	}
 	if !proto.Equal(got, want) {
 		t.Errorf("Mismatch!\nGot:\n%v\nWant:\n%v", got, want)
 	}
@@ -148,13 +159,12 @@ var parseTests = []parseTest{
 		  required double foo = 1 [default= inf ];
 		  required double foo = 1 [default=-inf ];
 		  required double foo = 1 [default= nan ];
-		  // TODO: uncomment these when the string parser handles them.
-		  //required string foo = 1 [default='13\\001'];
-		  //required string foo = 1 [default='a' "b"
-		  //"c"];
-		  //required bytes  foo = 1 [default='14\\002'];
-		  //required bytes  foo = 1 [default='a' "b"
-		  //'c'];
+		  required string foo = 1 [default='13\001'];
+		  required string foo = 1 [default='a' "b"
+		  "c"];
+		  required bytes  foo = 1 [default='14\\002'];
+		  required bytes  foo = 1 [default='a' "b"
+		  'c'];
 		  required bool   foo = 1 [default=true ];
 		  required Foo    foo = 1 [default=FOO  ];
 		  required int32  foo = 1 [default= 0x7FFFFFFF];
@@ -183,28 +193,18 @@ var parseTests = []parseTest{
 		  field { type:TYPE_DOUBLE  default_value:"inf"       ` + fieldDefaultsEtc + ` }
 		  field { type:TYPE_DOUBLE  default_value:"-inf"      ` + fieldDefaultsEtc + ` }
 		  field { type:TYPE_DOUBLE  default_value:"nan"       ` + fieldDefaultsEtc + ` }
-		  ` +
-			/*
-			  field { type:TYPE_STRING  default_value:"13\\001"   ` + fieldDefaultsEtc + ` }
-			  field { type:TYPE_STRING  default_value:"abc"       ` + fieldDefaultsEtc + ` }
-			  field { type:TYPE_BYTES   default_value:"14\\\\002" ` + fieldDefaultsEtc + ` }
-			*/
-			`
+		  field { type:TYPE_STRING  default_value:"13\001"    ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_STRING  default_value:"abc"       ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_BYTES   default_value:"14\\\\002" ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_BYTES   default_value:"abc"       ` + fieldDefaultsEtc + ` }
 		  field { type:TYPE_BOOL    default_value:"true"      ` + fieldDefaultsEtc + ` }
 		  field { type:TYPE_ENUM    type_name:".Foo"   default_value:"FOO"` + fieldDefaultsEtc + ` }
-
-		  ` +
-			/*
-			  descriptor.proto says "For numeric types, contains the original text representation of the value.";
-			  we match that, and thus diverge from protoc.
-			*/
-			`
-		  field { type:TYPE_INT32   default_value:"0x7FFFFFFF"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT32   default_value:"-0x80000000"        ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT32  default_value:"0xFFFFFFFF"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"0x7FFFFFFFFFFFFFFF" ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"-0x8000000000000000"` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT64  default_value:"0xFFFFFFFFFFFFFFFF" ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT32   default_value:"2147483647"           ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT32   default_value:"-2147483648"          ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_UINT32  default_value:"4294967295"           ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT64   default_value:"9223372036854775807"  ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT64   default_value:"-9223372036854775808" ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_UINT64  default_value:"18446744073709551615" ` + fieldDefaultsEtc + ` }
 		}
 		enum_type {
 			name:"Foo"
@@ -232,6 +232,49 @@ var parseTests = []parseTest{
 		  }
 		}`,
 	},
+	{
+		"Proto3Optional",
+		"syntax = \"proto3\";\nmessage TestMessage {\n  optional int32 foo = 1;\n  oneof bar {\n    int32 baz = 2;\n  }\n  optional string _foo = 3;\n  int32 qux = 4;\n}\n",
+		`syntax: "proto3"
+		message_type {
+		  name: "TestMessage"
+		  field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:1 }
+		  field { name:"baz" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 oneof_index:0 }
+		  field { name:"_foo" label:LABEL_OPTIONAL type:TYPE_STRING number:3 oneof_index:2 }
+		  field { name:"qux" label:LABEL_OPTIONAL type:TYPE_INT32 number:4 }
+		  oneof_decl { name: "bar" }
+		  oneof_decl { name: "X_foo" }
+		  oneof_decl { name: "XX_foo" }
+		}`,
+	},
+	{
+		"Editions",
+		`edition = "2023";
+		option features.field_presence = IMPLICIT;
+		message TestMessage {
+		  option features.json_format = LEGACY_BEST_EFFORT;
+		  int32 foo = 1 [features.field_presence = EXPLICIT, default = 7];
+		  repeated int32 bar = 2 [features.repeated_field_encoding = EXPANDED];
+		}
+		enum TestEnum {
+		  option features.enum_type = CLOSED;
+		  option = 0;
+		}
+		`,
+		`syntax: "editions"
+		options {}
+		message_type {
+		  name: "TestMessage"
+		  options {}
+		  field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 default_value:"7" options {} }
+		  field { name:"bar" label:LABEL_REPEATED type:TYPE_INT32 number:2 options {} }
+		}
+		enum_type {
+		  name: "TestEnum"
+		  options {}
+		  value { name:"option" number:0 }
+		}`,
+	},
 	{
 		"MultipleOneofs",
 		"message TestMessage {\n  oneof foo {\n    int32 a = 1;\n    string b = 2;\n  }\n  oneof bar {\n    int32 c = 3;\n    string d = 4;\n  }\n}\n",
@@ -263,6 +306,24 @@ var parseTests = []parseTest{
 		   field { name: "primitive_type_map" label: LABEL_REPEATED type:TYPE_MESSAGE type_name: ".TestMessage.PrimitiveTypeMapEntry" number: 1 }
 		}`,
 	},
+	{
+		// the entry of a map in an edition has features, and is a map entry
+		"EditionsMap",
+		"edition = \"2023\";\nmessage TestMessage {\n  map<int32, string> primitive_type_map = 1;\n}\n",
+		`syntax: "editions"
+		options {}
+		message_type {
+		   name: "TestMessage"
+		   options {}
+		   nested_type {
+		     name: "PrimitiveTypeMapEntry"
+		     field { name: "key" number: 1 label:LABEL_OPTIONAL type:TYPE_INT32 options {} }
+		     field { name: "value" number: 2 label:LABEL_OPTIONAL type:TYPE_STRING options {} }
+		     options { map_entry: true }
+		   }
+		   field { name: "primitive_type_map" label: LABEL_REPEATED type:TYPE_MESSAGE type_name: ".TestMessage.PrimitiveTypeMapEntry" number: 1 options {} }
+		}`,
+	},
 	{
 		"Group",
 		"message TestMessage {\n  optional group TestGroup = 1 {};\n}\n",
@@ -298,6 +359,27 @@ var parseTests = []parseTest{
 			`  extension_range { start:3   end:4         }` +
 			`}`,
 	},
+	{
+		"ExtensionRangeOptions",
+		`package foo;
+		message TestMessage {
+		  extensions 100 to 199 [
+		    declaration = { number: 100, full_name: ".foo.bar", type: ".foo.TestMessage" },
+		    declaration = { number: 101 reserved: true },
+		    verification = DECLARATION
+		  ];
+		  extensions 200 [verification = UNVERIFIED, (foo.kind) = SMALL];
+		}
+		extend TestMessage { optional TestMessage bar = 100; }
+		`,
+		`package: "foo"
+		message_type {
+		  name: "TestMessage"
+		  extension_range { start:100 end:200 }
+		  extension_range { start:200 end:201 }
+		}
+		extension { name:"bar" label:LABEL_OPTIONAL type:TYPE_MESSAGE type_name:".foo.TestMessage" number:100 extendee:".foo.TestMessage" }`,
+	},
 	{
 		"Extensions",
 		"extend Extendee1 { optional int32 foo = 12; }\nextend Extendee2 { repeated TestMessage bar = 22; }\n" +
@@ -333,7 +415,8 @@ var parseTests = []parseTest{
 		"syntax = \"proto3\";\nmessage TestMessage {\n  int32 foo = 1;\n  optional int32 bar = 2;\n}\n",
 		`syntax: "proto3" message_type { name: "TestMessage" ` +
 			`  field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 }` +
-			`  field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 }` +
+			`  field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 oneof_index:0 }` +
+			`  oneof_decl { name:"_bar" }` +
 			`}`,
 	},
 	{
@@ -341,6 +424,16 @@ var parseTests = []parseTest{
 		"enum TestEnum {\n  FOO = 13;\n  BAR = -10;\n  BAZ = 500;\n}\n",
 		`enum_type { name: "TestEnum" value { name:"FOO" number:13 } value { name:"BAR" number:-10 } value { name:"BAZ" number:500 } }`,
 	},
+	{
+		"EnumValueBases",
+		"enum TestEnum {\n  FOO = 0x10;\n  BAR = -010;\n  BAZ = -0x80000000;\n  QUX = 2147483647;\n}\n",
+		`enum_type { name: "TestEnum" value { name:"FOO" number:16 } value { name:"BAR" number:-8 } value { name:"BAZ" number:-2147483648 } value { name:"QUX" number:2147483647 } }`,
+	},
+	{
+		"TagNumberBases",
+		"message TestMessage {\n  required int32 foo = 0x10;\n  required int32 bar = 017;\n}\n",
+		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:16 } field { name:"bar" label:LABEL_REQUIRED type:TYPE_INT32 number:15 } }`,
+	},
 	{
 		"SimpleService",
 		"service TestService {\n  rpc Foo(In) returns (Out);\n}\n message In{} message Out{}",
@@ -367,6 +460,16 @@ var parseTests = []parseTest{
 		"option java_package = \"com.google.foo\";\noption optimize_for = CODE_SIZE;",
 		`options { uninterpreted_option { name { name_part: "java_package" is_extension: false } string_value: "com.google.foo"} uninterpreted_option { name { name_part: "optimize_for" is_extension: false } identifier_value: "CODE_SIZE" } }`,
 	},
+	{
+		"ParseFileOptionStrings",
+		"option java_package = 'com.' \"google\"\n  \".foo\";\noption go_package = \"\\x41\\102\\u00e9\\U0001F600\\?\";",
+		`options { uninterpreted_option { name { name_part: "java_package" is_extension: false } string_value: "com.google.foo"} uninterpreted_option { name { name_part: "go_package" is_extension: false } string_value: "AB\303\251\360\237\230\200?" } }`,
+	},
+	{
+		"ParseCustomFileOptions",
+		"option (my.opt) = { a: 1 b { c: \"d\" } };\noption (my.other) = BAR;",
+		`options { uninterpreted_option { name { name_part: "my.opt" is_extension: true } aggregate_value: "a: 1 b {c: \"d\"}"} uninterpreted_option { name { name_part: "my.other" is_extension: true } identifier_value: "BAR" } }`,
+	},
 	{
 		"ParsePublicImports",
 		"import \"foo.proto\";\nimport public \"bar.proto\";\nimport \"baz.proto\";\nimport public \"qux.proto\";\n",
@@ -377,6 +480,752 @@ var parseTests = []parseTest{
 func TestParsing(t *testing.T) {
 	for _, pt := range parseTests {
 		t.Logf("[ %v ]", pt.name)
-		tryParse(t, pt.input, pt.expected)
+		tryParse(t, pt.input, pt.expected, newerParseFields[pt.name])
+	}
+}
+
+func TestParseFileDoesNotResolve(t *testing.T) {
+	src := "syntax = \"proto3\";\nimport \"missing.proto\";\nmessage TestMessage {\n  other.Missing foo = 1;\n}\n"
+
+	f, err := ParseFile("test.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	if got := f.Imports; len(got) != 1 || got[0] != "missing.proto" {
+		t.Errorf("got imports %q, want [\"missing.proto\"]", got)
+	}
+	field := f.Messages[0].Fields[0]
+	if field.TypeName != "other.Missing" || field.Type != nil {
+		t.Errorf("got field type name %q (type %v), want \"other.Missing\" unresolved", field.TypeName, field.Type)
+	}
+}
+
+func TestParseFileError(t *testing.T) {
+	if _, err := ParseFile("test.proto", []byte("message TestMessage {")); err == nil {
+		t.Errorf("expected error parsing truncated input")
+	}
+}
+
+// newerParseFields lists, by the name of the test, the fields that the
+// vendored descriptor package predates, as recorded by gendesc.
+var newerParseFields = map[string][]string{
+	"Proto3Optional": {
+		"message_type[0].field[0]: proto3_optional:true",
+		"message_type[0].field[2]: proto3_optional:true",
+	},
+	"Editions": {
+		": edition:EDITION_2023",
+		"message_type[0].field[0].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:LEGACY_BEST_EFFORT >",
+		"message_type[0].field[1].options: features:<field_presence:IMPLICIT enum_type:OPEN repeated_field_encoding:EXPANDED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:LEGACY_BEST_EFFORT >",
+		"message_type[0].options: features:<field_presence:IMPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:LEGACY_BEST_EFFORT >",
+		"enum_type[0].options: features:<field_presence:IMPLICIT enum_type:CLOSED repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"options: features:<field_presence:IMPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+	},
+	"EditionsMap": {
+		": edition:EDITION_2023",
+		"message_type[0].field[0].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"message_type[0].nested_type[0].field[0].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"message_type[0].nested_type[0].field[1].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"message_type[0].nested_type[0].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"message_type[0].options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+		"options: features:<field_presence:EXPLICIT enum_type:OPEN repeated_field_encoding:PACKED utf8_validation:VERIFY message_encoding:LENGTH_PREFIXED json_format:ALLOW >",
+	},
+	"ExtensionRangeOptions": {
+		`message_type[0].extension_range[0]: options:<declaration:<number:100 full_name:".foo.bar" type:".foo.TestMessage" > declaration:<number:101 reserved:true > verification:DECLARATION >`,
+		`message_type[0].extension_range[1]: options:<verification:UNVERIFIED uninterpreted_option:<name:<name_part:"foo.kind" is_extension:true > identifier_value:"SMALL" > >`,
+	},
+	"OptionalOptionalLabelProto3": {
+		"message_type[0].field[1]: proto3_optional:true",
+	},
+}
+
+var parseErrorTests = []struct {
+	name  string
+	input string
+	want  string // the error message, less its position
+}{
+	{"BadMessageName", "message 1Foo {}", `invalid number "1Foo"`},
+	{"DottedMessageName", "message foo.Bar {}", `invalid message name "foo.Bar"`},
+	{"StringFieldName", "message Foo { required int32 \"bar\" = 1; }", `invalid field name "\"bar\""`},
+	{"BadEnumValueName", "enum Foo { 2BAR = 1; }", `invalid number "2BAR"`},
+	{"EnumValueOutOfRange", "enum Foo { BAR = 0x80000000; }", `enum number 2147483648 out of range`},
+	{"NegativeEnumValueOutOfRange", "enum Foo { BAR = -2147483649; }", `enum number -2147483649 out of range`},
+	{"FloatEnumValue", "enum Foo { BAR = 1.5; }", `bad enum number "1.5"`},
+	{"BadOctal", "message Foo { required int32 bar = 08; }", `invalid number "08"`},
+	{"BadHex", "message Foo { required int32 bar = 0x; }", `invalid number "0x"`},
+	{"UnterminatedComment", "message Foo {}\n/* foo", `encountered EOF inside multi-line comment`},
+	{"UnterminatedSlashComment", "/*/", `encountered EOF inside multi-line comment`},
+	{"UnterminatedCommentAfterBackOff", "message Foo { option /* foo", `encountered EOF inside multi-line comment`},
+	{"UnterminatedStringAfterBackOff", "message Foo { option \"foo", `encountered EOF inside string`},
+	{"TooDeep", strings.Repeat("message Foo { ", DefaultMaxDepth+1), `messages nested too deeply (the limit is 100)`},
+	{"BadFloat", "message Foo { required double bar = 1 [default = 1.2.3]; }", `invalid number "1.2.3"`},
+	{"BadExponent", "message Foo { required double bar = 1 [default = 1e]; }", `invalid number "1e"`},
+	{"LabelInOneof", "message Foo { oneof bar { optional int32 baz = 1; } }", `fields in oneofs must not have labels (required / optional / repeated)`},
+	{"InvalidEdition", `edition = "2022";`, `invalid edition "2022"`},
+	{"UnsupportedEdition", `edition = "2024";`, `invalid edition "2024"`},
+	{"EditionAndSyntax", "syntax = \"proto3\";\nedition = \"2023\";", `duplicate syntax statement`},
+	{"FeaturesOutsideEditions", "syntax = \"proto3\";\noption features.field_presence = EXPLICIT;", `features are only valid under editions`},
+	{"UnknownFeature", "edition = \"2023\";\noption features.foo = BAR;", `unknown feature "foo"`},
+	{"BadFeatureValue", "edition = \"2023\";\noption features.enum_type = EXPLICIT;", `invalid value "EXPLICIT" for feature "enum_type"`},
+	{"BadFeatureTarget", "edition = \"2023\";\nmessage Foo { option features.field_presence = IMPLICIT; }", `feature "field_presence" can't be set on a message`},
+	{"RequiredInEditions", "edition = \"2023\";\nmessage Foo { required int32 bar = 1; }", `label "required" is not supported in editions; use features.field_presence instead`},
+	{"RequiredInProto3", "syntax = \"proto3\";\nmessage Foo { required int32 bar = 1; }", `label "required" is not supported in proto3`},
+	{"OptionInOneof", "message Foo { oneof bar { option (baz) = 1; int32 qux = 1; } }", `options in a oneof are not supported`},
+	{"GroupInEditions", "edition = \"2023\";\nmessage Foo { repeated group Bar = 1 {} }", `groups are not supported in editions; use features.message_encoding = DELIMITED instead`},
+	{"DeclarationOutOfRange", "message Foo { extensions 10 to 20 [declaration = { number: 21, full_name: \".bar\", type: \"int32\" }]; }", `extension declaration number 21 is not in the extension range`},
+	{"DuplicateDeclaration", "message Foo { extensions 10 to 20 [declaration = { number: 11, reserved: true }, declaration = { number: 11, reserved: true }]; }", `extension number 11 is declared more than once`},
+	{"IncompleteDeclaration", "message Foo { extensions 10 to 20 [declaration = { number: 11, type: \"int32\" }]; }", `extension declaration 11 must have a full_name and type, unless it is reserved`},
+	{"UnqualifiedDeclarationName", "message Foo { extensions 10 to 20 [declaration = { number: 11, full_name: \"bar\", type: \"int32\" }]; }", `invalid extension full_name "bar"; it must be fully qualified, with a leading dot`},
+	{"UnknownDeclarationField", "message Foo { extensions 10 to 20 [declaration = { numbr: 11 }]; }", `unknown extension declaration field "numbr"`},
+	{"UnverifiedDeclarations", "message Foo { extensions 10 to 20 [declaration = { number: 11, reserved: true }, verification = UNVERIFIED]; }", `an extension range with declarations can't be UNVERIFIED`},
+	{"BadExtensionRangeOption", "message Foo { extensions 10 to 20 [packed = true]; }", `got "packed", want "declaration", "verification" or a custom option`},
+	{"FloatTag", "message Foo { required int32 bar = 1.0; }", `bad field number "1.0"`},
+	{"BadEscape", `option foo = "\q";`, `invalid quoted string ["\q"]: unknown escape sequence \q`},
+	{"BadHexEscape", `option foo = "\xzz";`, `invalid quoted string ["\xzz"]: \x used with no following hex digits`},
+	{"BadUnicodeEscape", `option foo = "\u12";`, `invalid quoted string ["\u12"]: \u requires 4 hex digits`},
+	{"NewlineInString", "option foo = \"a\nb\";", `newline in string`},
+	{"BadPackage", "package foo..bar;", `invalid package name ".bar"`},
+	{"UnknownFieldOption", "message Foo { optional int32 bar = 1 [lazy = true]; }", `unknown field option "lazy", want "default", "packed", "deprecated", "features.*" or a custom option in parentheses`},
+	{"UnterminatedMethodOptions", "service Foo { rpc Bar (A) returns (B) { /* foo", `encountered EOF inside multi-line comment`},
+	{"ReservedMix", "message Foo { reserved 1, \"bar\"; }", `reserved lists must be all tags or all names, not a mix`},
+	{"BadReservedName", "message Foo { reserved \"1bar\"; }", `reserved name "1bar" is not a valid identifier`},
+}
+
+var resolveErrorTests = []struct {
+	name  string
+	input string
+	want  string // the error message, less its position
+}{
+	{"Int32OutOfRange", "message Foo { optional int32 bar = 1 [default = 0x80000000]; }", `invalid default value 0x80000000 for field "bar": integer out of range [-2147483648, 2147483647]`},
+	{"NegativeUint", "message Foo { optional uint64 bar = 1 [default = -1]; }", `invalid default value -1 for field "bar": unsigned fields can't have negative default values`},
+	{"FloatForInt", "message Foo { optional int64 bar = 1 [default = 1.5]; }", `invalid default value 1.5 for field "bar": expected an integer`},
+	{"StringForInt", "message Foo { optional int32 bar = 1 [default = \"1\"]; }", `invalid default value "1" for field "bar": a string is not a valid int32`},
+	{"IdentForDouble", "message Foo { optional double bar = 1 [default = infinity]; }", `invalid default value infinity for field "bar": expected a number, inf or nan`},
+	{"BadBool", "message Foo { optional bool bar = 1 [default = 1]; }", `invalid default value 1 for field "bar": expected true or false`},
+	{"IdentForString", "message Foo { optional string bar = 1 [default = foo]; }", `invalid default value foo for field "bar": expected a string`},
+	{"UnknownEnumValue", "message Foo { optional E bar = 1 [default = BAZ]; } enum E { QUX = 0; }", `invalid default value BAZ for field "bar": enum E has no value named BAZ`},
+	{"MessageDefault", "message Foo { optional Foo bar = 1 [default = 1]; }", `invalid default value 1 for field "bar": message fields can't have default values`},
+	{"RepeatedDefault", "message Foo { repeated int32 bar = 1 [default = 1]; }", `repeated fields can't have default values`},
+	{"ImplicitPresenceDefault", "edition = \"2023\"; message Foo { int32 bar = 1 [features.field_presence = IMPLICIT, default = 1]; }", `implicit presence fields can't specify defaults`},
+	{"Proto3Default", "syntax = \"proto3\"; message Foo { int32 bar = 1 [default = 1]; }", `explicit default values are not allowed in proto3`},
+	{"ExtensionOutOfRange", "message Foo { extensions 10 to 20; } extend Foo { optional int32 bar = 21; }", `"Foo" does not declare 21 as an extension number`},
+	{"ExtensionCollision", "package p; message Foo { extensions 10 to 20; } extend Foo { optional int32 bar = 11; } extend Foo { optional int32 baz = 11; }", `extension number 11 of "p.Foo" is already used by "bar" at test.proto:1`},
+	{"UndeclaredExtension", "message Foo { extensions 10 to 20 [verification = DECLARATION]; } extend Foo { optional int32 bar = 11; }", `extension .bar uses number 11, which is not declared in the extension range of "Foo"`},
+	{"ReservedExtension", "message Foo { extensions 10 to 20 [declaration = { number: 11, reserved: true }]; } extend Foo { optional int32 bar = 11; }", `extension .bar uses number 11, which is reserved in the extension range of "Foo"`},
+	{"ExtensionNameMismatch", "message Foo { extensions 10 to 20 [declaration = { number: 11, full_name: \".baz\", type: \"int32\" }]; } extend Foo { optional int32 bar = 11; }", `extension .bar does not match the full name .baz declared for number 11`},
+	{"ExtensionTypeMismatch", "message Foo { extensions 10 to 20 [declaration = { number: 11, full_name: \".bar\", type: \".Foo\" }]; } extend Foo { optional int32 bar = 11; }", `extension .bar has type int32, but .Foo is declared`},
+	{"ExtensionRepeatedMismatch", "message Foo { extensions 10 to 20 [declaration = { number: 11, full_name: \".bar\", type: \"int32\", repeated: true }]; } extend Foo { optional int32 bar = 11; }", `extension .bar must be repeated, as declared`},
+}
+
+func TestResolveErrors(t *testing.T) {
+	for _, tt := range resolveErrorTests {
+		f, err := ParseFile("test.proto", []byte(tt.input))
+		if err != nil {
+			t.Errorf("%v: unexpected parse error: %v", tt.name, err)
+			continue
+		}
+		err = resolveSymbols(&ast.FileSet{Files: []*ast.File{f}}, false)
+		if err == nil {
+			t.Errorf("%v: expected error %q", tt.name, tt.want)
+			continue
+		}
+		got := err.Error()
+		if i := strings.Index(got, ": "); i != -1 {
+			got = got[i+2:]
+		}
+		if got != tt.want {
+			t.Errorf("%v: got error %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveImportVisibility(t *testing.T) {
+	parse := func(name, src string) *ast.File {
+		f, err := ParseFile(name, []byte(src))
+		if err != nil {
+			t.Fatalf("unexpected parse error: %v", err)
+		}
+		return f
+	}
+
+	files := func() []*ast.File {
+		return []*ast.File{
+			parse("a.proto", "package p; import \"b.proto\"; message A { optional C c = 1; }"),
+			parse("b.proto", "package p; import public \"c.proto\"; message B {}"),
+			parse("c.proto", "package p; message C {}"),
+			parse("d.proto", "package p; message D {}"),
+			parse("e.proto", "package p; message E { optional D d = 1; }"),
+		}
+	}
+
+	// C is visible to a.proto through the public import in b.proto
+	if err := resolveSymbols(&ast.FileSet{Files: files()[:4]}, true); err != nil {
+		t.Fatalf("unexpected resolve error: %v", err)
+	}
+
+	// D is in the same package as E, but e.proto does not import d.proto
+	err := resolveSymbols(&ast.FileSet{Files: files()}, true)
+	if err == nil || !strings.Contains(err.Error(), `failed to resolve name "D"`) {
+		t.Fatalf("got error %v, want failure to resolve D", err)
+	}
+
+	if err := resolveSymbols(&ast.FileSet{Files: files()}, false); err != nil {
+		t.Fatalf("unexpected resolve error without requireImports: %v", err)
+	}
+}
+
+func TestResolveFullyQualified(t *testing.T) {
+	f, err := ParseFile("a.proto", []byte(`package a.b;
+message M {
+  message M {}
+  optional .a.b.M outer = 1;
+  optional M inner = 2;
+  optional .a.b.M.M nested = 3;
+}
+service S {
+  rpc Get (.a.b.M) returns (.a.b.M.M);
+}
+`))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if err := Resolve(&ast.FileSet{Files: []*ast.File{f}}); err != nil {
+		t.Fatalf("unexpected resolve error: %v", err)
+	}
+
+	m := f.Messages[0]
+	types := []struct {
+		got  interface{}
+		want *ast.Message
+	}{
+		{m.Fields[0].Type, m},
+		{m.Fields[1].Type, m.Messages[0]},
+		{m.Fields[2].Type, m.Messages[0]},
+		{f.Services[0].Methods[0].InType, m},
+		{f.Services[0].Methods[0].OutType, m.Messages[0]},
+	}
+	for i, tt := range types {
+		if tt.got != tt.want {
+			t.Errorf("%v: resolved to %v, want %v", i, ast.FullName(tt.got), ast.FullName(tt.want))
+		}
+	}
+
+	// a fully qualified name is not relative to the package
+	f, err = ParseFile("b.proto", []byte("package a.b;\nmessage M { optional .b.M m = 1; }\n"))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	err = Resolve(&ast.FileSet{Files: []*ast.File{f}})
+	if err == nil || !strings.Contains(err.Error(), `failed to resolve name ".b.M"`) {
+		t.Errorf("got error %v, want failure to resolve .b.M", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range parseErrorTests {
+		_, err := ParseFile("test.proto", []byte(tt.input))
+		if err == nil {
+			t.Errorf("%v: expected error %q", tt.name, tt.want)
+			continue
+		}
+		got := err.Error()
+		if i := strings.Index(got, ": "); i != -1 {
+			got = got[i+2:]
+		}
+		if got != tt.want {
+			t.Errorf("%v: got error %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	_, err := ParseFile("test.proto", []byte("message Foo {\n  required int32 bar = 08;\n}"))
+	se, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("got %T parsing, want *SyntaxError", err)
+	}
+	if se.Filename != "test.proto" || se.Pos.Line != 2 || se.Pos.Offset != 37 {
+		t.Errorf("got SyntaxError at %v%v (offset %v), want test.proto:2 (offset 37)", se.Filename, se.Pos, se.Pos.Offset)
+	}
+	if got, want := se.Error(), "test.proto:2: "+se.Msg; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+
+	f, err := ParseFile("test.proto", []byte("message Foo {\n  optional Bar bar = 1;\n}"))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	err = Resolve(&ast.FileSet{Files: []*ast.File{f}})
+	re, ok := err.(*ResolveError)
+	if !ok {
+		t.Fatalf("got %T resolving, want *ResolveError", err)
+	}
+	if re.Filename != "test.proto" || re.Pos.Line != 2 {
+		t.Errorf("got ResolveError at %v%v, want test.proto:2", re.Filename, re.Pos)
+	}
+
+	var nse *SyntaxError
+	var nre *ResolveError
+	if nse.Error() != "<nil>" || nre.Error() != "<nil>" {
+		t.Errorf("got errors %q and %q for nil errors, want <nil>", nse.Error(), nre.Error())
+	}
+
+	// a limit on the file as a whole is reported at its start
+	c := &Config{MaxFileSize: 1}
+	_, err = c.ParseFile("test.proto", []byte("message Foo {}"))
+	se, ok = err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("got %T exceeding a limit, want *SyntaxError", err)
+	}
+	if se.Filename != "test.proto" || se.Pos != (ast.Position{Line: 1}) {
+		t.Errorf("got SyntaxError at %v%v (offset %v), want test.proto:1 (offset 0)", se.Filename, se.Pos, se.Pos.Offset)
+	}
+}
+
+func TestAggregateOptions(t *testing.T) {
+	src := `option (file.opt) = { a: 1 };
+option java_package = "foo";
+service Library {
+  rpc GetBook(GetBookRequest) returns (Book) {
+    option (google.api.http) = {
+      get: "/v1/{name=shelves/*/books/*}",
+      additional_bindings { get: "/v1/books/{id}"; }
+      additional_bindings: [{ post: "/v1/books:get" body: "*" }, {}]
+      [foo.bar]: -1.5
+      list: []
+      ids: [1, 2]
+    };
+  }
+}
+message Foo {
+  option (foo) = { a: "b" };
+  optional int32 bar = 1 [(baz) = { c: D }];
+  extensions 10 to 20 [(qux) = { e: 1 }];
+}
+enum E {
+  option (quux) = { f: 2 };
+  V = 0;
+}
+`
+	f, err := ParseFile("test.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+
+	want := `{get: "/v1/{name=shelves/*/books/*}" additional_bindings {get: "/v1/books/{id}"} additional_bindings {post: "/v1/books:get" body: "*"} additional_bindings {} [foo.bar]: -1.5 ids: 1 ids: 2}`
+	if got := f.Services[0].Methods[0].Options[0][1]; got != want {
+		t.Errorf("got method option %s, want %s", got, want)
+	}
+	if got, want := f.Messages[0].Options[0][1], `{a: "b"}`; got != want {
+		t.Errorf("got message option %s, want %s", got, want)
+	}
+	if got, want := f.Messages[0].Fields[0].Options[0][1], `{c: D}`; got != want {
+		t.Errorf("got field option %s, want %s", got, want)
+	}
+	if got, want := f.Messages[0].RangeOptions(0).Options, [][2]string{{"qux", `{e: 1}`}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got extension range options %q, want %q", got, want)
+	}
+	if got, want := f.Enums[0].Options, [][2]string{{"quux", `{f: 2}`}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got enum options %q, want %q", got, want)
+	}
+	// the key of a custom file option keeps its parentheses, as the file's
+	// options are built-in options too
+	if got, want := f.Options, [][2]string{{"(file.opt)", `{a: 1}`}, {"java_package", `"foo"`}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got file options %q, want %q", got, want)
+	}
+
+	a, err := ParseAggregate(want)
+	if err != nil {
+		t.Fatalf("ParseAggregate: %v", err)
+	}
+	if got := a.String(); got != want {
+		t.Errorf("ParseAggregate(%s) = %s", want, got)
+	}
+	if v, ok := a.Get("get"); !ok || v != `"/v1/{name=shelves/*/books/*}"` {
+		t.Errorf("Get(\"get\") = %s, %v", v, ok)
+	}
+	if n := len(a[1].Aggregate); n != 1 {
+		t.Errorf("additional_bindings has %d fields, want 1", n)
+	}
+
+	for _, s := range []string{`{a: }`, `{a b}`, `{a: 1} b`, `{a: [1 2]}`, strings.Repeat("{a ", DefaultMaxDepth+1)} {
+		if _, err := ParseAggregate(s); err == nil {
+			t.Errorf("ParseAggregate(%s) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     Config
+		input string
+		want  string // the error message, less its position; empty if none
+	}{
+		{"FileSize", Config{MaxFileSize: 10}, "message Foo {}", `file too large (14 bytes, the limit is 10)`},
+		{"FileSizeOK", Config{MaxFileSize: 14}, "message Foo {}", ``},
+		{"Depth", Config{MaxDepth: 2}, "message A { message B { optional group C = 1 {} } }", `messages nested too deeply (the limit is 2)`},
+		{"DepthOK", Config{MaxDepth: 2}, "message A { message B {} }", ``},
+		{"NoDepthLimit", Config{MaxDepth: -1}, strings.Repeat("message A { ", DefaultMaxDepth+1) + strings.Repeat("}", DefaultMaxDepth+1), ``},
+		{"Tokens", Config{MaxTokens: 5}, "message Foo { optional int32 bar = 1; }", `too many tokens (the limit is 5)`},
+		{"TokensOK", Config{MaxTokens: 11}, "message Foo { optional int32 bar = 1; }", ``},
+	}
+	for _, tt := range tests {
+		_, err := tt.c.ParseFile("test.proto", []byte(tt.input))
+		got := ""
+		if err != nil {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("%v: got %T, want *SyntaxError", tt.name, err)
+			}
+			got = err.Error()
+			if i := strings.Index(got, ": "); i != -1 {
+				got = got[i+2:]
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%v: got error %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigParseFilesLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser_test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"a.proto": "import \"b.proto\";\nimport \"c.proto\";\nmessage A {}\n",
+		"b.proto": "message B {}\n",
+		"c.proto": "message C {}\n",
+	})
+
+	tests := []struct {
+		name string
+		c    Config
+		want string
+	}{
+		{"Files", Config{MaxFiles: 2}, `too many files (the limit is 2)`},
+		{"FilesOK", Config{MaxFiles: 3}, ``},
+		// a.proto has 10 tokens, and b.proto and c.proto have 4 each
+		{"Tokens", Config{MaxTokens: 17}, `too many tokens (the limit is 17)`},
+		{"TokensOK", Config{MaxTokens: 18}, ``},
+		{"CachedTokens", Config{MaxTokens: 17, Cache: new(Cache)}, `too many tokens (the limit is 17)`},
+	}
+	for _, tt := range tests {
+		tt.c.ImportPaths = []string{dir}
+		if tt.c.Cache != nil {
+			// populate the cache, so that the limit is checked against it
+			if _, err := tt.c.Cache.ParseFile("b.proto", []byte("message B {}\n")); err != nil {
+				t.Fatalf("%v: could not populate cache: %v", tt.name, err)
+			}
+		}
+		_, err := tt.c.ParseFiles([]string{"a.proto"})
+		got := ""
+		if err != nil {
+			got = err.Error()
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("%v: got %T, want *SyntaxError", tt.name, err)
+			}
+			if i := strings.Index(got, ": "); i != -1 {
+				got = got[i+2:]
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%v: got error %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigParseFilesMissingImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser_test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"a.proto": "import \"b.proto\";\nmessage A {}\n",
+		"b.proto": "syntax = \"proto3\";\n\nimport public \"c.proto\";\nmessage B {}\n",
+	})
+
+	// the second use of cache finds the position of the import in it
+	want := "b.proto:3: import \"c.proto\" not found in import paths [" + dir + "]"
+	cache := new(Cache)
+	for _, c := range []Config{{}, {Cache: cache}, {Cache: cache}} {
+		c.ImportPaths = []string{dir}
+		_, err := c.ParseFiles([]string{"a.proto"})
+		if _, ok := err.(*ResolveError); !ok {
+			t.Fatalf("got %T, want *ResolveError", err)
+		}
+		if got := err.Error(); got != want {
+			t.Errorf("got error %q, want %q", got, want)
+		}
+	}
+}
+
+func TestResolvedFeatures(t *testing.T) {
+	src := `edition = "2023";
+option features.utf8_validation = NONE;
+message Foo {
+  option features.json_format = LEGACY_BEST_EFFORT;
+  message Bar {
+    repeated int32 baz = 1 [features.repeated_field_encoding = EXPANDED];
+  }
+}
+enum E {
+  option features.enum_type = CLOSED;
+  V = 0;
+}
+`
+	f, err := ParseFile("test.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := ast.Features{
+		FieldPresence:         "EXPLICIT",
+		EnumType:              "OPEN",
+		RepeatedFieldEncoding: "EXPANDED",
+		Utf8Validation:        "NONE",
+		MessageEncoding:       "LENGTH_PREFIXED",
+		JSONFormat:            "LEGACY_BEST_EFFORT",
+	}
+	if got := f.Messages[0].Messages[0].Fields[0].ResolvedFeatures(); got != want {
+		t.Errorf("field features: got %+v, want %+v", got, want)
+	}
+
+	want = ast.Features{
+		FieldPresence:         "EXPLICIT",
+		EnumType:              "CLOSED",
+		RepeatedFieldEncoding: "PACKED",
+		Utf8Validation:        "NONE",
+		MessageEncoding:       "LENGTH_PREFIXED",
+		JSONFormat:            "ALLOW",
+	}
+	if got := f.Enums[0].ResolvedFeatures(); got != want {
+		t.Errorf("enum features: got %+v, want %+v", got, want)
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatalf("could not write %v: %v", name, err)
+		}
+	}
+}
+
+func TestConfigParseFilesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser_test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"a.proto": "import \"b.proto\";\nimport \"c.proto\";\nmessage A { optional B b = 1; optional C c = 2; }\n",
+		"b.proto": "import \"d.proto\";\nmessage B { optional D d = 1; }\n",
+		"c.proto": "import \"d.proto\";\nmessage C { optional D d = 1; }\n",
+		"d.proto": "message D {}\n",
+	})
+
+	c := &Config{
+		ImportPaths: []string{dir},
+		Concurrency: 2,
+		Cache:       new(Cache),
+	}
+
+	parse := func() map[string]*ast.File {
+		fset, err := c.ParseFiles([]string{"a.proto"})
+		if err != nil {
+			t.Fatalf("ParseFiles failed: %v", err)
+		}
+		var names []string
+		res := make(map[string]*ast.File)
+		for _, f := range fset.Files {
+			names = append(names, f.Name)
+			res[f.Name] = f
+		}
+		if got, want := strings.Join(names, " "), "a.proto b.proto c.proto d.proto"; got != want {
+			t.Fatalf("got files %q, want %q", got, want)
+		}
+		if typ := res["c.proto"].Messages[0].Fields[0].Type; typ != res["d.proto"].Messages[0] {
+			t.Fatalf("C.d resolved to %v, want D", typ)
+		}
+		return res
+	}
+
+	cached := func() map[string]*ast.File {
+		res := make(map[string]*ast.File)
+		for name, e := range c.Cache.entries {
+			res[name] = e.file
+		}
+		return res
+	}
+
+	first := parse()
+	if n := c.Cache.Len(); n != 4 {
+		t.Errorf("cache holds %v files, want 4", n)
+	}
+	before := cached()
+
+	writeTestFiles(t, dir, map[string]string{
+		"c.proto": "import \"d.proto\";\nmessage C { optional D d = 1; optional int32 i = 2; }\n",
+	})
+
+	second := parse()
+	after := cached()
+	for _, name := range []string{"a.proto", "b.proto", "d.proto"} {
+		if before[name] != after[name] {
+			t.Errorf("unchanged file %v was parsed again", name)
+		}
+	}
+	if before["c.proto"] == after["c.proto"] {
+		t.Errorf("changed file c.proto was not parsed again")
+	}
+
+	// the FileSets share nothing, and the cached files are left unresolved
+	for name, f := range second {
+		if f == first[name] || f == after[name] {
+			t.Errorf("file %v is shared", name)
+		}
+	}
+	if typ := first["c.proto"].Messages[0].Fields[0].Type; typ != first["d.proto"].Messages[0] {
+		t.Errorf("C.d of the first FileSet resolved to %v, want its D", typ)
+	}
+	if typ := after["c.proto"].Messages[0].Fields[0].Type; typ != nil {
+		t.Errorf("C.d of the cached file resolved to %v, want nil", typ)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	c := &Cache{MaxFiles: 2}
+
+	parse := func(name, src string) {
+		c.ParseFile(name, []byte(src))
+	}
+	held := func() string {
+		var names []string
+		for name := range c.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	parse("a.proto", "message A {}\n")
+	parse("b.proto", "message B {}\n")
+	parse("a.proto", "message A {}\n")
+	parse("c.proto", "message C {}\n")
+	if got, want := held(), "a.proto c.proto"; got != want {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+
+	// a changed file that no longer parses is dropped
+	parse("a.proto", "message A {\n")
+	if got, want := held(), "c.proto"; got != want {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestCommentEnd(t *testing.T) {
+	src := "// a\n// bc\nmessage A {}\n/* d\n e */ message B {}\n"
+	f, err := ParseFile("comments.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+
+	want := []struct {
+		end  ast.Position
+		text string
+	}{
+		{ast.Position{Line: 2, Offset: strings.Index(src, "\nmessage A")}, "// a\n// bc"},
+		{ast.Position{Line: 5, Offset: strings.Index(src, " message B")}, "/* d\n e */"},
+	}
+	if len(f.Comments) != len(want) {
+		t.Fatalf("got %v comments, want %v", len(f.Comments), len(want))
+	}
+	for i, w := range want {
+		c := f.Comments[i]
+		if c.End != w.end {
+			t.Errorf("comment %v: got end %+v, want %+v", i, c.End, w.end)
+		}
+		if got := src[c.Start.Offset:c.End.Offset]; got != w.text {
+			t.Errorf("comment %v: got source %q, want %q", i, got, w.text)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	src := `// Leading is documented.
+message Leading {
+  int32 a = 1; // a
+  int32 b = 2; // b
+  // c is
+  // documented
+  int32 c = 3;
+}
+
+/*
+ * Block is documented.
+ */
+message Block {}
+`
+	f, err := ParseFile("comments.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+
+	text := func(c *ast.Comment) string {
+		if c == nil {
+			return "<nil>"
+		}
+		return strings.Join(c.Text, "|")
+	}
+
+	leading, block := f.Messages[0], f.Messages[1]
+	tests := []struct {
+		desc      string
+		got, want string
+	}{
+		{"leading comment of Leading", text(ast.LeadingComment(leading)), "Leading is documented."},
+		{"inline comment of a", text(ast.InlineComment(leading.Fields[0])), "a"},
+		{"inline comment of b", text(ast.InlineComment(leading.Fields[1])), "b"},
+		{"leading comment of c", text(ast.LeadingComment(leading.Fields[2])), "c is|documented"},
+		{"leading comment of Block", text(ast.LeadingComment(block)), "* Block is documented."},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.desc, tt.got, tt.want)
+		}
+	}
+}
+
+func TestSplitPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser_test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"a.proto": "package pkg;\nimport \"b.proto\";\nimport \"c.proto\";\nmessage A { optional B b = 1; optional pkg.C c = 2; }\n",
+		"b.proto": "package pkg;\nmessage B {}\n",
+		"c.proto": "package pkg;\nmessage C {}\n",
+	})
+
+	fset, err := ParseFiles([]string{"a.proto"}, []string{dir})
+	if err != nil {
+		t.Fatalf("ParseFiles failed: %v", err)
+	}
+
+	a := fset.Files[0].Messages[0]
+	if b := fset.Files[1].Messages[0]; a.Fields[0].Type != b {
+		t.Errorf("A.b resolved to %v, want B", a.Fields[0].Type)
+	}
+	if c := fset.Files[2].Messages[0]; a.Fields[1].Type != c {
+		t.Errorf("A.c resolved to %v, want C", a.Fields[1].Type)
 	}
 }
@@ -13,11 +13,16 @@ import (
 	"myitcv.io/g/protobuf/ast"
 )
 
-func resolveSymbols(fset *ast.FileSet) error {
+// resolveSymbols resolves the names in fset. If requireImports is set, a file
+// may only refer to definitions in the files it imports.
+func resolveSymbols(fset *ast.FileSet, requireImports bool) error {
 	r := &resolver{fset: fset}
 	s := new(scope)
 	s.push(fset)
 	for _, f := range fset.Files {
+		if requireImports {
+			s.visible = visibleFiles(fset, f)
+		}
 		if err := r.resolveFile(s, f); err != nil {
 			return err
 		}
@@ -29,15 +34,22 @@ func resolveSymbols(fset *ast.FileSet) error {
 type scope struct {
 	// Valid types: FileSet, File, Message, Enum
 	objects []interface{}
+
+	// visible are the files whose definitions may be referred to: the file
+	// being resolved, and those it imports; if nil, every file
+	visible map[*ast.File]bool
 }
 
 func (s *scope) global() bool       { return len(s.objects) == 0 }
 func (s *scope) push(o interface{}) { s.objects = append(s.objects, o) }
 func (s *scope) pop()               { s.objects = s.objects[:len(s.objects)-1] }
 
+func (s *scope) sees(f *ast.File) bool { return s.visible == nil || s.visible[f] }
+
 func (s *scope) dup() *scope {
 	sc := &scope{
 		objects: make([]interface{}, len(s.objects)),
+		visible: s.visible,
 	}
 	copy(sc.objects, s.objects)
 	return sc
@@ -61,6 +73,9 @@ func (s *scope) findName(name []string) []interface{} {
 	case *ast.FileSet:
 		ret := []interface{}{}
 		for _, f := range ov.Files {
+			if !s.sees(f) {
+				continue
+			}
 			if len(f.Package) == 0 {
 				// No package; match on message/enum names
 				fs := s.dup()
@@ -79,21 +94,32 @@ func (s *scope) findName(name []string) []interface{} {
 					}
 
 					if match {
-						return []interface{}{f}
+						// a package may be split across
+						// several files
+						ret = append(ret, f)
 					}
 				}
 			}
 		}
 		return ret
 	case *ast.File:
-		for _, msg := range ov.Messages {
-			if msg.Name == name[0] {
-				return []interface{}{msg}
-			}
+		if ret := findInFile(ov, name); ret != nil {
+			return ret
 		}
-		for _, enum := range ov.Enums {
-			if enum.Name == name[0] {
-				return []interface{}{enum}
+		// the name may be defined in another file of the same package that
+		// is imported
+		if len(ov.Package) == 0 {
+			return nil
+		}
+		fset, ok := s.objects[0].(*ast.FileSet)
+		if !ok {
+			return nil
+		}
+		for _, f := range fset.Files {
+			if f != ov && s.sees(f) && samePackage(f, ov) {
+				if ret := findInFile(f, name); ret != nil {
+					return ret
+				}
 			}
 		}
 	case *ast.Message:
@@ -112,6 +138,59 @@ func (s *scope) findName(name []string) []interface{} {
 	return nil
 }
 
+func findInFile(f *ast.File, name []string) []interface{} {
+	for _, msg := range f.Messages {
+		if msg.Name == name[0] {
+			return []interface{}{msg}
+		}
+	}
+	for _, enum := range f.Enums {
+		if enum.Name == name[0] {
+			return []interface{}{enum}
+		}
+	}
+	return nil
+}
+
+// visibleFiles returns the files of fset whose definitions f may refer to:
+// f itself, the files it imports, and those they import publicly, in turn.
+func visibleFiles(fset *ast.FileSet, f *ast.File) map[*ast.File]bool {
+	byName := make(map[string]*ast.File)
+	for _, f := range fset.Files {
+		byName[f.Name] = f
+	}
+
+	res := map[*ast.File]bool{f: true}
+	var public func(f *ast.File)
+	public = func(f *ast.File) {
+		for _, i := range f.PublicImports {
+			if pf, ok := byName[f.Imports[i]]; ok && !res[pf] {
+				res[pf] = true
+				public(pf)
+			}
+		}
+	}
+	for _, imp := range f.Imports {
+		if imf, ok := byName[imp]; ok && !res[imf] {
+			res[imf] = true
+			public(imf)
+		}
+	}
+	return res
+}
+
+func samePackage(a, b *ast.File) bool {
+	if len(a.Package) != len(b.Package) {
+		return false
+	}
+	for i := range a.Package {
+		if a.Package[i] != b.Package[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *scope) fullName() string {
 	n := make([]string, 0, len(s.objects))
 	for _, o := range s.objects {
@@ -129,6 +208,10 @@ func (s *scope) fullName() string {
 
 type resolver struct {
 	fset *ast.FileSet
+
+	// extensions records the extensions of each message by number, so
+	// that collisions can be reported
+	extensions map[*ast.Message]map[int]*ast.Field
 }
 
 func (r *resolver) resolveFile(s *scope, f *ast.File) error {
@@ -138,21 +221,21 @@ func (r *resolver) resolveFile(s *scope, f *ast.File) error {
 	// Resolve messages.
 	for _, msg := range f.Messages {
 		if err := r.resolveMessage(fs, msg); err != nil {
-			return fmt.Errorf("(%v): %v", msg.Name, err)
+			return err
 		}
 	}
 	// Resolve messages in services.
 	for _, srv := range f.Services {
 		for _, mth := range srv.Methods {
 			if err := r.resolveMethod(fs, mth); err != nil {
-				return fmt.Errorf("(%s.%s): %v", srv.Name, mth.Name, err)
+				return err
 			}
 		}
 	}
 	// Resolve types in extensions.
 	for _, ext := range f.Extensions {
 		if err := r.resolveExtension(fs, ext); err != nil {
-			return fmt.Errorf("(ext %s): %v", ext.Extendee, err)
+			return err
 		}
 	}
 
@@ -192,13 +275,17 @@ func (r *resolver) resolveMessage(s *scope, msg *ast.Message) error {
 	for _, field := range msg.Fields {
 		ft, ok := r.resolveFieldTypeName(ms, field.TypeName)
 		if !ok {
-			return fmt.Errorf("failed to resolve name %q", field.TypeName)
+			return errorAt(field, "failed to resolve name %q", field.TypeName)
 		}
 		field.Type = ft
 
+		if err := checkDefault(field); err != nil {
+			return err
+		}
+
 		if ktn := field.KeyTypeName; ktn != "" {
 			if !validMapKeyTypes[ktn] {
-				return fmt.Errorf("invalid map key type %q", ktn)
+				return errorAt(field, "invalid map key type %q", ktn)
 			}
 			field.KeyType = fieldTypeInverseMap[ktn]
 		}
@@ -235,13 +322,13 @@ func (r *resolver) resolveFieldTypeName(s *scope, name string) (interface{}, boo
 func (r *resolver) resolveMethod(s *scope, mth *ast.Method) error {
 	o := r.resolveName(s, mth.InTypeName)
 	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", mth.InTypeName)
+		return errorAt(mth, "failed to resolve name %q", mth.InTypeName)
 	}
 	mth.InType = o.last()
 
 	o = r.resolveName(s, mth.OutTypeName)
 	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", mth.OutTypeName)
+		return errorAt(mth, "failed to resolve name %q", mth.OutTypeName)
 	}
 	mth.OutType = o.last()
 
@@ -251,29 +338,120 @@ func (r *resolver) resolveMethod(s *scope, mth *ast.Method) error {
 func (r *resolver) resolveExtension(s *scope, ext *ast.Extension) error {
 	o := r.resolveName(s, ext.Extendee)
 	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", ext.Extendee)
+		return errorAt(ext, "failed to resolve name %q", ext.Extendee)
 	}
 	m, ok := o.last().(*ast.Message)
 	if !ok {
-		return fmt.Errorf("extendee %q resolved to non-message %T", ext.Extendee, o.last())
+		return errorAt(ext, "extendee %q resolved to non-message %T", ext.Extendee, o.last())
 	}
 	ext.ExtendeeType = m
 	// Resolve fields.
 	for _, field := range ext.Fields {
 		ft, ok := r.resolveFieldTypeName(s, field.TypeName)
 		if !ok {
-			return fmt.Errorf("failed to resolve name %q", field.TypeName)
+			return errorAt(field, "failed to resolve name %q", field.TypeName)
 		}
 		field.Type = ft
 
+		if err := checkDefault(field); err != nil {
+			return err
+		}
+		if err := r.checkExtensionNumber(s, m, field); err != nil {
+			return err
+		}
+
 		// TODO: Map fields should be forbidden?
 	}
 	return nil
 }
 
+// checkExtensionNumber checks that the number of field, an extension of m
+// defined in scope s, is within one of the extension ranges of m and matches
+// any declaration for it there, and that no other extension of m uses it.
+func (r *resolver) checkExtensionNumber(s *scope, m *ast.Message, field *ast.Field) *ResolveError {
+	rng := -1
+	for i, er := range m.ExtensionRanges {
+		if er[0] <= field.Tag && field.Tag <= er[1] {
+			rng = i
+			break
+		}
+	}
+	mname := ast.FullName(m)
+	if rng == -1 {
+		return errorAt(field, "%q does not declare %d as an extension number", mname, field.Tag)
+	}
+
+	if o := m.RangeOptions(rng); o != nil && (len(o.Declarations) > 0 || o.Verification == "DECLARATION") {
+		full := s.fullName()
+		if full != "." {
+			full += "."
+		}
+		full += field.Name
+
+		var decl *ast.ExtensionDeclaration
+		for i, d := range o.Declarations {
+			if d.Number == field.Tag {
+				decl = &o.Declarations[i]
+				break
+			}
+		}
+
+		switch {
+		case decl == nil:
+			return errorAt(field, "extension %v uses number %d, which is not declared in the extension range of %q", full, field.Tag, mname)
+		case decl.Reserved:
+			return errorAt(field, "extension %v uses number %d, which is reserved in the extension range of %q", full, field.Tag, mname)
+		case decl.FullName != full:
+			return errorAt(field, "extension %v does not match the full name %v declared for number %d", full, decl.FullName, field.Tag)
+		case decl.Type != ast.TypeName(field.Type):
+			return errorAt(field, "extension %v has type %v, but %v is declared", full, ast.TypeName(field.Type), decl.Type)
+		case decl.Repeated != field.Repeated:
+			if decl.Repeated {
+				return errorAt(field, "extension %v must be repeated, as declared", full)
+			}
+			return errorAt(field, "extension %v must not be repeated, as declared", full)
+		}
+	}
+
+	if r.extensions == nil {
+		r.extensions = make(map[*ast.Message]map[int]*ast.Field)
+	}
+	used := r.extensions[m]
+	if used == nil {
+		used = make(map[int]*ast.Field)
+		r.extensions[m] = used
+	}
+	if prev, ok := used[field.Tag]; ok {
+		return errorAt(field, "extension number %d of %q is already used by %q at %v:%v", field.Tag, mname, prev.Name, prev.File().Name, prev.Pos().Line)
+	}
+	used[field.Tag] = field
+
+	return nil
+}
+
+// errorAt returns an error positioned at n.
+func errorAt(n ast.Node, format string, a ...interface{}) *ResolveError {
+	re := &ResolveError{
+		Pos: n.Pos(),
+		Msg: fmt.Sprintf(format, a...),
+	}
+	if f := n.File(); f != nil {
+		re.Filename = f.Name
+	}
+	return re
+}
+
 func (r *resolver) resolveName(s *scope, name string) *scope {
 	parts := strings.Split(name, ".")
 
+	// A fully qualified name, with a leading dot, is found from the
+	// outermost scope alone.
+	if parts[0] == "" {
+		ws := s.dup()
+		ws.objects = ws.objects[:1]
+		return matchNameComponents(ws, parts[1:])
+	}
+
 	// Move up the scope, finding a place where the name makes sense.
 	for ws := s.dup(); !ws.global(); ws.pop() {
 		//log.Printf("Trying to resolve %q in %q", name, ws.fullName())
@@ -0,0 +1,347 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package proto3 helps migrate proto2 files to proto3. It reports the
+// constructs of a proto2 file that proto3 does not allow, rewrites those it
+// can, and describes the consequences of the migration for the data already
+// written with the proto2 schema.
+package proto3 // import "myitcv.io/g/protobuf/proto3"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// An Issue is a construct of a proto2 file that proto3 does not allow, or
+// whose meaning changes in proto3.
+type Issue struct {
+	Kind     Kind
+	Filename string
+	Pos      ast.Position
+
+	Message string
+
+	// Rewrite describes the rewrite made by Migrate, or is "" if the issue
+	// must be dealt with by hand, or needs no rewrite
+	Rewrite string
+
+	// Wire describes the consequence of the migration for data written with
+	// the proto2 schema, or for proto2 readers of data written with the
+	// proto3 schema, or is "" if there is none
+	Wire string
+}
+
+func (i *Issue) String() string {
+	return fmt.Sprintf("%v:%v: %v", i.Filename, i.Pos.Line, i.Message)
+}
+
+// Kind is the kind of an Issue.
+type Kind int
+
+const (
+	// Required is a required field. Migrate makes it optional.
+	Required Kind = iota
+
+	// Default is a field with a default value. Migrate removes it.
+	Default
+
+	// Group is a group. Migrate converts it into a nested message, used by
+	// a field with the same number.
+	Group
+
+	// Extension is an extension of a message other than an options message
+	// of google/protobuf/descriptor.proto. It must be replaced by hand.
+	Extension
+
+	// ExtensionRange is an extension range. It must be removed by hand.
+	ExtensionRange
+
+	// EnumZero is an enum whose first value is not zero. Migrate moves its
+	// zero value first, or adds one.
+	EnumZero
+
+	// ClosedEnum is a field whose type is an enum of another proto2 file,
+	// which proto3 messages cannot use. The file of the enum must be
+	// migrated first.
+	ClosedEnum
+
+	// OpenEnum is an enum that becomes open: proto3 readers keep unknown
+	// values in fields of the enum.
+	OpenEnum
+
+	// Packed is a repeated field of scalar numeric type that becomes packed
+	// by default. Migrate marks it [packed = false], so that it is written
+	// as before.
+	Packed
+
+	// UTF8 is a string field, or a map field with string keys or values,
+	// whose strings proto3 parsers validate as UTF-8.
+	UTF8
+)
+
+// Check returns the issues of the proto2 file f, in source order. f must
+// have been resolved, for example by parser.ParseFiles. f is not changed.
+func Check(f *ast.File) ([]*Issue, error) {
+	return migrate(f, false)
+}
+
+// Migrate rewrites the proto2 file f as a proto3 file, rewriting the issues
+// it can, and returns all the issues of f, in source order. f must have been
+// resolved, for example by parser.ParseFiles. f is proto3 once the issues
+// without a Rewrite of kinds Extension, ExtensionRange and ClosedEnum have
+// been dealt with by hand; its resolved types are left as they were.
+func Migrate(f *ast.File) ([]*Issue, error) {
+	return migrate(f, true)
+}
+
+// migrator holds the state of a migration
+type migrator struct {
+	file   *ast.File
+	fix    bool
+	issues []*Issue
+}
+
+func migrate(f *ast.File, fix bool) ([]*Issue, error) {
+	switch f.Syntax {
+	case "", "proto2":
+	default:
+		return nil, fmt.Errorf("%v is not a proto2 file", f.Name)
+	}
+
+	m := &migrator{file: f, fix: fix}
+	for _, e := range f.Enums {
+		m.enum(e)
+	}
+	for _, msg := range f.Messages {
+		m.message(msg)
+	}
+	m.extensions(f.Extensions)
+
+	if fix {
+		f.Syntax = "proto3"
+	}
+
+	sort.Stable(issueSort(m.issues))
+	return m.issues, nil
+}
+
+func (m *migrator) add(kind Kind, pos ast.Position, rewrite, wire string, format string, a ...interface{}) {
+	m.issues = append(m.issues, &Issue{
+		Kind:     kind,
+		Filename: m.file.Name,
+		Pos:      pos,
+		Message:  fmt.Sprintf(format, a...),
+		Rewrite:  rewrite,
+		Wire:     wire,
+	})
+}
+
+func (m *migrator) message(msg *ast.Message) {
+	for i, r := range msg.ExtensionRanges {
+		pos := msg.Position
+		if o := msg.RangeOptions(i); o != nil {
+			pos = o.Position
+		}
+		m.add(ExtensionRange, pos, "", "extensions set in data written with the proto2 schema become unknown fields",
+			"message %v declares the extension range %v to %v, which proto3 does not allow", msg.Name, r[0], r[1])
+	}
+
+	for _, f := range msg.Fields {
+		m.field(f)
+	}
+
+	for _, e := range msg.Enums {
+		m.enum(e)
+	}
+	for _, nm := range msg.Messages {
+		m.message(nm)
+	}
+	m.extensions(msg.Extensions)
+}
+
+func (m *migrator) field(f *ast.Field) {
+	if g, ok := f.Type.(*ast.Message); ok && g.Group {
+		name := strings.ToLower(f.Name)
+		m.add(Group, f.Position, fmt.Sprintf("the group becomes the nested message %v, used by the field %v", g.Name, name),
+			"not wire compatible: the field is written as a length-delimited message rather than a group, which readers of the other schema treat as an unknown field",
+			"field %v is a group, which proto3 does not allow", g.Name)
+		if m.fix {
+			g.Group = false
+			f.Name = name
+		}
+	}
+
+	if f.Required {
+		m.add(Required, f.Position, "the field is made optional",
+			"the field is written as before, but proto3 readers accept data without it, and proto2 readers reject data written without it",
+			"field %v is required, which proto3 does not allow", f.Name)
+		if m.fix {
+			f.Required = false
+			f.Optional = true
+		}
+	}
+
+	if f.HasDefault {
+		m.add(Default, f.Position, "the default is removed",
+			fmt.Sprintf("the field is written as before, but readers of the proto3 schema see an unset field as the zero value of its type rather than %v", f.Default),
+			"field %v has a default value, which proto3 does not allow", f.Name)
+		if m.fix {
+			f.HasDefault = false
+			f.Default = ""
+			f.DefaultValue = ""
+		}
+	}
+
+	if e, ok := f.Type.(*ast.Enum); ok {
+		if ef := e.File(); ef != m.file && ef != nil && (ef.Syntax == "" || ef.Syntax == "proto2") {
+			m.add(ClosedEnum, f.Position, "", "",
+				"field %v has the type %v, an enum of the proto2 file %v, which proto3 messages cannot use; migrate %v first", f.Name, f.TypeName, ef.Name, ef.Name)
+		}
+	}
+
+	if f.Repeated && f.KeyTypeName == "" && !f.HasPacked && packable(f.Type) {
+		m.add(Packed, f.Position, "[packed = false] is added, so that the field is written as before",
+			"without the rewrite, the field is written packed, as a single length-delimited record, rather than as a record per element; proto2 readers older than protobuf 2.3 cannot read it",
+			"field %v becomes packed", f.Name)
+		if m.fix {
+			f.HasPacked = true
+			f.Packed = false
+		}
+	}
+
+	if f.Type == ast.String || f.KeyType == ast.String {
+		m.add(UTF8, f.Position, "",
+			"the field is written as before, but proto3 parsers reject data in which its strings are not valid UTF-8, which proto2 parsers accept",
+			"field %v has strings, which proto3 validates as UTF-8", f.Name)
+	}
+}
+
+func (m *migrator) extensions(exts []*ast.Extension) {
+	for _, e := range exts {
+		if optionsMessage(e) {
+			continue
+		}
+		m.add(Extension, e.Position, "", "the extensions set in data written with the proto2 schema become unknown fields",
+			"extension of %v, which proto3 allows only for options messages; replace it with fields of %v, or an Any", e.Extendee, e.Extendee)
+	}
+}
+
+func (m *migrator) enum(e *ast.Enum) {
+	m.add(OpenEnum, e.Position, "",
+		"the enum is written as before, but proto3 readers keep unknown values in fields of the enum, where proto2 readers keep them as unknown fields",
+		"enum %v becomes open", e.Name)
+
+	if len(e.Values) == 0 || e.Values[0].Number == 0 {
+		return
+	}
+
+	first := e.Values[0]
+	var zero *ast.EnumValue
+	for _, v := range e.Values {
+		if v.Number == 0 {
+			zero = v
+			break
+		}
+	}
+
+	var rewrite string
+	if zero != nil {
+		rewrite = fmt.Sprintf("%v is moved first", zero.Name)
+		if m.fix {
+			vs := []*ast.EnumValue{zero}
+			for _, v := range e.Values {
+				if v != zero {
+					vs = append(vs, v)
+				}
+			}
+			e.Values = vs
+		}
+	} else {
+		name := unspecified(e)
+		rewrite = fmt.Sprintf("%v = 0 is added first", name)
+		zero = &ast.EnumValue{
+			Position: e.Position,
+			Name:     name,
+			Up:       e,
+		}
+		if m.fix {
+			e.Values = append([]*ast.EnumValue{zero}, e.Values...)
+		}
+	}
+
+	m.add(EnumZero, e.Position, rewrite,
+		fmt.Sprintf("the enum is written as before, but readers of the proto3 schema see an unset field of the enum as %v rather than %v", zero.Name, first.Name),
+		"the first value of enum %v, %v, is %v, but proto3 requires it to be 0", e.Name, first.Name, first.Number)
+}
+
+// unspecified returns the name of a new zero value for e, e.g.
+// KIND_UNSPECIFIED for the enum Kind, that is not already used by a value of
+// an enum in the same scope
+func unspecified(e *ast.Enum) string {
+	var enums []*ast.Enum
+	switch up := e.Up.(type) {
+	case *ast.File:
+		enums = up.Enums
+	case *ast.Message:
+		enums = up.Enums
+	}
+	used := make(map[string]bool)
+	for _, oe := range enums {
+		for _, v := range oe.Values {
+			used[v.Name] = true
+		}
+	}
+
+	base := upperSnake(e.Name) + "_UNSPECIFIED"
+	name := base
+	for i := 1; used[name]; i++ {
+		name = fmt.Sprintf("%v_%v", base, i)
+	}
+	return name
+}
+
+// upperSnake returns the camel-case name s in upper snake case, e.g.
+// PaymentMethod becomes PAYMENT_METHOD
+func upperSnake(s string) string {
+	var res []rune
+	rs := []rune(s)
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(rs[i-1]) || i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+			res = append(res, '_')
+		}
+		res = append(res, unicode.ToUpper(r))
+	}
+	return string(res)
+}
+
+// packable reports whether a repeated field of type typ may be packed
+func packable(typ interface{}) bool {
+	switch typ := typ.(type) {
+	case *ast.Enum:
+		return true
+	case ast.FieldType:
+		return typ != ast.String && typ != ast.Bytes
+	}
+	return false
+}
+
+// optionsMessage reports whether e extends one of the options messages of
+// google/protobuf/descriptor.proto, e.g. google.protobuf.FieldOptions
+func optionsMessage(e *ast.Extension) bool {
+	m := e.ExtendeeType
+	if m == nil {
+		return false
+	}
+	f, ok := m.Up.(*ast.File)
+	return ok && strings.Join(f.Package, ".") == "google.protobuf" && strings.HasSuffix(m.Name, "Options")
+}
+
+type issueSort []*Issue
+
+func (s issueSort) Len() int           { return len(s) }
+func (s issueSort) Less(i, j int) bool { return s[i].Pos.Before(s[j].Pos) }
+func (s issueSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,486 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package random
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/wire"
+)
+
+// Marshal returns m encoded in the binary wire format. Repeated fields are
+// packed, and messages delimited, as the features of their fields specify.
+func (m *Message) Marshal() []byte {
+	var b []byte
+	for _, f := range m.Fields {
+		b = appendField(b, f)
+	}
+	return b
+}
+
+func appendField(b []byte, f *Field) []byte {
+	fs := f.Field.ResolvedFeatures()
+	num := f.Field.Tag
+
+	if f.Field.Repeated && f.Field.KeyTypeName == "" && fs.RepeatedFieldEncoding == "PACKED" {
+		if wt := wireType(f.Field.Type); wt != wire.Bytes {
+			var packed []byte
+			for _, v := range f.Values {
+				packed = appendScalar(packed, f.Field.Type, v)
+			}
+			b = appendTag(b, num, wire.Bytes)
+			b = appendVarint(b, uint64(len(packed)))
+			return append(b, packed...)
+		}
+	}
+
+	for _, v := range f.Values {
+		switch v := v.(type) {
+		case MapEntry:
+			var entry []byte
+			entry = appendTag(entry, 1, wireType(f.Field.KeyType))
+			entry = appendScalar(entry, f.Field.KeyType, v.Key)
+			entry = appendValue(entry, 2, f.Field.Type, v.Value, false)
+			b = appendTag(b, num, wire.Bytes)
+			b = appendVarint(b, uint64(len(entry)))
+			b = append(b, entry...)
+		default:
+			b = appendValue(b, num, f.Field.Type, v, fs.MessageEncoding == "DELIMITED")
+		}
+	}
+	return b
+}
+
+// appendValue appends the field num with the value v, of the resolved type
+// typ, to b; a message is delimited, as a group, if delimited is set
+func appendValue(b []byte, num int, typ, v interface{}, delimited bool) []byte {
+	m, ok := v.(*Message)
+	switch {
+	case !ok:
+		b = appendTag(b, num, wireType(typ))
+		return appendScalar(b, typ, v)
+	case delimited:
+		b = appendTag(b, num, wire.StartGroup)
+		b = append(b, m.Marshal()...)
+		return appendTag(b, num, wire.EndGroup)
+	}
+	mb := m.Marshal()
+	b = appendTag(b, num, wire.Bytes)
+	b = appendVarint(b, uint64(len(mb)))
+	return append(b, mb...)
+}
+
+// appendScalar appends the encoding of v, a value of the scalar or enum type
+// typ, without a tag, to b
+func appendScalar(b []byte, typ, v interface{}) []byte {
+	switch v := v.(type) {
+	case *ast.EnumValue:
+		return appendVarint(b, uint64(int64(v.Number)))
+	case bool:
+		if v {
+			return appendVarint(b, 1)
+		}
+		return appendVarint(b, 0)
+	case string:
+		b = appendVarint(b, uint64(len(v)))
+		return append(b, v...)
+	case []byte:
+		b = appendVarint(b, uint64(len(v)))
+		return append(b, v...)
+	case float32:
+		return appendFixed32(b, math.Float32bits(v))
+	case float64:
+		return appendFixed64(b, math.Float64bits(v))
+	}
+
+	switch typ {
+	case ast.Int32:
+		return appendVarint(b, uint64(int64(v.(int32))))
+	case ast.Sint32:
+		n := v.(int32)
+		return appendVarint(b, uint64(uint32(n<<1^n>>31)))
+	case ast.Sfixed32:
+		return appendFixed32(b, uint32(v.(int32)))
+	case ast.Int64:
+		return appendVarint(b, uint64(v.(int64)))
+	case ast.Sint64:
+		n := v.(int64)
+		return appendVarint(b, uint64(n<<1^n>>63))
+	case ast.Sfixed64:
+		return appendFixed64(b, uint64(v.(int64)))
+	case ast.Uint32:
+		return appendVarint(b, uint64(v.(uint32)))
+	case ast.Fixed32:
+		return appendFixed32(b, v.(uint32))
+	case ast.Uint64:
+		return appendVarint(b, v.(uint64))
+	case ast.Fixed64:
+		return appendFixed64(b, v.(uint64))
+	}
+	return b
+}
+
+func appendTag(b []byte, num int, wt wire.Type) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wt))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendFixed32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// wireType returns the wire type of values of typ, a FieldType or *ast.Enum,
+// other than a packed repeated field
+func wireType(typ interface{}) wire.Type {
+	switch typ {
+	case ast.Fixed32, ast.Sfixed32, ast.Float:
+		return wire.Fixed32
+	case ast.Fixed64, ast.Sfixed64, ast.Double:
+		return wire.Fixed64
+	case ast.String, ast.Bytes:
+		return wire.Bytes
+	}
+	if _, ok := typ.(*ast.Message); ok {
+		return wire.Bytes
+	}
+	return wire.Varint
+}
+
+// MarshalText returns m encoded in the text format.
+func (m *Message) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	m.text(&buf, 0)
+	return buf.Bytes(), nil
+}
+
+func (m *Message) text(buf *bytes.Buffer, indent int) {
+	prefix := strings.Repeat("  ", indent)
+	for _, f := range m.Fields {
+		for _, v := range f.Values {
+			switch v := v.(type) {
+			case *Message:
+				fmt.Fprintf(buf, "%v%v {\n", prefix, f.Field.Name)
+				v.text(buf, indent+1)
+				fmt.Fprintf(buf, "%v}\n", prefix)
+			case MapEntry:
+				fmt.Fprintf(buf, "%v%v {\n", prefix, f.Field.Name)
+				fmt.Fprintf(buf, "%v  key: %v\n", prefix, textScalar(v.Key))
+				if vm, ok := v.Value.(*Message); ok {
+					fmt.Fprintf(buf, "%v  value {\n", prefix)
+					vm.text(buf, indent+2)
+					fmt.Fprintf(buf, "%v  }\n", prefix)
+				} else {
+					fmt.Fprintf(buf, "%v  value: %v\n", prefix, textScalar(v.Value))
+				}
+				fmt.Fprintf(buf, "%v}\n", prefix)
+			default:
+				fmt.Fprintf(buf, "%v%v: %v\n", prefix, f.Field.Name, textScalar(v))
+			}
+		}
+	}
+}
+
+// textScalar returns the scalar or enum value v in the text format
+func textScalar(v interface{}) string {
+	switch v := v.(type) {
+	case *ast.EnumValue:
+		return v.Name
+	case string:
+		return textQuote([]byte(v), true)
+	case []byte:
+		return textQuote(v, false)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// textQuote returns b quoted as a string of the text format. Printable
+// characters outside ASCII are written as they are if text is set, as it is
+// for a string value; otherwise they are written, like all other
+// non-printable bytes, as octal escapes.
+func textQuote(b []byte, text bool) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(b); {
+		r, n := rune(b[i]), 1
+		if text {
+			r, n = utf8.DecodeRune(b[i:])
+		}
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			buf.WriteRune(r)
+		case text && r != utf8.RuneError && unicode.IsPrint(r):
+			buf.WriteRune(r)
+		default:
+			for _, c := range b[i : i+n] {
+				fmt.Fprintf(&buf, `\%03o`, c)
+			}
+		}
+		i += n
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// MarshalJSON returns m encoded in JSON, as the proto3 JSON mapping
+// specifies.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.json(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Message) json(buf *bytes.Buffer) error {
+	name := ast.FullName(m.Type)
+	if _, ok := ast.WrapperTypes[name]; ok {
+		if len(m.Fields) > 0 {
+			return jsonElem(buf, m.Fields[0].Values[0])
+		}
+		return jsonElem(buf, zero(m.Type.Fields[0].Type))
+	}
+	switch name {
+	case "google.protobuf.Timestamp":
+		secs, nanos := m.int("seconds"), m.int("nanos")
+		t := time.Unix(secs, nanos).UTC()
+		fmt.Fprintf(buf, `"%v%vZ"`, t.Format("2006-01-02T15:04:05"), fraction(nanos))
+		return nil
+	case "google.protobuf.Duration":
+		secs, nanos := m.int("seconds"), m.int("nanos")
+		sign := ""
+		if secs < 0 || nanos < 0 {
+			sign = "-"
+		}
+		fmt.Fprintf(buf, `"%v%v%vs"`, sign, abs(secs), fraction(abs(nanos)))
+		return nil
+	case "google.protobuf.FieldMask":
+		var paths []string
+		if len(m.Fields) > 0 {
+			for _, p := range m.Fields[0].Values {
+				paths = append(paths, ast.JSONName(p.(string)))
+			}
+		}
+		return jsonValue(buf, strings.Join(paths, ","))
+	case "google.protobuf.Struct":
+		return m.jsonFields(buf, true)
+	case "google.protobuf.ListValue":
+		buf.WriteByte('[')
+		if len(m.Fields) > 0 {
+			for i, v := range m.Fields[0].Values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := v.(*Message).json(buf); err != nil {
+					return err
+				}
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case "google.protobuf.Value":
+		if len(m.Fields) == 0 {
+			return fmt.Errorf("google.protobuf.Value has no kind")
+		}
+		return jsonElem(buf, m.Fields[0].Values[0])
+	}
+	return m.jsonFields(buf, false)
+}
+
+// jsonFields writes the fields of m as a JSON object; if entries is set, m
+// is a Struct, whose map of fields is written instead
+func (m *Message) jsonFields(buf *bytes.Buffer, entries bool) error {
+	buf.WriteByte('{')
+	first := true
+	for _, f := range m.Fields {
+		if entries {
+			if err := jsonEntries(buf, f.Values); err != nil {
+				return err
+			}
+			first = false
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+
+		name := f.Field.Name
+		if tm, ok := f.Field.Type.(*ast.Message); ok && tm.Group {
+			name = strings.ToLower(name)
+		}
+		if err := jsonValue(buf, ast.JSONName(name)); err != nil {
+			return err
+		}
+		buf.WriteByte(':')
+
+		switch {
+		case f.Field.KeyTypeName != "":
+			buf.WriteByte('{')
+			if err := jsonEntries(buf, f.Values); err != nil {
+				return err
+			}
+			buf.WriteByte('}')
+		case f.Field.Repeated:
+			buf.WriteByte('[')
+			for i, v := range f.Values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := jsonElem(buf, v); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		default:
+			if err := jsonElem(buf, f.Values[0]); err != nil {
+				return err
+			}
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// jsonEntries writes the map entries values, separated by commas
+func jsonEntries(buf *bytes.Buffer, values []interface{}) error {
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		e := v.(MapEntry)
+		if err := jsonValue(buf, fmt.Sprint(e.Key)); err != nil {
+			return err
+		}
+		buf.WriteByte(':')
+		if err := jsonElem(buf, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonElem writes a single value v of a field in JSON
+func jsonElem(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case *Message:
+		return v.json(buf)
+	case *ast.EnumValue:
+		if ast.FullName(v.Up) == "google.protobuf.NullValue" {
+			buf.WriteString("null")
+			return nil
+		}
+		return jsonValue(buf, v.Name)
+	case int64, uint64:
+		return jsonValue(buf, fmt.Sprint(v))
+	case float32:
+		buf.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+		return nil
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		return nil
+	case []byte:
+		return jsonValue(buf, base64.StdEncoding.EncodeToString(v))
+	}
+	return jsonValue(buf, v)
+}
+
+func jsonValue(buf *bytes.Buffer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// int returns the value of the integer field called name of the well-known
+// type m, or zero if it is not set
+func (m *Message) int(name string) int64 {
+	for _, f := range m.Fields {
+		if f.Field.Name == name {
+			switch v := f.Values[0].(type) {
+			case int32:
+				return int64(v)
+			case int64:
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// fraction returns the fraction of a second of nanos nanoseconds, with 0, 3,
+// 6 or 9 digits, as the JSON mapping prefers
+func fraction(nanos int64) string {
+	switch {
+	case nanos == 0:
+		return ""
+	case nanos%1e6 == 0:
+		return fmt.Sprintf(".%03d", nanos/1e6)
+	case nanos%1e3 == 0:
+		return fmt.Sprintf(".%06d", nanos/1e3)
+	}
+	return fmt.Sprintf(".%09d", nanos)
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// zero returns the zero value of the scalar type typ
+func zero(typ interface{}) interface{} {
+	switch typ {
+	case ast.Double:
+		return float64(0)
+	case ast.Float:
+		return float32(0)
+	case ast.Int64:
+		return int64(0)
+	case ast.Uint64:
+		return uint64(0)
+	case ast.Bool:
+		return false
+	case ast.String:
+		return ""
+	case ast.Bytes:
+		return []byte{}
+	}
+	return 0
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package random generates random, valid, instances of messages, for use in
+// fuzzing and as test fixtures. An instance can be encoded in the binary
+// wire format, the text format or JSON.
+//
+// Instances respect the types of fields, the values of enums, the
+// exclusivity of oneofs, the key types of maps and required fields, and are
+// nested at most to a given depth. The well-known types of
+// google/protobuf are generated within their valid ranges, and are mapped to
+// JSON as the proto3 JSON mapping specifies; an Any is always empty.
+package random // import "myitcv.io/g/protobuf/random"
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/wire"
+)
+
+const (
+	// DefaultMaxDepth is the depth to which messages are nested if
+	// Generator.MaxDepth is zero
+	DefaultMaxDepth = 5
+
+	// DefaultMaxRepeated is the maximum number of elements of a repeated
+	// field, or entries of a map, if Generator.MaxRepeated is zero
+	DefaultMaxRepeated = 3
+
+	// DefaultMaxLength is the maximum length of a string or bytes value if
+	// Generator.MaxLength is zero
+	DefaultMaxLength = 16
+)
+
+// A Generator generates random instances of messages. A Generator is not
+// safe for concurrent use.
+type Generator struct {
+	// MaxDepth is the depth to which messages are nested: the fields of
+	// message type of a message at this depth are not set, unless they are
+	// required.
+	MaxDepth int
+
+	// MaxRepeated is the maximum number of elements of a repeated field, or
+	// entries of a map.
+	MaxRepeated int
+
+	// MaxLength is the maximum length, in characters or bytes, of a string
+	// or bytes value.
+	MaxLength int
+
+	rand *rand.Rand
+}
+
+// New returns a Generator whose instances are determined by seed.
+func New(seed int64) *Generator {
+	return &Generator{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// A Message is an instance of a message type.
+type Message struct {
+	Type *ast.Message
+
+	// Fields are the fields that are set, in the order of Type.Fields
+	Fields []*Field
+}
+
+// A Field is a field of a Message that is set.
+type Field struct {
+	Field *ast.Field
+
+	// Values are the values of the field, a single value unless the field is
+	// repeated. A value is an int32, int64, uint32, uint64, float32, float64,
+	// bool, string or []byte for a scalar field, according to its type, an
+	// *ast.EnumValue for an enum field, a *Message for a message field, or a
+	// MapEntry for a map field.
+	Values []interface{}
+}
+
+// A MapEntry is an entry of a map field.
+type MapEntry struct {
+	Key, Value interface{}
+}
+
+// Message returns a random instance of m, which must have been resolved, for
+// example by parser.ParseFiles.
+func (g *Generator) Message(m *ast.Message) (*Message, error) {
+	return g.message(m, 0)
+}
+
+func (g *Generator) maxDepth() int {
+	if g.MaxDepth > 0 {
+		return g.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+func (g *Generator) maxRepeated() int {
+	if g.MaxRepeated > 0 {
+		return g.MaxRepeated
+	}
+	return DefaultMaxRepeated
+}
+
+func (g *Generator) maxLength() int {
+	if g.MaxLength > 0 {
+		return g.MaxLength
+	}
+	return DefaultMaxLength
+}
+
+func (g *Generator) message(m *ast.Message, depth int) (*Message, error) {
+	if depth > wire.MaxDepth {
+		return nil, fmt.Errorf("the required fields of %v nest more than %d deep", ast.FullName(m), wire.MaxDepth)
+	}
+
+	res := &Message{Type: m}
+	name := ast.FullName(m)
+
+	switch name {
+	case "google.protobuf.Any":
+		// an Any holding random bytes is not valid; leave it empty
+		return res, nil
+	case "google.protobuf.Timestamp":
+		// between 0001-01-01 and 9999-12-31, as the JSON mapping requires
+		secs := g.rand.Int63n(253402300800+62135596800) - 62135596800
+		g.set(res, "seconds", secs)
+		g.set(res, "nanos", g.rand.Int31n(1e9))
+		return res, nil
+	case "google.protobuf.Duration":
+		secs := g.rand.Int63n(2*315576000000+1) - 315576000000
+		nanos := g.rand.Int31n(1e9)
+		if secs < 0 || secs == 0 && g.rand.Intn(2) == 0 {
+			// the nanos of a negative duration are negative
+			nanos = -nanos
+		}
+		g.set(res, "seconds", secs)
+		g.set(res, "nanos", nanos)
+		return res, nil
+	case "google.protobuf.FieldMask":
+		var paths []interface{}
+		for i := g.rand.Intn(g.maxRepeated() + 1); i > 0; i-- {
+			paths = append(paths, g.path())
+		}
+		if len(paths) > 0 {
+			res.Fields = append(res.Fields, &Field{Field: m.Fields[0], Values: paths})
+		}
+		return res, nil
+	}
+
+	// choose the field of each oneof that is set, if any; a Value has a kind
+	chosen := make(map[*ast.Oneof]*ast.Field)
+	for _, o := range m.Oneofs {
+		var fields []*ast.Field
+		for _, f := range m.Fields {
+			if _, ok := f.Type.(*ast.Message); f.Oneof == o && (!ok || depth < g.maxDepth()) {
+				fields = append(fields, f)
+			}
+		}
+		n := len(fields) + 1
+		if name == "google.protobuf.Value" {
+			n--
+		}
+		if i := g.rand.Intn(n); i < len(fields) {
+			chosen[o] = fields[i]
+		}
+	}
+
+	for _, f := range m.Fields {
+		fs := f.ResolvedFeatures()
+		required := fs.FieldPresence == "LEGACY_REQUIRED"
+		_, isMsg := f.Type.(*ast.Message)
+
+		var values []interface{}
+		switch {
+		case f.Oneof != nil:
+			if chosen[f.Oneof] != f {
+				continue
+			}
+			v, err := g.value(f.Type, depth)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		case f.Repeated:
+			if isMsg && depth >= g.maxDepth() {
+				continue
+			}
+			n := g.rand.Intn(g.maxRepeated() + 1)
+			seen := make(map[interface{}]bool)
+			for i := 0; i < n; i++ {
+				v, err := g.value(f.Type, depth)
+				if err != nil {
+					return nil, err
+				}
+				if f.KeyTypeName != "" {
+					k := g.scalar(f.KeyType)
+					if seen[k] {
+						continue
+					}
+					seen[k] = true
+					v = MapEntry{Key: k, Value: v}
+				}
+				values = append(values, v)
+			}
+		default:
+			if !required && (g.rand.Intn(2) == 0 || isMsg && depth >= g.maxDepth()) {
+				continue
+			}
+			v, err := g.value(f.Type, depth)
+			if err != nil {
+				return nil, err
+			}
+			if fs.FieldPresence == "IMPLICIT" && isZero(v) {
+				// a zero value is indistinguishable from an unset field
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) > 0 {
+			res.Fields = append(res.Fields, &Field{Field: f, Values: values})
+		}
+	}
+
+	return res, nil
+}
+
+// set sets the field called name of the well-known type m to v, unless v is
+// zero
+func (g *Generator) set(m *Message, name string, v interface{}) {
+	if isZero(v) {
+		return
+	}
+	for _, f := range m.Type.Fields {
+		if f.Name == name {
+			m.Fields = append(m.Fields, &Field{Field: f, Values: []interface{}{v}})
+		}
+	}
+}
+
+// value returns a random value of the resolved type typ, in a message at
+// depth
+func (g *Generator) value(typ interface{}, depth int) (interface{}, error) {
+	switch typ := typ.(type) {
+	case *ast.Message:
+		return g.message(typ, depth+1)
+	case *ast.Enum:
+		if len(typ.Values) == 0 {
+			return nil, fmt.Errorf("enum %v has no values", ast.FullName(typ))
+		}
+		return typ.Values[g.rand.Intn(len(typ.Values))], nil
+	case ast.FieldType:
+		return g.scalar(typ), nil
+	}
+	return nil, fmt.Errorf("unresolved type %T", typ)
+}
+
+// scalar returns a random value of type typ
+func (g *Generator) scalar(typ ast.FieldType) interface{} {
+	switch typ {
+	case ast.Double:
+		return g.float()
+	case ast.Float:
+		return float32(g.float())
+	case ast.Int32, ast.Sint32, ast.Sfixed32:
+		return int32(g.int(32))
+	case ast.Int64, ast.Sint64, ast.Sfixed64:
+		return g.int(64)
+	case ast.Uint32, ast.Fixed32:
+		return uint32(g.int(32))
+	case ast.Uint64, ast.Fixed64:
+		return uint64(g.int(64))
+	case ast.Bool:
+		return g.rand.Intn(2) == 1
+	case ast.String:
+		return g.string()
+	case ast.Bytes:
+		b := make([]byte, g.rand.Intn(g.maxLength()+1))
+		g.rand.Read(b)
+		return b
+	}
+	return nil
+}
+
+// int returns a random integer of the given number of bits, as a bit
+// pattern, sign-extended to 64 bits. Small and boundary values are more
+// likely than they would be were the bits uniformly distributed.
+func (g *Generator) int(bits uint) int64 {
+	if g.rand.Intn(4) == 0 {
+		edges := []int64{0, 1, -1, -1 << (bits - 1), 1<<(bits-1) - 1}
+		return edges[g.rand.Intn(len(edges))]
+	}
+	v := int64(g.rand.Uint64()) >> (64 - bits)
+	return v >> uint(g.rand.Intn(int(bits)))
+}
+
+// float returns a random, finite, float, whose magnitude is between about
+// 1e-6 and 1e6, or zero
+func (g *Generator) float() float64 {
+	if g.rand.Intn(8) == 0 {
+		return 0
+	}
+	return g.rand.NormFloat64() * math.Pow(10, float64(g.rand.Intn(13)-6))
+}
+
+// letters are the characters of random strings: some of them are outside
+// ASCII, and one is outside the Basic Multilingual Plane
+var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 _-.\"\\\néüλж中😀")
+
+// string returns a random, valid UTF-8, string
+func (g *Generator) string() string {
+	rs := make([]rune, g.rand.Intn(g.maxLength()+1))
+	for i := range rs {
+		rs[i] = letters[g.rand.Intn(len(letters))]
+	}
+	return string(rs)
+}
+
+// path returns a random field path for a FieldMask, e.g. foo_bar.baz
+func (g *Generator) path() string {
+	var parts []string
+	for i := g.rand.Intn(3); i >= 0; i-- {
+		rs := make([]rune, 1+g.rand.Intn(8))
+		for j := range rs {
+			rs[j] = 'a' + rune(g.rand.Intn(26))
+		}
+		if j := g.rand.Intn(2 * len(rs)); j > 0 && j < len(rs) {
+			rs[j] = '_'
+		}
+		parts = append(parts, string(rs))
+	}
+	return strings.Join(parts, ".")
+}
+
+// isZero reports whether v is the zero value of its type
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case int32:
+		return v == 0
+	case int64:
+		return v == 0
+	case uint32:
+		return v == 0
+	case uint64:
+		return v == 0
+	case float32:
+		return v == 0
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []byte:
+		return len(v) == 0
+	case *ast.EnumValue:
+		return v.Number == 0
+	}
+	return false
+}
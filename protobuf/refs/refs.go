@@ -0,0 +1,212 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package refs indexes the references to the messages and enums of a
+// resolved set of proto files, to answer the question of what uses a given
+// message or enum, and what a service depends on.
+package refs // import "myitcv.io/g/protobuf/refs"
+
+import (
+	"sort"
+	"strings"
+
+	"myitcv.io/g/protobuf/ast"
+)
+
+// Kind is the kind of a reference
+type Kind int
+
+const (
+	// FieldType is a reference by the type of a field, including a field of
+	// an extension.
+	FieldType Kind = iota
+
+	// MapValue is a reference by the value type of a map field.
+	MapValue
+
+	// Extendee is a reference by an extend block to the message it extends.
+	Extendee
+
+	// Input and Output are references by a method to its request and
+	// response messages.
+	Input
+	Output
+)
+
+func (k Kind) String() string {
+	switch k {
+	case FieldType:
+		return "field"
+	case MapValue:
+		return "map value"
+	case Extendee:
+		return "extendee"
+	case Input:
+		return "input"
+	case Output:
+		return "output"
+	}
+	return "unknown"
+}
+
+// A Use is a reference to a message or enum.
+type Use struct {
+	Kind Kind
+
+	// Node is the node making the reference: an *ast.Field for FieldType
+	// and MapValue, an *ast.Extension for Extendee and an *ast.Method for
+	// Input and Output.
+	Node ast.Node
+
+	// File and Position locate Node.
+	File     *ast.File
+	Position ast.Position
+}
+
+// An Index holds the references between the messages and enums of a set of
+// files.
+type Index struct {
+	uses  map[interface{}][]*Use
+	names map[string]interface{}
+}
+
+// New returns the index of the references within fset, which must have been
+// resolved, for example by parser.ParseFiles.
+func New(fset *ast.FileSet) *Index {
+	x := &Index{
+		uses:  make(map[interface{}][]*Use),
+		names: make(map[string]interface{}),
+	}
+	for _, f := range fset.Files {
+		for _, m := range f.Messages {
+			x.message(m)
+		}
+		for _, e := range f.Enums {
+			x.names[ast.FullName(e)] = e
+		}
+		for _, s := range f.Services {
+			x.names[ast.FullName(s)] = s
+			for _, m := range s.Methods {
+				x.add(m.InType, Input, m)
+				x.add(m.OutType, Output, m)
+			}
+		}
+		x.extensions(f.Extensions)
+	}
+
+	order := make(map[*ast.File]int)
+	for i, f := range fset.Files {
+		order[f] = i
+	}
+	for _, us := range x.uses {
+		sort.Stable(useSort{us, order})
+	}
+	return x
+}
+
+func (x *Index) message(m *ast.Message) {
+	x.names[ast.FullName(m)] = m
+	for _, f := range m.Fields {
+		x.field(f)
+	}
+	for _, nm := range m.Messages {
+		x.message(nm)
+	}
+	for _, e := range m.Enums {
+		x.names[ast.FullName(e)] = e
+	}
+	x.extensions(m.Extensions)
+}
+
+func (x *Index) extensions(exts []*ast.Extension) {
+	for _, ext := range exts {
+		x.add(ext.ExtendeeType, Extendee, ext)
+		for _, f := range ext.Fields {
+			x.field(f)
+		}
+	}
+}
+
+func (x *Index) field(f *ast.Field) {
+	if f.KeyTypeName != "" {
+		x.add(f.Type, MapValue, f)
+		return
+	}
+	x.add(f.Type, FieldType, f)
+}
+
+// add records a reference of the kind k to typ by n, if typ is a message or
+// an enum
+func (x *Index) add(typ interface{}, k Kind, n ast.Node) {
+	switch typ.(type) {
+	case *ast.Message, *ast.Enum:
+	default:
+		return
+	}
+	x.uses[typ] = append(x.uses[typ], &Use{
+		Kind:     k,
+		Node:     n,
+		File:     n.File(),
+		Position: n.Pos(),
+	})
+}
+
+// Lookup returns the *ast.Message, *ast.Enum or *ast.Service with the full
+// name, e.g. foo.Bar, or nil if there is none.
+func (x *Index) Lookup(name string) interface{} {
+	return x.names[strings.TrimPrefix(name, ".")]
+}
+
+// Uses returns the references to typ, an *ast.Message or *ast.Enum, in the
+// order of the files of the index and the nodes within them.
+func (x *Index) Uses(typ interface{}) []*Use {
+	return x.uses[typ]
+}
+
+// Reachable returns the messages reachable from the methods of s: their
+// requests and responses, and the messages that are the types, or map
+// values, of the fields of those, transitively. They are sorted by full
+// name.
+func (x *Index) Reachable(s *ast.Service) []*ast.Message {
+	seen := make(map[*ast.Message]bool)
+	var res []*ast.Message
+	var visit func(typ interface{})
+	visit = func(typ interface{}) {
+		m, ok := typ.(*ast.Message)
+		if !ok || seen[m] {
+			return
+		}
+		seen[m] = true
+		res = append(res, m)
+		for _, f := range m.Fields {
+			visit(f.Type)
+		}
+	}
+	for _, m := range s.Methods {
+		visit(m.InType)
+		visit(m.OutType)
+	}
+	sort.Sort(messageSort(res))
+	return res
+}
+
+type useSort struct {
+	uses  []*Use
+	order map[*ast.File]int
+}
+
+func (u useSort) Len() int { return len(u.uses) }
+func (u useSort) Less(i, j int) bool {
+	ui, uj := u.uses[i], u.uses[j]
+	if ui.File != uj.File {
+		return u.order[ui.File] < u.order[uj.File]
+	}
+	return ui.Position.Before(uj.Position)
+}
+func (u useSort) Swap(i, j int) { u.uses[i], u.uses[j] = u.uses[j], u.uses[i] }
+
+type messageSort []*ast.Message
+
+func (m messageSort) Len() int           { return len(m) }
+func (m messageSort) Less(i, j int) bool { return ast.FullName(m[i]) < ast.FullName(m[j]) }
+func (m messageSort) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
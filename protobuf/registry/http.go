@@ -0,0 +1,346 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+package registry
+
+// This file implements the HTTP API of a registry:
+//
+//	GET  /subjects                                 the names of the subjects, as JSON
+//	GET  /subjects/S/versions                      the versions of subject S, as JSON
+//	POST /subjects/S/versions                      register the FileDescriptorSet in the body
+//	GET  /subjects/S/versions/V                    the FileDescriptorSet of version V
+//	GET  /subjects/S/versions/V/proto[?file=F]     the .proto source of version V
+//	GET  /subjects/S/versions/V/diff[?from=W]      the differences from version W to V
+//	POST /compatibility/subjects/S                 check the FileDescriptorSet in the body
+//	GET  /config/S                                 the compatibility of subject S, as JSON
+//	PUT  /config/S                                 set the compatibility of subject S
+//
+// in which V and W may be latest; W defaults to the version before V. A
+// FileDescriptorSet is in the binary wire format. Errors are reported as
+// JSON objects with an error member, and, for incompatible versions, an
+// issues member.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/compat"
+	protofmt "myitcv.io/g/protobuf/fmt"
+)
+
+// MaxBodySize is the maximum size of the body of a request.
+const MaxBodySize = 16 << 20
+
+// Handler returns an http.Handler serving the HTTP API of r. The .proto
+// source of versions is formatted according to config; source that cannot
+// be formatted without loss is reported as an internal error.
+func Handler(r *Registry, config protofmt.Config) http.Handler {
+	return &handler{registry: r, config: config}
+}
+
+type handler struct {
+	registry *Registry
+	config   protofmt.Config
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	route := func(method string, pattern ...string) bool {
+		if len(parts) != len(pattern) {
+			return false
+		}
+		for i, p := range pattern {
+			if p != "*" && p != parts[i] {
+				return false
+			}
+		}
+		return req.Method == method
+	}
+
+	var err error
+	switch {
+	case route("GET", "subjects"):
+		err = h.subjects(w)
+	case route("GET", "subjects", "*", "versions"):
+		err = h.versions(w, parts[1])
+	case route("POST", "subjects", "*", "versions"):
+		err = h.register(w, req, parts[1])
+	case route("GET", "subjects", "*", "versions", "*"):
+		err = h.get(w, parts[1], parts[3])
+	case route("GET", "subjects", "*", "versions", "*", "proto"):
+		err = h.source(w, req, parts[1], parts[3])
+	case route("GET", "subjects", "*", "versions", "*", "diff"):
+		err = h.diff(w, req, parts[1], parts[3])
+	case route("POST", "compatibility", "subjects", "*"):
+		err = h.check(w, req, parts[2])
+	case route("GET", "config", "*"):
+		err = h.getConfig(w, parts[1])
+	case route("PUT", "config", "*"):
+		err = h.setConfig(w, req, parts[1])
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no route for %v %v", req.Method, req.URL.Path)})
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// errorResponse is the body of a response reporting an error
+type errorResponse struct {
+	Error  string   `json:"error"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+// compatibilityResponse is the body of a response to a check of
+// compatibility
+type compatibilityResponse struct {
+	Compatible bool     `json:"compatible"`
+	Issues     []string `json:"issues,omitempty"`
+}
+
+func (h *handler) subjects(w http.ResponseWriter) error {
+	ss, err := h.registry.Subjects()
+	if err != nil {
+		return err
+	}
+	if ss == nil {
+		ss = []string{}
+	}
+	writeJSON(w, http.StatusOK, ss)
+	return nil
+}
+
+func (h *handler) versions(w http.ResponseWriter, subject string) error {
+	vs, err := h.registry.Versions(subject)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, vs)
+	return nil
+}
+
+func (h *handler) register(w http.ResponseWriter, req *http.Request, subject string) error {
+	fds, err := readBody(w, req)
+	if err != nil {
+		return err
+	}
+	v, err := h.registry.Register(subject, fds)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"version": v})
+	return nil
+}
+
+func (h *handler) get(w http.ResponseWriter, subject, version string) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	fds, err := h.registry.Get(subject, v)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+	return nil
+}
+
+func (h *handler) source(w http.ResponseWriter, req *http.Request, subject, version string) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	fset, err := h.registry.FileSet(subject, v)
+	if err != nil {
+		return err
+	}
+
+	// all files, each preceded by its name, unless one is named
+	file := req.URL.Query().Get("file")
+	var buf bytes.Buffer
+	found := false
+	for _, f := range fset.Files {
+		if file != "" && f.Name != file {
+			continue
+		}
+		found = true
+		if file == "" {
+			fmt.Fprintf(&buf, "==> %v <==\n", f.Name)
+		}
+		var fb bytes.Buffer
+		pf := &protofmt.Formatter{
+			Output: &fb,
+			Config: h.config,
+		}
+		pf.FmtFile(f)
+
+		// nothing is served if formatting would lose part of a file
+		if err := protofmt.CheckFile(f, fb.Bytes()); err != nil {
+			return err
+		}
+		fb.WriteTo(&buf)
+	}
+	if !found {
+		return invalidf("version %v of subject %v has no file %v", version, subject, file)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteTo(w)
+	return nil
+}
+
+func (h *handler) diff(w http.ResponseWriter, req *http.Request, subject, version string) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	if v == Latest {
+		vs, err := h.registry.Versions(subject)
+		if err != nil {
+			return err
+		}
+		v = vs[len(vs)-1]
+	}
+	from := v - 1
+	if f := req.URL.Query().Get("from"); f != "" {
+		if from, err = parseVersion(f); err != nil {
+			return err
+		}
+	}
+
+	b, err := h.registry.FileSet(subject, v)
+	if err != nil {
+		return err
+	}
+	a := new(ast.FileSet)
+	if from != 0 {
+		if a, err = h.registry.FileSet(subject, from); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, d := range ast.Diff(a, b, ast.IgnorePositions|ast.IgnoreComments) {
+		fmt.Fprintln(w, d)
+	}
+	return nil
+}
+
+func (h *handler) check(w http.ResponseWriter, req *http.Request, subject string) error {
+	fds, err := readBody(w, req)
+	if err != nil {
+		return err
+	}
+	issues, err := h.registry.Check(subject, fds)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, compatibilityResponse{
+		Compatible: len(issues) == 0,
+		Issues:     issueStrings(issues),
+	})
+	return nil
+}
+
+func (h *handler) getConfig(w http.ResponseWriter, subject string) error {
+	mode, err := h.registry.Compatibility(subject)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, config{Compatibility: mode.String()})
+	return nil
+}
+
+func (h *handler) setConfig(w http.ResponseWriter, req *http.Request, subject string) error {
+	var c config
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MaxBodySize)).Decode(&c); err != nil {
+		return invalidf("invalid configuration: %v", err)
+	}
+	mode, err := compat.ParseMode(c.Compatibility)
+	if err != nil {
+		return invalidf("invalid configuration: %v", err)
+	}
+	if err := h.registry.SetCompatibility(subject, mode); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, config{Compatibility: mode.String()})
+	return nil
+}
+
+// readBody returns the FileDescriptorSet in the body of req
+func readBody(w http.ResponseWriter, req *http.Request) (*pb.FileDescriptorSet, error) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxBodySize))
+	if err != nil {
+		return nil, invalidf("could not read body: %v", err)
+	}
+	fds := new(pb.FileDescriptorSet)
+	if err := proto.Unmarshal(b, fds); err != nil {
+		return nil, invalidf("invalid FileDescriptorSet: %v", err)
+	}
+	if len(fds.File) == 0 {
+		return nil, invalidf("FileDescriptorSet has no files")
+	}
+	return fds, nil
+}
+
+// parseVersion returns the version named by s: a positive number, or latest
+func parseVersion(s string) (int, error) {
+	if s == "latest" {
+		return Latest, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		return 0, invalidf("invalid version %q", s)
+	}
+	return v, nil
+}
+
+func issueStrings(issues []*compat.Issue) []string {
+	var res []string
+	for _, i := range issues {
+		res = append(res, i.String())
+	}
+	return res
+}
+
+// writeError writes err to w, with the status corresponding to its type
+func writeError(w http.ResponseWriter, err error) {
+	resp := errorResponse{Error: err.Error()}
+	status := http.StatusInternalServerError
+	switch err := err.(type) {
+	case *NotFoundError:
+		status = http.StatusNotFound
+	case *InvalidError:
+		status = http.StatusBadRequest
+	case *IncompatibleError:
+		status = http.StatusConflict
+		resp.Issues = issueStrings(err.Issues)
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
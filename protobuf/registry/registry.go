@@ -0,0 +1,381 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package registry implements a schema registry, stored in a local
+// directory, for use in development and CI in place of a shared registry.
+//
+// The registry holds versions of the schemas of subjects, such as Kafka
+// topics. Each version of a subject is a FileDescriptorSet, as generated by
+// gendesc, or by protoc with --include_imports, which includes the files
+// imported by each of its files. A new version of a subject is accepted only
+// if it is compatible with the previous version, as checked by compat, in
+// the mode of the subject: BACKWARD unless configured otherwise.
+//
+// Versions are numbered from 1, and stored as dir/subject/N.pb; the mode
+// of a subject, if any, is stored as dir/subject/config.json. Handler serves
+// a registry over HTTP.
+package registry // import "myitcv.io/g/protobuf/registry"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/compat"
+	"myitcv.io/g/protobuf/fromdesc"
+)
+
+// Latest may be passed as a version to name the latest version of a subject.
+const Latest = -1
+
+// A Registry is a schema registry stored in a directory. It is safe for
+// concurrent use, but not for use by more than one process.
+type Registry struct {
+	dir  string
+	mode compat.Mode
+
+	mu sync.Mutex
+}
+
+// New returns the registry stored in dir, which is created if it does not
+// exist. mode is the compatibility required of subjects without their own.
+func New(dir string, mode compat.Mode) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &Registry{dir: dir, mode: mode}, nil
+}
+
+// NotFoundError is returned for a subject or version that does not exist.
+type NotFoundError struct {
+	Subject string
+	Version int // 0 if the subject does not exist
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("subject %v not found", e.Subject)
+	}
+	return fmt.Sprintf("version %v of subject %v not found", e.Version, e.Subject)
+}
+
+// InvalidError is returned for an invalid subject name, mode, or
+// FileDescriptorSet.
+type InvalidError struct {
+	Msg string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &InvalidError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// IncompatibleError is returned by Register for a version that is not
+// compatible with the previous version of its subject.
+type IncompatibleError struct {
+	Subject string
+	Mode    compat.Mode
+	Issues  []*compat.Issue
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("schema is not %v compatible with the latest version of subject %v: %v", strings.ToLower(e.Mode.String()), e.Subject, e.Issues[0].Message)
+}
+
+// Subjects returns the names of the subjects of r with at least one version,
+// in order.
+func (r *Registry) Subjects() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fis, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, fi := range fis {
+		if !fi.IsDir() || validSubject(fi.Name()) != nil {
+			continue
+		}
+		vs, err := r.versions(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(vs) > 0 {
+			res = append(res, fi.Name())
+		}
+	}
+	return res, nil
+}
+
+// Versions returns the versions of subject, in order.
+func (r *Registry) Versions(subject string) ([]int, error) {
+	if err := validSubject(subject); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vs, err := r.versions(subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) == 0 {
+		return nil, &NotFoundError{Subject: subject}
+	}
+	return vs, nil
+}
+
+// Get returns the FileDescriptorSet of version of subject, which may be
+// Latest.
+func (r *Registry) Get(subject string, version int) (*pb.FileDescriptorSet, error) {
+	if err := validSubject(subject); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fds, _, err := r.get(subject, version)
+	return fds, err
+}
+
+// FileSet returns the AST of version of subject, which may be Latest, as
+// built by fromdesc.
+func (r *Registry) FileSet(subject string, version int) (*ast.FileSet, error) {
+	fds, err := r.Get(subject, version)
+	if err != nil {
+		return nil, err
+	}
+	return fromdesc.FileSet(fds.File)
+}
+
+// Compatibility returns the compatibility required of new versions of
+// subject.
+func (r *Registry) Compatibility(subject string) (compat.Mode, error) {
+	if err := validSubject(subject); err != nil {
+		return compat.None, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.compatibility(subject)
+}
+
+// SetCompatibility sets the compatibility required of new versions of
+// subject, which need not exist yet.
+func (r *Registry) SetCompatibility(subject string, mode compat.Mode) error {
+	if err := validSubject(subject); err != nil {
+		return err
+	}
+	if mode&^compat.Full != 0 {
+		return invalidf("invalid compatibility %v", mode)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, err := json.Marshal(config{Compatibility: mode.String()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(r.dir, subject), 0777); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(r.dir, subject, "config.json"), append(b, '\n'))
+}
+
+// Check returns the issues of fds, as a new version of subject, that break
+// the compatibility required of it, if any.
+func (r *Registry) Check(subject string, fds *pb.FileDescriptorSet) ([]*compat.Issue, error) {
+	if err := validSubject(subject); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, issues, _, err := r.check(subject, fds)
+	return issues, err
+}
+
+// Register adds fds as a new version of subject, and returns its version
+// number. If fds is the same as the latest version, that version is returned
+// instead. If fds is not compatible with the latest version, the error is an
+// *IncompatibleError.
+func (r *Registry) Register(subject string, fds *pb.FileDescriptorSet) (int, error) {
+	if err := validSubject(subject); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mode, issues, latest, err := r.check(subject, fds)
+	if err != nil {
+		return 0, err
+	}
+	if len(issues) > 0 {
+		return 0, &IncompatibleError{Subject: subject, Mode: mode, Issues: issues}
+	}
+
+	vs, err := r.versions(subject)
+	if err != nil {
+		return 0, err
+	}
+	if len(vs) > 0 && proto.Equal(latest, fds) {
+		return vs[len(vs)-1], nil
+	}
+
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		return 0, err
+	}
+	v := 1
+	if len(vs) > 0 {
+		v = vs[len(vs)-1] + 1
+	}
+	if err := os.MkdirAll(filepath.Join(r.dir, subject), 0777); err != nil {
+		return 0, err
+	}
+	if err := writeFile(filepath.Join(r.dir, subject, fmt.Sprintf("%v.pb", v)), b); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// check returns the mode of subject, the issues of fds that break it, and
+// the latest version of subject, or nil if there is none
+func (r *Registry) check(subject string, fds *pb.FileDescriptorSet) (compat.Mode, []*compat.Issue, *pb.FileDescriptorSet, error) {
+	next, err := fromdesc.FileSet(fds.File)
+	if err != nil {
+		return compat.None, nil, nil, invalidf("invalid FileDescriptorSet: %v", err)
+	}
+
+	mode, err := r.compatibility(subject)
+	if err != nil {
+		return compat.None, nil, nil, err
+	}
+
+	latest, _, err := r.get(subject, Latest)
+	if _, ok := err.(*NotFoundError); ok {
+		return mode, nil, nil, nil
+	} else if err != nil {
+		return compat.None, nil, nil, err
+	}
+	prev, err := fromdesc.FileSet(latest.File)
+	if err != nil {
+		return compat.None, nil, nil, err
+	}
+
+	var issues []*compat.Issue
+	for _, i := range compat.Check(prev, next) {
+		if i.Breaks&mode != 0 {
+			issues = append(issues, i)
+		}
+	}
+	return mode, issues, latest, nil
+}
+
+// get returns the FileDescriptorSet of version of subject, which may be
+// Latest, and its version number
+func (r *Registry) get(subject string, version int) (*pb.FileDescriptorSet, int, error) {
+	if version == Latest {
+		vs, err := r.versions(subject)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(vs) == 0 {
+			return nil, 0, &NotFoundError{Subject: subject}
+		}
+		version = vs[len(vs)-1]
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, subject, fmt.Sprintf("%v.pb", version)))
+	if os.IsNotExist(err) {
+		if vs, _ := r.versions(subject); len(vs) == 0 {
+			return nil, 0, &NotFoundError{Subject: subject}
+		}
+		return nil, 0, &NotFoundError{Subject: subject, Version: version}
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	fds := new(pb.FileDescriptorSet)
+	if err := proto.Unmarshal(b, fds); err != nil {
+		return nil, 0, fmt.Errorf("version %v of subject %v is corrupt: %v", version, subject, err)
+	}
+	return fds, version, nil
+}
+
+// versions returns the versions of subject, in order, or nil if it does not
+// exist
+func (r *Registry) versions(subject string) ([]int, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(r.dir, subject))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []int
+	for _, fi := range fis {
+		n := strings.TrimSuffix(fi.Name(), ".pb")
+		if v, err := strconv.Atoi(n); err == nil && v > 0 && n+".pb" == fi.Name() {
+			res = append(res, v)
+		}
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+// config is the configuration of a subject, as stored in its config.json
+type config struct {
+	Compatibility string `json:"compatibility"`
+}
+
+func (r *Registry) compatibility(subject string) (compat.Mode, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, subject, "config.json"))
+	if os.IsNotExist(err) {
+		return r.mode, nil
+	} else if err != nil {
+		return compat.None, err
+	}
+	var c config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return compat.None, fmt.Errorf("invalid configuration of subject %v: %v", subject, err)
+	}
+	return compat.ParseMode(c.Compatibility)
+}
+
+// validSubject returns an error if subject is not a valid name for a subject,
+// which must be usable as the name of a directory.
+func validSubject(subject string) error {
+	if subject == "" || strings.HasPrefix(subject, ".") || strings.ContainsAny(subject, `/\:`) {
+		return invalidf("invalid subject name %q", subject)
+	}
+	return nil
+}
+
+// writeFile writes b to the file fn, or leaves it as it was if it cannot
+func writeFile(fn string, b []byte) error {
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
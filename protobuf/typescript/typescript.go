@@ -0,0 +1,362 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package typescript generates TypeScript definitions for the messages, enums
+// and services of a resolved set of proto files, following the proto3 JSON
+// mapping.
+//
+// Each proto file gives a TypeScript module. A message is an interface whose
+// properties are optional, since a printer omits fields with default values,
+// except for those of required fields. An enum is a union of the names of its
+// values, and a service is an interface with a method returning a Promise for
+// each of its methods. 64-bit integers and bytes are strings, and the
+// well-known types of google/protobuf have their special representations,
+// e.g. a google.protobuf.Timestamp is a string. Nested messages and enums are
+// named by joining the names of those enclosing them with underscores, e.g.
+// Book_Kind. Extensions are not represented.
+package typescript // import "myitcv.io/g/protobuf/typescript"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"myitcv.io/g/protobuf/ast"
+	"myitcv.io/g/protobuf/doc"
+)
+
+// A Generator generates TypeScript modules for the files of a FileSet. The
+// FileSet must have been resolved, for example by parser.ParseFiles.
+type Generator struct {
+	// UseProtoNames, if set, names properties by their field names rather
+	// than by their lowerCamelCase JSON names.
+	UseProtoNames bool
+}
+
+// Filename returns the name of the TypeScript module generated for f, e.g.
+// foo/bar.ts for foo/bar.proto.
+func Filename(f *ast.File) string {
+	return strings.TrimSuffix(f.Name, ".proto") + ".ts"
+}
+
+// Generate writes the TypeScript module for f to w. The module imports those
+// generated for the files defining the types f refers to, relative to its own
+// location.
+func (g *Generator) Generate(w io.Writer, f *ast.File) error {
+	gen := &generator{
+		Generator: g,
+		file:      f,
+		imports:   make(map[*ast.File]bool),
+	}
+
+	for _, m := range f.Messages {
+		gen.message(m)
+	}
+	for _, e := range f.Enums {
+		gen.enum(e)
+	}
+	for _, s := range f.Services {
+		gen.service(s)
+	}
+
+	var imports []*ast.File
+	for imp := range gen.imports {
+		imports = append(imports, imp)
+	}
+	sort.Sort(fileSort(imports))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by protots from %v. DO NOT EDIT.\n", f.Name)
+	if len(imports) > 0 {
+		buf.WriteString("\n")
+	}
+	for _, imp := range imports {
+		fmt.Fprintf(&buf, "import * as %v from %q;\n", moduleAlias(imp), modulePath(f, imp))
+	}
+	buf.Write(gen.body.Bytes())
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// generator holds the state used in generating the module for a file
+type generator struct {
+	*Generator
+
+	file *ast.File
+	body bytes.Buffer
+
+	// imports holds the files whose modules are referred to
+	imports map[*ast.File]bool
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+// comment writes the doc comment of n, indented by indent. prev is the node
+// defined immediately before n, if any.
+func (g *generator) comment(n, prev ast.Node, indent string) {
+	c := doc.Comment(n, prev)
+	if c == "" {
+		return
+	}
+	// the comment must not end early
+	c = strings.Replace(c, "*/", "*\\/", -1)
+
+	lines := strings.Split(c, "\n")
+	if len(lines) == 1 {
+		g.printf("%v/** %v */\n", indent, c)
+		return
+	}
+	g.printf("%v/**\n", indent)
+	for _, l := range lines {
+		if l == "" {
+			g.printf("%v *\n", indent)
+			continue
+		}
+		g.printf("%v * %v\n", indent, l)
+	}
+	g.printf("%v */\n", indent)
+}
+
+// message writes the interface of m, followed by those of its nested messages
+// and the types of its nested enums.
+func (g *generator) message(m *ast.Message) {
+	g.printf("\n")
+	g.comment(m, nil, "")
+	if len(m.Fields) == 0 {
+		g.printf("export interface %v {}\n", localName(m))
+	} else {
+		g.printf("export interface %v {\n", localName(m))
+		var prev ast.Node
+		for _, f := range m.Fields {
+			g.comment(f, prev, "  ")
+			prev = f
+
+			opt := "?"
+			if f.ResolvedFeatures().FieldPresence == "LEGACY_REQUIRED" {
+				opt = ""
+			}
+			g.printf("  %v%v: %v;\n", g.propertyName(f), opt, g.field(f))
+		}
+		g.printf("}\n")
+	}
+
+	for _, nm := range m.Messages {
+		g.message(nm)
+	}
+	for _, e := range m.Enums {
+		g.enum(e)
+	}
+}
+
+func (g *generator) enum(e *ast.Enum) {
+	g.printf("\n")
+	g.comment(e, nil, "")
+	var names []string
+	for _, v := range e.Values {
+		names = append(names, fmt.Sprintf("%q", v.Name))
+	}
+	g.printf("export type %v = %v;\n", localName(e), strings.Join(names, " | "))
+}
+
+// service writes the client interface of s, named after it with a Client
+// suffix, whose methods are named in lowerCamelCase.
+func (g *generator) service(s *ast.Service) {
+	g.printf("\n")
+	g.comment(s, nil, "")
+	g.printf("export interface %vClient {\n", s.Name)
+	var prev ast.Node
+	for _, m := range s.Methods {
+		g.comment(m, prev, "  ")
+		prev = m
+		g.printf("  %v(request: %v): Promise<%v>;\n", lowerFirst(m.Name), g.typ(m.InType), g.typ(m.OutType))
+	}
+	g.printf("}\n")
+}
+
+// propertyName returns the name of the JSON property of f
+func (g *generator) propertyName(f *ast.Field) string {
+	name := f.Name
+	if m, ok := f.Type.(*ast.Message); ok && m.Group {
+		// the field of a group is named after it, in lower case
+		name = strings.ToLower(name)
+	}
+	if g.UseProtoNames {
+		return name
+	}
+	return ast.JSONName(name)
+}
+
+// field returns the type of the value of f
+func (g *generator) field(f *ast.Field) string {
+	t := g.typ(f.Type)
+	switch {
+	case f.KeyTypeName != "":
+		// the keys of maps are always strings in JSON
+		return fmt.Sprintf("{ [key: string]: %v }", t)
+	case f.Repeated:
+		if strings.Contains(t, " | ") {
+			t = "(" + t + ")"
+		}
+		return t + "[]"
+	}
+	return t
+}
+
+// typ returns the TypeScript type for values of the resolved type typ
+func (g *generator) typ(typ interface{}) string {
+	switch typ := typ.(type) {
+	case ast.FieldType:
+		return scalarType(typ)
+	case *ast.Enum:
+		if ast.FullName(typ) == "google.protobuf.NullValue" {
+			return "null"
+		}
+		return g.ref(typ, typ.Up)
+	case *ast.Message:
+		if t, ok := wellKnownType(ast.FullName(typ)); ok {
+			return t
+		}
+		return g.ref(typ, typ.Up)
+	}
+	// unresolved; anything goes
+	return "unknown"
+}
+
+// ref returns a reference to the message or enum x, defined in up, qualified
+// by the alias of the module defining it if that is not the module being
+// generated.
+func (g *generator) ref(x interface{}, up ast.FileOrMessage) string {
+	f := fileOf(up)
+	if f == nil || f == g.file {
+		return localName(x)
+	}
+	g.imports[f] = true
+	return moduleAlias(f) + "." + localName(x)
+}
+
+func scalarType(typ ast.FieldType) string {
+	switch typ {
+	case ast.Int32, ast.Sint32, ast.Sfixed32, ast.Uint32, ast.Fixed32:
+		return "number"
+	case ast.Int64, ast.Sint64, ast.Sfixed64, ast.Uint64, ast.Fixed64:
+		return "string"
+	case ast.Float, ast.Double:
+		// NaN and the infinities are written as strings
+		return `number | "NaN" | "Infinity" | "-Infinity"`
+	case ast.Bool:
+		return "boolean"
+	case ast.String, ast.Bytes:
+		return "string"
+	}
+	return "unknown"
+}
+
+// wellKnownType returns the type of the well-known type name, and whether
+// name is a well-known type with a special JSON representation
+func wellKnownType(name string) (string, bool) {
+	if typ, ok := ast.WrapperTypes[name]; ok {
+		return scalarType(typ), true
+	}
+	typ, ok := ast.WellKnownJSONTypes[name]
+	if !ok {
+		return "", false
+	}
+	switch name {
+	case "google.protobuf.Empty":
+		return "{}", true
+	case "google.protobuf.Any":
+		return `{ "@type": string; [key: string]: unknown }`, true
+	}
+	switch typ {
+	case "string":
+		return "string", true
+	case "object":
+		return "{ [key: string]: unknown }", true
+	case "array":
+		return "unknown[]", true
+	}
+	return "unknown", true
+}
+
+// localName returns the name of the message or enum x within the module
+// generated for the file defining it: its name prefixed by those of the
+// messages enclosing it, joined by underscores.
+func localName(x interface{}) string {
+	var parts []string
+	for {
+		switch v := x.(type) {
+		case *ast.Message:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		case *ast.Enum:
+			parts = append([]string{v.Name}, parts...)
+			x = v.Up
+			continue
+		}
+		break
+	}
+	return strings.Join(parts, "_")
+}
+
+func fileOf(up ast.FileOrMessage) *ast.File {
+	switch up := up.(type) {
+	case *ast.File:
+		return up
+	case *ast.Message:
+		return up.File()
+	}
+	return nil
+}
+
+// moduleAlias returns the name by which the module generated for f is
+// imported, derived from its path, e.g. foo_bar for foo/bar.proto.
+func moduleAlias(f *ast.File) string {
+	name := strings.TrimSuffix(f.Name, ".proto")
+	alias := []rune{}
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+			r = '_'
+		}
+		alias = append(alias, r)
+	}
+	return string(alias)
+}
+
+// modulePath returns the path by which the module generated for from
+// imports that generated for to, e.g. ../common for foo/bar.proto and
+// common.proto.
+func modulePath(from, to *ast.File) string {
+	target := strings.TrimSuffix(to.Name, ".proto")
+	rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(from.Name)), filepath.FromSlash(target))
+	if err != nil {
+		return target
+	}
+	rel = filepath.ToSlash(rel)
+	if !strings.HasPrefix(rel, "../") {
+		rel = "./" + rel
+	}
+	return rel
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+type fileSort []*ast.File
+
+func (f fileSort) Len() int           { return len(f) }
+func (f fileSort) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f fileSort) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,236 @@
+// Copyright (c) 2016 Paul Jolly <paul@myitcv.org.uk>, all rights reserved.
+// Use of this document is governed by a license found in the LICENSE document.
+
+// Package wire parses the protobuf binary wire format without a schema, into
+// the fields of a message with their numbers, wire types and raw values.
+package wire // import "myitcv.io/g/protobuf/wire"
+
+import (
+	"fmt"
+	"math"
+)
+
+// Type is a wire type
+type Type int
+
+const (
+	Varint     Type = 0
+	Fixed64    Type = 1
+	Bytes      Type = 2
+	StartGroup Type = 3
+	EndGroup   Type = 4
+	Fixed32    Type = 5
+)
+
+func (t Type) String() string {
+	switch t {
+	case Varint:
+		return "varint"
+	case Fixed64:
+		return "fixed64"
+	case Bytes:
+		return "bytes"
+	case StartGroup:
+		return "group"
+	case EndGroup:
+		return "end group"
+	case Fixed32:
+		return "fixed32"
+	}
+	return fmt.Sprintf("wire type %d", int(t))
+}
+
+// MaxNumber is the largest valid field number
+const MaxNumber = 1<<29 - 1
+
+// MaxDepth is the maximum depth to which groups may be nested
+const MaxDepth = 100
+
+// A Field is a field of a message, as encoded.
+type Field struct {
+	Number int
+	Type   Type
+	Offset int // the offset of its tag within the message
+
+	// Value is the value of a Varint, Fixed32 or Fixed64 field.
+	Value uint64
+
+	// Bytes is the value of a Bytes field.
+	Bytes []byte
+
+	// Group holds the fields of a StartGroup field.
+	Group []*Field
+}
+
+// An Error is an error in parsing the wire format.
+type Error struct {
+	Offset int // the offset within the message parsed
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.Offset, e.Msg)
+}
+
+// Parse parses the fields of the message encoded in b. The fields are in the
+// order they are encoded, which may repeat field numbers. The Bytes of the
+// fields refer to b.
+func Parse(b []byte) ([]*Field, error) {
+	p := &parser{b: b}
+	fields, err := p.fields(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+type parser struct {
+	b   []byte
+	off int
+}
+
+func (p *parser) errorf(off int, format string, args ...interface{}) error {
+	return &Error{Offset: off, Msg: fmt.Sprintf(format, args...)}
+}
+
+// fields parses fields up to the end of the input or, if group is not zero,
+// to the end of the group with that number.
+func (p *parser) fields(group int, depth int) ([]*Field, error) {
+	var res []*Field
+	for p.off < len(p.b) {
+		start := p.off
+		tag, err := p.varint()
+		if err != nil {
+			return nil, err
+		}
+		num, typ := tag>>3, Type(tag&7)
+		if num == 0 || num > MaxNumber {
+			return nil, p.errorf(start, "invalid field number %d", num)
+		}
+		f := &Field{
+			Number: int(num),
+			Type:   typ,
+			Offset: start,
+		}
+
+		switch typ {
+		case Varint:
+			f.Value, err = p.varint()
+		case Fixed64:
+			f.Value, err = p.fixed(8)
+		case Fixed32:
+			f.Value, err = p.fixed(4)
+		case Bytes:
+			var n uint64
+			n, err = p.varint()
+			if err == nil && n > uint64(len(p.b)-p.off) {
+				err = p.errorf(start, "field %d has length %d, beyond the end of the input", num, n)
+			}
+			if err == nil {
+				f.Bytes = p.b[p.off : p.off+int(n)]
+				p.off += int(n)
+			}
+		case StartGroup:
+			if depth >= MaxDepth {
+				return nil, p.errorf(start, "groups nested too deeply (the limit is %d)", MaxDepth)
+			}
+			f.Group, err = p.fields(f.Number, depth+1)
+		case EndGroup:
+			if f.Number != group {
+				return nil, p.errorf(start, "unexpected end of group %d", num)
+			}
+			return res, nil
+		default:
+			return nil, p.errorf(start, "field %d has invalid wire type %d", num, int(typ))
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	if group != 0 {
+		return nil, p.errorf(p.off, "group %d is not terminated", group)
+	}
+	return res, nil
+}
+
+func (p *parser) varint() (uint64, error) {
+	v, n := DecodeVarint(p.b[p.off:])
+	if n == 0 {
+		return 0, p.errorf(p.off, "invalid varint")
+	}
+	p.off += n
+	return v, nil
+}
+
+func (p *parser) fixed(n int) (uint64, error) {
+	if len(p.b)-p.off < n {
+		return 0, p.errorf(p.off, "truncated fixed%d", n*8)
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(p.b[p.off+i])
+	}
+	p.off += n
+	return v, nil
+}
+
+// DecodeVarint decodes the varint at the start of b, returning its value and
+// length, or a length of 0 if b does not start with a valid varint.
+func DecodeVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		c := b[i]
+		if i == 9 && c > 1 {
+			// overflows 64 bits
+			return 0, 0
+		}
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// DecodePacked decodes b as packed varints, returning false if it is not a
+// sequence of valid varints.
+func DecodePacked(b []byte) ([]uint64, bool) {
+	var res []uint64
+	for len(b) > 0 {
+		v, n := DecodeVarint(b)
+		if n == 0 {
+			return nil, false
+		}
+		res = append(res, v)
+		b = b[n:]
+	}
+	return res, true
+}
+
+// DecodePackedFixed decodes b as packed fixed-size values of n bytes (4 or
+// 8), returning false if its length is not a multiple of n.
+func DecodePackedFixed(b []byte, n int) ([]uint64, bool) {
+	if len(b)%n != 0 {
+		return nil, false
+	}
+	var res []uint64
+	for ; len(b) > 0; b = b[n:] {
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		res = append(res, v)
+	}
+	return res, true
+}
+
+// DecodeZigZag decodes the zigzag encoding of a sint32 or sint64.
+func DecodeZigZag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Float32 and Float64 interpret the values of Fixed32 and Fixed64 fields as
+// floating point numbers.
+func Float32(v uint64) float32 { return math.Float32frombits(uint32(v)) }
+func Float64(v uint64) float64 { return math.Float64frombits(v) }